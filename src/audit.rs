@@ -0,0 +1,95 @@
+//! Append-only audit trail (`audit_log`) of what the user did: tunnels
+//! created, started, stopped and deleted, certificates regenerated, and VMs
+//! started or deallocated, with who, when, and the target's resource ID and
+//! ports. One JSON object per line; the file is only ever appended to, never
+//! rewritten or trimmed.
+
+use crate::json::json_object;
+use crate::model::{Machine, Tunnel};
+use chrono::Utc;
+use std::io::Write;
+use std::path::Path;
+
+/// The OS account running az-burrow.
+pub fn user() -> String {
+    std::env::var("USER")
+        .or_else(|_| std::env::var("USERNAME"))
+        .unwrap_or_else(|_| "unknown".into())
+}
+
+/// The line recorded for `action` (`create`, `start`, `stop`, `delete`) on
+/// `tunnel`.
+pub fn tunnel_entry(user: &str, action: &str, tunnel: &Tunnel) -> String {
+    json_object(&[
+        ("time", Some(&Utc::now().to_rfc3339())),
+        ("user", Some(user)),
+        ("action", Some(action)),
+        ("tunnel", Some(tunnel.display_name())),
+        ("machine", Some(&tunnel.machine.name)),
+        ("resource_id", Some(&tunnel.target_resource_id())),
+        ("target_ip", tunnel.machine.target_ip.as_deref()),
+        ("local_port", Some(&tunnel.local_port)),
+        ("remote_port", Some(&tunnel.remote_port)),
+    ])
+}
+
+/// The line recorded for regenerating `machine`'s certificate.
+pub fn cert_entry(user: &str, machine: &str) -> String {
+    json_object(&[
+        ("time", Some(&Utc::now().to_rfc3339())),
+        ("user", Some(user)),
+        ("action", Some("cert_regenerate")),
+        ("machine", Some(machine)),
+    ])
+}
+
+/// The line recorded for `action` (`vm_start`, `vm_deallocate`) on the VM
+/// `machine`.
+pub fn vm_entry(user: &str, action: &str, machine: &Machine) -> String {
+    json_object(&[
+        ("time", Some(&Utc::now().to_rfc3339())),
+        ("user", Some(user)),
+        ("action", Some(action)),
+        ("machine", Some(&machine.name)),
+        ("resource_id", Some(&machine.target_resource_id)),
+    ])
+}
+
+/// Append `entry` as one line to the audit file, creating it if needed.
+pub fn append(path: &Path, entry: &str) -> std::io::Result<()> {
+    let mut file = std::fs::OpenOptions::new()
+        .create(true)
+        .append(true)
+        .open(path)?;
+    writeln!(file, "{entry}")
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::model::{Machine, TunnelId};
+
+    #[test]
+    fn entries_are_appended_as_json_lines() {
+        let path = std::env::temp_dir().join(format!("az-burrow-audit-{}.log", std::process::id()));
+        let _ = std::fs::remove_file(&path);
+        let machine = Machine::test("vm-db");
+        append(&path, &vm_entry("alice", "vm_start", &machine)).unwrap();
+        let tunnel = Tunnel::new(TunnelId(1), machine, "15432", "5432");
+        append(&path, &tunnel_entry("alice", "start", &tunnel)).unwrap();
+        append(&path, &cert_entry("alice", "vm-db")).unwrap();
+
+        let text = std::fs::read_to_string(&path).unwrap();
+        let lines: Vec<&str> = text.lines().collect();
+        assert_eq!(lines.len(), 3);
+        assert!(lines[0].contains(
+            "\"action\":\"vm_start\",\"machine\":\"vm-db\",\"resource_id\":\"/subscriptions/s/vm-db\""
+        ));
+        assert!(lines[1].contains("\"user\":\"alice\",\"action\":\"start\""));
+        assert!(lines[1].contains("\"resource_id\":\"/subscriptions/s/vm-db\""));
+        assert!(lines[1].contains("\"local_port\":\"15432\",\"remote_port\":\"5432\""));
+        assert!(!lines[1].contains("target_ip"));
+        assert!(lines[2].contains("\"action\":\"cert_regenerate\",\"machine\":\"vm-db\""));
+        let _ = std::fs::remove_file(&path);
+    }
+}
@@ -0,0 +1,278 @@
+//! `import --from-az-ssh-config`: onboarding for people who already use
+//! `az ssh config`. That command keeps each machine's key and AAD
+//! certificate in a directory of its own, `~/.ssh/az_ssh_config/<rg>-<vm>`
+//! (or `<ip>`), and writes a `Host` block pointing at them into
+//! `~/.ssh/config`. Both are scanned here for the key directories; which VM
+//! each belongs to is looked up in Azure (see [`crate::azure::graph`]).
+
+use std::path::{Path, PathBuf};
+
+/// Where az writes key directories, under `~/.ssh`.
+const KEYS_DIR: &str = "az_ssh_config";
+
+/// The suffix az gives the certificate of `<key>`: `<key>.pub-aadcert.pub`.
+const CERT_SUFFIX: &str = ".pub-aadcert.pub";
+
+/// A directory holding a key `az ssh config` certified.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct KeyDir {
+    pub dir: PathBuf,
+    /// The private key's file name, `id_rsa` unless the block named another.
+    pub key: String,
+    /// Names the VM may go by, lowercased: the directory's name and the
+    /// `Host` aliases of blocks using the key, i.e. `<rg>-<vm>` or an IP.
+    pub names: Vec<String>,
+    /// The `HostName` of those blocks: the VM's private IP.
+    pub host_name: Option<String>,
+}
+
+/// The key directories under `ssh_dir` (`~/.ssh`): those az created in
+/// `az_ssh_config/`, and any other its `Host` blocks in `config` point at.
+pub fn key_dirs(ssh_dir: &Path) -> Vec<KeyDir> {
+    let mut found: Vec<KeyDir> = Vec::new();
+    if let Ok(text) = std::fs::read_to_string(ssh_dir.join("config")) {
+        for block in host_blocks(&text) {
+            let Some(dir) = block.identity.parent().map(Path::to_path_buf) else {
+                continue;
+            };
+            let key = file_name(&block.identity);
+            let at = match found.iter().position(|k| k.dir == dir) {
+                Some(at) => at,
+                None => {
+                    found.push(KeyDir {
+                        names: vec![file_name(&dir).to_lowercase()],
+                        dir,
+                        key,
+                        host_name: None,
+                    });
+                    found.len() - 1
+                }
+            };
+            let entry = &mut found[at];
+            for alias in block.aliases {
+                if !entry.names.contains(&alias) {
+                    entry.names.push(alias);
+                }
+            }
+            entry.host_name = entry.host_name.take().or(block.host_name);
+        }
+    }
+    let Ok(entries) = std::fs::read_dir(ssh_dir.join(KEYS_DIR)) else {
+        return found;
+    };
+    let mut dirs: Vec<PathBuf> = entries
+        .flatten()
+        .map(|e| e.path())
+        .filter(|p| p.is_dir())
+        .collect();
+    dirs.sort();
+    for dir in dirs {
+        if found.iter().any(|k| k.dir == dir) {
+            continue;
+        }
+        let Some(key) = certified_key(&dir) else {
+            continue;
+        };
+        found.push(KeyDir {
+            names: vec![file_name(&dir).to_lowercase()],
+            dir,
+            key,
+            host_name: None,
+        });
+    }
+    found
+}
+
+impl KeyDir {
+    /// The resource ID of the VM this directory's key is for, out of
+    /// `names`, (resource ID, name) pairs as from
+    /// [`crate::azure::graph::ssh_config_names`]. Its own names are tried
+    /// before the IP its blocks connect to.
+    pub fn vm<'a>(&self, names: &'a [(String, String)]) -> Result<&'a str, String> {
+        let matching = |wanted: &dyn Fn(&str) -> bool| {
+            let mut ids: Vec<&'a str> = Vec::new();
+            for (id, name) in names {
+                if wanted(name) && !ids.iter().any(|i| i.eq_ignore_ascii_case(id)) {
+                    ids.push(id);
+                }
+            }
+            ids
+        };
+        let mut ids = matching(&|name| self.names.iter().any(|n| n == name));
+        if ids.is_empty() {
+            ids = matching(&|name| self.host_name.as_deref() == Some(name));
+        }
+        match ids.as_slice() {
+            [id] => Ok(*id),
+            [] => Err("no VM you can read goes by its name or IP".into()),
+            _ => Err(format!("{} VMs go by its name or IP", ids.len())),
+        }
+    }
+}
+
+/// The key in `dir` az certified, from the certificate's name.
+fn certified_key(dir: &Path) -> Option<String> {
+    let mut keys: Vec<String> = std::fs::read_dir(dir)
+        .ok()?
+        .flatten()
+        .filter_map(|e| {
+            file_name(&e.path())
+                .strip_suffix(CERT_SUFFIX)
+                .map(str::to_string)
+        })
+        .collect();
+    keys.sort();
+    keys.into_iter().next()
+}
+
+fn file_name(path: &Path) -> String {
+    path.file_name()
+        .map(|n| n.to_string_lossy().into_owned())
+        .unwrap_or_default()
+}
+
+/// A `Host` block with both an `IdentityFile` and a `CertificateFile`, as
+/// `az ssh config` writes them.
+#[derive(Debug, Clone, PartialEq, Eq)]
+struct HostBlock {
+    /// Lowercased, without patterns.
+    aliases: Vec<String>,
+    host_name: Option<String>,
+    identity: PathBuf,
+}
+
+/// The `Host` blocks of an ssh_config that use an AAD certificate, leaving
+/// out az-burrow's own (`burrow-<machine>`, see [`crate::ssh`]).
+fn host_blocks(text: &str) -> Vec<HostBlock> {
+    // (aliases, HostName, IdentityFile, has a CertificateFile)
+    let mut blocks: Vec<(Vec<String>, Option<String>, Option<String>, bool)> = Vec::new();
+    for line in text.lines() {
+        let line = line.trim();
+        if line.is_empty() || line.starts_with('#') {
+            continue;
+        }
+        let (key, value) = match line.split_once(|c: char| c == '=' || c.is_whitespace()) {
+            Some((k, v)) => (k, v.trim().trim_start_matches('=').trim()),
+            None => (line, ""),
+        };
+        let value = value.trim_matches('"');
+        match key.to_ascii_lowercase().as_str() {
+            "host" => blocks.push((
+                value
+                    .split_whitespace()
+                    .map(str::to_lowercase)
+                    .filter(|a| !a.contains(['*', '?', '!']))
+                    .collect(),
+                None,
+                None,
+                false,
+            )),
+            "match" => blocks.push((Vec::new(), None, None, false)),
+            "hostname" => {
+                if let Some(b) = blocks.last_mut() {
+                    b.1 = Some(value.to_string());
+                }
+            }
+            "identityfile" => {
+                if let Some(b) = blocks.last_mut() {
+                    b.2.get_or_insert_with(|| crate::config::expand_tilde(value));
+                }
+            }
+            "certificatefile" => {
+                if let Some(b) = blocks.last_mut() {
+                    b.3 = true;
+                }
+            }
+            _ => {}
+        }
+    }
+    blocks
+        .into_iter()
+        .filter(|(aliases, ..)| !aliases.is_empty())
+        .filter(|(aliases, ..)| !aliases.iter().any(|a| a.starts_with("burrow-")))
+        .filter_map(|(aliases, host_name, identity, cert)| {
+            Some(HostBlock {
+                aliases,
+                host_name,
+                identity: PathBuf::from(identity.filter(|_| cert)?),
+            })
+        })
+        .collect()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn az_ssh_config_blocks_and_key_dirs_are_found() {
+        let ssh = std::env::temp_dir().join(format!("az-burrow-ssh-{}", std::process::id()));
+        let web = ssh.join(KEYS_DIR).join("rg-web-vm-web");
+        let db = ssh.join(KEYS_DIR).join("10.0.2.4");
+        for dir in [&web, &db] {
+            std::fs::create_dir_all(dir).unwrap();
+        }
+        std::fs::write(db.join(format!("id_ed25519{CERT_SUFFIX}")), "").unwrap();
+        std::fs::write(
+            ssh.join("config"),
+            format!(
+                "Host github.com\n    User git\n    IdentityFile ~/.ssh/github\n\n\
+                 Host rg-web-vm-web\n\tUser me@example.com\n\tHostName 10.0.1.4\n\
+                 \tCertificateFile \"{0}/id_rsa{CERT_SUFFIX}\"\n\tIdentityFile \"{0}/id_rsa\"\n\n\
+                 Host burrow-vm-web\n    HostName 127.0.0.1\n    IdentityFile \"{0}/id_rsa\"\n    CertificateFile \"{0}/id_rsa{CERT_SUFFIX}\"\n",
+                web.display()
+            ),
+        )
+        .unwrap();
+
+        let dirs = key_dirs(&ssh);
+        std::fs::remove_dir_all(&ssh).unwrap();
+        assert_eq!(
+            dirs,
+            vec![
+                KeyDir {
+                    dir: web,
+                    key: "id_rsa".into(),
+                    names: vec!["rg-web-vm-web".into()],
+                    host_name: Some("10.0.1.4".into()),
+                },
+                KeyDir {
+                    dir: db,
+                    key: "id_ed25519".into(),
+                    names: vec!["10.0.2.4".into()],
+                    host_name: None,
+                },
+            ]
+        );
+    }
+
+    #[test]
+    fn key_dirs_are_matched_to_vms_by_name_then_ip() {
+        let names = [
+            ("/s/rg-web/vm-web".to_string(), "rg-web-vm-web".to_string()),
+            ("/s/RG-WEB/vm-web".to_string(), "10.0.1.4".to_string()),
+            ("/s/rg-db/vm-db".to_string(), "rg-db-vm-db".to_string()),
+            ("/s/rg-db/vm-db".to_string(), "10.0.2.4".to_string()),
+            ("/s/rg-other/vm-db".to_string(), "10.0.2.4".to_string()),
+        ];
+        let dir = |names: &[&str], host_name: Option<&str>| KeyDir {
+            dir: PathBuf::from("/keys"),
+            key: "id_rsa".into(),
+            names: names.iter().map(|n| n.to_string()).collect(),
+            host_name: host_name.map(String::from),
+        };
+        assert_eq!(
+            dir(&["rg-web-vm-web"], Some("10.0.1.4")).vm(&names),
+            Ok("/s/rg-web/vm-web")
+        );
+        assert_eq!(
+            dir(&["old-name"], Some("10.0.1.4")).vm(&names),
+            Ok("/s/RG-WEB/vm-web")
+        );
+        assert_eq!(
+            dir(&["10.0.2.4"], None).vm(&names),
+            Err("2 VMs go by its name or IP".into())
+        );
+        assert!(dir(&["gone"], None).vm(&names).is_err());
+    }
+}
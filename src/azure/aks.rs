@@ -0,0 +1,86 @@
+//! Private AKS clusters, reached through a jump VM (`jump:` to the API
+//! server's private FQDN). While the tunnel is up, a kubeconfig from `az aks
+//! get-credentials` is kept at the cluster's `kubeconfig` path with its server
+//! pointed at the tunnel; it is deleted again when the tunnel stops.
+
+use crate::azure::az_command;
+use crate::config::expand_tilde;
+use crate::model::AksCluster;
+use std::path::PathBuf;
+
+/// Fetch the cluster's credentials into its kubeconfig and point the server
+/// at `127.0.0.1:<local_port>`. Returns the file written.
+pub async fn write_kubeconfig(cluster: &AksCluster, local_port: &str) -> Result<PathBuf, String> {
+    let path = PathBuf::from(expand_tilde(&cluster.kubeconfig));
+    if let Some(dir) = path.parent() {
+        std::fs::create_dir_all(dir).map_err(|e| e.to_string())?;
+    }
+    let out = az_command()
+        .args(["aks", "get-credentials", "--overwrite-existing"])
+        .args(["--resource-group", &cluster.resource_group])
+        .args(["--name", &cluster.name])
+        .arg("--file")
+        .arg(&path)
+        .output()
+        .await
+        .map_err(|e| format!("failed to run az: {e}"))?;
+    if !out.status.success() {
+        return Err(String::from_utf8_lossy(&out.stderr).trim().to_string());
+    }
+    let text = std::fs::read_to_string(&path).map_err(|e| e.to_string())?;
+    std::fs::write(&path, point_at_tunnel(&text, local_port)).map_err(|e| e.to_string())?;
+    Ok(path)
+}
+
+/// Delete the kubeconfig written for the cluster, if any.
+pub fn remove_kubeconfig(cluster: &AksCluster) {
+    let _ = std::fs::remove_file(expand_tilde(&cluster.kubeconfig));
+}
+
+/// Rewrite each cluster `server:` to the tunnel, keeping TLS verification
+/// working by naming the real host in `tls-server-name`.
+fn point_at_tunnel(kubeconfig: &str, local_port: &str) -> String {
+    let mut out = String::with_capacity(kubeconfig.len());
+    for line in kubeconfig.lines() {
+        let indent = &line[..line.len() - line.trim_start().len()];
+        match line.trim_start().strip_prefix("server: ") {
+            Some(server) => {
+                let host = server
+                    .trim()
+                    .trim_start_matches("https://")
+                    .split([':', '/'])
+                    .next()
+                    .unwrap_or_default();
+                out.push_str(&format!("{indent}server: https://127.0.0.1:{local_port}\n"));
+                out.push_str(&format!("{indent}tls-server-name: {host}\n"));
+            }
+            None => {
+                out.push_str(line);
+                out.push('\n');
+            }
+        }
+    }
+    out
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn server_points_at_the_tunnel_with_the_real_tls_name() {
+        let kubeconfig = "apiVersion: v1
+clusters:
+- cluster:
+    certificate-authority-data: abc
+    server: https://aks-prod-1a2b.privatelink.uksouth.azmk8s.io:443
+  name: aks-prod
+";
+        let out = point_at_tunnel(kubeconfig, "6443");
+        assert!(out.contains("\n    server: https://127.0.0.1:6443\n"));
+        assert!(
+            out.contains("\n    tls-server-name: aks-prod-1a2b.privatelink.uksouth.azmk8s.io\n")
+        );
+        assert!(out.contains("  name: aks-prod\n"));
+    }
+}
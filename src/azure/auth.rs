@@ -0,0 +1,357 @@
+//! Signing in without a person at the keyboard (`auth:` in config), for
+//! build agents, shared automation boxes and jump VMs. az-burrow runs `az
+//! login --service-principal` at startup with a client secret, a certificate
+//! or a federated token (workload identity), or `az login --identity` with
+//! the managed identity of the Azure VM it runs on. Either way it signs in
+//! to an az profile of its own (`AZURE_CONFIG_DIR`), so the sign-in never
+//! replaces the one az has for the user. Every later `az` call, certificates
+//! and tunnels alike, uses it.
+//!
+//! Anything left out is read from the variables Azure SDKs and the AKS
+//! workload identity webhook set: `AZURE_TENANT_ID`, `AZURE_CLIENT_ID`,
+//! `AZURE_CLIENT_SECRET` and `AZURE_FEDERATED_TOKEN_FILE`.
+//!
+//! Neither the secret nor the token goes on az's command line, where other
+//! users can read it: az is given `@-` and reads the secret from its stdin,
+//! and `@<file>` for the token, which it reads from the file.
+
+use crate::azure::az_command;
+use crate::config::expand_tilde;
+use serde::Deserialize;
+use std::path::PathBuf;
+use std::process::Stdio;
+use tokio::io::AsyncWriteExt;
+
+#[derive(Debug, Clone, Default, PartialEq, Eq, Deserialize)]
+pub struct Auth {
+    /// Directory (tenant) ID.
+    #[serde(default)]
+    pub tenant: Option<String>,
+    /// Application (client) ID of the service principal.
+    #[serde(default)]
+    pub client_id: Option<String>,
+    /// Environment variable holding the client secret (default
+    /// `AZURE_CLIENT_SECRET`). The secret itself never goes in the config.
+    #[serde(default)]
+    pub client_secret_env: Option<String>,
+    /// PEM file with the service principal's certificate and private key.
+    #[serde(default)]
+    pub certificate: Option<String>,
+    /// File holding a federated token (workload identity), read again at
+    /// every sign-in as it is rotated.
+    #[serde(default)]
+    pub federated_token_file: Option<String>,
+    /// Sign in with the managed identity of the Azure VM az-burrow runs on:
+    /// the system-assigned one, or the user-assigned one `client_id` names.
+    /// No tenant or credential is needed.
+    #[serde(default)]
+    pub managed_identity: bool,
+}
+
+/// What the service principal proves itself with.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub enum Credential {
+    /// A client secret, from the environment variable named.
+    Secret {
+        env: String,
+        secret: String,
+    },
+    Certificate(PathBuf),
+    FederatedToken(PathBuf),
+}
+
+/// A sign-in with everything it needs.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub enum Login {
+    ServicePrincipal {
+        tenant: String,
+        client_id: String,
+        credential: Credential,
+    },
+    /// The VM's system-assigned identity, or a user-assigned one by client
+    /// ID.
+    ManagedIdentity { client_id: Option<String> },
+}
+
+impl Auth {
+    /// The sign-in, or what is missing from the config and environment.
+    pub fn login(&self) -> Result<Login, String> {
+        self.login_with(|name| std::env::var(name).ok().filter(|v| !v.is_empty()))
+    }
+
+    /// The sign-in, reading unset values with `env`. A certificate wins over
+    /// a federated token, and either over a secret.
+    fn login_with(&self, env: impl Fn(&str) -> Option<String>) -> Result<Login, String> {
+        if self.managed_identity {
+            return Ok(Login::ManagedIdentity {
+                client_id: self.client_id.clone().or_else(|| env("AZURE_CLIENT_ID")),
+            });
+        }
+        let tenant = self
+            .tenant
+            .clone()
+            .or_else(|| env("AZURE_TENANT_ID"))
+            .ok_or("auth: set tenant (or AZURE_TENANT_ID)")?;
+        let client_id = self
+            .client_id
+            .clone()
+            .or_else(|| env("AZURE_CLIENT_ID"))
+            .ok_or("auth: set client_id (or AZURE_CLIENT_ID)")?;
+        let secret_env = self
+            .client_secret_env
+            .as_deref()
+            .unwrap_or("AZURE_CLIENT_SECRET");
+        let credential = if let Some(cert) = &self.certificate {
+            Credential::Certificate(PathBuf::from(expand_tilde(cert)))
+        } else if let Some(file) = self
+            .federated_token_file
+            .clone()
+            .or_else(|| env("AZURE_FEDERATED_TOKEN_FILE"))
+        {
+            Credential::FederatedToken(PathBuf::from(expand_tilde(&file)))
+        } else if let Some(secret) = env(secret_env) {
+            Credential::Secret {
+                env: secret_env.to_string(),
+                secret,
+            }
+        } else if self.client_secret_env.is_some() {
+            return Err(format!("auth: ${secret_env} is not set"));
+        } else {
+            return Err(
+                "auth: set certificate, federated_token_file or client_secret_env (or AZURE_CLIENT_SECRET)"
+                    .into(),
+            );
+        };
+        Ok(Login::ServicePrincipal {
+            tenant,
+            client_id,
+            credential,
+        })
+    }
+}
+
+impl Login {
+    /// Who signs in, for messages.
+    pub fn who(&self) -> String {
+        match self {
+            Login::ServicePrincipal { client_id, .. } => {
+                format!("service principal {client_id}")
+            }
+            Login::ManagedIdentity { client_id: None } => "the VM's managed identity".into(),
+            Login::ManagedIdentity {
+                client_id: Some(id),
+            } => format!("managed identity {id}"),
+        }
+    }
+
+    /// The az profile this sign-in lives in: `~/.azure/burrow/<client id>`,
+    /// or `managed-identity` for the system-assigned one.
+    pub fn config_dir(&self) -> Option<PathBuf> {
+        let name = match self {
+            Login::ServicePrincipal { client_id, .. } => client_id,
+            Login::ManagedIdentity { client_id } => {
+                client_id.as_deref().unwrap_or("managed-identity")
+            }
+        };
+        Some(home::home_dir()?.join(".azure").join("burrow").join(name))
+    }
+
+    /// The `az login` command line, with the secret or token left out, for
+    /// `--dry-run` and errors.
+    pub fn describe(&self) -> String {
+        match self {
+            Login::ServicePrincipal {
+                tenant,
+                client_id,
+                credential,
+            } => {
+                let proof = match credential {
+                    Credential::Secret { env, .. } => format!("--password ${env}"),
+                    Credential::Certificate(path) => {
+                        format!("--certificate {}", path.display())
+                    }
+                    Credential::FederatedToken(path) => {
+                        format!("--federated-token @{}", path.display())
+                    }
+                };
+                format!(
+                    "az login --service-principal --username {client_id} --tenant {tenant} {proof}"
+                )
+            }
+            Login::ManagedIdentity { client_id: None } => "az login --identity".into(),
+            Login::ManagedIdentity {
+                client_id: Some(id),
+            } => format!("az login --identity --username {id}"),
+        }
+    }
+
+    /// `az login`'s arguments. They name the secret's source rather than
+    /// holding it: see [`Login::secret`].
+    fn args(&self) -> Vec<String> {
+        let (tenant, client_id, credential) = match self {
+            Login::ServicePrincipal {
+                tenant,
+                client_id,
+                credential,
+            } => (tenant, client_id, credential),
+            Login::ManagedIdentity { client_id } => {
+                let mut args = vec!["--identity".to_string()];
+                if let Some(id) = client_id {
+                    args.extend(["--username".to_string(), id.clone()]);
+                }
+                return args;
+            }
+        };
+        let proof = match credential {
+            Credential::Secret { .. } => ["--password".to_string(), "@-".to_string()],
+            Credential::Certificate(path) => {
+                ["--certificate".to_string(), path.display().to_string()]
+            }
+            // az reads the file itself, so the token is as fresh as it gets.
+            Credential::FederatedToken(path) => [
+                "--federated-token".to_string(),
+                format!("@{}", path.display()),
+            ],
+        };
+        let mut args: Vec<String> = [
+            "--service-principal",
+            "--username",
+            client_id.as_str(),
+            "--tenant",
+            tenant.as_str(),
+        ]
+        .map(String::from)
+        .into();
+        args.extend(proof);
+        args
+    }
+
+    /// The client secret az reads from its stdin, if it signs in with one.
+    fn secret(&self) -> Option<&str> {
+        match self {
+            Login::ServicePrincipal {
+                credential: Credential::Secret { secret, .. },
+                ..
+            } => Some(secret),
+            _ => None,
+        }
+    }
+
+    /// Sign in. az must already be set to use [`Login::config_dir`] (see
+    /// [`crate::config::Config::az_settings`]).
+    pub async fn run(&self) -> Result<(), String> {
+        if let Some(dir) = self.config_dir() {
+            std::fs::create_dir_all(&dir)
+                .map_err(|e| format!("creating {}: {e}", dir.display()))?;
+        }
+        let mut child = az_command()
+            .args(["login", "--allow-no-subscriptions"])
+            .args(self.args())
+            .args(["-o", "none"])
+            .stdin(Stdio::piped())
+            .stdout(Stdio::piped())
+            .stderr(Stdio::piped())
+            .spawn()
+            .map_err(|e| format!("failed to run az: {e}"))?;
+        // Closed when dropped, so az sees where the secret ends. Without a
+        // secret az reads nothing and gets an empty stdin.
+        if let Some(mut stdin) = child.stdin.take() {
+            let secret = self.secret().unwrap_or_default();
+            stdin
+                .write_all(secret.as_bytes())
+                .await
+                .map_err(|e| format!("passing the secret to az: {e}"))?;
+        }
+        let out = child
+            .wait_with_output()
+            .await
+            .map_err(|e| format!("failed to run az: {e}"))?;
+        if !out.status.success() {
+            return Err(format!(
+                "{} failed: {}",
+                self.describe(),
+                String::from_utf8_lossy(&out.stderr).trim()
+            ));
+        }
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::path::Path;
+
+    #[test]
+    fn sign_ins_are_put_together_from_config_and_environment() {
+        let env = |name: &str| match name {
+            "AZURE_TENANT_ID" => Some("tenant-env".to_string()),
+            "AZURE_CLIENT_ID" => Some("client-env".to_string()),
+            "SP_SECRET" => Some("s3cret".to_string()),
+            _ => None,
+        };
+        let auth = Auth {
+            client_id: Some("client-cfg".into()),
+            client_secret_env: Some("SP_SECRET".into()),
+            ..Auth::default()
+        };
+        let login = auth.login_with(env).unwrap();
+        assert_eq!(
+            login,
+            Login::ServicePrincipal {
+                tenant: "tenant-env".into(),
+                client_id: "client-cfg".into(),
+                credential: Credential::Secret {
+                    env: "SP_SECRET".into(),
+                    secret: "s3cret".into()
+                },
+            }
+        );
+        assert!(!login.describe().contains("s3cret"));
+        assert!(!login.args().contains(&"s3cret".to_string()));
+        assert!(login.args().ends_with(&["--password".into(), "@-".into()]));
+        assert_eq!(login.secret(), Some("s3cret"));
+
+        let workload = |name: &str| match name {
+            "AZURE_FEDERATED_TOKEN_FILE" => Some("/var/run/token".to_string()),
+            _ => env(name),
+        };
+        let login = Auth::default().login_with(workload).unwrap();
+        assert!(matches!(
+            &login,
+            Login::ServicePrincipal {
+                credential: Credential::FederatedToken(path),
+                ..
+            } if path == Path::new("/var/run/token")
+        ));
+        assert!(login.args().contains(&"@/var/run/token".to_string()));
+        assert_eq!(login.secret(), None);
+
+        assert_eq!(
+            auth.login_with(|name| env(name).filter(|_| name != "SP_SECRET")),
+            Err("auth: $SP_SECRET is not set".into())
+        );
+        assert!(Auth::default().login_with(|_| None).is_err());
+    }
+
+    #[test]
+    fn managed_identities_need_no_tenant_or_credential() {
+        let system = Auth {
+            managed_identity: true,
+            ..Auth::default()
+        };
+        let login = system.login_with(|_| None).unwrap();
+        assert_eq!(login, Login::ManagedIdentity { client_id: None });
+        assert_eq!(login.args(), ["--identity"]);
+        assert!(login.config_dir().unwrap().ends_with("managed-identity"));
+
+        let user = Auth {
+            managed_identity: true,
+            client_id: Some("uami".into()),
+            ..Auth::default()
+        };
+        let login = user.login_with(|_| None).unwrap();
+        assert_eq!(login.describe(), "az login --identity --username uami");
+        assert_eq!(login.who(), "managed identity uami");
+    }
+}
@@ -0,0 +1,92 @@
+//! Pre-flight check that a machine's Bastion host can tunnel at all. Only the
+//! Standard and Premium SKUs with native client support (`enableTunneling`)
+//! accept `az network bastion tunnel`; anything else fails with an opaque
+//! websocket error, so we ask `az network bastion show` up front and explain.
+
+use crate::azure::az_command;
+use crate::model::Machine;
+use color_eyre::eyre::{eyre, Context, Result};
+
+/// Identifies a Bastion host across machines that share it.
+pub fn key(m: &Machine) -> String {
+    format!(
+        "{}/{}/{}",
+        m.bastion_subscription, m.bastion_resource_group, m.bastion_name
+    )
+}
+
+/// Query the machine's Bastion host. `Ok(None)` means it supports tunnelling,
+/// `Ok(Some(msg))` explains why it doesn't, and `Err` means `az` couldn't tell
+/// (no read access, offline), in which case the tunnel speaks for itself.
+pub async fn check(m: &Machine) -> Result<Option<String>> {
+    let mut cmd = az_command();
+    cmd.args(["network", "bastion", "show"]);
+    if !m.bastion_subscription.is_empty() {
+        cmd.arg("--subscription").arg(&m.bastion_subscription);
+    }
+    let out = cmd
+        .args(["-n", &m.bastion_name, "-g", &m.bastion_resource_group])
+        .args(["--query", "[sku.name, enableTunneling]", "-o", "tsv"])
+        .output()
+        .await
+        .wrap_err("failed to run az")?;
+    if !out.status.success() {
+        return Err(eyre!(
+            "az network bastion show failed: {}",
+            String::from_utf8_lossy(&out.stderr).trim()
+        ));
+    }
+    Ok(problem(
+        &m.bastion_name,
+        &String::from_utf8_lossy(&out.stdout),
+    ))
+}
+
+/// Read `[sku.name, enableTunneling]` as printed by `-o tsv` (tab- or
+/// newline-separated) and say what, if anything, stops tunnelling.
+fn problem(bastion: &str, tsv: &str) -> Option<String> {
+    let mut fields = tsv.split(['\t', '\n']).map(str::trim);
+    let sku = fields.next().unwrap_or_default();
+    let tunneling = fields
+        .next()
+        .unwrap_or_default()
+        .eq_ignore_ascii_case("true");
+    if sku.eq_ignore_ascii_case("basic") || sku.eq_ignore_ascii_case("developer") {
+        return Some(format!(
+            "Bastion '{bastion}' is on the {sku} SKU, which can't tunnel: upgrade it to Standard or Premium and enable native client support"
+        ));
+    }
+    if !tunneling {
+        return Some(format!(
+            "Bastion '{bastion}' has native client support turned off: enable it under the Bastion's Configuration in the portal"
+        ));
+    }
+    None
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn standard_or_premium_with_tunneling_is_fine() {
+        assert_eq!(problem("hub", "Standard\tTrue\n"), None);
+        assert_eq!(problem("hub", "Premium\ntrue\n"), None);
+    }
+
+    #[test]
+    fn basic_and_developer_skus_are_explained() {
+        let msg = problem("hub", "Basic\tNone\n").unwrap();
+        assert!(msg.contains("Basic SKU"));
+        assert!(msg.contains("Standard or Premium"));
+        assert!(problem("hub", "Developer\t\n")
+            .unwrap()
+            .contains("Developer SKU"));
+    }
+
+    #[test]
+    fn disabled_native_client_is_explained() {
+        let msg = problem("hub", "Standard\tFalse\n").unwrap();
+        assert!(msg.contains("native client support turned off"));
+    }
+}
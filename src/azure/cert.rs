@@ -1,109 +1,378 @@
-use crate::azure::parse::{parse_certificate_expiry, parse_expiry_from_output};
-use crate::config::expand_tilde;
-use crate::model::CertStatus;
+use crate::azure::parse::{
+    parse_certificate_expiry, parse_certificate_fields, parse_expiry_from_output,
+};
+use crate::azure::retry::{output_with_retry, RetryPolicy};
+use crate::bus::Bus;
+use crate::model::{CertStatus, KeyFiles};
 use crate::tui::action::BgEvent;
-use chrono::{DateTime, Duration as ChronoDuration, Local};
-use std::collections::HashMap;
-use std::path::PathBuf;
+use chrono::{DateTime, Duration as ChronoDuration, Utc};
+use std::collections::{HashMap, HashSet};
+use std::path::{Path, PathBuf};
+use std::sync::atomic::{AtomicBool, Ordering};
 use std::sync::{Arc, Mutex};
 use std::time::Duration;
 use tokio::process::Command;
-use tokio::sync::mpsc::UnboundedSender;
+use tokio::sync::{Notify, Semaphore};
 
-const CERT_LIFETIME: ChronoDuration = ChronoDuration::hours(1);
-const RENEWAL_WINDOW_MINS: i64 = 5;
-const RENEWAL_RETRY: ChronoDuration = ChronoDuration::seconds(30);
-const CHECK_INTERVAL: Duration = Duration::from_secs(60);
+/// Retries for a transiently failing `az ssh cert` unless `retry.cert` says otherwise.
+pub const DEFAULT_RETRY: RetryPolicy = RetryPolicy::new(2, Duration::from_secs(5));
+/// Certificates read with `ssh-keygen` at once by [`CertManager::register_all`].
+const REGISTER_WORKERS: usize = 8;
 
+/// When a certificate is renewed; `cert:` in config, per machine or for all.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct CertTiming {
+    /// Assumed lifetime of a new certificate when `az` doesn't print its
+    /// expiry.
+    pub lifetime: ChronoDuration,
+    /// Renew once this little time is left.
+    pub renewal_window: ChronoDuration,
+    /// Wait between failed renewals inside the window.
+    pub retry_delay: ChronoDuration,
+}
+
+impl Default for CertTiming {
+    fn default() -> Self {
+        Self {
+            lifetime: ChronoDuration::hours(1),
+            renewal_window: ChronoDuration::minutes(5),
+            retry_delay: ChronoDuration::seconds(30),
+        }
+    }
+}
+
+/// All times are UTC; nothing here depends on the local timezone, so expiry
+/// math stays correct across DST changes. Only display converts to local time.
 #[derive(Debug, Clone)]
 struct CertInfo {
     vm_name: String,
+    private_key_path: PathBuf,
     public_key_path: PathBuf,
     cert_path: PathBuf,
-    expires_at: DateTime<Local>,
-    last_renewal_try: Option<DateTime<Local>>,
+    timing: CertTiming,
+    expires_at: DateTime<Utc>,
+    last_renewal_try: Option<DateTime<Utc>>,
     status: CertStatus,
+    /// Kept until a renewal succeeds, unlike the status events.
+    last_error: Option<RenewalError>,
+}
+
+/// Why the most recent renewal of a certificate failed.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct RenewalError {
+    pub at: DateTime<Utc>,
+    /// Everything `az` printed (stdout and stderr), or why it couldn't run.
+    pub output: String,
+}
+
+/// A snapshot of one certificate, for the cert detail view.
+#[derive(Debug, Clone)]
+pub struct CertDetails {
+    pub expires_at: DateTime<Utc>,
+    pub status: CertStatus,
+    pub last_error: Option<RenewalError>,
+}
+
+/// The text of a failed `az` run: stdout and stderr, or the spawn error.
+fn failure_output(result: &std::io::Result<std::process::Output>) -> String {
+    match result {
+        Ok(out) => {
+            let stdout = String::from_utf8_lossy(&out.stdout);
+            let stderr = String::from_utf8_lossy(&out.stderr);
+            let text = [stdout.trim(), stderr.trim()]
+                .into_iter()
+                .filter(|s| !s.is_empty())
+                .collect::<Vec<_>>()
+                .join("\n");
+            if text.is_empty() {
+                format!("az exited with {} and printed nothing", out.status)
+            } else {
+                text
+            }
+        }
+        Err(e) => format!("could not run az: {e}"),
+    }
 }
 
 /// Determine status from expiry, matching Go getRenewalStatus.
-fn renewal_status(expires_at: DateTime<Local>) -> CertStatus {
-    let remaining = expires_at - Local::now();
+fn renewal_status(expires_at: DateTime<Utc>, window: ChronoDuration) -> CertStatus {
+    let remaining = expires_at - Utc::now();
     if remaining <= ChronoDuration::zero() {
         CertStatus::Expired
-    } else if remaining <= ChronoDuration::minutes(RENEWAL_WINDOW_MINS) {
+    } else if remaining <= window {
         CertStatus::ExpiringSoon
     } else {
         CertStatus::Valid
     }
 }
 
+/// When `cert` next needs looking at: its window opening, its expiry, or
+/// the next renewal attempt. `None` when nothing will change on its own,
+/// i.e. it has expired with renewal paused.
+fn next_check(cert: &CertInfo, paused: bool, now: DateTime<Utc>) -> Option<DateTime<Utc>> {
+    let window_opens = cert.expires_at - cert.timing.renewal_window;
+    if now < window_opens {
+        return Some(window_opens);
+    }
+    let expiry = (now < cert.expires_at).then_some(cert.expires_at);
+    if paused {
+        return expiry;
+    }
+    let attempt = cert
+        .last_renewal_try
+        .map_or(now, |t| t + cert.timing.retry_delay);
+    Some(expiry.map_or(attempt, |e| e.min(attempt)))
+}
+
 #[derive(Clone)]
 pub struct CertManager {
-    tx: UnboundedSender<BgEvent>,
+    bus: Bus,
     certs: Arc<Mutex<HashMap<String, CertInfo>>>,
+    /// Applied to `az ssh cert`, for renewals and `r` alike.
+    retry: RetryPolicy,
+    /// Machines whose automatic renewal is paused (`p`), kept apart from the
+    /// certs so re-registering doesn't resume them.
+    paused: Arc<Mutex<HashSet<String>>>,
+    /// Automatic renewal paused for every machine (`P`).
+    all_paused: Arc<AtomicBool>,
+    /// Load each new certificate into ssh-agent (`ssh_agent: true`).
+    ssh_agent: bool,
+    /// Wakes the monitoring loop to check now and reschedule, e.g. when a
+    /// certificate or pause changed.
+    check_now: Arc<Notify>,
 }
 
 impl CertManager {
-    pub fn new(tx: UnboundedSender<BgEvent>) -> Self {
+    pub fn new(bus: impl Into<Bus>) -> Self {
         Self {
-            tx,
+            bus: bus.into(),
             certs: Arc::new(Mutex::new(HashMap::new())),
+            retry: DEFAULT_RETRY,
+            paused: Arc::new(Mutex::new(HashSet::new())),
+            all_paused: Arc::new(AtomicBool::new(false)),
+            ssh_agent: false,
+            check_now: Arc::new(Notify::new()),
         }
     }
 
+    /// Retry transient `az ssh cert` failures under `policy`.
+    pub fn with_retry(mut self, policy: RetryPolicy) -> Self {
+        self.retry = policy;
+        self
+    }
+
+    /// Add each certificate to ssh-agent once it is generated or renewed.
+    pub fn with_ssh_agent(mut self, on: bool) -> Self {
+        self.ssh_agent = on;
+        self
+    }
+
+    /// Start with automatic renewal paused for every machine, as
+    /// [`set_all_paused`](Self::set_all_paused) would, so nothing is renewed
+    /// before the caller gets to pause it.
+    pub fn with_paused(self, paused: bool) -> Self {
+        self.all_paused.store(paused, Ordering::Relaxed);
+        self
+    }
+
     /// Register a cert for monitoring (cert may not exist yet -> marked expired).
-    pub fn register(&self, vm_name: &str, ssh_config_path: &str) {
-        let dir = PathBuf::from(expand_tilde(ssh_config_path));
-        let public_key_path = dir.join("id_rsa.pub");
-        let cert_path = dir.join("id_rsa.pub-aadcert.pub");
-
-        let (expires_at, status) = if cert_path.exists() {
-            let exp = read_cert_expiry(&cert_path).unwrap_or_else(|| Local::now() + CERT_LIFETIME);
-            (exp, renewal_status(exp))
-        } else {
-            (Local::now(), CertStatus::Expired)
-        };
+    /// Its key files are kept for renewals and for `r`.
+    pub fn register(&self, vm_name: &str, files: KeyFiles, timing: CertTiming) {
+        let KeyFiles {
+            private_key: private_key_path,
+            public_key: public_key_path,
+            cert: cert_path,
+        } = files;
+
+        let (expires_at, status) =
+            cert_state(&cert_path, timing).unwrap_or((Utc::now(), CertStatus::Expired));
 
         let info = CertInfo {
             vm_name: vm_name.to_string(),
+            private_key_path,
             public_key_path,
             cert_path,
+            timing,
             expires_at,
             last_renewal_try: None,
             status,
+            last_error: None,
         };
-        let expires_in = (info.expires_at - Local::now()).to_std().ok();
+        let expires_in = (info.expires_at - Utc::now()).to_std().ok();
         self.certs.lock().unwrap().insert(vm_name.to_string(), info);
-        let _ = self.tx.send(BgEvent::Cert {
+        // Sent before the monitor is woken, so a renewal it starts is
+        // reported after this and the UI ends on the newer state.
+        self.bus.publish(BgEvent::Cert {
             vm_name: vm_name.to_string(),
             status,
             expires_in,
         });
+        self.check_now();
+    }
+
+    /// [`register`](Self::register) every machine in `certs` in the
+    /// background, reading up to REGISTER_WORKERS certificates at a time, so
+    /// a long machine list doesn't hold up startup. Each reports its
+    /// [`BgEvent::Cert`] as soon as it is read.
+    pub fn register_all(&self, certs: Vec<(String, KeyFiles, CertTiming)>) {
+        let workers = Arc::new(Semaphore::new(REGISTER_WORKERS));
+        for (vm_name, files, timing) in certs {
+            let me = self.clone();
+            let workers = workers.clone();
+            tokio::spawn(async move {
+                let Ok(_permit) = workers.acquire_owned().await else {
+                    return;
+                };
+                // `ssh-keygen` is run and waited on synchronously.
+                let _ =
+                    tokio::task::spawn_blocking(move || me.register(&vm_name, files, timing)).await;
+            });
+        }
+    }
+
+    /// Current state of `vm_name`'s certificate, if it has one registered.
+    pub fn details(&self, vm_name: &str) -> Option<CertDetails> {
+        self.certs
+            .lock()
+            .unwrap()
+            .get(vm_name)
+            .map(|c| CertDetails {
+                expires_at: c.expires_at,
+                status: c.status,
+                last_error: c.last_error.clone(),
+            })
+    }
+
+    /// Stop (or resume) renewing `vm_name`'s certificate automatically. Its
+    /// status is still tracked, and `r` still regenerates it.
+    pub fn set_paused(&self, vm_name: &str, paused: bool) {
+        let mut set = self.paused.lock().unwrap();
+        if paused {
+            set.insert(vm_name.to_string());
+        } else {
+            set.remove(vm_name);
+        }
+        drop(set);
+        self.check_now();
+    }
+
+    /// [`CertManager::set_paused`] for every machine at once, on top of the
+    /// per-machine pauses.
+    pub fn set_all_paused(&self, paused: bool) {
+        self.all_paused.store(paused, Ordering::Relaxed);
+        self.check_now();
+    }
+
+    fn renewal_paused(&self, vm_name: &str) -> bool {
+        self.all_paused.load(Ordering::Relaxed) || self.paused.lock().unwrap().contains(vm_name)
+    }
+
+    /// Read `vm_name`'s certificate with `ssh-keygen -L`, answering with
+    /// [`BgEvent::CertInspected`].
+    pub fn inspect(&self, vm_name: &str) {
+        let cert_path = match self.certs.lock().unwrap().get(vm_name) {
+            Some(c) => c.cert_path.clone(),
+            None => return,
+        };
+        let bus = self.bus.clone();
+        let vm_name = vm_name.to_string();
+        tokio::spawn(async move {
+            let result = if !cert_path.exists() {
+                Err(format!(
+                    "no certificate at {}; r generates one",
+                    cert_path.display()
+                ))
+            } else {
+                match Command::new("ssh-keygen")
+                    .arg("-L")
+                    .arg("-f")
+                    .arg(&cert_path)
+                    .output()
+                    .await
+                {
+                    Ok(out) => parse_certificate_fields(&String::from_utf8_lossy(&out.stdout))
+                        .ok_or_else(|| String::from_utf8_lossy(&out.stderr).trim().to_string()),
+                    Err(e) => Err(format!("ssh-keygen: {e}")),
+                }
+            };
+            bus.publish(BgEvent::CertInspected { vm_name, result });
+        });
+    }
+
+    pub(crate) fn record_failure(&self, vm_name: &str, output: String) {
+        if let Some(c) = self.certs.lock().unwrap().get_mut(vm_name) {
+            c.status = CertStatus::RenewalFailed;
+            c.last_error = Some(RenewalError {
+                at: Utc::now(),
+                output,
+            });
+        }
+    }
+
+    /// Expiry of every registered certificate, by machine name.
+    pub fn expiries(&self) -> Vec<(String, DateTime<Utc>)> {
+        let mut out: Vec<_> = self
+            .certs
+            .lock()
+            .unwrap()
+            .values()
+            .map(|c| (c.vm_name.clone(), c.expires_at))
+            .collect();
+        out.sort();
+        out
     }
 
-    /// Spawn the periodic check-and-renew loop.
+    /// Spawn the check-and-renew loop. Rather than polling, it sleeps until
+    /// the earliest [`next_check`] of all certificates, so renewal starts
+    /// as the window opens.
     pub fn start_monitoring(&self) {
         let me = self.clone();
         tokio::spawn(async move {
-            let mut ticker = tokio::time::interval(CHECK_INTERVAL);
             loop {
-                ticker.tick().await;
                 me.check_and_renew().await;
+                match me.wait_until_due() {
+                    Some(wait) => {
+                        tokio::select! {
+                            _ = tokio::time::sleep(wait) => {}
+                            _ = me.check_now.notified() => {}
+                        }
+                    }
+                    None => me.check_now.notified().await,
+                }
             }
         });
     }
 
+    /// How long until some certificate is due, or `None` if none will be.
+    fn wait_until_due(&self) -> Option<Duration> {
+        let now = Utc::now();
+        self.certs
+            .lock()
+            .unwrap()
+            .values()
+            .filter_map(|c| next_check(c, self.renewal_paused(&c.vm_name), now))
+            .min()
+            .map(|at| (at - now).to_std().unwrap_or_default())
+    }
+
+    /// Check every certificate now rather than when the next is due, e.g.
+    /// after the machine wakes from sleep: timers count monotonic time, so
+    /// they run late across a suspend.
+    pub fn check_now(&self) {
+        self.check_now.notify_one();
+    }
+
     async fn check_and_renew(&self) {
         let snapshot: Vec<CertInfo> = self.certs.lock().unwrap().values().cloned().collect();
-        let now = Local::now();
+        let now = Utc::now();
         for cert in snapshot {
-            let new_status = renewal_status(cert.expires_at);
+            let new_status = renewal_status(cert.expires_at, cert.timing.renewal_window);
             if new_status != cert.status {
                 if let Some(c) = self.certs.lock().unwrap().get_mut(&cert.vm_name) {
                     c.status = new_status;
                 }
                 let expires_in = (cert.expires_at - now).to_std().ok();
-                let _ = self.tx.send(BgEvent::Cert {
+                self.bus.publish(BgEvent::Cert {
                     vm_name: cert.vm_name.clone(),
                     status: new_status,
                     expires_in,
@@ -111,67 +380,71 @@ impl CertManager {
             }
 
             let remaining = cert.expires_at - now;
-            let should_renew = remaining <= ChronoDuration::zero()
-                || (remaining <= ChronoDuration::minutes(RENEWAL_WINDOW_MINS)
-                    && cert
-                        .last_renewal_try
-                        .is_none_or(|t| now - t >= RENEWAL_RETRY));
-            if should_renew {
+            let should_renew = remaining <= cert.timing.renewal_window
+                && cert
+                    .last_renewal_try
+                    .is_none_or(|t| now - t >= cert.timing.retry_delay);
+            if should_renew && !self.renewal_paused(&cert.vm_name) {
                 self.renew(cert.vm_name.clone()).await;
             }
         }
     }
 
     async fn renew(&self, vm_name: String) {
-        let (public_key_path, cert_path) = {
+        let (public_key_path, cert_path, lifetime) = {
             let mut guard = self.certs.lock().unwrap();
             let Some(c) = guard.get_mut(&vm_name) else {
                 return;
             };
-            c.last_renewal_try = Some(Local::now());
+            c.last_renewal_try = Some(Utc::now());
             c.status = CertStatus::Renewing;
-            (c.public_key_path.clone(), c.cert_path.clone())
+            (
+                c.public_key_path.clone(),
+                c.cert_path.clone(),
+                c.timing.lifetime,
+            )
         };
-        let _ = self.tx.send(BgEvent::Cert {
+        self.bus.publish(BgEvent::Cert {
             vm_name: vm_name.clone(),
             status: CertStatus::Renewing,
             expires_in: None,
         });
 
-        let output = super::az_command()
-            .arg("ssh")
-            .arg("cert")
-            .arg("--file")
-            .arg(&cert_path)
-            .arg("--public-key-file")
-            .arg(&public_key_path)
-            .output()
-            .await;
+        let output = output_with_retry(self.retry, || {
+            let mut cmd = super::az_command();
+            cmd.arg("ssh")
+                .arg("cert")
+                .arg("--file")
+                .arg(&cert_path)
+                .arg("--public-key-file")
+                .arg(&public_key_path);
+            cmd
+        })
+        .await;
 
         match output {
             Ok(out) if out.status.success() => {
                 let text = String::from_utf8_lossy(&out.stdout);
-                let expires_at = parse_expiry_from_output(&text)
-                    .unwrap_or_else(|_| Local::now() + CERT_LIFETIME);
+                let expected = Utc::now() + lifetime;
+                let expires_at = parse_expiry_from_output(&text, expected).unwrap_or(expected);
                 if let Some(c) = self.certs.lock().unwrap().get_mut(&vm_name) {
                     c.expires_at = expires_at;
                     c.status = CertStatus::Valid;
+                    c.last_error = None;
                 }
-                let expires_in = (expires_at - Local::now()).to_std().ok();
-                let _ = self.tx.send(BgEvent::Cert {
+                self.load_into_agent(&vm_name).await;
+                let expires_in = (expires_at - Utc::now()).to_std().ok();
+                self.bus.publish(BgEvent::Cert {
                     vm_name,
                     status: CertStatus::Renewed,
                     expires_in,
                 });
             }
             _ => {
-                // Renewal failed (az error or non-zero exit). We surface this only as
-                // the RenewalFailed status, matching the Go TUI, which likewise does not
-                // display the underlying error message. A diagnostic log file is Phase 2.
-                if let Some(c) = self.certs.lock().unwrap().get_mut(&vm_name) {
-                    c.status = CertStatus::RenewalFailed;
-                }
-                let _ = self.tx.send(BgEvent::Cert {
+                // The status event can be missed or overwritten; the full
+                // output stays on the cert for the detail view (`i`).
+                self.record_failure(&vm_name, failure_output(&output));
+                self.bus.publish(BgEvent::Cert {
                     vm_name,
                     status: CertStatus::RenewalFailed,
                     expires_in: None,
@@ -180,15 +453,29 @@ impl CertManager {
         }
     }
 
-    /// Manual (re)generation triggered by `r`. Runs ssh-keygen if no key, then az ssh cert.
-    pub async fn generate(&self, vm_name: String, ssh_config_path: String) {
-        let dir = PathBuf::from(expand_tilde(&ssh_config_path));
-        let public_key_path = dir.join("id_rsa.pub");
-        let private_key_path = dir.join("id_rsa");
-        let cert_path = dir.join("id_rsa.pub-aadcert.pub");
+    /// Manual (re)generation triggered by `r`, with the key files `vm_name`
+    /// was registered with. Runs ssh-keygen if no key, then az ssh cert.
+    pub async fn generate(&self, vm_name: String) {
+        let paths = self.certs.lock().unwrap().get(&vm_name).map(|c| {
+            (
+                c.private_key_path.clone(),
+                c.public_key_path.clone(),
+                c.cert_path.clone(),
+                c.timing.lifetime,
+            )
+        });
+        let Some((private_key_path, public_key_path, cert_path, lifetime)) = paths else {
+            self.bus.publish(BgEvent::CertRegenResult {
+                vm_name,
+                ok: false,
+                message: "no certificate registered for this machine".into(),
+            });
+            return;
+        };
 
-        if let Err(e) = std::fs::create_dir_all(&dir) {
-            let _ = self.tx.send(BgEvent::CertRegenResult {
+        let dir = private_key_path.parent().unwrap_or(Path::new("."));
+        if let Err(e) = std::fs::create_dir_all(dir) {
+            self.bus.publish(BgEvent::CertRegenResult {
                 vm_name,
                 ok: false,
                 message: format!("mkdir failed: {e}"),
@@ -210,7 +497,7 @@ impl CertManager {
                 .await;
             if let Ok(out) = &kg {
                 if !out.status.success() {
-                    let _ = self.tx.send(BgEvent::CertRegenResult {
+                    self.bus.publish(BgEvent::CertRegenResult {
                         vm_name,
                         ok: false,
                         message: String::from_utf8_lossy(&out.stderr).to_string(),
@@ -218,7 +505,7 @@ impl CertManager {
                     return;
                 }
             } else if let Err(e) = kg {
-                let _ = self.tx.send(BgEvent::CertRegenResult {
+                self.bus.publish(BgEvent::CertRegenResult {
                     vm_name,
                     ok: false,
                     message: e.to_string(),
@@ -227,50 +514,50 @@ impl CertManager {
             }
         }
 
-        let out = super::az_command()
-            .arg("ssh")
-            .arg("cert")
-            .arg("--file")
-            .arg(&cert_path)
-            .arg("--public-key-file")
-            .arg(&public_key_path)
-            .output()
-            .await;
+        let out = output_with_retry(self.retry, || {
+            let mut cmd = super::az_command();
+            cmd.arg("ssh")
+                .arg("cert")
+                .arg("--file")
+                .arg(&cert_path)
+                .arg("--public-key-file")
+                .arg(&public_key_path);
+            cmd
+        })
+        .await;
 
         match out {
             Ok(o) if o.status.success() => {
                 let text = String::from_utf8_lossy(&o.stdout);
-                let expires_at = parse_expiry_from_output(&text)
-                    .unwrap_or_else(|_| Local::now() + CERT_LIFETIME);
-                self.certs.lock().unwrap().insert(
-                    vm_name.clone(),
-                    CertInfo {
-                        vm_name: vm_name.clone(),
-                        public_key_path,
-                        cert_path,
-                        expires_at,
-                        last_renewal_try: None,
-                        status: CertStatus::Valid,
-                    },
-                );
-                let expires_in = (expires_at - Local::now()).to_std().ok();
-                let _ = self.tx.send(BgEvent::Cert {
+                let expected = Utc::now() + lifetime;
+                let expires_at = parse_expiry_from_output(&text, expected).unwrap_or(expected);
+                if let Some(c) = self.certs.lock().unwrap().get_mut(&vm_name) {
+                    c.expires_at = expires_at;
+                    c.last_renewal_try = None;
+                    c.status = CertStatus::Valid;
+                    c.last_error = None;
+                }
+                self.check_now();
+                self.load_into_agent(&vm_name).await;
+                let expires_in = (expires_at - Utc::now()).to_std().ok();
+                self.bus.publish(BgEvent::Cert {
                     vm_name: vm_name.clone(),
                     status: CertStatus::Valid,
                     expires_in,
                 });
-                let _ = self.tx.send(BgEvent::CertRegenResult {
+                self.bus.publish(BgEvent::CertRegenResult {
                     vm_name,
                     ok: true,
                     message: "Certificate regenerated".into(),
                 });
             }
             other => {
+                self.record_failure(&vm_name, failure_output(&other));
                 let msg = match other {
                     Ok(o) => String::from_utf8_lossy(&o.stderr).to_string(),
                     Err(e) => e.to_string(),
                 };
-                let _ = self.tx.send(BgEvent::CertRegenResult {
+                self.bus.publish(BgEvent::CertRegenResult {
                     vm_name,
                     ok: false,
                     message: msg,
@@ -278,10 +565,87 @@ impl CertManager {
             }
         }
     }
+
+    /// With `ssh_agent: true`, add `vm_name`'s key and fresh certificate to
+    /// ssh-agent for as long as the certificate is valid, so running ssh
+    /// sessions and other tools pick it up. Failures are reported with
+    /// [`BgEvent::AgentLoadFailed`].
+    async fn load_into_agent(&self, vm_name: &str) {
+        if !self.ssh_agent {
+            return;
+        }
+        let Some((private_key, cert, expires_at)) =
+            self.certs.lock().unwrap().get(vm_name).map(|c| {
+                (
+                    c.private_key_path.clone(),
+                    c.cert_path.clone(),
+                    c.expires_at,
+                )
+            })
+        else {
+            return;
+        };
+        let result = add_to_agent(&private_key, &cert, expires_at - Utc::now()).await;
+        if let Err(error) = result {
+            self.bus.publish(BgEvent::AgentLoadFailed {
+                vm_name: vm_name.to_string(),
+                error,
+            });
+        }
+    }
+}
+
+/// Where ssh-add looks for the certificate of `private_key`: OpenSSH's
+/// `<key>-cert.pub`, rather than the `<key>.pub-aadcert.pub` az writes.
+fn agent_cert_path(private_key: &Path) -> PathBuf {
+    let mut name = private_key.as_os_str().to_os_string();
+    name.push("-cert.pub");
+    PathBuf::from(name)
+}
+
+/// `ssh-add -t <secs> <key>` with `cert` copied to where ssh-add finds it.
+async fn add_to_agent(
+    private_key: &Path,
+    cert: &Path,
+    valid_for: ChronoDuration,
+) -> Result<(), String> {
+    std::fs::copy(cert, agent_cert_path(private_key))
+        .map_err(|e| format!("copying the certificate for ssh-add: {e}"))?;
+    let out = Command::new("ssh-add")
+        .arg("-t")
+        .arg(valid_for.num_seconds().max(1).to_string())
+        .arg(private_key)
+        .stdin(std::process::Stdio::null())
+        .output()
+        .await
+        .map_err(|e| format!("ssh-add: {e}"))?;
+    if out.status.success() {
+        Ok(())
+    } else {
+        Err(String::from_utf8_lossy(&out.stderr).trim().to_string())
+    }
 }
 
-/// Read cert expiry via `ssh-keygen -L -f <cert>`, falling back to file mtime + 1h.
-fn read_cert_expiry(cert_path: &std::path::Path) -> Option<DateTime<Local>> {
+/// Expiry and status of the certificate at `cert_path` as it is on disk,
+/// without renewing it; `None` when there is none yet.
+pub fn cert_state(
+    cert_path: &std::path::Path,
+    timing: CertTiming,
+) -> Option<(DateTime<Utc>, CertStatus)> {
+    if !cert_path.exists() {
+        return None;
+    }
+    let exp = read_cert_expiry(cert_path, timing.lifetime)
+        .unwrap_or_else(|| Utc::now() + timing.lifetime);
+    Some((exp, renewal_status(exp, timing.renewal_window)))
+}
+
+/// Read cert expiry via `ssh-keygen -L -f <cert>`, falling back to file mtime
+/// + `lifetime`.
+fn read_cert_expiry(
+    cert_path: &std::path::Path,
+    lifetime: ChronoDuration,
+) -> Option<DateTime<Utc>> {
     let out = std::process::Command::new("ssh-keygen")
         .arg("-L")
         .arg("-f")
@@ -289,12 +653,23 @@ fn read_cert_expiry(cert_path: &std::path::Path) -> Option<DateTime<Local>> {
         .output()
         .ok()?;
     let text = String::from_utf8_lossy(&out.stdout);
-    if let Ok(exp) = parse_certificate_expiry(&text) {
+    if let Ok(exp) = parse_certificate_expiry(&text, Utc::now()) {
         return Some(exp);
     }
     let meta = std::fs::metadata(cert_path).ok()?;
-    let modified: DateTime<Local> = meta.modified().ok()?.into();
-    Some(modified + CERT_LIFETIME)
+    let modified: DateTime<Utc> = meta.modified().ok()?.into();
+    Some(modified + lifetime)
+}
+
+/// The user an AAD certificate logs in as, via `ssh-keygen -L -f <cert>`.
+pub fn read_cert_principal(cert_path: &std::path::Path) -> Option<String> {
+    let out = std::process::Command::new("ssh-keygen")
+        .arg("-L")
+        .arg("-f")
+        .arg(cert_path)
+        .output()
+        .ok()?;
+    super::parse::parse_certificate_principal(&String::from_utf8_lossy(&out.stdout))
 }
 
 #[cfg(test)]
@@ -302,21 +677,158 @@ mod tests {
     use super::*;
     use chrono::Duration as ChronoDuration;
 
+    #[test]
+    fn renewal_failure_is_kept_with_full_output() {
+        let (tx, _rx) = tokio::sync::mpsc::unbounded_channel();
+        let mgr = CertManager::new(tx);
+        mgr.register(
+            "vm",
+            KeyFiles::for_private_key("/nonexistent/az-burrow-test/id_rsa".into()),
+            CertTiming::default(),
+        );
+        assert_eq!(mgr.details("vm").unwrap().last_error, None);
+
+        mgr.record_failure("vm", "ERROR: AADSTS700082: token expired".into());
+        let details = mgr.details("vm").unwrap();
+        assert_eq!(details.status, CertStatus::RenewalFailed);
+        assert_eq!(
+            details.last_error.unwrap().output,
+            "ERROR: AADSTS700082: token expired"
+        );
+        assert!(mgr.details("other").is_none());
+    }
+
+    #[cfg(unix)]
+    #[test]
+    fn failure_output_joins_stdout_and_stderr() {
+        use std::os::unix::process::ExitStatusExt;
+        let out = std::process::Output {
+            status: std::process::ExitStatus::from_raw(1 << 8),
+            stdout: b"partial\n".to_vec(),
+            stderr: b"ERROR: denied\n".to_vec(),
+        };
+        assert_eq!(failure_output(&Ok(out)), "partial\nERROR: denied");
+    }
+
+    const WINDOW: ChronoDuration = ChronoDuration::minutes(5);
+
+    #[test]
+    fn agent_certificate_uses_openssh_naming() {
+        assert_eq!(
+            agent_cert_path(Path::new("/keys/vm/id_rsa")),
+            PathBuf::from("/keys/vm/id_rsa-cert.pub")
+        );
+    }
+
+    #[test]
+    fn next_check_follows_the_window_and_retries() {
+        let now = Utc::now();
+        let mut cert = CertInfo {
+            vm_name: "vm-web".into(),
+            private_key_path: PathBuf::from("id_rsa"),
+            public_key_path: PathBuf::from("id_rsa.pub"),
+            cert_path: PathBuf::from("id_rsa.pub-aadcert.pub"),
+            timing: CertTiming::default(),
+            expires_at: now + ChronoDuration::minutes(45),
+            last_renewal_try: None,
+            status: CertStatus::Valid,
+            last_error: None,
+        };
+        let window_opens = now + ChronoDuration::minutes(40);
+        assert_eq!(next_check(&cert, false, now), Some(window_opens));
+        assert_eq!(next_check(&cert, true, now), Some(window_opens));
+
+        let later = now + ChronoDuration::minutes(41);
+        assert_eq!(next_check(&cert, false, later), Some(later));
+        cert.last_renewal_try = Some(later);
+        assert_eq!(
+            next_check(&cert, false, later),
+            Some(later + ChronoDuration::seconds(30))
+        );
+        assert_eq!(next_check(&cert, true, later), Some(cert.expires_at));
+
+        let expired = now + ChronoDuration::hours(1);
+        assert_eq!(next_check(&cert, true, expired), None);
+        assert_eq!(
+            next_check(&cert, false, expired),
+            Some(later + ChronoDuration::seconds(30))
+        );
+    }
+
+    #[tokio::test]
+    async fn machines_are_registered_in_the_background() {
+        let (tx, mut rx) = tokio::sync::mpsc::unbounded_channel();
+        let mgr = CertManager::new(tx);
+        let certs: Vec<_> = (0..REGISTER_WORKERS * 2)
+            .map(|i| {
+                let key = format!("/nonexistent/az-burrow-test/vm-{i}/id_rsa");
+                (
+                    format!("vm-{i}"),
+                    KeyFiles::for_private_key(key.into()),
+                    CertTiming::default(),
+                )
+            })
+            .collect();
+        mgr.register_all(certs);
+
+        let mut seen = HashSet::new();
+        while seen.len() < REGISTER_WORKERS * 2 {
+            match rx.recv().await.unwrap() {
+                BgEvent::Cert {
+                    vm_name, status, ..
+                } => {
+                    assert_eq!(status, CertStatus::Expired, "no certificate yet");
+                    seen.insert(vm_name);
+                }
+                other => panic!("unexpected {other:?}"),
+            }
+        }
+        assert!(mgr.details("vm-0").is_some());
+    }
+
+    #[test]
+    fn pauses_per_machine_and_for_all() {
+        let (tx, _rx) = tokio::sync::mpsc::unbounded_channel();
+        let mgr = CertManager::new(tx.clone());
+        mgr.set_paused("vm-web", true);
+        assert!(mgr.renewal_paused("vm-web"));
+        assert!(!mgr.renewal_paused("vm-db"));
+
+        mgr.set_all_paused(true);
+        assert!(mgr.renewal_paused("vm-db"));
+        mgr.set_all_paused(false);
+        mgr.set_paused("vm-web", false);
+        assert!(!mgr.renewal_paused("vm-web"));
+
+        let paused = CertManager::new(tx).with_paused(true);
+        assert!(paused.renewal_paused("vm-web"));
+    }
+
     #[test]
     fn status_expired_when_past() {
-        let exp = chrono::Local::now() - ChronoDuration::minutes(1);
-        assert_eq!(renewal_status(exp), crate::model::CertStatus::Expired);
+        let exp = chrono::Utc::now() - ChronoDuration::minutes(1);
+        assert_eq!(
+            renewal_status(exp, WINDOW),
+            crate::model::CertStatus::Expired
+        );
     }
 
     #[test]
     fn status_expiring_within_window() {
-        let exp = chrono::Local::now() + ChronoDuration::minutes(3);
-        assert_eq!(renewal_status(exp), crate::model::CertStatus::ExpiringSoon);
+        let exp = chrono::Utc::now() + ChronoDuration::minutes(3);
+        assert_eq!(
+            renewal_status(exp, WINDOW),
+            crate::model::CertStatus::ExpiringSoon
+        );
     }
 
     #[test]
     fn status_valid_when_far() {
-        let exp = chrono::Local::now() + ChronoDuration::minutes(50);
-        assert_eq!(renewal_status(exp), crate::model::CertStatus::Valid);
+        let exp = chrono::Utc::now() + ChronoDuration::minutes(50);
+        assert_eq!(renewal_status(exp, WINDOW), crate::model::CertStatus::Valid);
+        assert_eq!(
+            renewal_status(exp, ChronoDuration::hours(1)),
+            crate::model::CertStatus::ExpiringSoon
+        );
     }
 }
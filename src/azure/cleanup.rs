@@ -3,6 +3,28 @@
 //! kill the whole tree — not just the direct child — to free the local port.
 //! On Unix we kill the process group; on Windows we kill the PID tree.
 
+/// Whether tunnels can be left running after az-burrow exits ("detach").
+/// Windows binds every child to a kill-on-close Job Object (see
+/// [`register_child`]), so the OS tears them down with us there.
+pub const CAN_DETACH: bool = cfg!(unix);
+
+/// Ask the process group to exit (SIGTERM) so az and ssh can close their
+/// connections; [`kill_process_group`] is the fallback when they don't.
+#[cfg(unix)]
+pub fn terminate_process_group(pid: u32) {
+    use nix::sys::signal::{killpg, Signal};
+    use nix::unistd::Pid;
+    let _ = killpg(Pid::from_raw(pid as i32), Signal::SIGTERM);
+}
+
+/// `taskkill` without `/F` asks the tree to close.
+#[cfg(windows)]
+pub fn terminate_process_group(pid: u32) {
+    let _ = std::process::Command::new("taskkill")
+        .args(["/PID", &pid.to_string(), "/T"])
+        .output();
+}
+
 #[cfg(unix)]
 pub fn kill_process_group(pid: u32) {
     use nix::sys::signal::{killpg, Signal};
@@ -17,14 +39,104 @@ pub fn kill_process_group(pid: u32) {
 pub fn kill_process_group(pid: u32) {
     // `pid` is the `cmd.exe` we spawned (see `az_command`); `/T` kills its whole
     // tree (cmd → az → python → tunnel) and `/F` forces it, freeing the port.
-    // Runs synchronously in `stop()` before the monitor task drops the Child, so
-    // the tree is still intact when taskkill walks it. Errors are ignored — the
+    // Runs before the monitor task drops the Child, so the tree is still
+    // intact when taskkill walks it. Errors are ignored — the
     // process may already be gone.
     let _ = std::process::Command::new("taskkill")
         .args(["/PID", &pid.to_string(), "/T", "/F"])
         .output();
 }
 
+/// Whether a process with this PID is still alive and signalable by us. Used to
+/// reattach to tunnels left running by a previous (detached) session, and to
+/// tell whether the instance holding a lock is still running.
+#[cfg(unix)]
+pub fn is_alive(pid: u32) -> bool {
+    use nix::sys::signal::kill;
+    use nix::unistd::Pid;
+    // 0 and anything that wraps negative would address a group, not a process.
+    let Ok(raw) = i32::try_from(pid) else {
+        return false;
+    };
+    if raw <= 0 {
+        return false;
+    }
+    // Signal 0 performs the permission/existence check without delivering.
+    kill(Pid::from_raw(raw), None).is_ok()
+}
+
+#[cfg(windows)]
+pub fn is_alive(pid: u32) -> bool {
+    use windows_sys::Win32::Foundation::{CloseHandle, STILL_ACTIVE};
+    use windows_sys::Win32::System::Threading::{
+        GetExitCodeProcess, OpenProcess, PROCESS_QUERY_LIMITED_INFORMATION,
+    };
+
+    if pid == 0 {
+        return false;
+    }
+    // SAFETY: the handle is checked before use and closed exactly once.
+    unsafe {
+        let process = OpenProcess(PROCESS_QUERY_LIMITED_INFORMATION, 0, pid);
+        if process.is_null() {
+            return false;
+        }
+        let mut code = 0u32;
+        let ok = GetExitCodeProcess(process, &mut code) != 0;
+        CloseHandle(process);
+        ok && code == STILL_ACTIVE as u32
+    }
+}
+
+/// When the process with this PID started, as `ps -o lstart` prints it (on
+/// Windows, its creation time in 100ns ticks). Kept next to a detached
+/// tunnel's PID, or an instance's in its lock, so that after a reboot or once
+/// the PID has been reused, some other process isn't taken for it (and
+/// killed with it).
+#[cfg(unix)]
+pub fn start_time(pid: u32) -> Option<String> {
+    let out = std::process::Command::new("ps")
+        .args(["-o", "lstart=", "-p", &pid.to_string()])
+        .output()
+        .ok()?;
+    let started = String::from_utf8_lossy(&out.stdout).trim().to_string();
+    (out.status.success() && !started.is_empty()).then_some(started)
+}
+
+#[cfg(windows)]
+pub fn start_time(pid: u32) -> Option<String> {
+    use windows_sys::Win32::Foundation::{CloseHandle, FILETIME};
+    use windows_sys::Win32::System::Threading::{
+        GetProcessTimes, OpenProcess, PROCESS_QUERY_LIMITED_INFORMATION,
+    };
+
+    let zero = FILETIME {
+        dwLowDateTime: 0,
+        dwHighDateTime: 0,
+    };
+    let (mut created, mut exited, mut kernel, mut user) = (zero, zero, zero, zero);
+    // SAFETY: the handle is checked before use and closed exactly once; the
+    // out-pointers are to live locals.
+    let ok = unsafe {
+        let process = OpenProcess(PROCESS_QUERY_LIMITED_INFORMATION, 0, pid);
+        if process.is_null() {
+            return None;
+        }
+        let ok = GetProcessTimes(process, &mut created, &mut exited, &mut kernel, &mut user);
+        CloseHandle(process);
+        ok != 0
+    };
+    ok.then(|| {
+        (u64::from(created.dwHighDateTime) << 32 | u64::from(created.dwLowDateTime)).to_string()
+    })
+}
+
+/// Whether `pid` is still the process that started at `started` (see
+/// [`start_time`]).
+pub fn is_same_process(pid: u32, started: &str) -> bool {
+    is_alive(pid) && start_time(pid).as_deref() == Some(started)
+}
+
 /// Bind a freshly-spawned tunnel child to OS-managed cleanup so it (and its
 /// descendants) are killed if az-burrow itself dies — including a crash or a
 /// force-kill, which the graceful `kill_process_group` path can't catch.
@@ -0,0 +1,277 @@
+//! `import --query`: machines from an Azure Resource Graph query. The query
+//! picks the VMs (any KQL whose rows have an `id`); each is then paired with
+//! a Bastion host in its own VNet or, failing that, in a VNet peered with it
+//! (the usual hub and spoke), found with three more queries over the network
+//! interfaces, Bastion hosts and VNet peerings the caller can read. Needs
+//! az's `resource-graph` extension. `import --from-az-ssh-config` finds its
+//! VMs here too, by the names `az ssh config` gave them ([`ssh_config_names`]).
+
+use crate::azure::az_command;
+use color_eyre::eyre::{eyre, Context, Result};
+use std::collections::{BTreeSet, HashMap};
+
+/// Rows asked of Resource Graph per query, its most.
+const PAGE: &str = "1000";
+
+const NICS: &str = "Resources \
+    | where type =~ 'microsoft.network/networkinterfaces' and isnotempty(properties.virtualMachine.id) \
+    | mv-expand c = properties.ipConfigurations \
+    | project vm = tolower(tostring(properties.virtualMachine.id)), subnet = tolower(tostring(c.properties.subnet.id))";
+
+const BASTIONS: &str = "Resources \
+    | where type =~ 'microsoft.network/bastionhosts' \
+    | mv-expand c = properties.ipConfigurations \
+    | project id, subnet = tolower(tostring(c.properties.subnet.id))";
+
+const PEERINGS: &str = "Resources \
+    | where type =~ 'microsoft.network/virtualnetworks' \
+    | mv-expand p = properties.virtualNetworkPeerings \
+    | where isnotempty(p) \
+    | project vnet = tolower(id), remote = tolower(tostring(p.properties.remoteVirtualNetwork.id))";
+
+const VM_NAMES: &str = "Resources \
+    | where type =~ 'microsoft.compute/virtualmachines' \
+    | project id, name = tolower(strcat(resourceGroup, '-', name))";
+
+const VM_IPS: &str = "Resources \
+    | where type =~ 'microsoft.network/networkinterfaces' and isnotempty(properties.virtualMachine.id) \
+    | mv-expand c = properties.ipConfigurations \
+    | project vm = tostring(properties.virtualMachine.id), ip = tostring(c.properties.privateIPAddress)";
+
+/// A VM the query found, with the Bastion host that can reach it, if any.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct Found {
+    pub vm_id: String,
+    pub bastion_id: Option<String>,
+}
+
+impl Found {
+    pub fn name(&self) -> &str {
+        last_segment(&self.vm_id)
+    }
+
+    /// The config keys for this machine, or `None` without a Bastion host.
+    /// `bastion_subscription` is only set when it differs from the VM's.
+    pub fn machine_fields(&self) -> Option<Vec<(&'static str, String)>> {
+        let bastion = self.bastion_id.as_deref()?;
+        let vm_subscription = segment_after(&self.vm_id, "subscriptions");
+        let bastion_subscription = segment_after(bastion, "subscriptions");
+        let mut fields = vec![
+            ("name", self.name().to_string()),
+            (
+                "resource_group",
+                segment_after(&self.vm_id, "resourceGroups")
+                    .unwrap_or_default()
+                    .to_string(),
+            ),
+            ("target_resource_id", self.vm_id.clone()),
+            ("bastion_name", last_segment(bastion).to_string()),
+            (
+                "bastion_resource_group",
+                segment_after(bastion, "resourceGroups")
+                    .unwrap_or_default()
+                    .to_string(),
+            ),
+        ];
+        if !bastion_subscription
+            .unwrap_or_default()
+            .eq_ignore_ascii_case(vm_subscription.unwrap_or_default())
+        {
+            fields.push((
+                "bastion_subscription",
+                bastion_subscription.unwrap_or_default().to_string(),
+            ));
+        }
+        Some(fields)
+    }
+}
+
+/// Run `kql` and pair every VM it returns with a Bastion host.
+pub async fn find_machines(kql: &str) -> Result<Vec<Found>> {
+    let vms: Vec<String> = query(kql, "id")
+        .await?
+        .into_iter()
+        .filter_map(|row| row.into_iter().next())
+        .filter(|id| {
+            id.to_lowercase()
+                .contains("/providers/microsoft.compute/virtualmachines/")
+        })
+        .collect();
+    with_bastions(vms).await
+}
+
+/// Pair each of `vms` (resource IDs) with a Bastion host.
+pub async fn with_bastions(vms: Vec<String>) -> Result<Vec<Found>> {
+    if vms.is_empty() {
+        return Ok(Vec::new());
+    }
+    let nics = pairs(query(NICS, "vm, subnet").await?);
+    let bastions = pairs(query(BASTIONS, "id, subnet").await?);
+    let peerings = pairs(query(PEERINGS, "vnet, remote").await?);
+    Ok(pair(&vms, &nics, &bastions, &peerings))
+}
+
+/// Every VM the caller can read, as (resource ID, name), under the names
+/// `az ssh config` gives its `Host` block and key directory: `<resource
+/// group>-<vm>` (lowercased) and each of its private IPs.
+pub async fn ssh_config_names() -> Result<Vec<(String, String)>> {
+    let mut names = pairs(query(VM_NAMES, "id, name").await?);
+    names.extend(pairs(query(VM_IPS, "vm, ip").await?));
+    Ok(names)
+}
+
+/// `az graph query -q <kql>`, the `columns` of each row as printed by
+/// `-o tsv`.
+async fn query(kql: &str, columns: &str) -> Result<Vec<Vec<String>>> {
+    let out = az_command()
+        .args(["graph", "query", "-q", kql, "--first", PAGE])
+        .args(["--query", &format!("data[].[{columns}]"), "-o", "tsv"])
+        .output()
+        .await
+        .wrap_err("failed to run az")?;
+    if !out.status.success() {
+        return Err(eyre!(
+            "az graph query failed: {}",
+            String::from_utf8_lossy(&out.stderr).trim()
+        ));
+    }
+    Ok(String::from_utf8_lossy(&out.stdout)
+        .lines()
+        .filter(|l| !l.trim().is_empty())
+        .map(|l| l.split('\t').map(|f| f.trim().to_string()).collect())
+        .collect())
+}
+
+fn pairs(rows: Vec<Vec<String>>) -> Vec<(String, String)> {
+    rows.into_iter()
+        .filter_map(|row| match row.as_slice() {
+            [a, b] if !a.is_empty() && !b.is_empty() => Some((a.clone(), b.clone())),
+            _ => None,
+        })
+        .collect()
+}
+
+/// Pair each VM with a Bastion host in a VNet one of its NICs is in, or else
+/// in a VNet peered with one; the first by ID when there are several. `nics`
+/// are (VM ID, subnet ID), `bastions` (Bastion ID, subnet ID) and `peerings`
+/// (VNet ID, remote VNet ID).
+fn pair(
+    vms: &[String],
+    nics: &[(String, String)],
+    bastions: &[(String, String)],
+    peerings: &[(String, String)],
+) -> Vec<Found> {
+    let mut by_vnet: HashMap<String, BTreeSet<&str>> = HashMap::new();
+    for (bastion, subnet) in bastions {
+        by_vnet.entry(vnet_of(subnet)).or_default().insert(bastion);
+    }
+    let in_vnets = |vnets: &BTreeSet<String>| -> Option<String> {
+        vnets
+            .iter()
+            .filter_map(|v| by_vnet.get(v))
+            .flatten()
+            .min()
+            .map(|b| b.to_string())
+    };
+    vms.iter()
+        .map(|vm| {
+            let own: BTreeSet<String> = nics
+                .iter()
+                .filter(|(id, _)| id.eq_ignore_ascii_case(vm))
+                .map(|(_, subnet)| vnet_of(subnet))
+                .collect();
+            let peered: BTreeSet<String> = peerings
+                .iter()
+                .filter(|(vnet, _)| own.contains(&vnet.to_lowercase()))
+                .map(|(_, remote)| remote.to_lowercase())
+                .collect();
+            Found {
+                vm_id: vm.clone(),
+                bastion_id: in_vnets(&own).or_else(|| in_vnets(&peered)),
+            }
+        })
+        .collect()
+}
+
+/// The VNet a subnet ID belongs to, lowercased.
+fn vnet_of(subnet: &str) -> String {
+    let subnet = subnet.to_lowercase();
+    match subnet.find("/subnets/") {
+        Some(at) => subnet[..at].to_string(),
+        None => subnet,
+    }
+}
+
+fn last_segment(id: &str) -> &str {
+    id.trim_end_matches('/').rsplit('/').next().unwrap_or(id)
+}
+
+/// The ID segment after `key`, e.g. the resource group after
+/// `resourceGroups`.
+fn segment_after<'a>(id: &'a str, key: &str) -> Option<&'a str> {
+    let mut parts = id.split('/');
+    parts.find(|p| p.eq_ignore_ascii_case(key))?;
+    parts.next().filter(|s| !s.is_empty())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn vm(sub: &str, rg: &str, name: &str) -> String {
+        format!("/subscriptions/{sub}/resourceGroups/{rg}/providers/Microsoft.Compute/virtualMachines/{name}")
+    }
+
+    fn vnet(sub: &str, name: &str) -> String {
+        format!("/subscriptions/{sub}/resourcegroups/net/providers/microsoft.network/virtualnetworks/{name}")
+    }
+
+    #[test]
+    fn vms_pair_with_a_bastion_in_their_vnet_or_a_peered_one() {
+        let vms = [
+            vm("s1", "RG-WEB", "vm-web"),
+            vm("s1", "RG-DB", "vm-db"),
+            vm("s1", "RG-X", "vm-lost"),
+        ];
+        let nics = [
+            (
+                vms[0].to_lowercase(),
+                format!("{}/subnets/app", vnet("s1", "spoke")),
+            ),
+            (
+                vms[1].to_lowercase(),
+                format!("{}/subnets/data", vnet("s1", "hub")),
+            ),
+            (
+                vms[2].to_lowercase(),
+                format!("{}/subnets/app", vnet("s1", "island")),
+            ),
+        ];
+        let hub_bastion = "/subscriptions/s0/resourceGroups/RG-HUB/providers/Microsoft.Network/bastionHosts/bastion-hub";
+        let bastions = [(
+            hub_bastion.to_string(),
+            format!("{}/subnets/azurebastionsubnet", vnet("s1", "hub")),
+        )];
+        let peerings = [(vnet("s1", "spoke"), vnet("s1", "hub"))];
+
+        let found = pair(&vms, &nics, &bastions, &peerings);
+        assert_eq!(found[0].bastion_id.as_deref(), Some(hub_bastion));
+        assert_eq!(found[1].bastion_id.as_deref(), Some(hub_bastion));
+        assert_eq!(found[2].bastion_id, None);
+        assert_eq!(found[2].machine_fields(), None);
+
+        let fields = found[0].machine_fields().unwrap();
+        let value = |key: &str| {
+            fields
+                .iter()
+                .find(|(k, _)| *k == key)
+                .map(|(_, v)| v.as_str())
+        };
+        assert_eq!(value("name"), Some("vm-web"));
+        assert_eq!(value("resource_group"), Some("RG-WEB"));
+        assert_eq!(value("target_resource_id"), Some(vms[0].as_str()));
+        assert_eq!(value("bastion_name"), Some("bastion-hub"));
+        assert_eq!(value("bastion_resource_group"), Some("RG-HUB"));
+        assert_eq!(value("bastion_subscription"), Some("s0"));
+    }
+}
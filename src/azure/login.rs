@@ -0,0 +1,119 @@
+//! Signing in to az from inside the TUI. When a tunnel, a certificate or the
+//! account check fails because az has no (or an expired) login, az-burrow
+//! runs `az login --use-device-code` and shows the code and page it prints
+//! in a dialog; az waits for the browser side to finish, and what failed is
+//! tried again once it has.
+
+use crate::azure::az_command;
+use regex::Regex;
+use std::process::Stdio;
+use tokio::io::{AsyncBufReadExt, BufReader};
+use tokio_util::sync::CancellationToken;
+
+/// What to open and type to finish signing in.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct DeviceCode {
+    pub url: String,
+    pub code: String,
+}
+
+/// Whether az failed for want of a login: none yet, an expired refresh
+/// token, or a policy that wants it done again (MFA, sign-in frequency).
+pub fn needs_login(output: &str) -> bool {
+    let output = output.to_lowercase();
+    ["az login", "interactive authentication is needed", "refresh token has expired"]
+        .iter()
+        .any(|p| output.contains(p))
+        // Expired or revoked tokens, and MFA or re-authentication demanded.
+        || ["aadsts50076", "aadsts50078", "aadsts50173", "aadsts70043", "aadsts700082"]
+            .iter()
+            .any(|code| output.contains(code))
+}
+
+/// The code and page in az's prompt: "To sign in, use a web browser to open
+/// the page https://microsoft.com/devicelogin and enter the code ABCD1234 to
+/// authenticate."
+pub fn parse_device_code(line: &str) -> Option<DeviceCode> {
+    let re = Regex::new(r"(https://\S+?)\.?\s.*\bcode\s+(\S+)\s+to authenticate").unwrap();
+    let caps = re.captures(line)?;
+    Some(DeviceCode {
+        url: caps[1].to_string(),
+        code: caps[2].to_string(),
+    })
+}
+
+/// Run `az login --use-device-code`, handing its prompt to `on_code`, until
+/// the user has signed in in the browser or `cancel` fires.
+pub async fn device_code(
+    mut on_code: impl FnMut(DeviceCode),
+    cancel: CancellationToken,
+) -> Result<(), String> {
+    let mut child = az_command()
+        .args(["login", "--use-device-code", "-o", "none"])
+        .stdin(Stdio::null())
+        .stdout(Stdio::null())
+        .stderr(Stdio::piped())
+        .kill_on_drop(true)
+        .spawn()
+        .map_err(|e| format!("failed to run az: {e}"))?;
+    let mut lines = BufReader::new(child.stderr.take().expect("piped")).lines();
+    let mut errors = Vec::new();
+    loop {
+        tokio::select! {
+            _ = cancel.cancelled() => {
+                let _ = child.kill().await;
+                return Err("cancelled".into());
+            }
+            line = lines.next_line() => match line {
+                Ok(Some(line)) => match parse_device_code(&line) {
+                    Some(code) => on_code(code),
+                    None if !line.trim().is_empty() => errors.push(line),
+                    None => {}
+                },
+                // az has closed stderr: it is about to exit.
+                _ => break,
+            },
+        }
+    }
+    let status = child
+        .wait()
+        .await
+        .map_err(|e| format!("failed to run az: {e}"))?;
+    if status.success() {
+        Ok(())
+    } else {
+        Err(errors
+            .last()
+            .cloned()
+            .unwrap_or_else(|| format!("az login exited with {status}")))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn login_errors_and_device_code_prompts_are_recognised() {
+        assert!(needs_login(
+            "ERROR: Please run 'az login' to setup account."
+        ));
+        assert!(needs_login(
+            "AADSTS700082: The refresh token has expired due to inactivity."
+        ));
+        assert!(!needs_login(
+            "ERROR: (AuthorizationFailed) The client does not have authorization"
+        ));
+
+        assert_eq!(
+            parse_device_code(
+                "WARNING: To sign in, use a web browser to open the page https://microsoft.com/devicelogin and enter the code FJ3K5PSMN to authenticate."
+            ),
+            Some(DeviceCode {
+                url: "https://microsoft.com/devicelogin".into(),
+                code: "FJ3K5PSMN".into(),
+            })
+        );
+        assert_eq!(parse_device_code("WARNING: Retrieving tenants..."), None);
+    }
+}
@@ -1,10 +1,51 @@
+pub mod aks;
+pub mod auth;
+pub mod bastion;
 pub mod cert;
 pub mod cleanup;
+pub mod graph;
+pub mod login;
 pub mod parse;
+pub mod resolve;
+pub mod retry;
+pub mod shared;
+pub mod token;
 pub mod tunnel;
+pub mod vm;
 
+use std::path::{Path, PathBuf};
+use std::sync::RwLock;
 use tokio::process::Command;
 
+/// Clouds the `cloud:` config option accepts (`az cloud list` names).
+pub const CLOUDS: [&str; 3] = ["AzureCloud", "AzureUSGovernment", "AzureChinaCloud"];
+
+/// How to run the Azure CLI, from the config's `az_path`, `az_args`, `cloud`
+/// and `auth`.
+#[derive(Debug, Clone, Default, PartialEq, Eq)]
+pub struct AzSettings {
+    /// Executable to run instead of `az` from `PATH`.
+    pub path: Option<String>,
+    /// Passed to every invocation, right after the executable.
+    pub args: Vec<String>,
+    pub cloud: Option<String>,
+    /// az profile to use instead of `~/.azure`, as `AZURE_CONFIG_DIR`: where
+    /// a service principal sign-in ([`auth`]) lives.
+    pub config_dir: Option<String>,
+}
+
+static SETTINGS: RwLock<AzSettings> = RwLock::new(AzSettings {
+    path: None,
+    args: Vec::new(),
+    cloud: None,
+    config_dir: None,
+});
+
+/// Use `settings` for every later `az` invocation.
+pub fn configure(settings: AzSettings) {
+    *SETTINGS.write().unwrap() = settings;
+}
+
 /// Build a [`Command`] that invokes the Azure CLI (`az`).
 ///
 /// On Windows the Azure CLI ships as `az.cmd`, a batch script. Rust's
@@ -12,14 +53,77 @@ use tokio::process::Command;
 /// `az` nor can launch a batch file directly — so a plain `Command::new("az")`
 /// fails with "program not found" even when `az` works in the shell. We route
 /// through `cmd /C az`, letting `cmd.exe` resolve and run it exactly as the
-/// shell does. On every other platform `az` is a normal executable.
+/// shell does. On every other platform `az` is a normal executable. A
+/// configured `az_path` takes the place of `az` either way.
+///
+/// A configured cloud is passed as `AZURE_CLOUD_NAME`, which az reads in
+/// place of `[cloud] name` from its config, so it applies to our processes
+/// only and never changes the user's `az cloud set` choice. A configured
+/// profile directory is passed the same way, as `AZURE_CONFIG_DIR`.
 pub fn az_command() -> Command {
-    if cfg!(target_os = "windows") {
+    az_command_with(&SETTINGS.read().unwrap())
+}
+
+fn az_command_with(settings: &AzSettings) -> Command {
+    let az = settings.path.as_deref().unwrap_or("az");
+    let mut c = if cfg!(target_os = "windows") {
         let mut c = Command::new("cmd");
-        c.arg("/C").arg("az");
+        c.arg("/C").arg(az);
         c
     } else {
-        Command::new("az")
+        Command::new(az)
+    };
+    // Up front, so they never land after an `az ssh arc ... --` separator.
+    c.args(&settings.args);
+    if let Some(cloud) = &settings.cloud {
+        c.env("AZURE_CLOUD_NAME", cloud);
+    }
+    if let Some(dir) = &settings.config_dir {
+        c.env("AZURE_CONFIG_DIR", dir);
+    }
+    c
+}
+
+/// A fresh directory only this user can read, for files handed to az or git
+/// (downloads, request bodies); removed with everything in it on drop. Its
+/// name is made new rather than reused, so a file planted in the shared temp
+/// directory can never stand in for ours.
+pub struct ScratchDir(PathBuf);
+
+impl ScratchDir {
+    pub fn new() -> std::io::Result<Self> {
+        use std::sync::atomic::{AtomicU64, Ordering};
+        static NEXT: AtomicU64 = AtomicU64::new(0);
+        let nanos = std::time::SystemTime::now()
+            .duration_since(std::time::UNIX_EPOCH)
+            .map_or(0, |d| d.subsec_nanos());
+        let mut builder = std::fs::DirBuilder::new();
+        #[cfg(unix)]
+        std::os::unix::fs::DirBuilderExt::mode(&mut builder, 0o700);
+        let mut tries = 0;
+        loop {
+            let path = std::env::temp_dir().join(format!(
+                "az-burrow-{}-{nanos:x}-{}",
+                std::process::id(),
+                NEXT.fetch_add(1, Ordering::Relaxed)
+            ));
+            // `create`, not `create_all`: someone else's directory is an error.
+            match builder.create(&path) {
+                Ok(()) => return Ok(Self(path)),
+                Err(e) if e.kind() == std::io::ErrorKind::AlreadyExists && tries < 16 => tries += 1,
+                Err(e) => return Err(e),
+            }
+        }
+    }
+
+    pub fn path(&self) -> &Path {
+        &self.0
+    }
+}
+
+impl Drop for ScratchDir {
+    fn drop(&mut self) {
+        let _ = std::fs::remove_dir_all(&self.0);
     }
 }
 
@@ -45,4 +149,65 @@ mod tests {
             assert!(args.is_empty());
         }
     }
+
+    #[test]
+    fn configured_cloud_is_passed_to_az() {
+        let cloud_env = |cmd: &Command| {
+            cmd.as_std()
+                .get_envs()
+                .find(|(k, _)| *k == "AZURE_CLOUD_NAME")
+                .and_then(|(_, v)| v.map(|v| v.to_string_lossy().into_owned()))
+        };
+        let gov = AzSettings {
+            cloud: Some("AzureUSGovernment".into()),
+            ..AzSettings::default()
+        };
+        assert_eq!(
+            cloud_env(&az_command_with(&gov)).as_deref(),
+            Some("AzureUSGovernment")
+        );
+        assert_eq!(cloud_env(&az_command_with(&AzSettings::default())), None);
+    }
+
+    #[test]
+    fn configured_path_and_args_come_first() {
+        let settings = AzSettings {
+            path: Some("/opt/venv/bin/az".into()),
+            args: vec!["--only-show-errors".into()],
+            ..AzSettings::default()
+        };
+        let mut cmd = az_command_with(&settings);
+        cmd.arg("version");
+        let args: Vec<String> = cmd
+            .as_std()
+            .get_args()
+            .map(|a| a.to_string_lossy().into_owned())
+            .collect();
+        if cfg!(target_os = "windows") {
+            assert_eq!(
+                args,
+                ["/C", "/opt/venv/bin/az", "--only-show-errors", "version"]
+            );
+        } else {
+            assert_eq!(cmd.as_std().get_program(), "/opt/venv/bin/az");
+            assert_eq!(args, ["--only-show-errors", "version"]);
+        }
+    }
+
+    #[test]
+    fn scratch_dirs_are_fresh_private_and_cleaned_up() {
+        let a = ScratchDir::new().unwrap();
+        let b = ScratchDir::new().unwrap();
+        assert_ne!(a.path(), b.path());
+        std::fs::write(a.path().join("body.json"), "{}").unwrap();
+        #[cfg(unix)]
+        {
+            use std::os::unix::fs::PermissionsExt;
+            let mode = std::fs::metadata(a.path()).unwrap().permissions().mode();
+            assert_eq!(mode & 0o777, 0o700);
+        }
+        let path = a.path().to_path_buf();
+        drop(a);
+        assert!(!path.exists());
+    }
 }
@@ -1,60 +1,324 @@
-use chrono::{Local, NaiveDateTime, TimeZone};
+use chrono::{
+    DateTime, Duration as ChronoDuration, Local, LocalResult, NaiveDateTime, Offset, TimeZone, Utc,
+};
 use color_eyre::eyre::{eyre, Result};
 use regex::Regex;
 
 /// Parse `az ssh cert` output: "... is valid until YYYY-MM-DD HH:MM:SS in local time".
-/// Returns the expiry as a UTC-based timestamp interpreted in local tz.
-pub fn parse_expiry_from_output(output: &str) -> Result<chrono::DateTime<Local>> {
+/// `hint` is roughly when we expect the cert to expire (now + lifetime); it
+/// picks the right instant when the local time is ambiguous across a DST change.
+pub fn parse_expiry_from_output(output: &str, hint: DateTime<Utc>) -> Result<DateTime<Utc>> {
+    parse_expiry_from_output_in(output, &Local, hint)
+}
+
+/// Parse `ssh-keygen -L -f <cert>` output: "Valid: from ... to YYYY-MM-DDTHH:MM:SS".
+pub fn parse_certificate_expiry(output: &str, hint: DateTime<Utc>) -> Result<DateTime<Utc>> {
+    parse_certificate_expiry_in(output, &Local, hint)
+}
+
+fn parse_expiry_from_output_in<Tz: TimeZone>(
+    output: &str,
+    tz: &Tz,
+    hint: DateTime<Utc>,
+) -> Result<DateTime<Utc>> {
     let re =
         Regex::new(r"is valid until (\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2}) in local time").unwrap();
     let caps = re
         .captures(output)
         .ok_or_else(|| eyre!("could not parse expiry time from output"))?;
     let naive = NaiveDateTime::parse_from_str(&caps[1], "%Y-%m-%d %H:%M:%S")?;
-    local_from_naive(naive)
+    local_to_utc(naive, tz, hint)
 }
 
-/// Parse `ssh-keygen -L -f <cert>` output: "Valid: from ... to YYYY-MM-DDTHH:MM:SS".
-pub fn parse_certificate_expiry(output: &str) -> Result<chrono::DateTime<Local>> {
+fn parse_certificate_expiry_in<Tz: TimeZone>(
+    output: &str,
+    tz: &Tz,
+    hint: DateTime<Utc>,
+) -> Result<DateTime<Utc>> {
     let re = Regex::new(r"Valid: from .+ to (\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2})").unwrap();
     let caps = re
         .captures(output)
         .ok_or_else(|| eyre!("could not parse certificate expiry from ssh-keygen output"))?;
     let naive = NaiveDateTime::parse_from_str(&caps[1], "%Y-%m-%dT%H:%M:%S")?;
-    local_from_naive(naive)
+    local_to_utc(naive, tz, hint)
 }
 
-fn local_from_naive(naive: NaiveDateTime) -> Result<chrono::DateTime<Local>> {
-    match Local.from_local_datetime(&naive) {
-        chrono::LocalResult::Single(dt) => Ok(dt),
-        chrono::LocalResult::Ambiguous(dt, _) => Ok(dt),
-        chrono::LocalResult::None => Err(eyre!("invalid local time")),
+/// Resolve a wall-clock time printed by the CLI (in `tz`) to a UTC instant.
+///
+/// - Ambiguous (clocks went back, the time occurs twice): take whichever
+///   instant is closer to `hint`.
+/// - Non-existent (clocks went forward, the time was skipped): read it with the
+///   offset in force before the jump, i.e. the instant the CLI actually meant.
+fn local_to_utc<Tz: TimeZone>(
+    naive: NaiveDateTime,
+    tz: &Tz,
+    hint: DateTime<Utc>,
+) -> Result<DateTime<Utc>> {
+    match tz.from_local_datetime(&naive) {
+        LocalResult::Single(dt) => Ok(dt.with_timezone(&Utc)),
+        LocalResult::Ambiguous(a, b) => {
+            let (a, b) = (a.with_timezone(&Utc), b.with_timezone(&Utc));
+            if (a - hint).abs() <= (b - hint).abs() {
+                Ok(a)
+            } else {
+                Ok(b)
+            }
+        }
+        LocalResult::None => {
+            // DST gaps are at most a couple of hours; find the offset just before.
+            for hours in 1..=3 {
+                if let LocalResult::Single(dt) =
+                    tz.from_local_datetime(&(naive - ChronoDuration::hours(hours)))
+                {
+                    let offset = dt.offset().fix().local_minus_utc();
+                    let utc = naive - ChronoDuration::seconds(offset.into());
+                    return Ok(Utc.from_utc_datetime(&utc));
+                }
+            }
+            Err(eyre!("invalid local time {naive}"))
+        }
     }
 }
 
+/// The first principal in `ssh-keygen -L -f <cert>` output: the user an AAD
+/// certificate logs in as.
+pub fn parse_certificate_principal(output: &str) -> Option<String> {
+    let mut lines = output.lines().map(str::trim);
+    lines.find(|l| *l == "Principals:")?;
+    lines
+        .next()
+        .filter(|p| !p.is_empty() && *p != "(none)")
+        .map(String::from)
+}
+
+/// What `ssh-keygen -L` says about a certificate, for the cert detail view.
+#[derive(Debug, Clone, Default, PartialEq, Eq)]
+pub struct CertificateFields {
+    pub key_id: String,
+    pub serial: String,
+    /// The CA's key type and fingerprint, e.g. `RSA SHA256:…`.
+    pub signing_ca: String,
+    /// `from <time> to <time>`, in local time as ssh-keygen prints it.
+    pub valid: String,
+    pub principals: Vec<String>,
+}
+
+/// Parse the fields of `ssh-keygen -L -f <cert>` output, or `None` if it
+/// isn't describing a certificate.
+pub fn parse_certificate_fields(output: &str) -> Option<CertificateFields> {
+    let mut fields = CertificateFields::default();
+    let mut in_principals = false;
+    let mut found = false;
+    for line in output.lines() {
+        let line = line.trim();
+        // Principals are listed one per line under their heading, up to the
+        // next "Name: value" or "Name:" line.
+        if in_principals {
+            if !(line.ends_with(':') || line.contains(": ")) {
+                if !line.is_empty() {
+                    fields.principals.push(line.to_string());
+                }
+                continue;
+            }
+            in_principals = false;
+        }
+        let Some((name, value)) = line.split_once(':') else {
+            continue;
+        };
+        let value = value.trim();
+        match name {
+            "Key ID" => fields.key_id = value.trim_matches('"').to_string(),
+            "Serial" => fields.serial = value.to_string(),
+            "Signing CA" => fields.signing_ca = value.to_string(),
+            "Valid" => {
+                fields.valid = value.to_string();
+                found = true;
+            }
+            "Principals" => in_principals = value.is_empty(),
+            _ => {}
+        }
+    }
+    found.then_some(fields)
+}
+
+/// The signed-in account from `az account show --query "[user.name, name]"
+/// -o tsv`: the user, then the subscription's name.
+pub fn parse_account(output: &str) -> Option<String> {
+    let mut lines = output.lines().map(str::trim).filter(|l| !l.is_empty());
+    let user = lines.next()?;
+    Some(match lines.next() {
+        Some(subscription) => format!("{user} · {subscription}"),
+        None => user.to_string(),
+    })
+}
+
 #[cfg(test)]
 mod tests {
     use super::*;
-    use chrono::{Datelike, Timelike};
+
+    #[test]
+    fn certificate_fields_from_ssh_keygen() {
+        let output = "/home/me/.ssh/az_ssh_config/vm-web/id_rsa.pub-aadcert.pub:
+        Type: ssh-rsa-cert-v01@openssh.com user certificate
+        Public key: RSA-CERT SHA256:3bq9ZlbW2zGq
+        Signing CA: RSA SHA256:Yj1o1xvSc6nT (using rsa-sha2-256)
+        Key ID: \"alice@contoso.com\"
+        Serial: 5216934812
+        Valid: from 2025-03-01T10:00:00 to 2025-03-01T11:05:00
+        Principals: 
+                alice@contoso.com
+                alice
+        Critical Options: (none)
+        Extensions: 
+                permit-pty
+";
+        let fields = parse_certificate_fields(output).unwrap();
+        assert_eq!(fields.key_id, "alice@contoso.com");
+        assert_eq!(fields.serial, "5216934812");
+        assert_eq!(
+            fields.signing_ca,
+            "RSA SHA256:Yj1o1xvSc6nT (using rsa-sha2-256)"
+        );
+        assert_eq!(
+            fields.valid,
+            "from 2025-03-01T10:00:00 to 2025-03-01T11:05:00"
+        );
+        assert_eq!(fields.principals, ["alice@contoso.com", "alice"]);
+        assert_eq!(
+            parse_certificate_fields("ssh-keygen: not a certificate"),
+            None
+        );
+    }
+
+    #[test]
+    fn account_is_user_and_subscription() {
+        assert_eq!(
+            parse_account("alice@contoso.com\nContoso Dev\n").as_deref(),
+            Some("alice@contoso.com · Contoso Dev")
+        );
+        assert_eq!(parse_account("\n"), None);
+    }
+    use chrono::{FixedOffset, NaiveDate, Timelike};
+
+    /// UK-style zone for 2025: UTC+0, UTC+1 from 30 Mar 01:00 UTC until
+    /// 26 Oct 01:00 UTC. Lets DST edge cases run without depending on the
+    /// host's timezone.
+    #[derive(Clone, Copy)]
+    struct TestUk;
+
+    fn utc(y: i32, m: u32, d: u32, h: u32, min: u32) -> NaiveDateTime {
+        NaiveDate::from_ymd_opt(y, m, d)
+            .unwrap()
+            .and_hms_opt(h, min, 0)
+            .unwrap()
+    }
+
+    impl TimeZone for TestUk {
+        type Offset = FixedOffset;
+
+        fn from_offset(_: &FixedOffset) -> Self {
+            TestUk
+        }
+
+        fn offset_from_local_date(&self, local: &NaiveDate) -> LocalResult<FixedOffset> {
+            self.offset_from_local_datetime(&local.and_hms_opt(12, 0, 0).unwrap())
+        }
+
+        fn offset_from_local_datetime(&self, local: &NaiveDateTime) -> LocalResult<FixedOffset> {
+            let gmt = FixedOffset::east_opt(0).unwrap();
+            let bst = FixedOffset::east_opt(3600).unwrap();
+            let as_gmt = self.offset_from_utc_datetime(local);
+            let as_bst = self.offset_from_utc_datetime(&(*local - ChronoDuration::hours(1)));
+            match (as_gmt == gmt, as_bst == bst) {
+                (true, true) => LocalResult::Ambiguous(bst, gmt),
+                (true, false) => LocalResult::Single(gmt),
+                (false, true) => LocalResult::Single(bst),
+                (false, false) => LocalResult::None,
+            }
+        }
+
+        fn offset_from_utc_date(&self, utc_date: &NaiveDate) -> FixedOffset {
+            self.offset_from_utc_datetime(&utc_date.and_hms_opt(12, 0, 0).unwrap())
+        }
+
+        fn offset_from_utc_datetime(&self, t: &NaiveDateTime) -> FixedOffset {
+            let summer = *t >= utc(2025, 3, 30, 1, 0) && *t < utc(2025, 10, 26, 1, 0);
+            FixedOffset::east_opt(if summer { 3600 } else { 0 }).unwrap()
+        }
+    }
+
+    fn az_line(local: &str) -> String {
+        format!("Generated SSH certificate /tmp/x is valid until {local} in local time.")
+    }
 
     #[test]
     fn parses_az_output_expiry() {
-        let out =
-            "Generated SSH certificate /tmp/x is valid until 2025-10-15 18:06:23 in local time.";
-        let t = parse_expiry_from_output(out).unwrap();
-        assert_eq!((t.year(), t.month(), t.day()), (2025, 10, 15));
-        assert_eq!((t.hour(), t.minute(), t.second()), (18, 6, 23));
+        let out = az_line("2025-10-15 18:06:23");
+        let t = parse_expiry_from_output_in(&out, &TestUk, Utc::now()).unwrap();
+        // 18:06:23 BST is 17:06:23 UTC.
+        assert_eq!((t.hour(), t.minute(), t.second()), (17, 6, 23));
     }
 
     #[test]
     fn az_output_without_marker_errors() {
-        assert!(parse_expiry_from_output("nothing here").is_err());
+        assert!(parse_expiry_from_output("nothing here", Utc::now()).is_err());
     }
 
     #[test]
     fn parses_ssh_keygen_validity() {
         let out = "        Valid: from 2025-10-15T17:31:23 to 2025-10-15T18:31:23\n";
-        let t = parse_certificate_expiry(out).unwrap();
-        assert_eq!((t.hour(), t.minute(), t.second()), (18, 31, 23));
+        let t = parse_certificate_expiry_in(out, &TestUk, Utc::now()).unwrap();
+        assert_eq!((t.hour(), t.minute(), t.second()), (17, 31, 23));
+    }
+
+    #[test]
+    fn ambiguous_fall_back_time_picks_instant_nearest_hint() {
+        // Issued 00:40 BST (23:40 UTC) on 26 Oct; valid one hour, until 01:40
+        // local — which happens twice. The real expiry is the first (BST) one.
+        let out = az_line("2025-10-26 01:40:00");
+        let hint = Utc.from_utc_datetime(&utc(2025, 10, 26, 0, 40));
+        let t = parse_expiry_from_output_in(&out, &TestUk, hint).unwrap();
+        assert_eq!(t.naive_utc(), utc(2025, 10, 26, 0, 40));
+
+        // Issued 01:10 GMT (second pass): expiry 02:10 GMT, unambiguous.
+        let out = az_line("2025-10-26 02:10:00");
+        let hint = Utc.from_utc_datetime(&utc(2025, 10, 26, 2, 10));
+        let t = parse_expiry_from_output_in(&out, &TestUk, hint).unwrap();
+        assert_eq!(t.naive_utc(), utc(2025, 10, 26, 2, 10));
+    }
+
+    #[test]
+    fn ambiguous_time_later_hint_picks_second_instant() {
+        // Issued 01:40 BST (00:40 UTC); an hour later it is 01:40 GMT — the
+        // same wall time again, and this time the second instant is meant.
+        let out = az_line("2025-10-26 01:40:00");
+        let hint = Utc.from_utc_datetime(&utc(2025, 10, 26, 1, 40));
+        let t = parse_expiry_from_output_in(&out, &TestUk, hint).unwrap();
+        assert_eq!(t.naive_utc(), utc(2025, 10, 26, 1, 40));
+    }
+
+    #[test]
+    fn reads_the_certificate_principal() {
+        let out = "
+        Type: ssh-rsa-cert-v01@openssh.com user certificate
+        Principals: 
+                alice@contoso.com
+        Critical Options: (none)";
+        assert_eq!(
+            parse_certificate_principal(out).as_deref(),
+            Some("alice@contoso.com")
+        );
+        assert_eq!(
+            parse_certificate_principal("Principals: \n        (none)"),
+            None
+        );
+    }
+
+    #[test]
+    fn skipped_spring_forward_time_uses_pre_jump_offset() {
+        // 01:30 local doesn't exist on 30 Mar; the CLI computed it with GMT.
+        let out = az_line("2025-03-30 01:30:00");
+        let t = parse_expiry_from_output_in(&out, &TestUk, Utc::now()).unwrap();
+        assert_eq!(t.naive_utc(), utc(2025, 3, 30, 1, 30));
     }
 }
@@ -0,0 +1,205 @@
+//! Fill in `target_resource_id` for machines that leave it out, by asking
+//! `az vm show -n <name> -g <resource_group> --query id` (`az vmss show` for
+//! scale sets). Answers are cached in `burrow.cache.yaml` next to the config,
+//! so Azure is only asked once per machine. Arc machines and `target_ip`
+//! targets are addressed without an ID and are left alone.
+
+use crate::azure::az_command;
+use crate::config::MachineConfig;
+use crate::model::TargetType;
+use color_eyre::eyre::{eyre, Context, Result};
+use serde::{Deserialize, Serialize};
+use std::collections::BTreeMap;
+use std::path::{Path, PathBuf};
+
+/// Stands in for a resource ID that is not looked up yet.
+pub const UNRESOLVED: &str = "<resource-id>";
+
+#[derive(Debug, Default, Serialize, Deserialize)]
+struct Cache {
+    /// `<resource_group>/<vm name>` (`vmss:`-prefixed for scale sets) -> ARM
+    /// resource ID.
+    #[serde(default)]
+    resource_ids: BTreeMap<String, String>,
+}
+
+/// Sibling cache file next to the config: same directory, `burrow.cache.yaml`.
+pub fn cache_path(config_path: &Path) -> PathBuf {
+    match config_path.parent() {
+        Some(dir) => dir.join("burrow.cache.yaml"),
+        None => PathBuf::from("burrow.cache.yaml"),
+    }
+}
+
+fn cache_key(m: &MachineConfig) -> String {
+    match m.target_type() {
+        TargetType::Vmss => format!("vmss:{}/{}", m.resource_group, m.name),
+        _ => format!("{}/{}", m.resource_group, m.name),
+    }
+}
+
+fn needs_lookup(m: &MachineConfig) -> bool {
+    m.target_resource_id.is_empty() && m.target_ip.is_none() && m.target_type() != TargetType::Arc
+}
+
+/// Resolve every empty `target_resource_id`, from the cache or via `az`,
+/// calling `on_lookup` with each machine's name before asking `az`. A VM
+/// that `az` cannot find is an error, so typos surface at startup.
+pub async fn resolve_resource_ids(
+    machines: &mut [MachineConfig],
+    cache_path: &Path,
+    mut on_lookup: impl FnMut(&str),
+) -> Result<()> {
+    if !machines.iter().any(needs_lookup) {
+        return Ok(());
+    }
+    let mut cache = load_cache(cache_path);
+    let mut dirty = false;
+    for m in machines.iter_mut().filter(|m| needs_lookup(m)) {
+        let key = cache_key(m);
+        if let Some(id) = cache.resource_ids.get(&key) {
+            m.target_resource_id = id.clone();
+            continue;
+        }
+        on_lookup(&m.name);
+        let id = az_resource_id(show_group(m), &m.name, &m.resource_group)
+            .await
+            .wrap_err_with(|| format!("could not resolve target_resource_id for '{}'", m.name))?;
+        cache.resource_ids.insert(key, id.clone());
+        m.target_resource_id = id;
+        dirty = true;
+    }
+    if dirty {
+        // Best effort: failing to cache only costs another lookup next time.
+        if let Ok(text) = serde_norway::to_string(&cache) {
+            let _ = std::fs::write(cache_path, text);
+        }
+    }
+    Ok(())
+}
+
+/// Fill in what the cache knows without asking `az`, for `--dry-run`. The
+/// rest get [`UNRESOLVED`]; returned are the lookups that would run for them.
+pub fn resolve_from_cache(machines: &mut [MachineConfig], cache_path: &Path) -> Vec<String> {
+    let cache = load_cache(cache_path);
+    let mut lookups = Vec::new();
+    for m in machines.iter_mut().filter(|m| needs_lookup(m)) {
+        match cache.resource_ids.get(&cache_key(m)) {
+            Some(id) => m.target_resource_id = id.clone(),
+            None => {
+                lookups.push(format!(
+                    "az {} show -n {} -g {} --query id -o tsv",
+                    show_group(m),
+                    m.name,
+                    m.resource_group
+                ));
+                m.target_resource_id = UNRESOLVED.to_string();
+            }
+        }
+    }
+    lookups
+}
+
+/// Like the state file, a missing or corrupt cache just means starting over.
+fn load_cache(path: &Path) -> Cache {
+    std::fs::read_to_string(path)
+        .ok()
+        .and_then(|text| serde_norway::from_str(&text).ok())
+        .unwrap_or_default()
+}
+
+/// The `az` command group that shows `m`.
+fn show_group(m: &MachineConfig) -> &'static str {
+    match m.target_type() {
+        TargetType::Vmss => "vmss",
+        _ => "vm",
+    }
+}
+
+/// `az <group> show` (`group` is `vm` or `vmss`) for the resource's ID.
+async fn az_resource_id(group: &str, name: &str, resource_group: &str) -> Result<String> {
+    let out = az_command()
+        .args([group, "show", "-n", name, "-g", resource_group])
+        .args(["--query", "id", "-o", "tsv"])
+        .output()
+        .await
+        .wrap_err("failed to run az")?;
+    if !out.status.success() {
+        return Err(eyre!(
+            "az {group} show failed: {}",
+            String::from_utf8_lossy(&out.stderr).trim()
+        ));
+    }
+    let id = String::from_utf8_lossy(&out.stdout).trim().to_string();
+    if id.is_empty() {
+        return Err(eyre!("az {group} show returned no resource ID"));
+    }
+    Ok(id)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn machine(name: &str, id: &str) -> MachineConfig {
+        MachineConfig {
+            name: name.into(),
+            resource_group: "RG".into(),
+            target_resource_id: id.into(),
+            target_type: None,
+            instance_id: None,
+            target_ip: None,
+            bastion_name: "b".into(),
+            bastion_resource_group: "brg".into(),
+            bastion_subscription: String::new(),
+            ssh_config_path: None,
+            ssh_key: None,
+            cert: Default::default(),
+            presets: Vec::new(),
+        }
+    }
+
+    #[test]
+    fn cache_path_is_sibling_of_config() {
+        assert_eq!(
+            cache_path(Path::new("/home/u/.config/burrow.config.yaml")),
+            PathBuf::from("/home/u/.config/burrow.cache.yaml")
+        );
+    }
+
+    #[tokio::test]
+    async fn missing_ids_come_from_cache_without_calling_az() {
+        let path = std::env::temp_dir().join("az-burrow-resolve-test-cache.yaml");
+        let cache = Cache {
+            resource_ids: BTreeMap::from([("RG/vm".to_string(), "/subs/x/vm".to_string())]),
+        };
+        std::fs::write(&path, serde_norway::to_string(&cache).unwrap()).unwrap();
+
+        let mut machines = vec![machine("vm", ""), machine("other", "/subs/y/other")];
+        resolve_resource_ids(&mut machines, &path, |_| {})
+            .await
+            .unwrap();
+        assert_eq!(machines[0].target_resource_id, "/subs/x/vm");
+        assert_eq!(machines[1].target_resource_id, "/subs/y/other");
+        let _ = std::fs::remove_file(&path);
+    }
+
+    #[test]
+    fn dry_run_resolution_lists_the_lookups_it_skips() {
+        let path = std::env::temp_dir().join(format!(
+            "az-burrow-resolve-dry-run-{}.yaml",
+            std::process::id()
+        ));
+        let cache = Cache {
+            resource_ids: BTreeMap::from([("RG/vm".to_string(), "/subs/x/vm".to_string())]),
+        };
+        std::fs::write(&path, serde_norway::to_string(&cache).unwrap()).unwrap();
+
+        let mut machines = vec![machine("vm", ""), machine("new", "")];
+        let lookups = resolve_from_cache(&mut machines, &path);
+        assert_eq!(machines[0].target_resource_id, "/subs/x/vm");
+        assert_eq!(machines[1].target_resource_id, UNRESOLVED);
+        assert_eq!(lookups, ["az vm show -n new -g RG --query id -o tsv"]);
+        let _ = std::fs::remove_file(&path);
+    }
+}
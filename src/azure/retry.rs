@@ -0,0 +1,122 @@
+//! Retrying `az` calls that failed for reasons likely to pass on their own:
+//! throttling, network blips, a token refreshed mid-request. Anything else
+//! (bad config, missing permissions) fails straight away as before.
+
+use std::collections::hash_map::RandomState;
+use std::hash::{BuildHasher, Hasher};
+use std::time::Duration;
+use tokio::process::Command;
+
+/// How many times to retry an operation and how long to wait in between.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct RetryPolicy {
+    /// Extra attempts after the first; 0 turns retrying off.
+    pub retries: u32,
+    /// Delay before the first retry; doubled for each one after.
+    pub base_delay: Duration,
+    pub max_delay: Duration,
+}
+
+impl RetryPolicy {
+    pub const fn new(retries: u32, base_delay: Duration) -> Self {
+        Self {
+            retries,
+            base_delay,
+            max_delay: Duration::from_secs(60),
+        }
+    }
+
+    /// How long to wait before retry number `retry` (1-based): exponential
+    /// backoff with jitter, somewhere between half and all of the full delay,
+    /// so tunnels failing together don't retry in lockstep.
+    pub fn delay(&self, retry: u32) -> Duration {
+        let full = self
+            .base_delay
+            .saturating_mul(1 << retry.saturating_sub(1).min(16))
+            .min(self.max_delay);
+        let half = full / 2;
+        let jitter = RandomState::new().build_hasher().finish() % (half.as_millis() as u64 + 1);
+        half + Duration::from_millis(jitter)
+    }
+}
+
+/// Whether `az` output describes a failure worth retrying.
+pub fn is_transient(output: &str) -> bool {
+    // No bare status codes: tunnel logs are full of port numbers.
+    const MARKERS: [&str; 13] = [
+        "toomanyrequests",
+        "too many requests",
+        "throttl",
+        "serviceunavailable",
+        "service unavailable",
+        "bad gateway",
+        "gatewaytimeout",
+        "timed out",
+        "connection reset",
+        "connection aborted",
+        "temporary failure in name resolution",
+        "max retries exceeded",
+        "expiredauthenticationtoken",
+    ];
+    let output = output.to_lowercase();
+    MARKERS.iter().any(|m| output.contains(m))
+}
+
+/// Run the command `make` builds, retrying transient failures under
+/// `policy`. Returns the last attempt's result.
+pub async fn output_with_retry(
+    policy: RetryPolicy,
+    mut make: impl FnMut() -> Command,
+) -> std::io::Result<std::process::Output> {
+    let mut retry = 0;
+    loop {
+        let result = make().output().await;
+        let transient = match &result {
+            Ok(out) if out.status.success() => false,
+            Ok(out) => {
+                is_transient(&String::from_utf8_lossy(&out.stderr))
+                    || is_transient(&String::from_utf8_lossy(&out.stdout))
+            }
+            Err(_) => false,
+        };
+        if !transient || retry >= policy.retries {
+            return result;
+        }
+        retry += 1;
+        tokio::time::sleep(policy.delay(retry)).await;
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn throttling_and_network_errors_are_transient() {
+        assert!(is_transient(
+            "ERROR: (TooManyRequests) The request is being throttled."
+        ));
+        assert!(is_transient(
+            "ERROR: HTTPSConnectionPool(host='management.azure.com', port=443): Max retries exceeded"
+        ));
+        assert!(is_transient("Connection reset by peer"));
+        assert!(!is_transient(
+            "ERROR: (AuthorizationFailed) The client does not have authorization"
+        ));
+        assert!(!is_transient(
+            "ERROR: Please run 'az login' to setup account."
+        ));
+    }
+
+    #[test]
+    fn delay_doubles_with_jitter_and_is_capped() {
+        let policy = RetryPolicy::new(5, Duration::from_secs(2));
+        for _ in 0..20 {
+            let first = policy.delay(1);
+            assert!(first >= Duration::from_secs(1) && first <= Duration::from_secs(2));
+            let third = policy.delay(3);
+            assert!(third >= Duration::from_secs(4) && third <= Duration::from_secs(8));
+            assert!(policy.delay(30) <= policy.max_delay);
+        }
+    }
+}
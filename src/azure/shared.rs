@@ -0,0 +1,364 @@
+//! Shared team configs published by a platform team. A local config with a
+//! `config_source` is layered over the shared one, fetched from:
+//!
+//! - `azblob://<account>/<container>/<path>`: a blob in Azure Storage,
+//!   downloaded with the signed-in `az` account
+//! - `azkv://<vault>/<secret>`: a Key Vault secret holding the YAML
+//! - `https://…`: any URL, fetched with `az rest` so az's proxy and
+//!   certificate settings apply
+//! - `git+<repo>#[<ref>:]<path>`: a file in a git repository, read from a
+//!   shallow clone with the `git` on `PATH` and its credentials
+//!
+//! The last good copy is cached in `burrow.shared.yaml` next to the local
+//! config, so startup doesn't wait on the network; `R` in the app fetches a
+//! fresh one.
+
+use crate::azure::{az_command, ScratchDir};
+use crate::bus::Bus;
+use crate::config::{self, Config};
+use crate::model::Machine;
+use crate::tui::action::BgEvent;
+use color_eyre::eyre::{eyre, Context, Result};
+use std::path::{Path, PathBuf};
+use tokio::process::Command;
+
+/// Where a shared config lives, parsed from `config_source`.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub enum Source {
+    Blob {
+        account: String,
+        container: String,
+        blob: String,
+    },
+    KeyVault {
+        vault: String,
+        secret: String,
+    },
+    Url(String),
+    Git {
+        repo: String,
+        /// Branch or tag; the default branch when `None`.
+        rev: Option<String>,
+        path: String,
+    },
+}
+
+impl Source {
+    pub fn parse(url: &str) -> Result<Self> {
+        if let Some(rest) = url.strip_prefix("azblob://") {
+            let usage = || {
+                eyre!(
+                    "config_source '{url}' should look like azblob://<account>/<container>/<path>"
+                )
+            };
+            let mut parts = rest.splitn(3, '/');
+            let (Some(account), Some(container), Some(blob)) =
+                (parts.next(), parts.next(), parts.next())
+            else {
+                return Err(usage());
+            };
+            if account.is_empty() || container.is_empty() || blob.is_empty() {
+                return Err(usage());
+            }
+            return Ok(Source::Blob {
+                account: account.to_string(),
+                container: container.to_string(),
+                blob: blob.to_string(),
+            });
+        }
+        if let Some(rest) = url.strip_prefix("azkv://") {
+            return match rest.split_once('/') {
+                Some((vault, secret))
+                    if !vault.is_empty() && !secret.is_empty() && !secret.contains('/') =>
+                {
+                    Ok(Source::KeyVault {
+                        vault: vault.to_string(),
+                        secret: secret.to_string(),
+                    })
+                }
+                _ => Err(eyre!(
+                    "config_source '{url}' should look like azkv://<vault>/<secret>"
+                )),
+            };
+        }
+        if let Some(rest) = url.strip_prefix("git+") {
+            let (repo, file) = rest.split_once('#').unwrap_or((rest, ""));
+            let (rev, path) = match file.split_once(':') {
+                Some((rev, path)) => (Some(rev.to_string()), path),
+                None => (None, file),
+            };
+            if repo.is_empty() || path.is_empty() || rev.as_deref() == Some("") {
+                return Err(eyre!(
+                    "config_source '{url}' should look like git+<repo>#[<branch>:]<path>"
+                ));
+            }
+            return Ok(Source::Git {
+                repo: repo.to_string(),
+                rev,
+                path: path.to_string(),
+            });
+        }
+        if url.starts_with("https://") {
+            return Ok(Source::Url(url.to_string()));
+        }
+        Err(eyre!(
+            "config_source '{url}' should start with azblob://, azkv://, https:// or git+"
+        ))
+    }
+}
+
+/// Sibling cache file next to the config: same directory, `burrow.shared.yaml`.
+pub fn cache_path(config_path: &Path) -> PathBuf {
+    match config_path.parent() {
+        Some(dir) => dir.join("burrow.shared.yaml"),
+        None => PathBuf::from("burrow.shared.yaml"),
+    }
+}
+
+/// Layer `local` over its shared config and validate the result. Uses the
+/// cached copy unless `refresh` is set or there is none yet; a download only
+/// replaces the cache once it parses, so a bad upload never breaks startup.
+pub async fn with_shared(local: Config, config_path: &Path, refresh: bool) -> Result<Config> {
+    let Some(url) = local.config_source.clone() else {
+        return Ok(local);
+    };
+    let source = Source::parse(&url)?;
+    let cached = if refresh { None } else { cached(config_path) };
+    let shared = match cached {
+        Some(shared) => shared,
+        // Missing, unreadable or corrupt cache: fetch again.
+        None => {
+            let text = download(&source).await?;
+            let shared = config::parse(&text)
+                .wrap_err_with(|| format!("in shared config {url}"))?
+                .shared();
+            // Best effort: failing to cache only costs another download.
+            let _ = std::fs::write(cache_path(config_path), text);
+            shared
+        }
+    };
+    let cfg = local.over(shared);
+    cfg.validate()?;
+    Ok(cfg)
+}
+
+/// The shared config as last downloaded, if there is a readable copy,
+/// without the settings only a local config may make ([`Config::shared`]).
+pub fn cached(config_path: &Path) -> Option<Config> {
+    let text = std::fs::read_to_string(cache_path(config_path)).ok()?;
+    config::parse(&text).ok().map(Config::shared)
+}
+
+/// Fetch the shared config's text from `source`.
+async fn download(source: &Source) -> Result<String> {
+    let scratch = ScratchDir::new().wrap_err("failed to create a temporary directory")?;
+    // Not created yet: `git clone` wants a directory of its own.
+    let tmp = scratch.path().join("shared");
+    let result = match source {
+        Source::Blob {
+            account,
+            container,
+            blob,
+        } => {
+            let mut cmd = az_command();
+            cmd.args(["storage", "blob", "download", "--auth-mode", "login"])
+                .args(["--account-name", account])
+                .args(["--container-name", container])
+                .args(["--name", blob])
+                .arg("--file")
+                .arg(&tmp)
+                .args(["--only-show-errors", "-o", "none"]);
+            run(cmd, "az storage blob download")
+                .await
+                .and_then(|_| read(&tmp))
+        }
+        Source::KeyVault { vault, secret } => {
+            let mut cmd = az_command();
+            cmd.args(["keyvault", "secret", "show"])
+                .args(["--vault-name", vault])
+                .args(["--name", secret])
+                .args(["--query", "value", "-o", "tsv", "--only-show-errors"]);
+            run(cmd, "az keyvault secret show").await
+        }
+        Source::Url(url) => {
+            let mut cmd = az_command();
+            cmd.args(["rest", "--method", "get", "--url", url])
+                .args(["--skip-authorization-header", "--output-file"])
+                .arg(&tmp)
+                .args(["--only-show-errors"]);
+            run(cmd, "az rest").await.and_then(|_| read(&tmp))
+        }
+        Source::Git { repo, rev, path } => {
+            let mut cmd = Command::new("git");
+            cmd.args(["clone", "--quiet", "--depth", "1"]);
+            if let Some(rev) = rev {
+                cmd.args(["--branch", rev]);
+            }
+            cmd.arg("--").arg(repo).arg(&tmp);
+            run(cmd, "git clone")
+                .await
+                .and_then(|_| read(&tmp.join(path)))
+        }
+    };
+    result
+}
+
+/// Run a fetch command, returning its stdout or, on failure, its stderr as
+/// the error.
+async fn run(mut cmd: Command, what: &str) -> Result<String> {
+    let out = cmd
+        .stdin(std::process::Stdio::null())
+        .output()
+        .await
+        .wrap_err_with(|| format!("failed to run {what}"))?;
+    if !out.status.success() {
+        return Err(eyre!(
+            "{what} failed: {}",
+            String::from_utf8_lossy(&out.stderr).trim()
+        ));
+    }
+    Ok(String::from_utf8_lossy(&out.stdout).into_owned())
+}
+
+fn read(path: &Path) -> Result<String> {
+    std::fs::read_to_string(path).wrap_err("failed to read downloaded config")
+}
+
+/// Reloads the machine list on request and hands it to the UI: after a
+/// fresh download of the shared config as [`BgEvent::SharedConfig`] (`R`),
+/// or after the local file was edited as [`BgEvent::ConfigReloaded`].
+#[derive(Clone)]
+pub struct SharedConfig {
+    config_path: PathBuf,
+    /// Whether the config has a `config_source` to refresh.
+    has_source: bool,
+    bus: Bus,
+}
+
+impl SharedConfig {
+    pub fn new(config_path: PathBuf, has_source: bool, bus: impl Into<Bus>) -> Self {
+        Self {
+            config_path,
+            has_source,
+            bus: bus.into(),
+        }
+    }
+
+    pub fn config_path(&self) -> &Path {
+        &self.config_path
+    }
+
+    pub fn has_source(&self) -> bool {
+        self.has_source
+    }
+
+    /// Re-read the local config, download the shared one and resolve any
+    /// missing resource IDs, in the background.
+    pub fn refresh(&self) {
+        let this = self.clone();
+        tokio::spawn(async move {
+            let result = this.load(true).await.map_err(|e| format!("{e:#}"));
+            this.bus.publish(BgEvent::SharedConfig { result });
+        });
+    }
+
+    /// Re-read the local config over the cached shared one, in the
+    /// background.
+    pub fn reload(&self) {
+        let this = self.clone();
+        tokio::spawn(async move {
+            let result = this.load(false).await.map_err(|e| format!("{e:#}"));
+            this.bus.publish(BgEvent::ConfigReloaded { result });
+        });
+    }
+
+    async fn load(&self, refresh: bool) -> Result<Vec<Machine>> {
+        let local = config::load(&self.config_path)?;
+        let mut cfg = with_shared(local, &self.config_path, refresh).await?;
+        crate::azure::resolve::resolve_resource_ids(
+            &mut cfg.machines,
+            &crate::azure::resolve::cache_path(&self.config_path),
+            // The TUI owns the screen by now; its spinner says we're busy.
+            |_| {},
+        )
+        .await?;
+        let cert = cfg.cert;
+        Ok(cfg
+            .machines
+            .into_iter()
+            .map(|m| m.into_machine(cert))
+            .collect())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn parses_azblob_urls() {
+        assert_eq!(
+            Source::parse("azblob://teamstore/configs/dev/burrow.yaml").unwrap(),
+            Source::Blob {
+                account: "teamstore".into(),
+                container: "configs".into(),
+                blob: "dev/burrow.yaml".into(),
+            }
+        );
+        assert!(Source::parse("http://teamstore/configs/x.yaml").is_err());
+        assert!(Source::parse("azblob://teamstore/configs").is_err());
+        assert!(Source::parse("azblob://teamstore//x.yaml").is_err());
+    }
+
+    #[test]
+    fn parses_key_vault_url_and_git_sources() {
+        assert_eq!(
+            Source::parse("azkv://kv-platform/burrow-config").unwrap(),
+            Source::KeyVault {
+                vault: "kv-platform".into(),
+                secret: "burrow-config".into(),
+            }
+        );
+        assert!(Source::parse("azkv://kv-platform").is_err());
+        assert_eq!(
+            Source::parse("https://platform.example.com/burrow.yaml").unwrap(),
+            Source::Url("https://platform.example.com/burrow.yaml".into())
+        );
+        assert_eq!(
+            Source::parse("git+https://github.com/org/platform.git#main:burrow/config.yaml")
+                .unwrap(),
+            Source::Git {
+                repo: "https://github.com/org/platform.git".into(),
+                rev: Some("main".into()),
+                path: "burrow/config.yaml".into(),
+            }
+        );
+        assert_eq!(
+            Source::parse("git+git@github.com:org/platform.git#burrow.yaml").unwrap(),
+            Source::Git {
+                repo: "git@github.com:org/platform.git".into(),
+                rev: None,
+                path: "burrow.yaml".into(),
+            }
+        );
+        assert!(Source::parse("git+https://github.com/org/platform.git").is_err());
+    }
+
+    #[tokio::test]
+    async fn cached_shared_config_is_used_without_downloading() {
+        let dir = std::env::temp_dir().join("az-burrow-blob-test");
+        std::fs::create_dir_all(&dir).unwrap();
+        let config_path = dir.join("burrow.config.yaml");
+        std::fs::write(
+            cache_path(&config_path),
+            "machines:\n  - name: shared-vm\n    resource_group: RG\n    target_resource_id: /subs/x/vm\n    bastion_name: b\n    bastion_resource_group: HUB\n",
+        )
+        .unwrap();
+        let local = config::parse("config_source: azblob://acct/configs/burrow.yaml").unwrap();
+
+        let cfg = with_shared(local, &config_path, false).await.unwrap();
+        assert_eq!(cfg.machines.len(), 1);
+        assert_eq!(cfg.machines[0].name, "shared-vm");
+        let _ = std::fs::remove_dir_all(&dir);
+    }
+}
@@ -0,0 +1,84 @@
+//! The az access token's lifetime. az refreshes the token on its own when a
+//! command needs one, but a tunnel that starts just before it expires can
+//! lose it halfway through Bastion's setup. So the expiry is shown in the
+//! status bar, and a tunnel starting close to it waits for
+//! `az account get-access-token` first, which has az refresh the token (with
+//! its refresh token) when it is nearly used up.
+
+use crate::azure::az_command;
+use chrono::{DateTime, Local, NaiveDateTime, TimeZone, Utc};
+use std::time::Duration;
+
+/// A token expiring sooner than this is refreshed before a tunnel starts:
+/// Bastion's setup and the first connection outlast anything shorter.
+pub const REFRESH_MARGIN: Duration = Duration::from_secs(10 * 60);
+
+/// Whether a token expiring `at` should be refreshed before a tunnel starts.
+pub fn due(at: DateTime<Utc>, now: DateTime<Utc>) -> bool {
+    (at - now)
+        .to_std()
+        .map_or(true, |left| left < REFRESH_MARGIN)
+}
+
+/// When the access token expires, from `az account get-access-token --query
+/// "[expires_on, expiresOn]" -o tsv`: a POSIX timestamp from newer az, or
+/// else the local time older versions print ("2025-03-01 11:05:00.000000").
+pub fn parse_expiry(output: &str) -> Option<DateTime<Utc>> {
+    let fields: Vec<&str> = output
+        .split(['\n', '\t'])
+        .map(str::trim)
+        .filter(|f| !f.is_empty() && *f != "None")
+        .collect();
+    if let Some(secs) = fields.iter().find_map(|f| f.parse::<i64>().ok()) {
+        return DateTime::from_timestamp(secs, 0);
+    }
+    fields.iter().find_map(|f| {
+        let naive = NaiveDateTime::parse_from_str(f, "%Y-%m-%d %H:%M:%S%.f").ok()?;
+        Some(
+            Local
+                .from_local_datetime(&naive)
+                .earliest()?
+                .with_timezone(&Utc),
+        )
+    })
+}
+
+/// Get an access token, which refreshes it if it is close to expiring, and
+/// return when it expires.
+pub async fn refresh() -> Result<DateTime<Utc>, String> {
+    let out = az_command()
+        .args(["account", "get-access-token"])
+        .args(["--query", "[expires_on, expiresOn]", "-o", "tsv"])
+        .output()
+        .await
+        .map_err(|e| format!("failed to run az: {e}"))?;
+    if !out.status.success() {
+        return Err(String::from_utf8_lossy(&out.stderr).trim().to_string());
+    }
+    parse_expiry(&String::from_utf8_lossy(&out.stdout))
+        .ok_or_else(|| "az account get-access-token printed no expiry".to_string())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn expiry_is_read_from_new_and_old_az() {
+        assert_eq!(
+            parse_expiry("1740827100\t2025-03-01 11:05:00.000000\n"),
+            DateTime::from_timestamp(1740827100, 0)
+        );
+        let old = parse_expiry("None\t2025-03-01 11:05:00.000000\n").unwrap();
+        assert_eq!(
+            old.with_timezone(&Local).naive_local().to_string(),
+            "2025-03-01 11:05:00"
+        );
+        assert_eq!(parse_expiry(""), None);
+
+        let now = Utc::now();
+        assert!(due(now + chrono::Duration::minutes(5), now));
+        assert!(due(now - chrono::Duration::minutes(5), now));
+        assert!(!due(now + chrono::Duration::minutes(45), now));
+    }
+}
@@ -1,14 +1,53 @@
-use crate::azure::cleanup::kill_process_group;
-use crate::model::{Tunnel, TunnelId, TunnelStatus};
+use crate::azure::cleanup::{
+    is_same_process, kill_process_group, start_time, terminate_process_group,
+};
+use crate::azure::retry::RetryPolicy;
+use crate::azure::vm::PowerAction;
+use crate::bus::Bus;
+use crate::model::{AksCluster, Machine, SshForward, TargetType, Tunnel, TunnelId, TunnelStatus};
+use crate::readiness::{probe_health, wait_until_ready, ReadyCheck};
 use crate::tui::action::BgEvent;
-use std::collections::HashMap;
+use crate::tui::history::Severity;
+use crate::tunnel_log::{self, LogFile};
+use chrono::{DateTime, Local};
+use std::collections::{HashMap, HashSet, VecDeque};
+use std::future::Future;
+use std::net::{IpAddr, Ipv4Addr};
+use std::path::PathBuf;
 use std::process::Stdio;
 use std::sync::{Arc, Mutex};
+use std::time::Duration;
 use tokio::io::{AsyncBufReadExt, BufReader};
-use tokio::sync::mpsc::UnboundedSender;
+use tokio::net::{TcpListener, TcpStream};
 use tokio_util::sync::CancellationToken;
 
-const MAX_LOG_LINES: usize = 100;
+/// Lines of output kept per tunnel, unless `log_lines` says otherwise.
+pub const DEFAULT_LOG_LINES: usize = 100;
+/// Longer lines are cut short before they are stored.
+const MAX_LINE_LEN: usize = 4096;
+/// How often a reattached (detached) tunnel's PID is polled for liveness.
+const ADOPT_POLL_INTERVAL: Duration = Duration::from_secs(2);
+/// How long a stopping tunnel gets to exit before it is killed, and how long
+/// [`TunnelManager::stop_all_with_progress`] waits on one tunnel's kill
+/// (`taskkill` on Windows can hang), unless `stop_timeout_secs` says otherwise.
+pub const DEFAULT_STOP_TIMEOUT: Duration = Duration::from_secs(5);
+/// How long a starting tunnel gets to come up before it is stopped and marked
+/// failed, unless `start_timeout_secs` says otherwise.
+pub const DEFAULT_START_TIMEOUT: Duration = Duration::from_secs(60);
+/// How often an adopted tunnel being stopped is checked for having exited.
+const STOP_POLL_INTERVAL: Duration = Duration::from_millis(100);
+/// Restarts for a tunnel that exits with a transient `az` error, unless
+/// `retry.tunnel` says otherwise.
+pub const DEFAULT_RETRY: RetryPolicy = RetryPolicy::new(3, Duration::from_secs(2));
+
+/// Where a [`TunnelManager::stop_all_with_progress`] shutdown has got to.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct StopProgress {
+    pub done: usize,
+    pub total: usize,
+    /// Tunnels still running after the timeout; counted in `done`.
+    pub timed_out: usize,
+}
 
 #[derive(Debug, PartialEq, Eq, Clone, Copy)]
 pub enum StatusHint {
@@ -16,12 +55,111 @@ pub enum StatusHint {
     Connecting,
 }
 
-/// Append to a capped ring buffer (keep the last MAX_LOG_LINES).
-fn push_log(logs: &mut Vec<String>, line: String) {
-    logs.push(line);
-    if logs.len() > MAX_LOG_LINES {
-        let excess = logs.len() - MAX_LOG_LINES;
-        logs.drain(0..excess);
+/// One line of a tunnel's output, stamped and classified as it was captured.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct LogLine {
+    pub at: DateTime<Local>,
+    pub severity: Severity,
+    pub text: String,
+}
+
+impl std::fmt::Display for LogLine {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        write!(
+            f,
+            "{} {:<5} {}",
+            self.at.format("%Y-%m-%d %H:%M:%S"),
+            self.severity.label(),
+            self.text
+        )
+    }
+}
+
+impl LogLine {
+    /// Whether this is a line az wrote to stderr. Those are stored as is;
+    /// stdout and the ssh stage are tagged `[OUT]` and `[SSH]`, and notes of
+    /// our own `[ERR]`.
+    pub fn is_stderr(&self) -> bool {
+        !["[OUT] ", "[SSH] ", "[ERR] "]
+            .iter()
+            .any(|tag| self.text.starts_with(tag))
+    }
+}
+
+/// A tunnel's captured output: a ring buffer of its last `capacity` lines
+/// (`log_lines`), the oldest dropped as each new one arrives.
+///
+/// A chatty az process must neither grow memory nor flood the event channel,
+/// so the UI is sent one [`BgEvent::TunnelLog`] per batch rather than per
+/// line: once one is queued, later lines only land in the buffer until
+/// [`TunnelManager::logs`] reads it. Repeated identical status hints are
+/// likewise sent only once. With `log_files` on, every line is mirrored to
+/// the tunnel's log file as well.
+#[derive(Debug)]
+struct LogBuffer {
+    lines: VecDeque<LogLine>,
+    capacity: usize,
+    file: Option<LogFile>,
+    /// A TunnelLog is queued that `logs()` hasn't answered yet.
+    notified: bool,
+    last_status: Option<TunnelStatus>,
+}
+
+impl Default for LogBuffer {
+    fn default() -> Self {
+        Self::new(DEFAULT_LOG_LINES, None)
+    }
+}
+
+impl LogBuffer {
+    fn new(capacity: usize, file: Option<LogFile>) -> Self {
+        Self {
+            lines: VecDeque::new(),
+            capacity: capacity.max(1),
+            file,
+            notified: false,
+            last_status: None,
+        }
+    }
+
+    /// Store `line`, dropping the oldest one when full. Returns whether the
+    /// UI needs telling.
+    fn push(&mut self, severity: Severity, mut line: String) -> bool {
+        if line.len() > MAX_LINE_LEN {
+            let mut end = MAX_LINE_LEN;
+            while !line.is_char_boundary(end) {
+                end -= 1;
+            }
+            line.truncate(end);
+            line.push('…');
+        }
+        if let Some(file) = &mut self.file {
+            file.write_line(&format!("{:<5} {line}", severity.label()));
+        }
+        if self.lines.len() == self.capacity {
+            self.lines.pop_front();
+        }
+        self.lines.push_back(LogLine {
+            at: Local::now(),
+            severity,
+            text: line,
+        });
+        !std::mem::replace(&mut self.notified, true)
+    }
+
+    /// The buffered lines, oldest first; re-arms the notification.
+    fn read(&mut self) -> Vec<LogLine> {
+        self.notified = false;
+        self.lines.iter().cloned().collect()
+    }
+
+    /// Whether `status` differs from the last one reported.
+    fn status_changed(&mut self, status: &TunnelStatus) -> bool {
+        if self.last_status.as_ref() == Some(status) {
+            return false;
+        }
+        self.last_status = Some(status.clone());
+        true
     }
 }
 
@@ -42,40 +180,384 @@ fn is_error_line(line: &str) -> bool {
     l.contains("error") || l.contains("failed")
 }
 
+/// How a captured line is tagged in the logs view: az prefixes its own
+/// warnings with `WARNING:`.
+fn severity_of(line: &str) -> Severity {
+    if is_error_line(line) {
+        Severity::Error
+    } else if line.to_lowercase().contains("warning") {
+        Severity::Warning
+    } else {
+        Severity::Info
+    }
+}
+
+/// The `az` invocation that forwards `tunnel.local_port` to the remote port:
+/// a Bastion tunnel for VMs, `az ssh arc` port forwarding for Arc servers.
+fn tunnel_command(tunnel: &Tunnel) -> tokio::process::Command {
+    let m = &tunnel.machine;
+    let mut cmd = super::az_command();
+    match m.target_type {
+        TargetType::Vm | TargetType::Vmss => {
+            cmd.arg("network").arg("bastion").arg("tunnel");
+            // Omit --subscription when blank (spec decision).
+            if !m.bastion_subscription.is_empty() {
+                cmd.arg("--subscription").arg(&m.bastion_subscription);
+            }
+            cmd.arg("--resource-group")
+                .arg(&m.bastion_resource_group)
+                .arg("--name")
+                .arg(&m.bastion_name);
+            match &m.target_ip {
+                Some(ip) => cmd.arg("--target-ip-address").arg(ip),
+                None => cmd
+                    .arg("--target-resource-id")
+                    .arg(tunnel.target_resource_id()),
+            };
+            cmd.arg("--resource-port")
+                .arg(&tunnel.remote_port)
+                .arg("--port")
+                .arg(&tunnel.local_port);
+        }
+        TargetType::Arc => {
+            cmd.arg("ssh").arg("arc");
+            if m.target_resource_id.is_empty() {
+                cmd.arg("--resource-group")
+                    .arg(&m.resource_group)
+                    .arg("--name")
+                    .arg(&m.name);
+            } else {
+                cmd.arg("--resource-id").arg(&m.target_resource_id);
+            }
+            // Reuse the certificate CertManager keeps fresh, if there is one.
+            if let Some(files) = m.key_files() {
+                cmd.arg("--private-key-file")
+                    .arg(files.private_key)
+                    .arg("--certificate-file")
+                    .arg(files.cert);
+            }
+            if let Some(fwd) = &tunnel.ssh {
+                cmd.arg("--local-user").arg(fwd.user());
+            }
+            // Everything after `--` goes to ssh: forward only, never prompt.
+            cmd.arg("--").arg("-N");
+            match &tunnel.ssh {
+                Some(fwd) => cmd.args(fwd.ssh_args(&tunnel.listen_spec())),
+                None => cmd.arg("-L").arg(format!(
+                    "{}:localhost:{}",
+                    tunnel.listen_spec(),
+                    tunnel.remote_port
+                )),
+            };
+            cmd.args(["-o", "ExitOnForwardFailure=yes"])
+                .args(["-o", "BatchMode=yes"])
+                .args(["-o", "StrictHostKeyChecking=accept-new"]);
+        }
+    }
+    cmd
+}
+
+/// Stands in for the Bastion stage's port, or the port behind a [`relay`],
+/// picked afresh on every start, in [`command_lines`].
+const STAGE_PORT: &str = "<free-port>";
+
+/// The commands starting `tunnel` runs, as shell lines to reproduce it by
+/// hand: the `az` invocation and, for a tunnel that goes on over SSH through
+/// Bastion, the `ssh` stage.
+pub fn command_lines(tunnel: &Tunnel) -> Vec<String> {
+    let behind = Tunnel {
+        local_port: STAGE_PORT.to_string(),
+        ..tunnel.clone()
+    };
+    match (&tunnel.ssh, tunnel.machine.target_type) {
+        (Some(fwd), TargetType::Vm | TargetType::Vmss) => vec![
+            shell_line(tunnel_command(&behind)),
+            shell_line(ssh_stage_command(tunnel, fwd, STAGE_PORT, None)),
+        ],
+        _ if needs_relay(tunnel) => vec![shell_line(tunnel_command(&behind))],
+        _ => vec![shell_line(tunnel_command(tunnel))],
+    }
+}
+
+/// Whether `tunnel` listens through a [`relay`]: a plain Bastion tunnel with
+/// a `bind_address` other than 127.0.0.1, which az can't listen on itself.
+/// ssh takes the bind address directly.
+fn needs_relay(tunnel: &Tunnel) -> bool {
+    tunnel.ssh.is_none()
+        && tunnel.machine.target_type != TargetType::Arc
+        && tunnel
+            .bind_address
+            .is_some_and(|ip| ip != IpAddr::V4(Ipv4Addr::LOCALHOST))
+}
+
+/// Pass each connection accepted on a tunnel's bind address through to az
+/// listening on loopback at `target`, until `done`.
+async fn relay(listener: TcpListener, target: String, done: CancellationToken) {
+    loop {
+        let accepted = tokio::select! {
+            _ = done.cancelled() => return,
+            accepted = listener.accept() => accepted,
+        };
+        let Ok((mut inbound, _)) = accepted else {
+            // Out of file descriptors, say: don't spin.
+            tokio::time::sleep(Duration::from_millis(100)).await;
+            continue;
+        };
+        let target = target.clone();
+        tokio::spawn(async move {
+            if let Ok(mut outbound) = TcpStream::connect(&target).await {
+                let _ = tokio::io::copy_bidirectional(&mut inbound, &mut outbound).await;
+            }
+        });
+    }
+}
+
+/// `cmd` as one shell line, environment first, quoting words that need it.
+fn shell_line(cmd: tokio::process::Command) -> String {
+    let cmd = cmd.as_std();
+    let env = cmd.get_envs().filter_map(|(k, v)| {
+        Some(format!(
+            "{}={}",
+            k.to_string_lossy(),
+            shell_word(&v?.to_string_lossy())
+        ))
+    });
+    let words = std::iter::once(cmd.get_program())
+        .chain(cmd.get_args())
+        .map(|w| shell_word(&w.to_string_lossy()));
+    env.chain(words).collect::<Vec<_>>().join(" ")
+}
+
+fn shell_word(word: &str) -> String {
+    let plain = |c: char| c.is_ascii_alphanumeric() || "-_./:=@,+%".contains(c);
+    // Placeholders such as `<free-port>` are for the reader to fill in.
+    let placeholder = word.starts_with('<') && word.ends_with('>');
+    if placeholder || (!word.is_empty() && word.chars().all(plain)) {
+        word.to_string()
+    } else {
+        format!("'{}'", word.replace('\'', r"'\''"))
+    }
+}
+
+/// Report the tunnel Active once `addr` accepts connections, for forwards
+/// that print nothing when they are up.
+fn watch_port(bus: &Bus, cancel: &CancellationToken, id: TunnelId, addr: &str) {
+    let bus = bus.clone();
+    let cancel = cancel.clone();
+    let addr = addr.to_string();
+    tokio::spawn(async move {
+        tokio::select! {
+            _ = cancel.cancelled() => {}
+            ready = wait_until_ready(&ReadyCheck::Tcp, &addr) => {
+                if ready.is_ok() {
+                    bus.publish(BgEvent::TunnelStatus { id, status: TunnelStatus::Active });
+                }
+            }
+        }
+    });
+}
+
+/// A free local port for the Bastion stage of a two-stage tunnel.
+fn free_port() -> color_eyre::Result<String> {
+    let listener = std::net::TcpListener::bind("127.0.0.1:0")
+        .map_err(|e| color_eyre::eyre::eyre!("no free local port: {e}"))?;
+    Ok(listener.local_addr()?.port().to_string())
+}
+
+/// Ask process group `pid` to exit and wait up to `timeout` for `exited`,
+/// killing the group if it is still there. Returns whether it was killed.
+async fn stop_process_group(pid: u32, exited: impl Future<Output = ()>, timeout: Duration) -> bool {
+    let _ = tokio::task::spawn_blocking(move || terminate_process_group(pid)).await;
+    if tokio::time::timeout(timeout, exited).await.is_ok() {
+        return false;
+    }
+    let _ = tokio::task::spawn_blocking(move || kill_process_group(pid)).await;
+    true
+}
+
+/// The log line for a tunnel that had to be killed.
+fn forced_stop_line(timeout: Duration) -> String {
+    format!(
+        "[ERR] Still running {}s after being asked to stop; killed",
+        timeout.as_secs_f32()
+    )
+}
+
+/// Kill the az process group (and with it ssh, on Unix) so the monitor sees
+/// it exit.
+fn kill_az(pid: Option<u32>) {
+    if let Some(pid) = pid {
+        kill_process_group(pid);
+    }
+}
+
+/// The SSH stage: `ssh -D` or `-L` on the tunnel's local port, through the
+/// Bastion stage listening on `bastion_port`. It joins az's process group
+/// (`pgid`) so stopping or reattaching the tunnel covers both.
+fn ssh_stage_command(
+    tunnel: &Tunnel,
+    fwd: &SshForward,
+    bastion_port: &str,
+    pgid: Option<u32>,
+) -> tokio::process::Command {
+    let mut cmd = tokio::process::Command::new("ssh");
+    cmd.arg("-N")
+        .args(fwd.ssh_args(&tunnel.listen_spec()))
+        .arg("-p")
+        .arg(bastion_port)
+        .args(["-o", "ExitOnForwardFailure=yes"])
+        .args(["-o", "BatchMode=yes"])
+        .args(["-o", "StrictHostKeyChecking=accept-new"])
+        // The Bastion stage's port changes every run; pin the host key to
+        // the machine instead of 127.0.0.1:<port>.
+        .arg("-o")
+        .arg(format!("HostKeyAlias={}", tunnel.machine.name));
+    if let Some(files) = tunnel.machine.key_files() {
+        cmd.arg("-i")
+            .arg(&files.private_key)
+            .arg("-o")
+            .arg(format!("CertificateFile={}", files.cert.display()));
+    }
+    cmd.arg(format!("{}@127.0.0.1", fwd.user()))
+        .stdin(Stdio::null())
+        .stdout(Stdio::null())
+        .stderr(Stdio::piped())
+        .kill_on_drop(true);
+    #[cfg(unix)]
+    if let Some(pgid) = pgid {
+        cmd.process_group(pgid as i32);
+    }
+    #[cfg(not(unix))]
+    let _ = pgid;
+    cmd
+}
+
+/// Keep reading a detached process's output once we are gone. Its pipe goes
+/// to a `cat` into /dev/null, so az and ssh don't die of SIGPIPE on their
+/// next line. `cat` joins the tunnel's process group, so stopping the tunnel
+/// later takes it too; otherwise it ends with the last writer.
+fn drain_after_detach<R>(lines: Option<tokio::io::Lines<BufReader<R>>>, pgid: Option<u32>)
+where
+    R: TryInto<Stdio, Error = std::io::Error>,
+{
+    let Some(Ok(pipe)) = lines.map(|l| l.into_inner().into_inner().try_into()) else {
+        return;
+    };
+    let mut cmd = std::process::Command::new("cat");
+    cmd.stdin(pipe).stdout(Stdio::null()).stderr(Stdio::null());
+    #[cfg(unix)]
+    if let Some(pgid) = pgid {
+        use std::os::unix::process::CommandExt;
+        cmd.process_group(pgid as i32);
+    }
+    #[cfg(not(unix))]
+    let _ = pgid;
+    let _ = cmd.spawn();
+}
+
 struct Running {
+    /// Fired by [`TunnelManager::stop`]: the monitor stops the process and
+    /// reports [`BgEvent::TunnelStopped`].
     cancel: CancellationToken,
+    /// Fired by the monitor once it is done and the process gone (or was
+    /// killed and never exited), so the entry can be released.
+    done: CancellationToken,
+    /// Fired by [`TunnelManager::detach_all`]: the monitor lets go of the
+    /// process instead of killing it.
+    detach: CancellationToken,
     pid: Option<u32>,
-    logs: Arc<Mutex<Vec<String>>>,
+    /// The process's start time, when known already (a reattached one).
+    started: Option<String>,
+    /// Whether this process runs a [`relay`] in front of az, which can't
+    /// outlive us.
+    relayed: bool,
+    logs: Arc<Mutex<LogBuffer>>,
+}
+
+/// A tunnel's az process left running by [`TunnelManager::detach_all`].
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct Detached {
+    pub pid: u32,
+    /// When it started (see [`crate::azure::cleanup::start_time`]), to make
+    /// sure a PID found alive later is still it.
+    pub started: String,
 }
 
 /// Manages live `az network bastion tunnel` processes, keyed by stable TunnelId.
 pub struct TunnelManager {
-    tx: UnboundedSender<BgEvent>,
+    bus: Bus,
     running: HashMap<TunnelId, Running>,
+    /// Bastion hosts that passed the pre-flight check; not asked again.
+    bastions_ok: Arc<Mutex<HashSet<String>>>,
+    stop_timeout: Duration,
+    /// Where per-tunnel log files go, when `log_files` is on.
+    log_dir: Option<PathBuf>,
+    log_lines: usize,
 }
 
 impl TunnelManager {
-    pub fn new(tx: UnboundedSender<BgEvent>) -> Self {
+    pub fn new(bus: impl Into<Bus>) -> Self {
         Self {
-            tx,
+            bus: bus.into(),
             running: HashMap::new(),
+            bastions_ok: Arc::default(),
+            stop_timeout: DEFAULT_STOP_TIMEOUT,
+            log_dir: None,
+            log_lines: DEFAULT_LOG_LINES,
         }
     }
 
-    #[allow(dead_code)]
+    /// Give a stopping tunnel `timeout` to exit before it is killed.
+    pub fn with_stop_timeout(mut self, timeout: Duration) -> Self {
+        self.stop_timeout = timeout;
+        self
+    }
+
+    /// Mirror every tunnel's output to a rotated log file in `dir`.
+    pub fn with_log_dir(mut self, dir: Option<PathBuf>) -> Self {
+        self.log_dir = dir;
+        self
+    }
+
+    /// Keep the last `lines` lines of each tunnel's output in memory.
+    pub fn with_log_lines(mut self, lines: usize) -> Self {
+        self.log_lines = lines;
+        self
+    }
+
+    /// A fresh buffer for `tunnel`, writing through to its log file if log
+    /// files are on. A file that can't be opened only costs the mirror.
+    fn log_buffer(&self, tunnel: &Tunnel) -> LogBuffer {
+        let file = self
+            .log_dir
+            .as_deref()
+            .and_then(|dir| LogFile::open(tunnel_log::path_for(dir, tunnel)).ok());
+        LogBuffer::new(self.log_lines, file)
+    }
+
     pub fn is_running(&self, id: TunnelId) -> bool {
         self.running.contains_key(&id)
     }
 
-    pub fn logs(&self, id: TunnelId) -> Vec<String> {
+    pub fn logs(&self, id: TunnelId) -> Vec<LogLine> {
         match self.running.get(&id) {
-            Some(r) => r.logs.lock().unwrap().clone(),
-            None => vec!["Tunnel not running".to_string()],
+            Some(r) => r.logs.lock().unwrap().read(),
+            None => vec![LogLine {
+                at: Local::now(),
+                severity: Severity::Info,
+                text: "Tunnel not running".to_string(),
+            }],
         }
     }
 
     /// Spawn the az tunnel process and its output-monitor task.
     ///
+    /// A tunnel that goes on over SSH (a SOCKS proxy or a host behind a jump
+    /// VM) runs in two stages through Bastion: az opens a Bastion tunnel to
+    /// the machine's SSH port on a spare local port, then `ssh -D`/`-L`
+    /// serves the tunnel's local port through it. The monitor treats the pair
+    /// as one tunnel: either exiting takes the other down and ends it.
+    ///
     /// # Cleanup contract
     ///
     /// The monitor task does **not** remove its own entry from `self.running` on
@@ -83,32 +565,41 @@ impl TunnelManager {
     /// natural exit, [`TunnelManager::is_running`] therefore still returns
     /// `true` and a second call to `start` for the same `id` would be
     /// rejected.  The consuming `App` must call [`TunnelManager::stop(id)`]
-    /// when it receives [`BgEvent::TunnelExited`] to free the slot and allow
-    /// a restart.
+    /// when it receives [`BgEvent::TunnelExited`] or
+    /// [`BgEvent::TunnelStopped`] to free the slot and allow a restart.
     pub fn start(&mut self, tunnel: &Tunnel) -> color_eyre::Result<()> {
         let id = tunnel.id;
         if self.running.contains_key(&id) {
             return Err(color_eyre::eyre::eyre!("tunnel already running"));
         }
 
-        let mut cmd = super::az_command();
-        cmd.arg("network").arg("bastion").arg("tunnel");
-        // Omit --subscription when blank (spec decision).
-        if !tunnel.machine.bastion_subscription.is_empty() {
-            cmd.arg("--subscription")
-                .arg(&tunnel.machine.bastion_subscription);
-        }
-        cmd.arg("--resource-group")
-            .arg(&tunnel.machine.bastion_resource_group)
-            .arg("--name")
-            .arg(&tunnel.machine.bastion_name)
-            .arg("--target-resource-id")
-            .arg(&tunnel.machine.target_resource_id)
-            .arg("--resource-port")
-            .arg(&tunnel.remote_port)
-            .arg("--port")
-            .arg(&tunnel.local_port)
-            .stdout(Stdio::piped())
+        let bastion_port = match (&tunnel.ssh, tunnel.machine.target_type) {
+            (Some(_), TargetType::Vm | TargetType::Vmss) => Some(free_port()?),
+            _ => None,
+        };
+        // az only listens on loopback: a relay takes the bind address, in
+        // front of az on a free port.
+        let relay_to = if needs_relay(tunnel) {
+            let spec = tunnel.listen_spec();
+            let listener = std::net::TcpListener::bind(&spec)
+                .and_then(|l| l.set_nonblocking(true).map(|()| l))
+                .and_then(TcpListener::from_std)
+                .map_err(|e| color_eyre::eyre::eyre!("can't listen on {spec}: {e}"))?;
+            Some((listener, free_port()?))
+        } else {
+            None
+        };
+        let az_port = bastion_port
+            .clone()
+            .or_else(|| relay_to.as_ref().map(|(_, port)| port.clone()));
+        let mut cmd = match &az_port {
+            Some(port) => tunnel_command(&Tunnel {
+                local_port: port.clone(),
+                ..tunnel.clone()
+            }),
+            None => tunnel_command(tunnel),
+        };
+        cmd.stdout(Stdio::piped())
             .stderr(Stdio::piped())
             .kill_on_drop(true);
 
@@ -125,64 +616,494 @@ impl TunnelManager {
         // az-burrow still tears down the tunnel tree and frees the port.
         crate::azure::cleanup::register_child(&child);
         let pid = child.id();
-        let logs = Arc::new(Mutex::new(Vec::<String>::new()));
+        let mut buffer = self.log_buffer(tunnel);
+        if let Some(file) = &mut buffer.file {
+            for line in command_lines(tunnel) {
+                file.write_line(&format!("[CMD] {line}"));
+            }
+        }
+        let logs = Arc::new(Mutex::new(buffer));
         let cancel = CancellationToken::new();
+        let detach = CancellationToken::new();
 
-        let _ = self.tx.send(BgEvent::TunnelStatus {
+        self.bus.publish(BgEvent::TunnelStatus {
             id,
             status: TunnelStatus::Connecting,
         });
+        if tunnel.machine.target_type != TargetType::Arc {
+            self.check_bastion(tunnel);
+        }
+        if super::vm::has_power_state(&tunnel.machine) {
+            self.check_power_state(&tunnel.machine);
+        }
+        // ssh forwarding prints nothing once it's up, so watch the port.
+        if tunnel.machine.target_type == TargetType::Arc {
+            watch_port(&self.bus, &cancel, id, &tunnel.local_addr());
+        }
+        // The SSH stage starts once the Bastion stage listens.
+        let (stage_tx, mut stage_rx) = tokio::sync::oneshot::channel();
+        if let Some(port) = bastion_port.clone() {
+            tokio::spawn(async move {
+                let ready = wait_until_ready(&ReadyCheck::Tcp, &format!("127.0.0.1:{port}")).await;
+                let _ = stage_tx.send(ready);
+            });
+        }
+        let stage = bastion_port.map(|port| (tunnel.clone(), port));
+        let ready_hints = stage.is_none();
+        let watch = (self.bus.clone(), cancel.clone());
 
         let stdout = child.stdout.take();
         let stderr = child.stderr.take();
-        let tx = self.tx.clone();
+        let bus = self.bus.clone();
         let logs_task = logs.clone();
         let cancel_task = cancel.clone();
+        let detach_task = detach.clone();
+        let done = CancellationToken::new();
+        let done_task = done.clone();
+        let relayed = relay_to.is_some();
+        if let Some((listener, port)) = relay_to {
+            tokio::spawn(relay(listener, format!("127.0.0.1:{port}"), done.clone()));
+        }
+        let stop_timeout = self.stop_timeout;
 
         tokio::spawn(async move {
             let mut out_lines = stdout.map(|s| BufReader::new(s).lines());
             let mut err_lines = stderr.map(|s| BufReader::new(s).lines());
+            let mut awaiting_stage = stage.is_some();
+            let mut ssh: Option<tokio::process::Child> = None;
+            let mut ssh_lines = None;
+            // Why we brought az down ourselves, if we did.
+            let mut stage_error: Option<String> = None;
 
             loop {
                 tokio::select! {
-                    _ = cancel_task.cancelled() => break,
+                    _ = cancel_task.cancelled() => {
+                        // SIGTERM reaches ssh too: it shares az's group.
+                        let forced = match pid {
+                            Some(pid) => stop_process_group(pid, async { let _ = child.wait().await; }, stop_timeout).await,
+                            None => false,
+                        };
+                        if forced {
+                            logs_task.lock().unwrap().push(Severity::Error, forced_stop_line(stop_timeout));
+                            // `done` promises the process is gone, as far as
+                            // a kill can make it.
+                            let _ = tokio::time::timeout(stop_timeout, child.wait()).await;
+                        }
+                        done_task.cancel();
+                        bus.publish(BgEvent::TunnelStopped { id, forced });
+                        break;
+                    }
+                    _ = detach_task.cancelled() => {
+                        // Leave az running: forgetting the handle skips
+                        // kill_on_drop. Its process group outlives us.
+                        drain_after_detach(out_lines.take(), pid);
+                        drain_after_detach(err_lines.take(), pid);
+                        drain_after_detach(ssh_lines.take(), pid);
+                        std::mem::forget(child);
+                        std::mem::forget(ssh);
+                        break;
+                    }
                     line = read_opt(&mut out_lines) => {
                         match line {
-                            Some(line) => handle_line(&tx, &logs_task, id, format!("[OUT] {line}"), &line, false),
+                            Some(line) => handle_line(&bus, &logs_task, id, format!("[OUT] {line}"), &line, false, ready_hints),
                             None => out_lines = None,
                         }
                     }
                     line = read_opt(&mut err_lines) => {
                         match line {
-                            Some(line) => handle_line(&tx, &logs_task, id, line.clone(), &line, true),
+                            Some(line) => handle_line(&bus, &logs_task, id, line.clone(), &line, true, ready_hints),
                             None => err_lines = None,
                         }
                     }
+                    ready = &mut stage_rx, if awaiting_stage => {
+                        awaiting_stage = false;
+                        let (tunnel, port) = stage.as_ref().expect("set while awaiting_stage");
+                        let fwd = tunnel.ssh.as_ref().expect("two-stage tunnels go on over SSH");
+                        let spawned = match ready {
+                            Ok(Ok(())) => ssh_stage_command(tunnel, fwd, port, pid).spawn().map_err(|e| format!("failed to start ssh: {e}")),
+                            Ok(Err(e)) => Err(format!("Bastion tunnel never opened: {e}")),
+                            Err(_) => Err("Bastion tunnel never opened".to_string()),
+                        };
+                        match spawned {
+                            Ok(mut c) => {
+                                crate::azure::cleanup::register_child(&c);
+                                ssh_lines = c.stderr.take().map(|s| BufReader::new(s).lines());
+                                ssh = Some(c);
+                                watch_port(&watch.0, &watch.1, id, &tunnel.local_addr());
+                            }
+                            Err(e) => {
+                                stage_error = Some(e);
+                                kill_az(pid);
+                            }
+                        }
+                    }
+                    line = read_opt(&mut ssh_lines) => {
+                        match line {
+                            Some(line) => handle_line(&bus, &logs_task, id, format!("[SSH] {line}"), &line, true, true),
+                            None => ssh_lines = None,
+                        }
+                    }
+                    status = wait_opt(&mut ssh) => {
+                        ssh = None;
+                        stage_error = Some(match status {
+                            Ok(s) => format!("ssh through the machine exited: {s}"),
+                            Err(e) => format!("ssh through the machine failed: {e}"),
+                        });
+                        kill_az(pid);
+                    }
                     status = child.wait() => {
-                        drain_remaining(&mut out_lines, &tx, &logs_task, id, false).await;
-                        drain_remaining(&mut err_lines, &tx, &logs_task, id, true).await;
-                        let err = match status {
+                        drain_remaining(&mut out_lines, &bus, &logs_task, id, false, ready_hints).await;
+                        drain_remaining(&mut err_lines, &bus, &logs_task, id, true, ready_hints).await;
+                        drain_remaining(&mut ssh_lines, &bus, &logs_task, id, true, true).await;
+                        let err = stage_error.take().or(match status {
                             Ok(s) if s.success() => None,
                             Ok(s) => Some(format!("tunnel process exited: {s}")),
                             Err(e) => Some(format!("tunnel process error: {e}")),
-                        };
+                        });
                         if let Some(ref e) = err {
-                            push_log(&mut logs_task.lock().unwrap(), format!("[ERR] Process exited: {e}"));
+                            logs_task.lock().unwrap().push(Severity::Error, format!("[ERR] Process exited: {e}"));
                         }
-                        let _ = tx.send(BgEvent::TunnelExited { id, error: err });
+                        done_task.cancel();
+                        bus.publish(BgEvent::TunnelExited { id, error: err });
                         break;
                     }
                 }
             }
         });
 
-        self.running.insert(id, Running { cancel, pid, logs });
+        self.running.insert(
+            id,
+            Running {
+                cancel,
+                done,
+                detach,
+                pid,
+                started: None,
+                relayed,
+                logs,
+            },
+        );
         Ok(())
     }
 
-    /// Stop a tunnel: cancel its monitor task and kill the process group.
+    /// Ask az which account and subscription it is signed in to, answering
+    /// with [`BgEvent::Account`].
+    pub fn fetch_account(&self) {
+        let bus = self.bus.clone();
+        tokio::spawn(async move {
+            let out = super::az_command()
+                .args([
+                    "account",
+                    "show",
+                    "--query",
+                    "[user.name, name]",
+                    "-o",
+                    "tsv",
+                ])
+                .output()
+                .await;
+            let result = match out {
+                Ok(o) if o.status.success() => {
+                    super::parse::parse_account(&String::from_utf8_lossy(&o.stdout))
+                        .ok_or_else(|| "az account show printed nothing".to_string())
+                }
+                Ok(o) => Err(String::from_utf8_lossy(&o.stderr).trim().to_string()),
+                Err(e) => Err(e.to_string()),
+            };
+            bus.publish(BgEvent::Account { result });
+        });
+    }
+
+    /// Have az refresh its access token if it is due, answering with
+    /// [`BgEvent::Token`].
+    pub fn refresh_token(&self) {
+        let bus = self.bus.clone();
+        tokio::spawn(async move {
+            let result = super::token::refresh().await;
+            bus.publish(BgEvent::Token { result });
+        });
+    }
+
+    /// Check the tunnel's Bastion host alongside the tunnel itself, reporting
+    /// [`BgEvent::BastionChecked`]. Hosts that failed are asked again next
+    /// time, in case they have been fixed since.
+    fn check_bastion(&self, tunnel: &Tunnel) {
+        let key = super::bastion::key(&tunnel.machine);
+        if self.bastions_ok.lock().unwrap().contains(&key) {
+            return;
+        }
+        let bus = self.bus.clone();
+        let ok = self.bastions_ok.clone();
+        let machine = tunnel.machine.clone();
+        tokio::spawn(async move {
+            let Ok(problem) = super::bastion::check(&machine).await else {
+                return;
+            };
+            if problem.is_none() {
+                ok.lock().unwrap().insert(key.clone());
+            }
+            bus.publish(BgEvent::BastionChecked {
+                bastion: key,
+                problem,
+            });
+        });
+    }
+
+    /// Sign in to az with a device code in the background, publishing
+    /// [`BgEvent::DeviceCode`] once az has one and [`BgEvent::LoggedIn`] when
+    /// it is done. Cancelling the returned token gives up.
+    pub fn device_login(&self) -> CancellationToken {
+        let bus = self.bus.clone();
+        let cancel = CancellationToken::new();
+        let token = cancel.clone();
+        tokio::spawn(async move {
+            let prompt = bus.clone();
+            let result =
+                super::login::device_code(|code| prompt.publish(BgEvent::DeviceCode(code)), token)
+                    .await;
+            bus.publish(BgEvent::LoggedIn { result });
+        });
+        cancel
+    }
+
+    /// Ask for a VM's power state in the background, answering with
+    /// [`BgEvent::PowerState`].
+    pub fn check_power_state(&self, machine: &Machine) {
+        let bus = self.bus.clone();
+        let machine = machine.clone();
+        tokio::spawn(async move {
+            let result = super::vm::power_state(&machine).await;
+            bus.publish(BgEvent::PowerState {
+                machine: machine.name,
+                result,
+            });
+        });
+    }
+
+    /// Ask for a VM's size, OS and private IP in the background, answering
+    /// with [`BgEvent::VmInfo`].
+    pub fn fetch_vm_info(&self, machine: &Machine) {
+        let bus = self.bus.clone();
+        let machine = machine.clone();
+        tokio::spawn(async move {
+            let result = super::vm::info(&machine).await;
+            bus.publish(BgEvent::VmInfo {
+                machine: machine.name,
+                result,
+            });
+        });
+    }
+
+    /// Start or deallocate a VM in the background, answering with
+    /// [`BgEvent::PowerChanged`] and then, if it went through, the
+    /// [`BgEvent::PowerState`] it ended up in.
+    pub fn set_power(&self, machine: &Machine, action: PowerAction) {
+        let bus = self.bus.clone();
+        let machine = machine.clone();
+        tokio::spawn(async move {
+            let result = super::vm::set_power(&machine, action).await;
+            let changed = result.is_ok();
+            bus.publish(BgEvent::PowerChanged {
+                machine: machine.name.clone(),
+                action,
+                result,
+            });
+            if changed {
+                let result = super::vm::power_state(&machine).await;
+                bus.publish(BgEvent::PowerState {
+                    machine: machine.name,
+                    result,
+                });
+            }
+        });
+    }
+
+    /// Reattach to a tunnel process left running by a previous detached
+    /// session. Its output pipes went away with that session, so no logs are
+    /// captured; a watcher polls the PID and reports [`BgEvent::TunnelExited`]
+    /// once it is gone. [`TunnelManager::stop`] kills it like any other tunnel.
+    pub fn adopt(&mut self, tunnel: &Tunnel, detached: Detached) {
+        let Detached { pid, started } = detached;
+        let known_start = started.clone();
+        let id = tunnel.id;
+        if self.running.contains_key(&id) {
+            return;
+        }
+        let mut buffer = self.log_buffer(tunnel);
+        buffer.push(
+            Severity::Info,
+            format!(
+                "[OUT] Reattached to detached tunnel (pid {pid}); earlier output is unavailable"
+            ),
+        );
+        let logs = Arc::new(Mutex::new(buffer));
+        let cancel = CancellationToken::new();
+        let detach = CancellationToken::new();
+        let bus = self.bus.clone();
+        let cancel_task = cancel.clone();
+        let detach_task = detach.clone();
+        let done = CancellationToken::new();
+        let done_task = done.clone();
+        let logs_task = logs.clone();
+        let stop_timeout = self.stop_timeout;
+
+        tokio::spawn(async move {
+            loop {
+                tokio::select! {
+                    _ = cancel_task.cancelled() => {
+                        // Not our child, so there is no exit to wait on.
+                        let exited = async {
+                            while is_same_process(pid, &started) {
+                                tokio::time::sleep(STOP_POLL_INTERVAL).await;
+                            }
+                        };
+                        let forced = stop_process_group(pid, exited, stop_timeout).await;
+                        if forced {
+                            logs_task.lock().unwrap().push(Severity::Error, forced_stop_line(stop_timeout));
+                        }
+                        done_task.cancel();
+                        bus.publish(BgEvent::TunnelStopped { id, forced });
+                        break;
+                    }
+                    _ = detach_task.cancelled() => break,
+                    _ = tokio::time::sleep(ADOPT_POLL_INTERVAL) => {
+                        if !is_same_process(pid, &started) {
+                            done_task.cancel();
+                            bus.publish(BgEvent::TunnelExited { id, error: None });
+                            break;
+                        }
+                    }
+                }
+            }
+        });
+
+        self.running.insert(
+            id,
+            Running {
+                cancel,
+                done,
+                detach,
+                pid: Some(pid),
+                started: Some(known_start),
+                relayed: false,
+                logs,
+            },
+        );
+    }
+
+    /// Stop a tunnel without waiting for it: its monitor asks the process
+    /// group to exit, kills it if it is still there after the stop timeout
+    /// (noting that in its logs), and reports [`BgEvent::TunnelStopped`].
+    /// Until then the tunnel counts as running, so it can't be restarted
+    /// onto a port that is still held. Once the process is gone (that event,
+    /// or [`BgEvent::TunnelExited`]), `stop` releases the tunnel.
     pub fn stop(&mut self, id: TunnelId) {
-        if let Some(r) = self.running.remove(&id) {
+        match self.running.get(&id) {
+            Some(r) if r.done.is_cancelled() => {
+                self.running.remove(&id);
+            }
+            Some(r) => r.cancel.cancel(),
+            None => {}
+        }
+    }
+
+    /// Run `check` against a dependency listening on `local_addr` in the
+    /// background, reporting [`BgEvent::TunnelReady`] for the waiting tunnel `id`.
+    pub fn probe_ready(&self, id: TunnelId, check: ReadyCheck, local_addr: String) {
+        let bus = self.bus.clone();
+        tokio::spawn(async move {
+            let result = wait_until_ready(&check, &local_addr).await;
+            bus.publish(BgEvent::TunnelReady { id, result });
+        });
+    }
+
+    /// Check that the active `tunnel` still gets through, reporting
+    /// [`BgEvent::TunnelHealth`].
+    pub fn probe_health(&self, tunnel: &Tunnel) {
+        let bus = self.bus.clone();
+        let id = tunnel.id;
+        let local_addr = tunnel.local_addr();
+        // Through an ssh stage the local port is a forward, not sshd.
+        let ssh = tunnel.ssh.is_none() && tunnel.remote_port == "22";
+        tokio::spawn(async move {
+            let result = probe_health(&local_addr, ssh).await;
+            bus.publish(BgEvent::TunnelHealth { id, result });
+        });
+    }
+
+    /// Write the kubeconfig for the AKS cluster tunnel `id` reaches on
+    /// `local_port` in the background, answering with
+    /// [`BgEvent::KubeconfigWritten`].
+    pub fn write_kubeconfig(&self, id: TunnelId, cluster: AksCluster, local_port: String) {
+        let bus = self.bus.clone();
+        tokio::spawn(async move {
+            let result = super::aks::write_kubeconfig(&cluster, &local_port).await;
+            bus.publish(BgEvent::KubeconfigWritten { id, result });
+        });
+    }
+
+    /// Fetch the instance IDs of a scale set in the background, answering
+    /// with [`BgEvent::ScaleSetInstances`] for `machine`.
+    pub fn list_scale_set_instances(
+        &self,
+        machine: String,
+        resource_group: String,
+        scale_set: String,
+    ) {
+        let bus = self.bus.clone();
+        tokio::spawn(async move {
+            let out = super::az_command()
+                .args([
+                    "vmss",
+                    "list-instances",
+                    "-g",
+                    &resource_group,
+                    "-n",
+                    &scale_set,
+                ])
+                .args(["--query", "[].instanceId", "-o", "tsv"])
+                .output()
+                .await;
+            let result = match out {
+                Ok(o) if o.status.success() => Ok(String::from_utf8_lossy(&o.stdout)
+                    .lines()
+                    .map(str::trim)
+                    .filter(|l| !l.is_empty())
+                    .map(String::from)
+                    .collect()),
+                Ok(o) => Err(String::from_utf8_lossy(&o.stderr).trim().to_string()),
+                Err(e) => Err(e.to_string()),
+            };
+            bus.publish(BgEvent::ScaleSetInstances { machine, result });
+        });
+    }
+
+    /// Release every live tunnel without killing it, returning the PIDs to
+    /// record for reattaching on the next launch. Tunnels without a PID can't
+    /// be found again, and a relayed tunnel's `bind_address` would stop
+    /// answering, so those are stopped instead.
+    pub fn detach_all(&mut self) -> HashMap<TunnelId, Detached> {
+        let mut detached = HashMap::new();
+        for (id, r) in self.running.drain() {
+            // One whose start time can't be read couldn't be told from a
+            // stranger with its PID later.
+            let started = |pid| r.started.clone().or_else(|| start_time(pid));
+            let pid = r.pid.filter(|_| !r.relayed);
+            match pid.and_then(|pid| Some((pid, started(pid)?))) {
+                Some((pid, started)) => {
+                    r.detach.cancel();
+                    detached.insert(id, Detached { pid, started });
+                }
+                None => r.cancel.cancel(),
+            }
+        }
+        detached
+    }
+
+    /// Kill every live tunnel at once, without the grace period of
+    /// [`TunnelManager::stop`] (called on quit and from the panic hook).
+    pub fn stop_all(&mut self) {
+        for (_, r) in self.running.drain() {
             r.cancel.cancel();
             if let Some(pid) = r.pid {
                 kill_process_group(pid);
@@ -190,12 +1111,52 @@ impl TunnelManager {
         }
     }
 
-    /// Kill every live tunnel (called on quit and from the panic hook).
-    pub fn stop_all(&mut self) {
-        let ids: Vec<TunnelId> = self.running.keys().copied().collect();
-        for id in ids {
-            self.stop(id);
+    /// Kill every live tunnel concurrently, giving each the stop timeout to
+    /// be seen exiting, and call `on_progress` once up front and again as
+    /// each one finishes. Returns the tunnels (and PIDs) still there at the
+    /// timeout. The running set is taken over first, so nothing can change
+    /// under it.
+    pub async fn stop_all_with_progress(
+        &mut self,
+        mut on_progress: impl FnMut(StopProgress),
+    ) -> Vec<(TunnelId, u32)> {
+        let timeout = self.stop_timeout;
+        let mut kills: futures::stream::FuturesUnordered<_> = self
+            .running
+            .drain()
+            .map(|(id, r)| {
+                r.cancel.cancel();
+                async move {
+                    let pid = r.pid?;
+                    // The monitor reaps the process, then fires `done`.
+                    let gone = async {
+                        let _ = tokio::task::spawn_blocking(move || kill_process_group(pid)).await;
+                        r.done.cancelled().await;
+                    };
+                    match tokio::time::timeout(timeout, gone).await {
+                        Ok(()) => None,
+                        Err(_) => Some((id, pid)),
+                    }
+                }
+            })
+            .collect();
+        let mut progress = StopProgress {
+            done: 0,
+            total: kills.len(),
+            timed_out: 0,
+        };
+        on_progress(progress);
+        let mut left = Vec::new();
+        while let Some(leftover) = futures::StreamExt::next(&mut kills).await {
+            progress.done += 1;
+            if let Some(leftover) = leftover {
+                progress.timed_out += 1;
+                left.push(leftover);
+            }
+            on_progress(progress);
         }
+        left.sort_by_key(|(id, _)| id.0);
+        left
     }
 }
 
@@ -204,10 +1165,11 @@ impl TunnelManager {
 /// pipes to EOF independently of cmd.Wait).
 async fn drain_remaining<R: AsyncBufReadExt + Unpin>(
     lines: &mut Option<tokio::io::Lines<R>>,
-    tx: &UnboundedSender<BgEvent>,
-    logs: &Arc<Mutex<Vec<String>>>,
+    bus: &Bus,
+    logs: &Arc<Mutex<LogBuffer>>,
     id: TunnelId,
     is_stderr: bool,
+    ready_hints: bool,
 ) {
     if let Some(l) = lines {
         while let Ok(Some(line)) = l.next_line().await {
@@ -216,11 +1178,21 @@ async fn drain_remaining<R: AsyncBufReadExt + Unpin>(
             } else {
                 format!("[OUT] {line}")
             };
-            handle_line(tx, logs, id, stored, &line, is_stderr);
+            handle_line(bus, logs, id, stored, &line, is_stderr, ready_hints);
         }
     }
 }
 
+/// Wait for an optional child to exit, or never-resolve if absent.
+async fn wait_opt(
+    child: &mut Option<tokio::process::Child>,
+) -> std::io::Result<std::process::ExitStatus> {
+    match child {
+        Some(c) => c.wait().await,
+        None => std::future::pending().await,
+    }
+}
+
 /// Read the next line from an optional line stream, or never-resolve if absent.
 async fn read_opt<R: AsyncBufReadExt + Unpin>(
     lines: &mut Option<tokio::io::Lines<R>>,
@@ -234,28 +1206,31 @@ async fn read_opt<R: AsyncBufReadExt + Unpin>(
     }
 }
 
+/// Log one line of output and report what it says about the tunnel's status.
+/// `ready_hints` is off for the Bastion stage of a two-stage tunnel, which
+/// isn't up until ssh is.
 fn handle_line(
-    tx: &UnboundedSender<BgEvent>,
-    logs: &Arc<Mutex<Vec<String>>>,
+    bus: &Bus,
+    logs: &Arc<Mutex<LogBuffer>>,
     id: TunnelId,
     stored: String,
     raw: &str,
     is_stderr: bool,
+    ready_hints: bool,
 ) {
-    push_log(&mut logs.lock().unwrap(), stored.clone());
-    let _ = tx.send(BgEvent::TunnelLog { id, line: stored });
-    if let Some(hint) = classify_status(raw) {
-        let status = match hint {
-            StatusHint::Active => TunnelStatus::Active,
-            StatusHint::Connecting => TunnelStatus::Connecting,
-        };
-        let _ = tx.send(BgEvent::TunnelStatus { id, status });
+    let mut buf = logs.lock().unwrap();
+    if buf.push(severity_of(raw), stored) {
+        bus.publish(BgEvent::TunnelLog { id });
     }
-    if is_stderr && is_error_line(raw) {
-        let _ = tx.send(BgEvent::TunnelStatus {
-            id,
-            status: TunnelStatus::Error(raw.to_string()),
-        });
+    let hint = classify_status(raw).and_then(|hint| match hint {
+        StatusHint::Active => ready_hints.then_some(TunnelStatus::Active),
+        StatusHint::Connecting => Some(TunnelStatus::Connecting),
+    });
+    let error = (is_stderr && is_error_line(raw)).then(|| TunnelStatus::Error(raw.to_string()));
+    for status in [hint, error].into_iter().flatten() {
+        if buf.status_changed(&status) {
+            bus.publish(BgEvent::TunnelStatus { id, status });
+        }
     }
 }
 
@@ -263,15 +1238,79 @@ fn handle_line(
 mod tests {
     use super::*;
 
+    #[cfg(unix)]
+    #[tokio::test]
+    async fn detached_processes_can_still_write_once_let_go() {
+        let mut child = tokio::process::Command::new("sh")
+            .args(["-c", "sleep 0.5; echo still here; echo still here >&2"])
+            .stdout(Stdio::piped())
+            .stderr(Stdio::piped())
+            .process_group(0)
+            .spawn()
+            .unwrap();
+        let pid = child.id();
+        drain_after_detach(child.stdout.take().map(|s| BufReader::new(s).lines()), pid);
+        drain_after_detach(child.stderr.take().map(|s| BufReader::new(s).lines()), pid);
+        // Without a reader the echoes would die of SIGPIPE.
+        assert!(child.wait().await.unwrap().success());
+    }
+
     #[test]
     fn ring_buffer_caps_at_100() {
-        let mut logs: Vec<String> = Vec::new();
+        let mut buf = LogBuffer::default();
         for i in 0..150 {
-            push_log(&mut logs, format!("line {i}"));
+            buf.push(Severity::Info, format!("line {i}"));
         }
+        let logs = buf.read();
         assert_eq!(logs.len(), 100);
-        assert_eq!(logs.first().unwrap(), "line 50");
-        assert_eq!(logs.last().unwrap(), "line 149");
+        assert_eq!(logs.first().unwrap().text, "line 50");
+        assert_eq!(logs.last().unwrap().text, "line 149");
+    }
+
+    #[test]
+    fn ring_buffer_keeps_the_configured_number_of_lines() {
+        let mut buf = LogBuffer::new(1000, None);
+        for i in 0..1500 {
+            buf.push(Severity::Info, format!("line {i}"));
+        }
+        let logs = buf.read();
+        assert_eq!(logs.len(), 1000);
+        assert_eq!(logs.first().unwrap().text, "line 500");
+
+        // Zero would keep nothing; a buffer always holds the latest line.
+        let mut buf = LogBuffer::new(0, None);
+        buf.push(Severity::Info, "first".into());
+        buf.push(Severity::Info, "second".into());
+        assert_eq!(buf.read().len(), 1);
+    }
+
+    #[test]
+    fn chatty_output_queues_one_event_until_read() {
+        let bus = Bus::new();
+        let mut rx = bus.subscribe();
+        let logs = Arc::new(Mutex::new(LogBuffer::default()));
+        for i in 0..1000 {
+            let line = format!("Tunnel is ready, connect on port 2022 ({i})");
+            handle_line(&bus, &logs, TunnelId(1), line.clone(), &line, false, true);
+        }
+        let mut events = Vec::new();
+        while let Ok(e) = rx.try_recv() {
+            events.push(e);
+        }
+        assert_eq!(events.len(), 2, "one log batch and one status: {events:?}");
+
+        assert_eq!(logs.lock().unwrap().read().len(), 100);
+        handle_line(&bus, &logs, TunnelId(1), "more".into(), "more", false, true);
+        assert!(matches!(rx.try_recv(), Ok(BgEvent::TunnelLog { .. })));
+    }
+
+    #[test]
+    fn long_lines_are_truncated() {
+        let mut buf = LogBuffer::default();
+        buf.push(Severity::Info, "é".repeat(MAX_LINE_LEN));
+        let line = &buf.read()[0].text;
+        assert!(line.len() <= MAX_LINE_LEN + '…'.len_utf8());
+        assert!(line.ends_with('…'));
     }
 
     #[test]
@@ -287,6 +1326,288 @@ mod tests {
         assert_eq!(classify_status("nothing interesting"), None);
     }
 
+    #[test]
+    fn lines_are_tagged_with_severity_as_captured() {
+        let bus = Bus::new();
+        let logs = Arc::new(Mutex::new(LogBuffer::default()));
+        for line in [
+            "Opening tunnel on port: 2022",
+            "WARNING: This command is in preview",
+            "ERROR: Bastion host not found",
+        ] {
+            handle_line(&bus, &logs, TunnelId(1), line.into(), line, true, true);
+        }
+        let severities: Vec<Severity> = logs
+            .lock()
+            .unwrap()
+            .read()
+            .iter()
+            .map(|l| l.severity)
+            .collect();
+        assert_eq!(
+            severities,
+            [Severity::Info, Severity::Warning, Severity::Error]
+        );
+    }
+
+    fn tunnel_for(target_type: TargetType, target_resource_id: &str) -> Tunnel {
+        Tunnel {
+            id: TunnelId(1),
+            machine: crate::model::Machine {
+                resource_group: "ARC-RG".into(),
+                target_resource_id: target_resource_id.into(),
+                target_type,
+                bastion_name: "bastion".into(),
+                bastion_resource_group: "HUB".into(),
+                ..crate::model::Machine::test("onprem-01")
+            },
+            local_port: "2022".into(),
+            remote_port: "22".into(),
+            status: TunnelStatus::Inactive,
+            cert_status: None,
+            cert_expires_in: None,
+            name: None,
+            depends: None,
+            group: None,
+            instance: None,
+            hooks: Default::default(),
+            color: None,
+            icon: None,
+            ssh: None,
+            aks: None,
+            database: None,
+            note: None,
+            bind_address: None,
+        }
+    }
+
+    fn args_of(tunnel: &Tunnel) -> Vec<String> {
+        tunnel_command(tunnel)
+            .as_std()
+            .get_args()
+            .map(|a| a.to_string_lossy().into_owned())
+            .collect()
+    }
+
+    fn args_for(target_type: TargetType, target_resource_id: &str) -> Vec<String> {
+        args_of(&tunnel_for(target_type, target_resource_id))
+    }
+
+    #[test]
+    fn vm_targets_use_a_bastion_tunnel() {
+        let args = args_for(TargetType::Vm, "/subs/x/virtualMachines/vm");
+        let joined = args.join(" ");
+        assert!(joined.contains("network bastion tunnel"));
+        assert!(joined.contains("--target-resource-id /subs/x/virtualMachines/vm"));
+        assert!(joined.contains("--resource-port 22 --port 2022"));
+    }
+
+    #[test]
+    fn ip_targets_use_bastion_ip_connect() {
+        let mut tunnel = tunnel_for(TargetType::Vm, "");
+        tunnel.machine.target_ip = Some("10.1.0.4".into());
+        let joined = args_of(&tunnel).join(" ");
+        assert!(joined.contains("--target-ip-address 10.1.0.4"));
+        assert!(!joined.contains("--target-resource-id"));
+    }
+
+    #[test]
+    fn arc_targets_forward_through_az_ssh_arc() {
+        let joined = args_for(TargetType::Arc, "").join(" ");
+        assert!(joined.contains("ssh arc --resource-group ARC-RG --name onprem-01"));
+        assert!(joined.contains("-- -N -L 2022:localhost:22"));
+        assert!(!joined.contains("bastion"));
+
+        let joined = args_for(TargetType::Arc, "/subs/x/machines/onprem-01").join(" ");
+        assert!(joined.contains("--resource-id /subs/x/machines/onprem-01"));
+    }
+
+    #[test]
+    fn bind_addresses_go_to_ssh_or_through_a_relay() {
+        let mut tunnel = tunnel_for(TargetType::Arc, "");
+        tunnel.bind_address = Some("0.0.0.0".parse().unwrap());
+        assert!(args_of(&tunnel)
+            .join(" ")
+            .contains("-N -L 0.0.0.0:2022:localhost:22"));
+        assert_eq!(tunnel.local_addr(), "127.0.0.1:2022");
+        tunnel.bind_address = Some("::".parse().unwrap());
+        assert_eq!(tunnel.listen_spec(), "[::]:2022");
+
+        // az can't bind elsewhere: it listens on a free port behind a relay.
+        tunnel.machine.target_type = TargetType::Vm;
+        assert!(needs_relay(&tunnel));
+        assert!(command_lines(&tunnel)[0].ends_with("--port <free-port>"));
+        tunnel.bind_address = Some("127.0.0.1".parse().unwrap());
+        assert!(!needs_relay(&tunnel));
+    }
+
+    #[tokio::test]
+    async fn relay_passes_connections_through_until_done() {
+        use tokio::io::{AsyncReadExt, AsyncWriteExt};
+        let backend = TcpListener::bind("127.0.0.1:0").await.unwrap();
+        let target = backend.local_addr().unwrap().to_string();
+        tokio::spawn(async move {
+            let (mut conn, _) = backend.accept().await.unwrap();
+            let (mut r, mut w) = conn.split();
+            let _ = tokio::io::copy(&mut r, &mut w).await;
+        });
+        let front = TcpListener::bind("127.0.0.1:0").await.unwrap();
+        let addr = front.local_addr().unwrap();
+        let done = CancellationToken::new();
+        let relaying = tokio::spawn(relay(front, target, done.clone()));
+
+        let mut client = TcpStream::connect(addr).await.unwrap();
+        client.write_all(b"ping").await.unwrap();
+        let mut echoed = [0u8; 4];
+        client.read_exact(&mut echoed).await.unwrap();
+        assert_eq!(&echoed, b"ping");
+
+        done.cancel();
+        relaying.await.unwrap();
+        assert!(TcpStream::connect(addr).await.is_err());
+    }
+
+    #[test]
+    fn socks_tunnels_forward_dynamically() {
+        let mut tunnel = tunnel_for(TargetType::Vm, "/subs/x/virtualMachines/vm");
+        tunnel.local_port = "1080".into();
+        let fwd = SshForward::Socks {
+            user: "azureuser".into(),
+        };
+        tunnel.ssh = Some(fwd.clone());
+        let joined = ssh_stage_command(&tunnel, &fwd, "50123", None)
+            .as_std()
+            .get_args()
+            .map(|a| a.to_string_lossy().into_owned())
+            .collect::<Vec<_>>()
+            .join(" ");
+        assert!(joined.starts_with("-N -D 1080 -p 50123"));
+        assert!(joined.contains("HostKeyAlias=onprem-01"));
+        assert!(joined.ends_with("azureuser@127.0.0.1"));
+
+        tunnel.machine.target_type = TargetType::Arc;
+        let joined = args_of(&tunnel).join(" ");
+        assert!(joined.contains("--local-user azureuser -- -N -D 1080"));
+        assert!(!joined.contains("-L"));
+    }
+
+    #[test]
+    fn jump_tunnels_forward_to_the_host_behind() {
+        let mut tunnel = tunnel_for(TargetType::Vm, "/subs/x/virtualMachines/vm");
+        tunnel.local_port = "15432".into();
+        let fwd = SshForward::parse_jump("azureuser@10.2.0.5:5432").unwrap();
+        tunnel.ssh = Some(fwd.clone());
+        let joined = ssh_stage_command(&tunnel, &fwd, "50123", None)
+            .as_std()
+            .get_args()
+            .map(|a| a.to_string_lossy().into_owned())
+            .collect::<Vec<_>>()
+            .join(" ");
+        assert!(joined.starts_with("-N -L 15432:10.2.0.5:5432 -p 50123"));
+        assert!(joined.ends_with("azureuser@127.0.0.1"));
+
+        tunnel.machine.target_type = TargetType::Arc;
+        let joined = args_of(&tunnel).join(" ");
+        assert!(joined.contains("-- -N -L 15432:10.2.0.5:5432"));
+    }
+
+    #[test]
+    fn command_lines_can_be_pasted_into_a_shell() {
+        let mut tunnel = tunnel_for(TargetType::Vm, "/subs/x/virtualMachines/vm");
+        tunnel.machine.bastion_resource_group = "Hub RG's".into();
+        let lines = command_lines(&tunnel);
+        assert_eq!(lines.len(), 1);
+        assert!(lines[0].contains("network bastion tunnel --resource-group 'Hub RG'\\''s'"));
+        assert!(lines[0].ends_with("--resource-port 22 --port 2022"));
+
+        tunnel.ssh = Some(SshForward::parse_jump("azureuser@10.2.0.5:5432").unwrap());
+        let lines = command_lines(&tunnel);
+        assert!(lines[0].ends_with("--resource-port 22 --port <free-port>"));
+        assert!(lines[1].starts_with("ssh -N -L 2022:10.2.0.5:5432 -p <free-port>"));
+    }
+
+    #[tokio::test]
+    async fn stop_all_reports_progress_for_every_tunnel() {
+        let (tx, _rx) = tokio::sync::mpsc::unbounded_channel();
+        let mut mgr = TunnelManager::new(tx);
+        // Reattached tunnels with PIDs above any pid_max: killing them is a no-op.
+        let first = tunnel_for(TargetType::Vm, "/subscriptions/s/vm");
+        let second = Tunnel {
+            id: TunnelId(2),
+            ..first.clone()
+        };
+        for (tunnel, pid) in [(&first, 0x7fff_fff0), (&second, 0x7fff_fff1)] {
+            let started = String::new();
+            mgr.adopt(tunnel, Detached { pid, started });
+        }
+
+        let mut seen = Vec::new();
+        let left = mgr.stop_all_with_progress(|p| seen.push(p)).await;
+        assert!(left.is_empty());
+        assert_eq!(seen.len(), 3);
+        assert_eq!(seen[0].done, 0);
+        assert_eq!(
+            seen[2],
+            StopProgress {
+                done: 2,
+                total: 2,
+                timed_out: 0
+            }
+        );
+        assert!(!mgr.is_running(TunnelId(1)));
+    }
+
+    #[cfg(unix)]
+    #[tokio::test]
+    async fn stop_asks_first_and_kills_after_the_timeout() {
+        use std::io::BufRead;
+        use std::os::unix::process::CommandExt;
+        let (tx, mut rx) = tokio::sync::mpsc::unbounded_channel();
+        let mut mgr = TunnelManager::new(tx).with_stop_timeout(Duration::from_millis(500));
+        for (n, script, forced) in [
+            (1, "echo up; sleep 30", false),
+            (2, "trap '' TERM; echo up; sleep 30", true),
+        ] {
+            let mut child = std::process::Command::new("sh")
+                .args(["-c", script])
+                .process_group(0)
+                .stdout(Stdio::piped())
+                .spawn()
+                .unwrap();
+            let pid = child.id();
+            // Stop only once the trap is set.
+            let mut up = String::new();
+            std::io::BufReader::new(child.stdout.take().unwrap())
+                .read_line(&mut up)
+                .unwrap();
+            // Reap it, as the session that started it would have.
+            std::thread::spawn(move || child.wait());
+            let id = TunnelId(n);
+            let tunnel = Tunnel {
+                id,
+                ..tunnel_for(TargetType::Vm, "/subscriptions/s/vm")
+            };
+            let started = start_time(pid).unwrap();
+            mgr.adopt(&tunnel, Detached { pid, started });
+
+            mgr.stop(id);
+            assert!(mgr.is_running(id), "held until the process is gone");
+            match rx.recv().await.unwrap() {
+                BgEvent::TunnelStopped { id: got, forced: f } => {
+                    assert_eq!((got, f), (id, forced), "{script}");
+                }
+                other => panic!("unexpected {other:?}"),
+            }
+            assert_eq!(
+                mgr.logs(id).last().unwrap().text.contains("killed"),
+                forced,
+                "{script}"
+            );
+            mgr.stop(id);
+            assert!(!mgr.is_running(id));
+        }
+    }
+
     #[test]
     fn detects_error_lines() {
         assert!(is_error_line("ERROR: something broke"));
@@ -0,0 +1,250 @@
+//! A VM's power state, from `az vm get-instance-view`. A tunnel to a VM that
+//! is stopped or deallocated only fails once Bastion gives up on it, so the
+//! state is asked for alongside the tunnel, and for every VM the machines view
+//! (`m`) lists. The machines view can also start or deallocate a VM, and
+//! shows the selected VM's size, OS and private IP ([`VmInfo`]).
+
+use crate::azure::az_command;
+use crate::model::{Machine, TargetType};
+
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub enum PowerState {
+    Running,
+    Starting,
+    Stopping,
+    /// Stopped from inside the guest: still allocated (and billed).
+    Stopped,
+    Deallocating,
+    Deallocated,
+    /// A state az reported that we don't know, as reported.
+    Other(String),
+}
+
+impl PowerState {
+    /// From an instance view status code, e.g. `PowerState/deallocated`.
+    pub fn from_code(code: &str) -> Self {
+        let state = code.trim();
+        let state = state.strip_prefix("PowerState/").unwrap_or(state);
+        match state.to_ascii_lowercase().as_str() {
+            "running" => PowerState::Running,
+            "starting" => PowerState::Starting,
+            "stopping" => PowerState::Stopping,
+            "stopped" => PowerState::Stopped,
+            "deallocating" => PowerState::Deallocating,
+            "deallocated" => PowerState::Deallocated,
+            _ => PowerState::Other(state.to_string()),
+        }
+    }
+
+    pub fn label(&self) -> &str {
+        match self {
+            PowerState::Running => "running",
+            PowerState::Starting => "starting",
+            PowerState::Stopping => "stopping",
+            PowerState::Stopped => "stopped",
+            PowerState::Deallocating => "deallocating",
+            PowerState::Deallocated => "deallocated",
+            PowerState::Other(s) => s,
+        }
+    }
+
+    /// Whether a tunnel to the VM has no chance: it is off or on its way
+    /// there. A VM still starting may be up by the time Bastion connects.
+    pub fn is_down(&self) -> bool {
+        matches!(
+            self,
+            PowerState::Stopping
+                | PowerState::Stopped
+                | PowerState::Deallocating
+                | PowerState::Deallocated
+        )
+    }
+}
+
+/// What the machines view can do to a VM (`s` / `x`).
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum PowerAction {
+    Start,
+    /// Stop and release the VM's compute, so it isn't billed.
+    Deallocate,
+}
+
+impl PowerAction {
+    /// The `az vm` subcommand, also its verb.
+    pub fn command(self) -> &'static str {
+        match self {
+            PowerAction::Start => "start",
+            PowerAction::Deallocate => "deallocate",
+        }
+    }
+
+    pub fn done(self) -> &'static str {
+        match self {
+            PowerAction::Start => "started",
+            PowerAction::Deallocate => "deallocated",
+        }
+    }
+
+    /// The state the VM goes through on the way.
+    pub fn transition(self) -> PowerState {
+        match self {
+            PowerAction::Start => PowerState::Starting,
+            PowerAction::Deallocate => PowerState::Deallocating,
+        }
+    }
+}
+
+/// Whether `m` has a power state to ask for: a plain VM, named by resource
+/// ID. Arc servers, scale sets and IP targets don't.
+pub fn has_power_state(m: &Machine) -> bool {
+    m.target_type == TargetType::Vm && m.target_ip.is_none()
+}
+
+/// Ask az for `m`'s power state.
+pub async fn power_state(m: &Machine) -> Result<PowerState, String> {
+    let out = az_command()
+        .args(["vm", "get-instance-view", "--ids", &m.target_resource_id])
+        .args([
+            "--query",
+            "instanceView.statuses[?starts_with(code, 'PowerState/')].code | [0]",
+            "-o",
+            "tsv",
+        ])
+        .output()
+        .await
+        .map_err(|e| format!("failed to run az: {e}"))?;
+    if !out.status.success() {
+        return Err(String::from_utf8_lossy(&out.stderr).trim().to_string());
+    }
+    let code = String::from_utf8_lossy(&out.stdout);
+    if code.trim().is_empty() {
+        return Err("az vm get-instance-view reported no power state".into());
+    }
+    Ok(PowerState::from_code(&code))
+}
+
+/// What `az vm show -d` says about a VM, to tell similarly named ones apart.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct VmInfo {
+    /// e.g. `Standard_B2s`.
+    pub size: String,
+    /// `Linux` or `Windows`.
+    pub os: String,
+    /// The marketplace offer it was built from, e.g.
+    /// `0001-com-ubuntu-server-jammy`; not for custom images.
+    pub image: Option<String>,
+    /// Comma-separated when it has several.
+    pub private_ip: Option<String>,
+    pub location: String,
+}
+
+impl VmInfo {
+    /// One line for the machines view: size, OS, IP and region.
+    pub fn summary(&self) -> String {
+        let os = match &self.image {
+            Some(image) => format!("{} ({image})", self.os),
+            None => self.os.clone(),
+        };
+        [
+            Some(self.size.as_str()),
+            Some(&os),
+            self.private_ip.as_deref(),
+            Some(&self.location),
+        ]
+        .into_iter()
+        .flatten()
+        .filter(|s| !s.is_empty())
+        .collect::<Vec<_>>()
+        .join(" · ")
+    }
+}
+
+/// Read `[size, os type, image offer, private IPs, location]` as printed by
+/// `-o tsv`. az prints nothing (or `None`) for what a VM doesn't have.
+fn parse_info(tsv: &str) -> Option<VmInfo> {
+    let fields: Vec<Option<String>> = tsv
+        .trim_end_matches('\n')
+        .split(['\t', '\n'])
+        .map(|f| {
+            let f = f.trim();
+            (!f.is_empty() && f != "None").then(|| f.to_string())
+        })
+        .collect();
+    let [size, os, image, private_ip, location] = fields.try_into().ok()?;
+    Some(VmInfo {
+        size: size?,
+        os: os.unwrap_or_default(),
+        image,
+        private_ip,
+        location: location.unwrap_or_default(),
+    })
+}
+
+/// Ask az for `m`'s size, OS, private IP and region.
+pub async fn info(m: &Machine) -> Result<VmInfo, String> {
+    let out = az_command()
+        .args(["vm", "show", "-d", "--ids", &m.target_resource_id])
+        .args([
+            "--query",
+            "[hardwareProfile.vmSize, storageProfile.osDisk.osType, storageProfile.imageReference.offer, privateIps, location]",
+            "-o",
+            "tsv",
+        ])
+        .output()
+        .await
+        .map_err(|e| format!("failed to run az: {e}"))?;
+    if !out.status.success() {
+        return Err(String::from_utf8_lossy(&out.stderr).trim().to_string());
+    }
+    parse_info(&String::from_utf8_lossy(&out.stdout))
+        .ok_or_else(|| "az vm show printed nothing we could read".to_string())
+}
+
+/// Start or deallocate `m`. az waits until the VM gets there, which can take
+/// minutes.
+pub async fn set_power(m: &Machine, action: PowerAction) -> Result<(), String> {
+    let out = az_command()
+        .args(["vm", action.command(), "--ids", &m.target_resource_id])
+        .output()
+        .await
+        .map_err(|e| format!("failed to run az: {e}"))?;
+    if !out.status.success() {
+        return Err(String::from_utf8_lossy(&out.stderr).trim().to_string());
+    }
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn power_states_are_read_from_status_codes() {
+        assert_eq!(
+            PowerState::from_code("PowerState/running\n"),
+            PowerState::Running
+        );
+        let off = PowerState::from_code("PowerState/deallocated");
+        assert_eq!(off, PowerState::Deallocated);
+        assert!(off.is_down());
+        assert!(!PowerState::from_code("PowerState/starting").is_down());
+        let odd = PowerState::from_code("PowerState/hibernated");
+        assert_eq!(odd.label(), "hibernated");
+        assert!(!odd.is_down());
+    }
+
+    #[test]
+    fn vm_details_are_read_from_tsv() {
+        let info =
+            parse_info("Standard_B2s\tLinux\t0001-com-ubuntu-server-jammy\t10.0.1.4\twesteurope\n")
+                .unwrap();
+        assert_eq!(
+            info.summary(),
+            "Standard_B2s · Linux (0001-com-ubuntu-server-jammy) · 10.0.1.4 · westeurope"
+        );
+        let custom = parse_info("Standard_D4s_v5\nWindows\nNone\n\nuksouth\n").unwrap();
+        assert_eq!(custom.image, None);
+        assert_eq!(custom.summary(), "Standard_D4s_v5 · Windows · uksouth");
+        assert_eq!(parse_info(""), None);
+    }
+}
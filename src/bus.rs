@@ -0,0 +1,75 @@
+//! The event bus every background task publishes to. [`TunnelManager`],
+//! [`CertManager`], the shared config and webhooks publish [`BgEvent`]s; each
+//! subscriber (the TUI's event loop, and whatever else wants to watch tunnels
+//! and certificates) gets its own copy of every event, in order.
+//!
+//! A plain `UnboundedSender<BgEvent>` converts into a bus with that one
+//! subscriber, so code that only needs the events can keep handing over a
+//! channel.
+//!
+//! [`TunnelManager`]: crate::azure::tunnel::TunnelManager
+//! [`CertManager`]: crate::azure::cert::CertManager
+
+use crate::tui::action::BgEvent;
+use std::sync::{Arc, Mutex};
+use tokio::sync::mpsc::{UnboundedReceiver, UnboundedSender};
+
+#[derive(Debug, Clone, Default)]
+pub struct Bus {
+    subscribers: Arc<Mutex<Vec<UnboundedSender<BgEvent>>>>,
+}
+
+impl Bus {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// A receiver for every event published from now on. Dropping it
+    /// unsubscribes.
+    pub fn subscribe(&self) -> UnboundedReceiver<BgEvent> {
+        let (tx, rx) = tokio::sync::mpsc::unbounded_channel();
+        self.subscribers.lock().unwrap().push(tx);
+        rx
+    }
+
+    /// Hand `event` to every subscriber, forgetting those that are gone.
+    /// Nobody listening is not an error: the TUI may be shutting down.
+    pub fn publish(&self, event: BgEvent) {
+        self.subscribers
+            .lock()
+            .unwrap()
+            .retain(|s| s.send(event.clone()).is_ok());
+    }
+}
+
+impl From<UnboundedSender<BgEvent>> for Bus {
+    fn from(tx: UnboundedSender<BgEvent>) -> Self {
+        Self {
+            subscribers: Arc::new(Mutex::new(vec![tx])),
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::model::TunnelId;
+
+    #[test]
+    fn every_subscriber_gets_every_event_until_it_leaves() {
+        let bus = Bus::new();
+        bus.publish(BgEvent::TunnelLog { id: TunnelId(0) });
+        let mut ui = bus.subscribe();
+        let log = bus.subscribe();
+        bus.publish(BgEvent::TunnelLog { id: TunnelId(1) });
+        drop(log);
+        bus.publish(BgEvent::TunnelLog { id: TunnelId(2) });
+        assert_eq!(bus.subscribers.lock().unwrap().len(), 1);
+
+        let mut seen = Vec::new();
+        while let Ok(BgEvent::TunnelLog { id }) = ui.try_recv() {
+            seen.push(id.0);
+        }
+        assert_eq!(seen, [1, 2]);
+    }
+}
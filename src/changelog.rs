@@ -0,0 +1,55 @@
+//! The embedded CHANGELOG.md, used for the one-time "what's new" screen.
+
+const CHANGELOG: &str = include_str!("../CHANGELOG.md");
+
+/// Release notes for `version`, if the changelog has a section for it.
+pub fn notes(version: &str) -> Option<&'static str> {
+    section(CHANGELOG, version)
+}
+
+/// The body of the `## <version>` section (a leading `v` is optional), up to
+/// the next `## ` heading.
+fn section<'a>(changelog: &'a str, version: &str) -> Option<&'a str> {
+    let version = version.trim_start_matches('v');
+    let mut start = None;
+    let mut offset = 0;
+    for line in changelog.split_inclusive('\n') {
+        if let Some(heading) = line.strip_prefix("## ") {
+            if let Some(s) = start {
+                return non_empty(&changelog[s..offset]);
+            }
+            let heading = heading.trim().trim_start_matches('v');
+            // Allow trailing notes such as `## 0.3.0 (2025-11-02)`.
+            if heading.split_whitespace().next() == Some(version) {
+                start = Some(offset + line.len());
+            }
+        }
+        offset += line.len();
+    }
+    start.and_then(|s| non_empty(&changelog[s..]))
+}
+
+fn non_empty(s: &str) -> Option<&str> {
+    let s = s.trim();
+    (!s.is_empty()).then_some(s)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    const SAMPLE: &str =
+        "# Changelog\n\n## v0.3.0 (2025-11-02)\n\n- new thing\n- other\n\n## 0.2.1\n\n- older\n";
+
+    #[test]
+    fn finds_section_for_version() {
+        assert_eq!(section(SAMPLE, "0.3.0"), Some("- new thing\n- other"));
+        assert_eq!(section(SAMPLE, "v0.2.1"), Some("- older"));
+    }
+
+    #[test]
+    fn unknown_version_has_no_notes() {
+        assert_eq!(section(SAMPLE, "0.2"), None);
+        assert_eq!(section(SAMPLE, "9.9.9"), None);
+    }
+}
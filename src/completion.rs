@@ -0,0 +1,92 @@
+//! Shell completion through clap_complete. `az-burrow completions <shell>`
+//! prints a short script that asks az-burrow itself what fits the word being
+//! completed, by running it with `COMPLETE=<shell>`. So options and
+//! subcommands always match the command line, paths complete as file names,
+//! and session names come from the sessions saved next to the config.
+
+use crate::{config, session};
+use clap::ValueEnum;
+use clap_complete::engine::CompletionCandidate;
+use clap_complete::env::{Bash, EnvCompleter, Fish, Zsh};
+use std::ffi::OsStr;
+use std::path::Path;
+
+/// Environment variable the scripts set when they run az-burrow to complete
+/// a word.
+pub const VAR: &str = "COMPLETE";
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, ValueEnum)]
+pub enum Shell {
+    Bash,
+    Zsh,
+    Fish,
+}
+
+/// The script that has `shell` complete the command `name`.
+pub fn script(shell: Shell, name: &str) -> String {
+    let completer: &dyn EnvCompleter = match shell {
+        Shell::Bash => &Bash,
+        Shell::Zsh => &Zsh,
+        Shell::Fish => &Fish,
+    };
+    let mut out = Vec::new();
+    // Writing into a Vec can't fail.
+    let _ = completer.write_registration(VAR, name, name, name, &mut out);
+    String::from_utf8_lossy(&out).into_owned()
+}
+
+/// Saved sessions starting with `current`, for `--session` and `session
+/// delete`: those next to the config az-burrow loads when none is named.
+pub fn session_names(current: &OsStr) -> Vec<CompletionCandidate> {
+    let Ok(config_path) = config::resolve_config_path(None) else {
+        return Vec::new();
+    };
+    sessions_in(
+        &session::sessions_path(&config_path),
+        &current.to_string_lossy(),
+    )
+    .into_iter()
+    .map(CompletionCandidate::new)
+    .collect()
+}
+
+fn sessions_in(path: &Path, prefix: &str) -> Vec<String> {
+    let Ok(sessions) = session::load(path) else {
+        return Vec::new();
+    };
+    sessions
+        .sessions
+        .into_iter()
+        .map(|s| s.name)
+        .filter(|name| name.starts_with(prefix))
+        .collect()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn scripts_ask_the_binary_to_complete() {
+        for shell in [Shell::Bash, Shell::Zsh, Shell::Fish] {
+            let script = script(shell, "az-burrow");
+            assert!(script.contains("az-burrow"), "{script}");
+            assert!(script.contains(VAR), "{script}");
+        }
+    }
+
+    #[test]
+    fn session_names_complete_from_the_sessions_file() {
+        let path =
+            std::env::temp_dir().join(format!("az-burrow-completion-{}.yaml", std::process::id()));
+        std::fs::write(
+            &path,
+            "sessions:\n  - name: prod\n  - name: prod-db\n  - name: staging\n",
+        )
+        .unwrap();
+        assert_eq!(sessions_in(&path, "pr"), ["prod", "prod-db"]);
+        assert_eq!(sessions_in(&path, "").len(), 3);
+        let _ = std::fs::remove_file(&path);
+        assert!(sessions_in(&path, "").is_empty());
+    }
+}
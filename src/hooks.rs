@@ -0,0 +1,142 @@
+//! Lifecycle hooks: the `on_start`, `on_ready`, `on_stop` and `on_error`
+//! commands of a configured tunnel, run through the shell when it gets there,
+//! e.g. to open `psql` or mount `sshfs` once the tunnel is Active. Hooks run in
+//! the background with no terminal and are not waited for; a hook that fails
+//! to launch is reported, its exit status is not.
+
+use crate::model::Tunnel;
+use std::process::Stdio;
+use tokio::process::Command;
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum HookEvent {
+    /// The az process was launched.
+    Start,
+    /// The tunnel reported Active.
+    Ready,
+    /// The user stopped it, or it exited cleanly.
+    Stop,
+    /// It failed to start or exited with an error.
+    Error,
+}
+
+impl HookEvent {
+    pub fn name(self) -> &'static str {
+        match self {
+            HookEvent::Start => "on_start",
+            HookEvent::Ready => "on_ready",
+            HookEvent::Stop => "on_stop",
+            HookEvent::Error => "on_error",
+        }
+    }
+}
+
+/// The variables a hook sees: `BURROW_TUNNEL`, `BURROW_MACHINE`,
+/// `BURROW_LOCAL_PORT`, `BURROW_REMOTE_PORT`, `BURROW_EVENT` and, for
+/// `on_error`, `BURROW_ERROR`.
+pub fn env(tunnel: &Tunnel, event: HookEvent, error: Option<&str>) -> Vec<(&'static str, String)> {
+    let mut vars = vec![
+        ("BURROW_TUNNEL", tunnel.display_name().to_string()),
+        ("BURROW_MACHINE", tunnel.machine.name.clone()),
+        ("BURROW_LOCAL_PORT", tunnel.local_port.clone()),
+        ("BURROW_REMOTE_PORT", tunnel.remote_port.clone()),
+        (
+            "BURROW_EVENT",
+            event.name().trim_start_matches("on_").to_string(),
+        ),
+    ];
+    if let Some(error) = error {
+        vars.push(("BURROW_ERROR", error.to_string()));
+    }
+    vars
+}
+
+/// Launch `tunnel`'s hook for `event`, if it has one. Must be called within a
+/// tokio runtime, which reaps the process when it exits.
+pub fn run(tunnel: &Tunnel, event: HookEvent, error: Option<&str>) -> std::io::Result<()> {
+    let hooks = &tunnel.hooks;
+    let command = match event {
+        HookEvent::Start => &hooks.on_start,
+        HookEvent::Ready => &hooks.on_ready,
+        HookEvent::Stop => &hooks.on_stop,
+        HookEvent::Error => &hooks.on_error,
+    };
+    let Some(command) = command.as_deref() else {
+        return Ok(());
+    };
+    let mut cmd = shell(command);
+    cmd.envs(env(tunnel, event, error))
+        .stdin(Stdio::null())
+        .stdout(Stdio::null())
+        .stderr(Stdio::null());
+    let mut child = cmd.spawn()?;
+    tokio::spawn(async move {
+        let _ = child.wait().await;
+    });
+    Ok(())
+}
+
+#[cfg(unix)]
+fn shell(command: &str) -> Command {
+    let mut cmd = Command::new("sh");
+    cmd.arg("-c").arg(command);
+    cmd
+}
+
+#[cfg(windows)]
+fn shell(command: &str) -> Command {
+    let mut cmd = Command::new("cmd");
+    cmd.arg("/C").arg(command);
+    cmd
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::model::{Machine, TunnelId};
+
+    fn tunnel() -> Tunnel {
+        let machine = Machine::test("vm-db");
+        let mut t = Tunnel::new(TunnelId(1), machine, "15432", "5432");
+        t.name = Some("prod-db".into());
+        t
+    }
+
+    #[test]
+    fn env_describes_the_tunnel_and_event() {
+        let vars = env(&tunnel(), HookEvent::Error, Some("exit status: 1"));
+        assert!(vars.contains(&("BURROW_TUNNEL", "prod-db".into())));
+        assert!(vars.contains(&("BURROW_MACHINE", "vm-db".into())));
+        assert!(vars.contains(&("BURROW_LOCAL_PORT", "15432".into())));
+        assert!(vars.contains(&("BURROW_REMOTE_PORT", "5432".into())));
+        assert!(vars.contains(&("BURROW_EVENT", "error".into())));
+        assert!(vars.contains(&("BURROW_ERROR", "exit status: 1".into())));
+        assert!(env(&tunnel(), HookEvent::Ready, None)
+            .iter()
+            .all(|(k, _)| *k != "BURROW_ERROR"));
+    }
+
+    #[cfg(unix)]
+    #[tokio::test]
+    async fn hook_runs_with_the_tunnel_env() {
+        let out = std::env::temp_dir().join(format!("az-burrow-hook-{}", std::process::id()));
+        let mut t = tunnel();
+        t.hooks.on_ready = Some(format!(
+            "echo \"$BURROW_EVENT $BURROW_LOCAL_PORT\" > {}",
+            out.display()
+        ));
+        run(&t, HookEvent::Ready, None).unwrap();
+        run(&t, HookEvent::Stop, None).unwrap(); // no on_stop: nothing to do
+        for _ in 0..50 {
+            if let Ok(text) = std::fs::read_to_string(&out) {
+                if !text.is_empty() {
+                    assert_eq!(text.trim(), "ready 15432");
+                    let _ = std::fs::remove_file(&out);
+                    return;
+                }
+            }
+            tokio::time::sleep(std::time::Duration::from_millis(20)).await;
+        }
+        panic!("hook did not run");
+    }
+}
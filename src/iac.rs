@@ -0,0 +1,111 @@
+//! `import --from-state`: machines from infrastructure as code, so a team
+//! that declares its VMs in Terraform or Bicep doesn't keep the list twice.
+//! The VMs and Bastion hosts are read from whatever JSON names them by
+//! resource ID: a Terraform state file, `terraform show -json`, or
+//! `az deployment group show` (its `outputResources`).
+
+use regex::Regex;
+
+/// The resources a state file or deployment names, by resource ID, each once
+/// and in the order first seen.
+#[derive(Debug, Clone, Default, PartialEq, Eq)]
+pub struct Resources {
+    pub vms: Vec<String>,
+    pub bastions: Vec<String>,
+}
+
+/// Every VM and Bastion host resource ID quoted in `text`. Child resources
+/// (a VM's extensions, say) aren't matched, and IDs only referred to (a NIC's
+/// `virtual_machine_id`) are the same VMs again.
+pub fn resources(text: &str) -> Resources {
+    let re = Regex::new(
+        r#"(?i)"(/subscriptions/[^/"]+/resourceGroups/[^/"]+/providers/Microsoft\.(?:Compute/virtualMachines|Network/bastionHosts)/[^/"]+)""#,
+    )
+    .unwrap();
+    let mut found = Resources::default();
+    for cap in re.captures_iter(text) {
+        let id = &cap[1];
+        let list = if id.to_lowercase().contains("/bastionhosts/") {
+            &mut found.bastions
+        } else {
+            &mut found.vms
+        };
+        if !list.iter().any(|known| known.eq_ignore_ascii_case(id)) {
+            list.push(id.to_string());
+        }
+    }
+    found
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn vms_and_bastions_are_read_from_terraform_and_deployments() {
+        let tfstate = r#"{
+  "version": 4,
+  "resources": [
+    {
+      "mode": "managed",
+      "type": "azurerm_linux_virtual_machine",
+      "name": "web",
+      "instances": [
+        {
+          "attributes": {
+            "id": "/subscriptions/s1/resourceGroups/rg-web/providers/Microsoft.Compute/virtualMachines/vm-web",
+            "network_interface_ids": ["/subscriptions/s1/resourceGroups/rg-web/providers/Microsoft.Network/networkInterfaces/nic-web"]
+          }
+        }
+      ]
+    },
+    {
+      "mode": "managed",
+      "type": "azurerm_virtual_machine_extension",
+      "name": "aad",
+      "instances": [
+        {
+          "attributes": {
+            "id": "/subscriptions/s1/resourceGroups/rg-web/providers/Microsoft.Compute/virtualMachines/vm-web/extensions/AADSSHLoginForLinux",
+            "virtual_machine_id": "/subscriptions/s1/resourceGroups/rg-web/providers/Microsoft.Compute/virtualMachines/vm-web"
+          }
+        }
+      ]
+    },
+    {
+      "mode": "managed",
+      "type": "azurerm_bastion_host",
+      "name": "hub",
+      "instances": [
+        {
+          "attributes": {
+            "id": "/subscriptions/s1/resourceGroups/rg-hub/providers/Microsoft.Network/bastionHosts/bastion-hub"
+          }
+        }
+      ]
+    }
+  ]
+}"#;
+        assert_eq!(
+            resources(tfstate),
+            Resources {
+                vms: vec![
+                    "/subscriptions/s1/resourceGroups/rg-web/providers/Microsoft.Compute/virtualMachines/vm-web".into()
+                ],
+                bastions: vec![
+                    "/subscriptions/s1/resourceGroups/rg-hub/providers/Microsoft.Network/bastionHosts/bastion-hub".into()
+                ],
+            }
+        );
+
+        let deployment = r#"{"properties": {"outputResources": [
+            {"id": "/subscriptions/s1/resourceGroups/RG-DB/providers/Microsoft.Compute/virtualMachines/vm-db", "resourceGroup": "RG-DB"},
+            {"id": "/subscriptions/s1/resourceGroups/rg-db/providers/microsoft.compute/virtualmachines/VM-DB"}
+        ]}}"#;
+        assert_eq!(
+            resources(deployment).vms,
+            vec!["/subscriptions/s1/resourceGroups/RG-DB/providers/Microsoft.Compute/virtualMachines/vm-db"]
+        );
+        assert_eq!(resources("{}"), Resources::default());
+    }
+}
@@ -0,0 +1,43 @@
+//! Just enough JSON writing for flat string objects (webhook bodies, audit
+//! lines), without pulling in a serializer.
+
+/// Quote `s` as a JSON string.
+pub fn json_string(s: &str) -> String {
+    let mut out = String::with_capacity(s.len() + 2);
+    out.push('"');
+    for c in s.chars() {
+        match c {
+            '"' => out.push_str("\\\""),
+            '\\' => out.push_str("\\\\"),
+            '\n' => out.push_str("\\n"),
+            '\r' => out.push_str("\\r"),
+            '\t' => out.push_str("\\t"),
+            c if (c as u32) < 0x20 => out.push_str(&format!("\\u{:04x}", c as u32)),
+            c => out.push(c),
+        }
+    }
+    out.push('"');
+    out
+}
+
+/// A flat JSON object of string fields; `None` values are left out.
+pub fn json_object(fields: &[(&str, Option<&str>)]) -> String {
+    let body: Vec<String> = fields
+        .iter()
+        .filter_map(|(k, v)| v.map(|v| format!("{}:{}", json_string(k), json_string(v))))
+        .collect();
+    format!("{{{}}}", body.join(","))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn escapes_and_skips_missing_fields() {
+        assert_eq!(
+            json_object(&[("a", Some("x\"y\\\n\u{1}")), ("b", None), ("c", Some("é"))]),
+            r#"{"a":"x\"y\\\n\u0001","c":"é"}"#
+        );
+    }
+}
@@ -0,0 +1,64 @@
+//! Tunnel orchestration behind the az-burrow TUI, for tools that want Bastion
+//! tunnels and SSH certificate renewal without the terminal UI.
+//!
+//! [`TunnelManager`] starts and stops `az network bastion tunnel` processes;
+//! [`CertManager`] keeps `az ssh cert` certificates fresh. Both publish
+//! [`BgEvent`]s to the [`bus::Bus`] (or plain channel) they are given, and
+//! need a tokio runtime.
+//! Machines come from [`Machine::new`] or a parsed [`config::Config`], and
+//! [`azure::configure`] sets the cloud and `az` executable for every call.
+//!
+//! ```no_run
+//! use az_burrow::{BgEvent, Machine, Tunnel, TunnelId, TunnelManager};
+//!
+//! # async fn run() -> color_eyre::Result<()> {
+//! let (tx, mut rx) = tokio::sync::mpsc::unbounded_channel();
+//! let mut tunnels = TunnelManager::new(tx);
+//! let mut machine = Machine::new("vm-web");
+//! machine.resource_group = "rg-web".into();
+//! machine.target_resource_id = "/subscriptions/…/virtualMachines/vm-web".into();
+//! machine.bastion_name = "bastion-hub".into();
+//! machine.bastion_resource_group = "rg-hub".into();
+//! tunnels.start(&Tunnel::new(TunnelId(1), machine, "2022", "22"))?;
+//! while let Some(event) = rx.recv().await {
+//!     if let BgEvent::TunnelStatus { id, status } = event {
+//!         println!("{id:?}: {}", status.label());
+//!     }
+//! }
+//! # Ok(())
+//! # }
+//! ```
+//!
+//! The remaining modules are the TUI's own and carry no stability promise.
+
+pub mod audit;
+pub mod az_ssh_config;
+pub mod azure;
+pub mod bus;
+pub mod changelog;
+pub mod completion;
+pub mod config;
+pub mod config_edit;
+pub mod export;
+pub mod hooks;
+pub mod iac;
+pub mod json;
+pub mod lock;
+pub mod metrics;
+pub mod migrate;
+pub mod model;
+pub mod policy;
+pub mod readiness;
+pub mod recent;
+pub mod session;
+pub mod ssh;
+pub mod state;
+pub mod tui;
+pub mod tunnel_log;
+pub mod webhook;
+pub mod wsl;
+
+pub use azure::cert::CertManager;
+pub use azure::tunnel::TunnelManager;
+pub use model::{Machine, TargetType, Tunnel, TunnelId, TunnelStatus};
+pub use tui::action::BgEvent;
@@ -0,0 +1,306 @@
+//! One az-burrow per config: `burrow.lock`, next to the config, names the
+//! instance running against it. Two instances would fight over the same local
+//! ports and orphan each other's tunnels, so a second launch either quits or
+//! takes over. Taking over asks the running instance, through the lock file,
+//! to stop its tunnels and exit; it checks for that every tick.
+
+use crate::azure::cleanup;
+use color_eyre::eyre::{eyre, Context, Result};
+use serde::{Deserialize, Serialize};
+use std::io::Write;
+use std::path::{Path, PathBuf};
+use std::time::{Duration, Instant};
+
+/// How often a waiting takeover checks whether the lock was released.
+const RELEASE_POLL_INTERVAL: Duration = Duration::from_millis(200);
+
+/// How long a lock file that can't be read yet gets to be written: another
+/// instance may have created it a moment ago.
+const UNREADABLE_GRACE: Duration = Duration::from_millis(100);
+
+/// The on-disk shape of `burrow.lock`.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+struct LockFile {
+    pid: u32,
+    /// When the holder started ([`cleanup::start_time`]), so a PID reused by
+    /// some other program isn't taken for it.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    started: Option<String>,
+    /// Set by an instance taking over; the holder exits when it sees it.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    takeover: Option<u32>,
+}
+
+/// Sibling lock file next to the config: same directory, `burrow.lock`.
+pub fn lock_path(config_path: &Path) -> PathBuf {
+    match config_path.parent() {
+        Some(dir) => dir.join("burrow.lock"),
+        None => PathBuf::from("burrow.lock"),
+    }
+}
+
+/// Held for as long as this instance runs; removes the lock file on drop
+/// unless another instance has claimed it since.
+#[derive(Debug)]
+pub struct InstanceLock {
+    path: PathBuf,
+    pid: u32,
+}
+
+/// What [`acquire`] found.
+#[derive(Debug)]
+pub enum Claim {
+    Acquired(InstanceLock),
+    /// Another instance, by PID, holds the lock.
+    Held(u32),
+}
+
+/// Claim the lock at `path` for this process. A lock left by an instance that
+/// is no longer running is claimed as if it weren't there.
+pub fn acquire(path: &Path) -> Result<Claim> {
+    if let Some(lock) = create(path)? {
+        return Ok(Claim::Acquired(lock));
+    }
+    let found = read(path).or_else(|| {
+        std::thread::sleep(UNREADABLE_GRACE);
+        read(path)
+    });
+    if let Some(held) = &found {
+        if held.pid != std::process::id() && held.running() {
+            return Ok(Claim::Held(held.pid));
+        }
+    }
+    // Stale. Unless another instance has replaced it meanwhile, clear it and
+    // claim it the same way as a missing one, so only one of several
+    // instances starting together wins.
+    if read(path) == found {
+        let _ = std::fs::remove_file(path);
+    }
+    match create(path)? {
+        Some(lock) => Ok(Claim::Acquired(lock)),
+        None => match read(path) {
+            Some(held) => Ok(Claim::Held(held.pid)),
+            None => Err(eyre!("{} is held by another instance", path.display())),
+        },
+    }
+}
+
+/// Ask the instance `holder` to stop its tunnels and exit, then claim the lock
+/// once it has let go. Gives up after `timeout` if it is still running.
+pub async fn take_over(path: &Path, holder: u32, timeout: Duration) -> Result<InstanceLock> {
+    let held = read(path).filter(|l| l.pid == holder).unwrap_or(LockFile {
+        pid: holder,
+        started: None,
+        takeover: None,
+    });
+    let request = LockFile {
+        takeover: Some(std::process::id()),
+        ..held.clone()
+    };
+    write(path, &request)?;
+    let deadline = Instant::now() + timeout;
+    let beaten = || eyre!("another instance claimed {} first", path.display());
+    loop {
+        match read(path) {
+            // Let go: claim it the way a new instance would.
+            None => return create(path)?.ok_or_else(beaten),
+            Some(l) if l.pid != holder => return Err(beaten()),
+            // Gone without letting go.
+            Some(_) if !held.running() => return write_own(path),
+            Some(_) => {}
+        }
+        if Instant::now() >= deadline {
+            return Err(eyre!(
+                "az-burrow (pid {holder}) did not exit within {}s; stop it and try again",
+                timeout.as_secs()
+            ));
+        }
+        tokio::time::sleep(RELEASE_POLL_INTERVAL).await;
+    }
+}
+
+impl InstanceLock {
+    /// Whether another instance has asked to take over, or already has.
+    pub fn taken_over(&self) -> bool {
+        read(&self.path).is_some_and(|l| l.pid != self.pid || l.takeover.is_some())
+    }
+}
+
+impl Drop for InstanceLock {
+    fn drop(&mut self) {
+        if read(&self.path).is_some_and(|l| l.pid == self.pid) {
+            let _ = std::fs::remove_file(&self.path);
+        }
+    }
+}
+
+fn read(path: &Path) -> Option<LockFile> {
+    let text = std::fs::read_to_string(path).ok()?;
+    serde_norway::from_str(&text).ok()
+}
+
+fn write(path: &Path, lock: &LockFile) -> Result<()> {
+    let text = serde_norway::to_string(lock).wrap_err("serializing lock")?;
+    std::fs::write(path, text).wrap_err("writing lock file")?;
+    Ok(())
+}
+
+fn own() -> LockFile {
+    let pid = std::process::id();
+    LockFile {
+        pid,
+        started: cleanup::start_time(pid),
+        takeover: None,
+    }
+}
+
+fn write_own(path: &Path) -> Result<InstanceLock> {
+    let lock = own();
+    write(path, &lock)?;
+    Ok(InstanceLock {
+        path: path.to_path_buf(),
+        pid: lock.pid,
+    })
+}
+
+/// Create the lock file at `path` for this process, or `None` if there
+/// already is one: the check and the claim are one step, so two instances
+/// can't both see the lock free.
+fn create(path: &Path) -> Result<Option<InstanceLock>> {
+    let lock = own();
+    let text = serde_norway::to_string(&lock).wrap_err("serializing lock")?;
+    let mut file = match std::fs::OpenOptions::new()
+        .write(true)
+        .create_new(true)
+        .open(path)
+    {
+        Ok(file) => file,
+        Err(e) if e.kind() == std::io::ErrorKind::AlreadyExists => return Ok(None),
+        Err(e) => return Err(e).wrap_err("creating lock file"),
+    };
+    if let Err(e) = file.write_all(text.as_bytes()) {
+        let _ = std::fs::remove_file(path);
+        return Err(e).wrap_err("writing lock file");
+    }
+    Ok(Some(InstanceLock {
+        path: path.to_path_buf(),
+        pid: lock.pid,
+    }))
+}
+
+impl LockFile {
+    /// Whether the instance that wrote this lock is still running: its PID
+    /// is alive and, when the lock says when it started, still that process
+    /// rather than another given the same PID since.
+    fn running(&self) -> bool {
+        match &self.started {
+            Some(started) => cleanup::is_same_process(self.pid, started),
+            None => cleanup::is_alive(self.pid),
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn tmp(name: &str) -> PathBuf {
+        let path = std::env::temp_dir().join(format!("az-burrow-lock-test-{name}.lock"));
+        let _ = std::fs::remove_file(&path);
+        path
+    }
+
+    #[test]
+    fn lock_path_is_sibling_of_config() {
+        let cfg = Path::new("/home/u/.config/burrow.config.yaml");
+        assert_eq!(lock_path(cfg), PathBuf::from("/home/u/.config/burrow.lock"));
+    }
+
+    #[test]
+    fn acquire_claims_free_and_stale_locks_and_releases_on_drop() {
+        let path = tmp("stale");
+        let Claim::Acquired(lock) = acquire(&path).unwrap() else {
+            panic!("a missing lock is free");
+        };
+        assert!(!lock.taken_over());
+        drop(lock);
+        assert!(!path.exists());
+
+        // PID 0 is never a running process.
+        write(
+            &path,
+            &LockFile {
+                pid: 0,
+                started: None,
+                takeover: None,
+            },
+        )
+        .unwrap();
+        assert!(matches!(acquire(&path).unwrap(), Claim::Acquired(_)));
+    }
+
+    #[cfg(unix)]
+    #[test]
+    fn a_lock_whose_pid_was_reused_is_stale() {
+        let path = tmp("reused");
+        let mut other = std::process::Command::new("sleep")
+            .arg("30")
+            .spawn()
+            .unwrap();
+        let mut lock = LockFile {
+            pid: other.id(),
+            started: cleanup::start_time(other.id()),
+            takeover: None,
+        };
+        write(&path, &lock).unwrap();
+        assert!(matches!(acquire(&path).unwrap(), Claim::Held(_)));
+
+        lock.started = Some("Thu Jan  1 00:00:00 1970".into());
+        write(&path, &lock).unwrap();
+        assert!(matches!(acquire(&path).unwrap(), Claim::Acquired(_)));
+        other.kill().unwrap();
+        other.wait().unwrap();
+    }
+
+    #[cfg(unix)]
+    #[tokio::test]
+    async fn a_takeover_is_seen_by_the_holder_and_waits_for_it() {
+        let path = tmp("takeover");
+        // Stand in for another instance: a live process whose PID isn't ours.
+        let mut other = std::process::Command::new("sleep")
+            .arg("30")
+            .spawn()
+            .unwrap();
+        let holder = InstanceLock {
+            path: path.clone(),
+            pid: other.id(),
+        };
+        write(
+            &path,
+            &LockFile {
+                pid: other.id(),
+                started: cleanup::start_time(other.id()),
+                takeover: None,
+            },
+        )
+        .unwrap();
+        assert!(matches!(acquire(&path).unwrap(), Claim::Held(pid) if pid == other.id()));
+
+        let err = take_over(&path, other.id(), Duration::from_millis(300))
+            .await
+            .unwrap_err();
+        assert!(err.to_string().contains("did not exit"), "{err}");
+        assert!(holder.taken_over());
+
+        // The holder exits and releases the lock; the next takeover claims it.
+        drop(holder);
+        other.kill().unwrap();
+        other.wait().unwrap();
+        let lock = take_over(&path, other.id(), Duration::from_secs(5))
+            .await
+            .unwrap();
+        assert!(!lock.taken_over());
+        drop(lock);
+        assert!(!path.exists());
+    }
+}
@@ -1,93 +1,723 @@
-mod azure;
-mod config;
-mod model;
-mod state;
-mod tui;
-
-use crate::azure::cert::CertManager;
-use crate::azure::tunnel::TunnelManager;
-use crate::model::{Machine, Tunnel, TunnelId, TunnelStatus};
-use color_eyre::eyre::Result;
+use az_burrow::azure::cert::CertManager;
+use az_burrow::azure::cleanup;
+use az_burrow::azure::tunnel::{Detached, TunnelManager};
+use az_burrow::bus::Bus;
+use az_burrow::model::{CertStatus, Dependency, Machine, Tunnel, TunnelId, TunnelStatus};
+use az_burrow::readiness::ReadyCheck;
+use az_burrow::{
+    az_ssh_config, azure, completion, config, config_edit, iac, lock, migrate, recent, session,
+    ssh, state, tui, tunnel_log, webhook, wsl,
+};
+use clap::{ArgGroup, CommandFactory, Parser, Subcommand, ValueEnum};
+use clap_complete::engine::ArgValueCompleter;
+use color_eyre::eyre::{eyre, Context, Result};
 use crossterm::execute;
 use crossterm::terminal::{
     disable_raw_mode, enable_raw_mode, EnterAlternateScreen, LeaveAlternateScreen,
 };
 use ratatui::backend::CrosstermBackend;
 use ratatui::Terminal;
-use std::io::stdout;
+use std::io::{stdout, IsTerminal};
+use std::path::{Path, PathBuf};
+use std::time::Duration;
 
 const VERSION: &str = env!("CARGO_PKG_VERSION");
 
-fn print_help() {
-    print!(
-        r#"az-burrow v{VERSION} - A cosy TUI for managing Azure Bastion SSH tunnels
+/// Time on top of its stop timeout for an instance being taken over to notice
+/// (once a second) and to show its quit screen.
+const TAKEOVER_GRACE: Duration = Duration::from_secs(5);
+
+/// Printed after the options in `--help`.
+const AFTER_HELP: &str = r#"Configuration:
+  Looks for a config file in this order:
+    1. --config, or the path passed as the first argument
+    2. $BURROW_CONFIG
+    3. ./burrow.config.yaml
+    4. $XDG_CONFIG_HOME/burrow/config.yaml (default ~/.config/burrow/config.yaml)
+    5. ~/.config/burrow.config.yaml
+  The file in use is shown in the status bar.
 
-Usage:
-  az-burrow [config-file]
-  az-burrow -h | --help
-  az-burrow --version
+Quick tunnel:
+  --quick (or BURROW_QUICK=<spec>) opens a single tunnel straight away,
+  without reading a config file or saving anything to the state file.
+  <spec> is <resource-id>:<bastion>:<bastion-rg>:<local-port>:<remote-port>.
 
-Arguments:
-  config-file    Path to YAML configuration file (default: burrow.config.yaml)
+ASCII mode:
+  --ascii (or BURROW_ASCII=1, or ascii: true in the config) draws status
+  markers as text and leaves out emoji, for terminals, fonts and screen
+  readers that don't handle them.
 
-Configuration:
-  Looks for a config file in this order:
-    1. The path you pass as an argument
-    2. ./burrow.config.yaml
-    3. ~/.config/burrow.config.yaml
+Sessions:
+  session save <name> keeps the tunnel list of the last run under a name
+  (tunnels left running by a detach start again on restore); restore it
+  with --session <name>, or save and restore from the TUI with S.
+  session list and session delete <name> manage saved sessions.
+
+Read-only mode:
+  --read-only shows the machines, tunnels and certificate states without
+  letting anything be created, started, stopped or renewed, for on-call
+  observers and screen sharing. It writes no state and runs beside an
+  instance that already holds the config.
+
+Dry run:
+  --dry-run loads the config, checks certificates on disk and prints the
+  az commands each tunnel would run, without running az. Resource IDs and
+  the shared config come from their caches; what would be fetched is
+  listed instead. Exits non-zero on config errors, e.g. in CI.
+
+Importing machines:
+  import --query "<KQL>" runs an Azure Resource Graph query and adds each
+  VM it returns to the config, paired with a Bastion host in its VNet or a
+  peered one, e.g. import --query "Resources | where type =~
+  'microsoft.compute/virtualmachines' and tags.team == 'data'". Machines
+  already in the config are left alone. Needs az's resource-graph extension.
+  import --from-az-ssh-config does the same for the key directories `az ssh
+  config` left in ~/.ssh/az_ssh_config (and ~/.ssh/config), setting each
+  machine's ssh_config_path to its directory. import --from-state <file>
+  reads the VMs and Bastion hosts from a Terraform state, terraform show
+  -json or az deployment group show output (- for stdin).
+
+Service principals and managed identities:
+  auth: in the config signs in with a client secret, certificate or
+  federated token (workload identity) at startup, in an az profile of its
+  own under ~/.azure/burrow, for build agents and shared automation boxes.
+  AZURE_TENANT_ID, AZURE_CLIENT_ID, AZURE_CLIENT_SECRET and
+  AZURE_FEDERATED_TOKEN_FILE fill in what it leaves out. On an Azure VM,
+  auth: { managed_identity: true } signs in with the VM's managed identity.
+
+Shell completion:
+  completions <bash|zsh|fish> prints a completion script, e.g.
+  source <(az-burrow completions bash)
+
+Migrating from az scripts:
+  init --from-history scans your shell history for `az network bastion
+  tunnel` commands and prints matching machines and tunnels as config,
+  ready to review and save as burrow.config.yaml.
 
 For more information:
-  https://github.com/hegde-atri/az-burrow
-"#
+  https://github.com/hegde-atri/az-burrow"#;
+
+#[derive(Debug, Parser)]
+#[command(
+    name = "az-burrow",
+    version,
+    about = "A cosy TUI for managing Azure Bastion SSH tunnels",
+    after_help = AFTER_HELP,
+    args_conflicts_with_subcommands = true
+)]
+struct Cli {
+    /// Path to YAML configuration file (default: burrow.config.yaml)
+    #[arg(short, long, value_name = "FILE")]
+    config: Option<PathBuf>,
+    /// Same as --config
+    #[arg(value_name = "CONFIG_FILE", conflicts_with = "config")]
+    config_file: Option<PathBuf>,
+    /// Open one tunnel without a config file
+    #[arg(
+        long,
+        value_name = "SPEC",
+        env = "BURROW_QUICK",
+        hide_env_values = true
+    )]
+    quick: Option<String>,
+    /// Draw with ASCII only, without emoji
+    #[arg(long)]
+    ascii: bool,
+    /// Draw without colour (also NO_COLOR=1)
+    #[arg(long)]
+    no_color: bool,
+    /// Restore a saved session at startup
+    #[arg(
+        long,
+        value_name = "NAME",
+        conflicts_with = "quick",
+        add = ArgValueCompleter::new(completion::session_names)
+    )]
+    session: Option<String>,
+    /// Check the config and print the az commands it would run, then exit
+    #[arg(long, conflicts_with_all = ["quick", "session"])]
+    dry_run: bool,
+    /// Show tunnels and certificates without changing anything
+    #[arg(long, conflicts_with_all = ["quick", "session", "dry_run"])]
+    read_only: bool,
+    #[command(subcommand)]
+    command: Option<Command>,
+}
+
+#[derive(Debug, Subcommand)]
+enum Command {
+    /// Write a first config
+    Init {
+        /// Propose machines and tunnels from the az commands in shell history
+        #[arg(long, required = true)]
+        from_history: bool,
+    },
+    /// Add machines to the config from Azure
+    #[command(group(ArgGroup::new("source").required(true).args(["query", "from_az_ssh_config", "from_state"])))]
+    Import {
+        /// Resource Graph (KQL) query whose rows' `id`s are the VMs to add
+        #[arg(long, value_name = "KQL")]
+        query: Option<String>,
+        /// Add the machines `az ssh config` keeps keys for in ~/.ssh
+        #[arg(long)]
+        from_az_ssh_config: bool,
+        /// Add the VMs a Terraform state or `az deployment group show` output
+        /// declares (`-` for stdin)
+        #[arg(long, value_name = "FILE")]
+        from_state: Option<PathBuf>,
+        /// Path to YAML configuration file to add the machines to
+        #[arg(short, long, value_name = "FILE")]
+        config: Option<PathBuf>,
+    },
+    /// Print a shell completion script
+    Completions { shell: completion::Shell },
+    /// Save, list or delete named sessions
+    Session {
+        action: SessionAction,
+        /// Session name, for save and delete
+        #[arg(add = ArgValueCompleter::new(completion::session_names))]
+        name: Option<String>,
+        /// Path to YAML configuration file whose sessions to use
+        #[arg(short, long, value_name = "FILE")]
+        config: Option<PathBuf>,
+    },
+}
+
+#[derive(Debug, Clone, Copy, ValueEnum)]
+enum SessionAction {
+    /// Save the tunnels of the last run under a name
+    Save,
+    /// List saved sessions
+    List,
+    /// Delete a saved session
+    Delete,
+}
+
+/// Whether an on/off environment variable is set to anything but "" or "0".
+fn env_flag(name: &str) -> bool {
+    std::env::var(name).is_ok_and(|v| !matches!(v.as_str(), "" | "0"))
+}
+
+/// `init --from-history`: print config for the Bastion tunnels found in shell
+/// history. Nothing is written; the user reviews and saves it.
+fn init_from_history() -> Result<()> {
+    let mut found = Vec::new();
+    for path in migrate::history_files() {
+        let Ok(bytes) = std::fs::read(&path) else {
+            continue;
+        };
+        for inv in migrate::scan(&String::from_utf8_lossy(&bytes)) {
+            if !found.contains(&inv) {
+                found.push(inv);
+            }
+        }
+        eprintln!("Scanned {}", path.display());
+    }
+    let Some(yaml) = migrate::propose(&found) else {
+        eprintln!("No `az network bastion tunnel` commands found in shell history.");
+        return Ok(());
+    };
+    eprintln!(
+        "Found {} tunnel command(s). Review the config below and save it as burrow.config.yaml:\n",
+        found.len()
+    );
+    print!("{yaml}");
+    Ok(())
+}
+
+/// `session save|list|delete`: manage the sessions kept next to the config.
+/// Saving takes the tunnel list from the state file, as the last run left it.
+fn session_command(action: SessionAction, name: Option<String>, arg: Option<&Path>) -> Result<()> {
+    let config_path = config::resolve_config_path(arg)?;
+    let path = session::sessions_path(&config_path);
+    let mut sessions = session::load(&path)?;
+    let named = || name.clone().ok_or_else(|| eyre!("give the session a name"));
+    match action {
+        SessionAction::List => {
+            if sessions.sessions.is_empty() {
+                eprintln!("No saved sessions in {}.", path.display());
+            }
+            for s in &sessions.sessions {
+                let started = s.tunnels.iter().filter(|t| t.start).count();
+                println!(
+                    "{}\t{} tunnel(s), {started} started on restore",
+                    s.name,
+                    s.tunnels.len()
+                );
+            }
+        }
+        SessionAction::Save => {
+            let name = named()?;
+            let state = state::load(&state::state_path(&config_path));
+            if state.tunnels.is_empty() {
+                return Err(eyre!(
+                    "no tunnels to save: the state file next to {} has none",
+                    config_path.display()
+                ));
+            }
+            let tunnels = session::from_state(&state, cleanup::is_same_process);
+            let started = tunnels.iter().filter(|t| t.start).count();
+            eprintln!(
+                "Saved {} tunnel(s) as {name} ({started} started on restore).",
+                tunnels.len()
+            );
+            sessions.put(session::Session { name, tunnels });
+            session::save(&path, &sessions)?;
+        }
+        SessionAction::Delete => {
+            let name = named()?;
+            if !sessions.remove(&name) {
+                return Err(eyre!("no saved session named '{name}'"));
+            }
+            session::save(&path, &sessions)?;
+            eprintln!("Deleted session {name}.");
+        }
+    }
+    Ok(())
+}
+
+/// Sign in as the service principal or managed identity `auth:` names, if
+/// any, before anything else runs az. az must be configured with its profile
+/// already.
+async fn sign_in(auth: Option<&azure::auth::Auth>) -> Result<()> {
+    let Some(auth) = auth else {
+        return Ok(());
+    };
+    let login = auth.login().map_err(|e| eyre!(e))?;
+    eprintln!("Signing in as {}…", login.who());
+    login.run().await.map_err(|e| eyre!(e))
+}
+
+/// A machine an importer found, by name: its config keys, or why it can't
+/// be added.
+type Imported = (String, Result<Vec<(&'static str, String)>, String>);
+
+const NO_BASTION: &str = "no Bastion host in its VNet or a peered one";
+
+/// Where `import` finds machines.
+enum ImportSource<'a> {
+    /// `--query`: a Resource Graph query.
+    Query(&'a str),
+    /// `--from-az-ssh-config`.
+    AzSshConfig,
+    /// `--from-state`: a Terraform state or deployment, or `-` for stdin.
+    State(&'a Path),
+}
+
+/// `import`: append the machines found in `source` to the config, each with
+/// the Bastion host that reaches it. Those that can't be paired, and names
+/// the config already has, are reported and skipped.
+async fn import_command(source: ImportSource<'_>, arg: Option<&Path>) -> Result<()> {
+    let config_path = config::resolve_config_path(arg)?;
+    let exists = config_path.exists();
+    let mut names: Vec<String> = Vec::new();
+    if exists {
+        let cfg = config::load(&config_path)?;
+        azure::configure(cfg.az_settings());
+        sign_in(cfg.auth.as_ref()).await?;
+        names.extend(cfg.machines.into_iter().map(|m| m.name));
+    }
+
+    let found = match source {
+        ImportSource::Query(kql) => import_query(kql).await?,
+        ImportSource::AzSshConfig => import_az_ssh_config().await?,
+        ImportSource::State(path) => import_state(path).await?,
+    };
+    let mut entries = Vec::new();
+    for (name, fields) in found {
+        if names.contains(&name) {
+            eprintln!("Skipped {name}: the config already has a machine by that name");
+            continue;
+        }
+        let fields = match fields {
+            Ok(fields) => fields,
+            Err(why) => {
+                eprintln!("Skipped {name}: {why}");
+                continue;
+            }
+        };
+        eprintln!("Added {name}");
+        names.push(name);
+        entries.push(fields);
+    }
+    if entries.is_empty() {
+        return Ok(());
+    }
+    let add = |text: &str| {
+        entries.iter().fold(text.to_string(), |text, fields| {
+            let fields: Vec<(&str, &str)> = fields.iter().map(|(k, v)| (*k, v.as_str())).collect();
+            config_edit::add_machine(&text, &fields)
+        })
+    };
+    if exists {
+        config_edit::update(&config_path, |text| Some(add(text)))?;
+    } else {
+        std::fs::write(&config_path, add(""))?;
+    }
+    eprintln!(
+        "Wrote {} machine(s) to {}.",
+        entries.len(),
+        config_path.display()
+    );
+    Ok(())
+}
+
+/// `import --query`: the VMs a Resource Graph query returns.
+async fn import_query(kql: &str) -> Result<Vec<Imported>> {
+    let found = azure::graph::find_machines(kql).await?;
+    if found.is_empty() {
+        eprintln!("The query returned no VMs.");
+    }
+    Ok(imported(&found))
+}
+
+fn imported(found: &[azure::graph::Found]) -> Vec<Imported> {
+    found
+        .iter()
+        .map(|vm| {
+            let fields = vm.machine_fields().ok_or_else(|| NO_BASTION.to_string());
+            (vm.name().to_string(), fields)
+        })
+        .collect()
+}
+
+/// `import --from-state`: the VMs a Terraform state or deployment declares.
+/// When it declares a single Bastion host, every VM goes through that one;
+/// otherwise each is paired as `--query` pairs them.
+async fn import_state(path: &Path) -> Result<Vec<Imported>> {
+    let text = if path == Path::new("-") {
+        std::io::read_to_string(std::io::stdin())?
+    } else {
+        std::fs::read_to_string(path).wrap_err_with(|| format!("reading {}", path.display()))?
+    };
+    let declared = iac::resources(&text);
+    if declared.vms.is_empty() {
+        eprintln!("No VMs found in {}.", path.display());
+        return Ok(Vec::new());
+    }
+    let found = match declared.bastions.as_slice() {
+        [bastion] => declared
+            .vms
+            .into_iter()
+            .map(|vm_id| azure::graph::Found {
+                vm_id,
+                bastion_id: Some(bastion.clone()),
+            })
+            .collect(),
+        _ => azure::graph::with_bastions(declared.vms).await?,
+    };
+    Ok(imported(&found))
+}
+
+/// `import --from-az-ssh-config`: a machine for each key directory `az ssh
+/// config` left in `~/.ssh`, with `ssh_config_path` (and `ssh_key`) set so
+/// az-burrow keeps renewing the certificate there.
+async fn import_az_ssh_config() -> Result<Vec<Imported>> {
+    let ssh_dir = home::home_dir()
+        .ok_or_else(|| eyre!("could not determine home directory"))?
+        .join(".ssh");
+    let dirs = az_ssh_config::key_dirs(&ssh_dir);
+    if dirs.is_empty() {
+        eprintln!(
+            "No az ssh config key directories found in {}.",
+            ssh_dir.display()
+        );
+        return Ok(Vec::new());
+    }
+    let names = azure::graph::ssh_config_names().await?;
+    let vms: Vec<Result<&str, String>> = dirs.iter().map(|d| d.vm(&names)).collect();
+    let ids: Vec<String> = vms.iter().flatten().map(|id| id.to_string()).collect();
+    let mut paired = azure::graph::with_bastions(ids).await?.into_iter();
+    Ok(dirs
+        .iter()
+        .zip(vms)
+        .map(|(dir, vm)| {
+            let shown = config::contract_tilde(&dir.dir);
+            if let Err(why) = vm {
+                return (shown, Err(why));
+            }
+            let vm = paired.next().expect("one per VM");
+            let Some(mut fields) = vm.machine_fields() else {
+                return (vm.name().to_string(), Err(NO_BASTION.to_string()));
+            };
+            fields.push(("ssh_config_path", shown));
+            if dir.key != "id_rsa" {
+                fields.push(("ssh_key", dir.key.clone()));
+            }
+            (vm.name().to_string(), Ok(fields))
+        })
+        .collect())
+}
+
+/// `--dry-run`: go through startup as far as building the tunnels, printing
+/// what would run instead of running `az`, so a config can be checked in CI.
+/// Certificates are only read from disk. Fails only on config errors.
+fn dry_run(config_path: &Path, local: config::Config) -> Result<()> {
+    println!("Config: {}", config_path.display());
+    let mut cfg = match local.config_source.clone() {
+        None => local,
+        Some(url) => match azure::shared::cached(config_path) {
+            Some(shared) => {
+                println!("Shared config: {url} (cached copy)");
+                let cfg = local.over(shared);
+                cfg.validate()?;
+                cfg
+            }
+            None => {
+                println!("Shared config: {url} is not cached; would download it");
+                println!("  Only the local config is checked below.");
+                local
+            }
+        },
+    };
+    azure::configure(cfg.az_settings());
+    if let Some(auth) = &cfg.auth {
+        let login = auth.login().map_err(|e| eyre!(e))?;
+        println!("Would sign in: {}", login.describe());
+    }
+    let lookups = azure::resolve::resolve_from_cache(
+        &mut cfg.machines,
+        &azure::resolve::cache_path(config_path),
     );
+    for lookup in &lookups {
+        println!("Would look up: {lookup}");
+    }
+    let cert_settings = cfg.cert;
+    let machines: Vec<Machine> = cfg
+        .machines
+        .into_iter()
+        .map(|m| m.into_machine(cert_settings))
+        .collect();
+
+    println!("\nCertificates:");
+    let mut any_keys = false;
+    for m in &machines {
+        let Some(files) = m.key_files() else {
+            continue;
+        };
+        any_keys = true;
+        let missing: Vec<&Path> = [&files.private_key, &files.public_key]
+            .into_iter()
+            .map(PathBuf::as_path)
+            .filter(|p| !p.exists())
+            .collect();
+        if !missing.is_empty() {
+            for path in missing {
+                println!("  {}: missing {}", m.name, path.display());
+            }
+            continue;
+        }
+        match azure::cert::cert_state(&files.cert, m.cert_timing) {
+            Some((expires_at, CertStatus::Valid)) => println!(
+                "  {}: {}, expires {}",
+                m.name,
+                CertStatus::Valid.label(),
+                expires_at.format("%Y-%m-%d %H:%M UTC")
+            ),
+            state => {
+                let why = match state {
+                    Some((_, status)) => status.label(),
+                    None => "no certificate yet",
+                };
+                println!(
+                    "  {}: {why}; would run: az ssh cert --file {} --public-key-file {}",
+                    m.name,
+                    files.cert.display(),
+                    files.public_key.display()
+                );
+            }
+        }
+    }
+    if !any_keys {
+        println!("  (no machine sets ssh_config_path)");
+    }
+
+    let mut tunnels = Vec::new();
+    add_config_tunnels(&machines, cfg.tunnels, &mut tunnels, &mut Vec::new());
+    println!("\nTunnels:");
+    if tunnels.is_empty() {
+        println!("  (none in the config)");
+    }
+    for t in &tunnels {
+        println!(
+            "  {} ({} {}:{})",
+            t.display_name(),
+            t.machine.name,
+            t.local_port,
+            t.remote_port
+        );
+        for line in azure::tunnel::command_lines(t) {
+            println!("    $ {line}");
+        }
+    }
+    Ok(())
 }
 
 #[tokio::main]
 async fn main() -> Result<()> {
+    // Answers the completion scripts' calls (`COMPLETE=<shell>`) and exits.
+    clap_complete::CompleteEnv::with_factory(Cli::command)
+        .var(completion::VAR)
+        .complete();
     color_eyre::install()?;
 
-    let args: Vec<String> = std::env::args().skip(1).collect();
-    if let Some(first) = args.first() {
-        match first.as_str() {
-            "-h" | "--help" => {
-                print_help();
-                return Ok(());
-            }
-            "--version" => {
-                println!("Az-Burrow v{VERSION}");
-                return Ok(());
-            }
-            _ => {}
+    let cli = Cli::parse();
+    match cli.command {
+        Some(Command::Init { .. }) => return init_from_history(),
+        Some(Command::Import {
+            query,
+            from_state,
+            config,
+            ..
+        }) => {
+            let source = match (&query, &from_state) {
+                (Some(kql), _) => ImportSource::Query(kql),
+                (_, Some(path)) => ImportSource::State(path),
+                _ => ImportSource::AzSshConfig,
+            };
+            return import_command(source, config.as_deref()).await;
+        }
+        Some(Command::Completions { shell }) => {
+            print!("{}", completion::script(shell, Cli::command().get_name()));
+            return Ok(());
         }
+        Some(Command::Session {
+            action,
+            name,
+            config,
+        }) => return session_command(action, name, config.as_deref()),
+        None => {}
     }
 
-    let config_path = config::resolve_config_path(args.first().map(|s| s.as_str()))?;
-    let cfg = config::load(&config_path)?;
+    // `--quick <spec>` / BURROW_QUICK: one ad-hoc tunnel, no config file, and
+    // no state read or written.
+    let quick_spec = cli.quick.filter(|s| !s.trim().is_empty());
+    let quick = quick_spec.is_some();
+    let (config_path, mut cfg, signed_in) = match &quick_spec {
+        Some(spec) => (
+            std::env::current_dir()?.join("burrow.config.yaml"),
+            config::quick(spec)?,
+            None,
+        ),
+        None => {
+            let arg = cli.config.or(cli.config_file);
+            let path = config::resolve_config_path(arg.as_deref())?;
+            let local = config::load(&path)?;
+            if cli.dry_run {
+                return dry_run(&path, local);
+            }
+            // The shared config is fetched with the local file's az settings.
+            azure::configure(local.az_settings());
+            sign_in(local.auth.as_ref()).await?;
+            let signed_in = local.auth.clone();
+            let cfg = azure::shared::with_shared(local, &path, false).await?;
+            (path, cfg, signed_in)
+        }
+    };
+    azure::configure(cfg.az_settings());
+    if cfg.auth != signed_in {
+        sign_in(cfg.auth.as_ref()).await?;
+    }
+    // With `auth:` az-burrow signs in on its own; otherwise az may need the
+    // user to, from inside the TUI.
+    let interactive_login = cfg.auth.is_none() && !cli.read_only;
+    // One instance per config. Claimed before the state file is read, so an
+    // instance taken over has saved its tunnels by then. A read-only observer
+    // runs beside it.
+    let instance_lock = if quick || cli.read_only {
+        None
+    } else {
+        match claim_instance(&config_path, cfg.stop_timeout()).await? {
+            Some(held) => Some(held),
+            None => return Ok(()),
+        }
+    };
+    let shared = cfg.config_source.is_some();
+    let (tunnel_retry, cert_retry) = (cfg.tunnel_retry(), cfg.cert_retry());
+    let cert_settings = cfg.cert;
+    let ssh_agent = cfg.ssh_agent.unwrap_or(false);
+    let stop_timeout = cfg.stop_timeout();
+    let start_timeout = cfg.start_timeout();
+    let log_lines = cfg.log_lines();
+    let policy = cfg.policy.take().unwrap_or_default();
+    let webhook_url = cfg.notifications.webhook_url.take();
+    let tmux = cfg.tmux.unwrap_or_default();
+    tui::glyphs::set_ascii(cli.ascii || env_flag("BURROW_ASCII") || cfg.ascii.unwrap_or(false));
+    tui::theme::set(cfg.theme.unwrap_or_default());
+    // NO_COLOR (no-color.org): any non-empty value turns colour off.
+    tui::theme::set_no_color(
+        cli.no_color || std::env::var("NO_COLOR").is_ok_and(|v| !v.is_empty()),
+    );
+    let audit_log = cfg
+        .audit_log
+        .as_deref()
+        .map(|p| std::path::PathBuf::from(config::expand_tilde(p)));
+    let log_files = cfg.log_files.unwrap_or(false);
+    let log_dir = log_files.then(tunnel_log::log_dir).flatten();
+    let metrics_textfile = cfg
+        .metrics_textfile
+        .as_deref()
+        .map(|p| std::path::PathBuf::from(config::expand_tilde(p)));
+    azure::resolve::resolve_resource_ids(
+        &mut cfg.machines,
+        &azure::resolve::cache_path(&config_path),
+        |name| eprintln!("Looking up resource ID for {name}…"),
+    )
+    .await?;
 
     let machines: Vec<Machine> = cfg
         .machines
         .into_iter()
-        .map(|m| Machine {
-            name: m.name,
-            resource_group: m.resource_group,
-            target_resource_id: m.target_resource_id,
-            bastion_name: m.bastion_name,
-            bastion_resource_group: m.bastion_resource_group,
-            bastion_subscription: m.bastion_subscription,
-            ssh_config_path: m.ssh_config_path,
-        })
+        .map(|m| m.into_machine(cert_settings))
         .collect();
 
     let state_path = state::state_path(&config_path);
-    let restored = state::load(&state_path);
-    let tunnels: Vec<Tunnel> = restored
+    // Only an existing state file from another version counts as an upgrade;
+    // a first run has nothing new to announce.
+    let upgraded = !quick && state_path.exists();
+    let restored = if quick {
+        state::PersistedState::default()
+    } else {
+        state::load(&state_path)
+    };
+    let upgraded = upgraded && restored.last_seen_version.as_deref() != Some(VERSION);
+    // `--session <name>`: looked up now, so a typo fails before the TUI opens.
+    let session = match &cli.session {
+        Some(name) => {
+            let sessions = session::load(&session::sessions_path(&config_path))?;
+            let found = sessions.get(name).cloned().ok_or_else(|| {
+                eyre!("no saved session named '{name}' (see `az-burrow session list`)")
+            })?;
+            Some(found)
+        }
+        None => None,
+    };
+    // Printed before the TUI takes the screen they would be lost, so
+    // problems found from here on are reported inside it.
+    let mut warnings = Vec::new();
+    if log_files && log_dir.is_none() {
+        warnings.push("log_files is on, but there is no home directory to keep logs in".into());
+    }
+    for m in &machines {
+        if let Some(files) = m.key_files().filter(|f| !f.private_key.exists()) {
+            warnings.push(format!(
+                "{}: SSH key {} not found, so its certificate can't be generated",
+                m.name,
+                files.private_key.display()
+            ));
+        }
+    }
+    let mut dropped: Vec<String> = Vec::new();
+    let (mut tunnels, mut detached): (Vec<Tunnel>, Vec<Option<Detached>>) = restored
         .tunnels
         .into_iter()
         .filter_map(|p| {
-            machines
-                .iter()
-                .find(|m| m.name == p.machine)
-                .map(|m| Tunnel {
+            let machine = machines.iter().find(|m| m.name == p.machine);
+            if machine.is_none() && !dropped.contains(&p.machine) {
+                dropped.push(p.machine.clone());
+            }
+            machine.map(|m| {
+                let tunnel = Tunnel {
                     id: TunnelId(0), // reassigned by App::new
                     machine: m.clone(),
                     local_port: p.local_port,
@@ -95,21 +725,58 @@ async fn main() -> Result<()> {
                     status: TunnelStatus::Inactive,
                     cert_status: None,
                     cert_expires_in: None,
-                })
+                    name: None,
+                    depends: None,
+                    group: p.group,
+                    instance: p.instance,
+                    hooks: Default::default(),
+                    color: p.color,
+                    icon: p.icon,
+                    ssh: None,
+                    aks: None,
+                    database: None,
+                    note: p.note,
+                    bind_address: None,
+                };
+                let left_running = p
+                    .pid
+                    .zip(p.pid_started)
+                    .map(|(pid, started)| Detached { pid, started });
+                (tunnel, left_running)
+            })
         })
-        .collect();
+        .unzip();
+    if !dropped.is_empty() {
+        warnings.push(format!(
+            "Saved tunnels to {} were dropped: no such machine in the config",
+            dropped.join(", ")
+        ));
+    }
 
-    let (tx, rx) = tokio::sync::mpsc::unbounded_channel();
-    let tunnel_mgr = TunnelManager::new(tx.clone());
-    let cert_mgr = CertManager::new(tx.clone());
+    add_config_tunnels(&machines, cfg.tunnels, &mut tunnels, &mut detached);
 
-    for m in &machines {
-        if let Some(p) = &m.ssh_config_path {
-            if !p.is_empty() {
-                cert_mgr.register(&m.name, p);
-            }
-        }
-    }
+    // Tunnels, certificates, the shared config and webhooks all publish to
+    // one bus; the TUI is its subscriber.
+    let bus = Bus::new();
+    let rx = bus.subscribe();
+    let tunnel_mgr = TunnelManager::new(bus.clone())
+        .with_stop_timeout(stop_timeout)
+        .with_log_dir(log_dir)
+        .with_log_lines(log_lines);
+    let cert_mgr = CertManager::new(bus.clone())
+        .with_retry(cert_retry)
+        .with_ssh_agent(ssh_agent)
+        // A read-only instance leaves renewals to the one that owns the tunnels.
+        .with_paused(cli.read_only);
+
+    // Certificates are read in the background; their states come in as
+    // events once the TUI is up.
+    cert_mgr.register_all(
+        machines
+            .iter()
+            .filter_map(|m| Some((m.name.clone(), m.key_files()?, m.cert_timing)))
+            .collect(),
+    );
     cert_mgr.start_monitoring();
 
     install_panic_hook();
@@ -131,11 +798,53 @@ async fn main() -> Result<()> {
         tunnel_mgr,
         cert_mgr,
     );
+    app.reattach(&detached);
+    app.sessions_path = (!quick).then(|| session::sessions_path(&config_path));
+    if !quick {
+        let path = recent::recent_path(&config_path);
+        app.recent = recent::load(&path);
+        app.recent_path = Some(path);
+    }
+    if let Some(session) = &session {
+        app.restore_session(session);
+    }
+    app.report_startup(&warnings);
+    app.busy.start("account", "Checking az account");
+    app.tunnel_mgr.fetch_account();
+    app.refresh_token();
+    app.config_path = (!quick).then(|| config::contract_tilde(&config_path));
+    app.metrics_textfile = metrics_textfile;
+    app.tunnel_retry = tunnel_retry;
+    app.start_timeout = start_timeout;
+    app.audit_log = audit_log;
+    app.instance_lock = instance_lock;
+    app.tmux = ssh::in_tmux().then_some(tmux);
+    app.policy = policy;
+    app.webhook = webhook_url.map(|url| webhook::Webhook::new(url, bus.clone()));
+    app.wsl_hint = wsl::detect().and_then(wsl::port_hint);
+    app.interactive_login = interactive_login;
+    if !quick {
+        app.shared_config = Some(azure::shared::SharedConfig::new(
+            config_path,
+            shared,
+            bus.clone(),
+        ));
+    }
+    if quick {
+        app.ephemeral = true;
+        app.start_tunnel(0);
+    }
+    if cli.read_only {
+        app.set_read_only();
+    }
+    if upgraded {
+        app.show_whats_new();
+    }
     let run_result = app.run(&mut terminal, rx).await;
 
     // Belt-and-suspenders: ensure no `az` child survives regardless of how run()
-    // exited. The happy path already called stop_all() inside run(); this is
-    // idempotent and also covers the case where run() returned an error early.
+    // exited. The happy path already called stop_all() (or detach_all()) inside
+    // run(); this is idempotent and also covers run() returning an error early.
     app.tunnel_mgr.stop_all();
 
     // Always restore the terminal; ignore teardown errors so they can't mask the
@@ -143,9 +852,130 @@ async fn main() -> Result<()> {
     let _ = disable_raw_mode();
     let _ = execute!(stdout(), LeaveAlternateScreen);
 
+    if !app.leftovers.is_empty() {
+        eprintln!("These tunnels did not exit and may still hold their ports:");
+        for left in &app.leftovers {
+            eprintln!("  {left}");
+        }
+    }
     run_result
 }
 
+/// Config-declared tunnels take over a matching restored entry (keeping its
+/// position and any detached PID); otherwise they are appended. A `ports`
+/// entry becomes one tunnel per pair, grouped as a single connection.
+fn add_config_tunnels(
+    machines: &[Machine],
+    configs: Vec<config::TunnelConfig>,
+    tunnels: &mut Vec<Tunnel>,
+    detached: &mut Vec<Option<Detached>>,
+) {
+    let mut next_group = tunnels.iter().filter_map(|t| t.group).max().unwrap_or(0) + 1;
+    for tc in configs {
+        let Some(m) = machines.iter().find(|m| m.name == tc.machine) else {
+            continue;
+        };
+        // Already validated by Config::validate.
+        let pairs = tc.port_pairs().unwrap_or_default();
+        let group = (pairs.len() > 1).then(|| {
+            next_group += 1;
+            next_group - 1
+        });
+        let hooks = tc.hooks();
+        // Already validated by Config::validate.
+        let ssh = tc.ssh_forward().unwrap_or_default();
+        let aks = tc.aks();
+        let depends = tc.wait_for.map(|tunnel| Dependency {
+            tunnel,
+            // Already validated by Config::validate.
+            check: tc
+                .ready_check
+                .as_deref()
+                .and_then(|c| ReadyCheck::parse(c).ok()),
+        });
+        for (local, remote) in pairs {
+            let (local_port, remote_port) = (local.to_string(), remote.to_string());
+            match tunnels.iter_mut().find(|t| {
+                t.machine.name == tc.machine
+                    && t.local_port == local_port
+                    && t.remote_port == remote_port
+            }) {
+                Some(t) => {
+                    t.name = Some(tc.name.clone());
+                    t.depends = depends.clone();
+                    t.group = group;
+                    t.hooks = hooks.clone();
+                    t.color = tc.color.or(t.color);
+                    t.icon = tc.icon.clone().or(t.icon.take());
+                    t.ssh = ssh.clone();
+                    t.aks = aks.clone();
+                    t.database = tc.database.clone();
+                    t.note = tc.note.clone().or(t.note.take());
+                    t.bind_address = tc.bind_address;
+                }
+                None => {
+                    tunnels.push(Tunnel {
+                        id: TunnelId(0),
+                        machine: m.clone(),
+                        local_port,
+                        remote_port,
+                        status: TunnelStatus::Inactive,
+                        cert_status: None,
+                        cert_expires_in: None,
+                        name: Some(tc.name.clone()),
+                        depends: depends.clone(),
+                        group,
+                        instance: m.instance_id.clone(),
+                        hooks: hooks.clone(),
+                        color: tc.color,
+                        icon: tc.icon.clone(),
+                        ssh: ssh.clone(),
+                        aks: aks.clone(),
+                        database: tc.database.clone(),
+                        note: tc.note.clone(),
+                        bind_address: tc.bind_address,
+                    });
+                    detached.push(None);
+                }
+            }
+        }
+    }
+}
+
+/// Claim `burrow.lock` for this config, offering to take over from an instance
+/// already running against it. `None` when the user declines.
+async fn claim_instance(
+    config_path: &Path,
+    stop_timeout: Duration,
+) -> Result<Option<lock::InstanceLock>> {
+    let path = lock::lock_path(config_path);
+    let holder = match lock::acquire(&path)? {
+        lock::Claim::Acquired(held) => return Ok(Some(held)),
+        lock::Claim::Held(pid) => pid,
+    };
+    eprintln!(
+        "az-burrow is already running for {} (pid {holder}).",
+        config_path.display()
+    );
+    if !std::io::stdin().is_terminal() {
+        return Err(eyre!(
+            "another az-burrow (pid {holder}) is using this config; quit it first"
+        ));
+    }
+    // Attaching needs a control socket the running instance doesn't have yet.
+    eprintln!("Attaching to it isn't supported yet. Taking over stops its tunnels.");
+    eprint!("Take over? [y/N] ");
+    let mut answer = String::new();
+    std::io::stdin().read_line(&mut answer)?;
+    if !matches!(answer.trim(), "y" | "Y" | "yes") {
+        return Ok(None);
+    }
+    eprintln!("Waiting for pid {holder} to stop its tunnels…");
+    lock::take_over(&path, holder, stop_timeout + TAKEOVER_GRACE)
+        .await
+        .map(Some)
+}
+
 /// Restore the terminal before printing a panic, so a crash never leaves a broken TTY.
 fn install_panic_hook() {
     let original = std::panic::take_hook();
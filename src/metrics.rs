@@ -0,0 +1,163 @@
+//! Tunnel state for Prometheus, written as a node_exporter textfile-collector
+//! file (`metrics_textfile`) for setups that can't expose a metrics port.
+//! The file is replaced atomically so the collector never reads half of it.
+
+use crate::model::{Tunnel, TunnelStatus};
+use chrono::{DateTime, Utc};
+use std::fmt::Write as _;
+use std::path::Path;
+use std::time::Duration;
+
+/// How often the running app rewrites the file.
+pub const WRITE_INTERVAL: Duration = Duration::from_secs(15);
+
+const STATES: [&str; 7] = [
+    "inactive",
+    "starting",
+    "connecting",
+    "active",
+    "waiting",
+    "stopping",
+    "error",
+];
+
+fn state_name(status: &TunnelStatus) -> &'static str {
+    match status {
+        TunnelStatus::Inactive => "inactive",
+        TunnelStatus::Starting => "starting",
+        TunnelStatus::Connecting => "connecting",
+        TunnelStatus::Active => "active",
+        TunnelStatus::Waiting(_) => "waiting",
+        TunnelStatus::Stopping => "stopping",
+        TunnelStatus::Error(_) => "error",
+    }
+}
+
+/// Escape a label value per the exposition format.
+fn escape(value: &str) -> String {
+    value
+        .replace('\\', "\\\\")
+        .replace('"', "\\\"")
+        .replace('\n', "\\n")
+}
+
+/// The metrics for `tunnels`, plus seconds until each certificate in
+/// `cert_expiry` (machine name -> expiry) runs out, negative once expired.
+pub fn render(
+    tunnels: &[Tunnel],
+    cert_expiry: &[(String, DateTime<Utc>)],
+    now: DateTime<Utc>,
+) -> String {
+    let labels: Vec<String> = tunnels
+        .iter()
+        .map(|t| {
+            format!(
+                "tunnel=\"{}\",machine=\"{}\",local_port=\"{}\",remote_port=\"{}\"",
+                escape(t.display_name()),
+                escape(&t.machine.name),
+                escape(&t.local_port),
+                escape(&t.remote_port)
+            )
+        })
+        .collect();
+
+    let mut out = String::new();
+    out.push_str("# HELP az_burrow_tunnel_up Whether the tunnel is active.\n");
+    out.push_str("# TYPE az_burrow_tunnel_up gauge\n");
+    for (t, l) in tunnels.iter().zip(&labels) {
+        let up = u8::from(t.status == TunnelStatus::Active);
+        let _ = writeln!(out, "az_burrow_tunnel_up{{{l}}} {up}");
+    }
+    out.push_str(
+        "# HELP az_burrow_tunnel_state Current tunnel state (1 for the state it is in).\n",
+    );
+    out.push_str("# TYPE az_burrow_tunnel_state gauge\n");
+    for (t, l) in tunnels.iter().zip(&labels) {
+        let current = state_name(&t.status);
+        for state in STATES {
+            let v = u8::from(state == current);
+            let _ = writeln!(out, "az_burrow_tunnel_state{{{l},state=\"{state}\"}} {v}");
+        }
+    }
+    out.push_str("# HELP az_burrow_cert_expiry_seconds Seconds until the machine's SSH certificate expires.\n");
+    out.push_str("# TYPE az_burrow_cert_expiry_seconds gauge\n");
+    for (machine, expires_at) in cert_expiry {
+        let secs = (*expires_at - now).num_seconds();
+        let _ = writeln!(
+            out,
+            "az_burrow_cert_expiry_seconds{{machine=\"{}\"}} {secs}",
+            escape(machine)
+        );
+    }
+    out
+}
+
+/// Replace `path` with `text` via a temp file in the same directory, as the
+/// textfile collector requires.
+pub fn write(path: &Path, text: &str) -> std::io::Result<()> {
+    let mut tmp = path.as_os_str().to_owned();
+    tmp.push(".tmp");
+    std::fs::write(&tmp, text)?;
+    std::fs::rename(&tmp, path)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::model::{Machine, TunnelId};
+
+    fn tunnel(name: &str, status: TunnelStatus) -> Tunnel {
+        Tunnel {
+            id: TunnelId(1),
+            machine: Machine::test("vm-1"),
+            local_port: "2022".into(),
+            remote_port: "22".into(),
+            status,
+            cert_status: None,
+            cert_expires_in: None,
+            name: Some(name.into()),
+            depends: None,
+            group: None,
+            instance: None,
+            hooks: Default::default(),
+            color: None,
+            icon: None,
+            ssh: None,
+            aks: None,
+            database: None,
+            note: None,
+            bind_address: None,
+        }
+    }
+
+    #[test]
+    fn renders_tunnel_states_and_cert_expiry() {
+        let now = Utc::now();
+        let text = render(
+            &[tunnel("db", TunnelStatus::Active)],
+            &[("vm-1".into(), now + chrono::Duration::seconds(1800))],
+            now,
+        );
+        let labels = "tunnel=\"db\",machine=\"vm-1\",local_port=\"2022\",remote_port=\"22\"";
+        assert!(text.contains(&format!("az_burrow_tunnel_up{{{labels}}} 1\n")));
+        assert!(text.contains(&format!(
+            "az_burrow_tunnel_state{{{labels},state=\"active\"}} 1\n"
+        )));
+        assert!(text.contains(&format!(
+            "az_burrow_tunnel_state{{{labels},state=\"error\"}} 0\n"
+        )));
+        assert!(text.contains("az_burrow_cert_expiry_seconds{machine=\"vm-1\"} 1800\n"));
+        assert!(text.contains("# TYPE az_burrow_tunnel_up gauge\n"));
+    }
+
+    #[test]
+    fn label_values_are_escaped() {
+        let text = render(
+            &[tunnel("say \"hi\"\\", TunnelStatus::Inactive)],
+            &[],
+            Utc::now(),
+        );
+        assert!(text.contains("tunnel=\"say \\\"hi\\\"\\\\\""));
+        assert!(text.contains("} 0\n"));
+    }
+}
@@ -0,0 +1,293 @@
+//! `az-burrow init --from-history`: onboarding for people who already run
+//! `az network bastion tunnel` by hand. Shell history is scanned for those
+//! commands, duplicates are dropped, and the machines and tunnels they reach
+//! are printed as config for the user to review and save.
+
+use serde::Serialize;
+use std::path::PathBuf;
+
+/// One `az network bastion tunnel` command found in history.
+#[derive(Debug, Clone, PartialEq, Eq, Hash)]
+pub struct Invocation {
+    pub bastion_name: String,
+    pub bastion_resource_group: String,
+    pub subscription: Option<String>,
+    pub target_resource_id: Option<String>,
+    pub target_ip: Option<String>,
+    pub remote_port: u16,
+    pub local_port: u16,
+}
+
+/// History files of the shells az-burrow users are likely to run `az` from,
+/// `$HISTFILE` first. Missing files are left for the caller to skip.
+pub fn history_files() -> Vec<PathBuf> {
+    let mut files: Vec<PathBuf> = std::env::var_os("HISTFILE")
+        .map(PathBuf::from)
+        .into_iter()
+        .collect();
+    if let Some(home) = home::home_dir() {
+        files.push(home.join(".bash_history"));
+        files.push(home.join(".zsh_history"));
+        files.push(home.join(".local/share/fish/fish_history"));
+    }
+    if let Some(appdata) = std::env::var_os("APPDATA") {
+        files.push(
+            PathBuf::from(appdata)
+                .join("Microsoft/Windows/PowerShell/PSReadLine/ConsoleHost_history.txt"),
+        );
+    }
+    files.dedup();
+    files
+}
+
+/// The Bastion tunnel commands in a history file's text, oldest first and
+/// without duplicates.
+pub fn scan(text: &str) -> Vec<Invocation> {
+    let mut found: Vec<Invocation> = Vec::new();
+    for line in text.lines() {
+        let Some(inv) = parse_command(strip_history_prefix(line)) else {
+            continue;
+        };
+        if !found.contains(&inv) {
+            found.push(inv);
+        }
+    }
+    found
+}
+
+/// The command on a history line: zsh's extended format prefixes
+/// `: <time>:<duration>;`, fish's YAML-ish file `- cmd: `.
+fn strip_history_prefix(line: &str) -> &str {
+    let line = line.trim();
+    if let Some(cmd) = line.strip_prefix("- cmd: ") {
+        return cmd;
+    }
+    if line.starts_with(": ") {
+        if let Some((_, cmd)) = line.split_once(';') {
+            return cmd;
+        }
+    }
+    line
+}
+
+/// Parse one `az network bastion tunnel ...` command line.
+fn parse_command(line: &str) -> Option<Invocation> {
+    let words = split_words(line);
+    let start = words
+        .windows(4)
+        .position(|w| w == ["az", "network", "bastion", "tunnel"])?;
+    let mut flags = std::collections::HashMap::new();
+    let mut rest = words[start + 4..].iter();
+    while let Some(word) = rest.next() {
+        if matches!(word.as_str(), "|" | "&&" | "||" | ";" | "&") {
+            break;
+        }
+        if let Some((flag, value)) = word.split_once('=').filter(|_| word.starts_with("--")) {
+            flags.insert(flag.to_string(), value.to_string());
+        } else if word.starts_with('-') {
+            if let Some(value) = rest.next() {
+                flags.insert(word.clone(), value.clone());
+            }
+        }
+    }
+    let get = |long: &str, short: &str| {
+        flags
+            .get(long)
+            .or_else(|| flags.get(short))
+            .filter(|v| !v.is_empty())
+            .cloned()
+    };
+    let port = |long: &str| get(long, long).and_then(|p| p.parse::<u16>().ok());
+    let target_resource_id = get("--target-resource-id", "--target-resource-id");
+    let target_ip = get("--target-ip-address", "--target-ip-address");
+    if target_resource_id.is_none() && target_ip.is_none() {
+        return None;
+    }
+    Some(Invocation {
+        bastion_name: get("--name", "-n")?,
+        bastion_resource_group: get("--resource-group", "-g")?,
+        subscription: get("--subscription", "--subscription"),
+        target_resource_id,
+        target_ip,
+        remote_port: port("--resource-port")?,
+        local_port: port("--port")?,
+    })
+}
+
+/// Split a command line into words, honouring single and double quotes and
+/// backslash escapes the way a POSIX shell would for plain arguments.
+fn split_words(line: &str) -> Vec<String> {
+    let mut words = Vec::new();
+    let mut word = String::new();
+    let mut in_word = false;
+    let mut quote: Option<char> = None;
+    let mut chars = line.chars();
+    while let Some(c) = chars.next() {
+        match (quote, c) {
+            (Some(q), c) if c == q => quote = None,
+            (Some(_), c) => word.push(c),
+            (None, '\'' | '"') => {
+                quote = Some(c);
+                in_word = true;
+            }
+            (None, '\\') => {
+                if let Some(next) = chars.next() {
+                    word.push(next);
+                    in_word = true;
+                }
+            }
+            (None, c) if c.is_whitespace() => {
+                if in_word {
+                    words.push(std::mem::take(&mut word));
+                    in_word = false;
+                }
+            }
+            (None, c) => {
+                word.push(c);
+                in_word = true;
+            }
+        }
+    }
+    if in_word {
+        words.push(word);
+    }
+    words
+}
+
+#[derive(Serialize)]
+struct ProposedConfig {
+    machines: Vec<ProposedMachine>,
+    tunnels: Vec<ProposedTunnel>,
+}
+
+#[derive(Serialize)]
+struct ProposedMachine {
+    name: String,
+    resource_group: String,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    target_resource_id: Option<String>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    target_ip: Option<String>,
+    bastion_name: String,
+    bastion_resource_group: String,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    bastion_subscription: Option<String>,
+}
+
+#[derive(Serialize)]
+struct ProposedTunnel {
+    name: String,
+    machine: String,
+    local_port: u16,
+    remote_port: u16,
+}
+
+/// Config YAML with a machine per distinct target and a tunnel per distinct
+/// port pair, or `None` when there is nothing to propose.
+pub fn propose(invocations: &[Invocation]) -> Option<String> {
+    let mut config = ProposedConfig {
+        machines: Vec::new(),
+        tunnels: Vec::new(),
+    };
+    for inv in invocations {
+        let name = machine_name(inv);
+        if !config.machines.iter().any(|m| m.name == name) {
+            config.machines.push(ProposedMachine {
+                name: name.clone(),
+                resource_group: inv
+                    .target_resource_id
+                    .as_deref()
+                    .and_then(resource_group_of)
+                    .unwrap_or(&inv.bastion_resource_group)
+                    .to_string(),
+                target_resource_id: inv.target_resource_id.clone(),
+                target_ip: inv.target_ip.clone(),
+                bastion_name: inv.bastion_name.clone(),
+                bastion_resource_group: inv.bastion_resource_group.clone(),
+                bastion_subscription: inv.subscription.clone(),
+            });
+        }
+        let base = format!("{name}-{}", inv.remote_port);
+        let mut tunnel = base.clone();
+        let mut n = 1;
+        while config.tunnels.iter().any(|t| t.name == tunnel) {
+            n += 1;
+            tunnel = format!("{base}-{n}");
+        }
+        config.tunnels.push(ProposedTunnel {
+            name: tunnel,
+            machine: name,
+            local_port: inv.local_port,
+            remote_port: inv.remote_port,
+        });
+    }
+    if config.machines.is_empty() {
+        return None;
+    }
+    serde_norway::to_string(&config).ok()
+}
+
+/// A config name for the target: the VM's name, or its IP.
+fn machine_name(inv: &Invocation) -> String {
+    match (&inv.target_resource_id, &inv.target_ip) {
+        (Some(id), _) => id
+            .trim_end_matches('/')
+            .rsplit('/')
+            .next()
+            .unwrap_or(id)
+            .to_string(),
+        (None, Some(ip)) => format!("host-{}", ip.replace(['.', ':'], "-")),
+        (None, None) => "machine".to_string(),
+    }
+}
+
+fn resource_group_of(id: &str) -> Option<&str> {
+    let mut parts = id.split('/');
+    parts.find(|p| p.eq_ignore_ascii_case("resourceGroups"))?;
+    parts.next().filter(|rg| !rg.is_empty())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    const ID: &str =
+        "/subscriptions/s/resourceGroups/RG-WEB/providers/Microsoft.Compute/virtualMachines/vm-web";
+
+    #[test]
+    fn finds_tunnels_in_bash_zsh_and_fish_history() {
+        let history = format!(
+            "ls -la
+az network bastion tunnel --name hub -g RG-HUB --target-resource-id {ID} --resource-port 22 --port 2022
+: 1700000000:0;az network bastion tunnel -n hub --resource-group RG-HUB --target-resource-id \"{ID}\" --resource-port 22 --port 2022
+- cmd: az network bastion tunnel --name=hub --resource-group=RG-HUB --target-ip-address 10.1.0.4 --resource-port 5432 --port 15432
+az network bastion tunnel --name hub
+"
+        );
+        let found = scan(&history);
+        assert_eq!(found.len(), 2, "{found:?}");
+        assert_eq!(found[0].target_resource_id.as_deref(), Some(ID));
+        assert_eq!((found[0].local_port, found[0].remote_port), (2022, 22));
+        assert_eq!(found[1].target_ip.as_deref(), Some("10.1.0.4"));
+        assert_eq!(found[1].bastion_name, "hub");
+    }
+
+    #[test]
+    fn proposal_is_a_valid_config() {
+        let history = format!(
+            "az network bastion tunnel --name hub -g RG-HUB --target-resource-id {ID} --resource-port 22 --port 2022
+az network bastion tunnel --name hub -g RG-HUB --target-resource-id {ID} --resource-port 22 --port 2023
+az network bastion tunnel --name hub -g RG-HUB --target-ip-address 10.1.0.4 --resource-port 5432 --port 15432"
+        );
+        let yaml = propose(&scan(&history)).unwrap();
+        let cfg = crate::config::parse(&yaml).unwrap();
+        cfg.validate().unwrap();
+        assert_eq!(cfg.machines.len(), 2);
+        assert_eq!(cfg.machines[0].name, "vm-web");
+        assert_eq!(cfg.machines[0].resource_group, "RG-WEB");
+        assert_eq!(cfg.machines[1].name, "host-10-1-0-4");
+        let names: Vec<&str> = cfg.tunnels.iter().map(|t| t.name.as_str()).collect();
+        assert_eq!(names, ["vm-web-22", "vm-web-22-2", "host-10-1-0-4-5432"]);
+        assert!(propose(&[]).is_none());
+    }
+}
@@ -1,22 +1,122 @@
+use crate::azure::cert::CertTiming;
+use crate::config::expand_tilde;
+use crate::readiness::ReadyCheck;
+use serde::{Deserialize, Serialize};
+use std::net::{IpAddr, Ipv4Addr, SocketAddr};
+use std::path::PathBuf;
 use std::time::Duration;
 
 /// Stable identity for a tunnel instance (mirrors Go's Tunnel.ID).
 #[derive(Debug, Clone, Copy, PartialEq, Eq, Hash)]
 pub struct TunnelId(pub u64);
 
-/// An Azure VM target loaded from config.
-#[derive(Debug, Clone)]
+/// What kind of machine a target is, which decides how it is reached.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Default, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum TargetType {
+    /// A `Microsoft.Compute/virtualMachines` VM, reached through Bastion.
+    #[default]
+    Vm,
+    /// An Azure Arc-enabled server (`Microsoft.HybridCompute/machines`),
+    /// reached with `az ssh arc` port forwarding. Bastion fields are unused.
+    Arc,
+    /// A VM scale set, reached through Bastion; each tunnel targets one
+    /// instance (`<scale set ID>/virtualMachines/<instance>`).
+    Vmss,
+}
+
+/// An Azure VM target loaded from config. Outside this crate, start from
+/// [`Machine::new`] and set the fields that apply: more may be added.
+#[derive(Debug, Clone, Default)]
+#[non_exhaustive]
 pub struct Machine {
     pub name: String,
     /// Parsed from config for completeness; not yet used by the tunnel command.
     #[allow(dead_code)]
     pub resource_group: String,
     pub target_resource_id: String,
+    pub target_type: TargetType,
+    /// Private IP reached through Bastion IP connect instead of a resource ID.
+    pub target_ip: Option<String>,
     pub bastion_name: String,
     pub bastion_resource_group: String,
     pub bastion_subscription: String,
     /// Optional SSH config dir, e.g. ~/.ssh/az_ssh_config/vm-name (may contain a leading ~).
     pub ssh_config_path: Option<String>,
+    /// Private key in `ssh_config_path` to certify; `id_rsa` when `None`.
+    pub ssh_key: Option<String>,
+    /// When its certificate is renewed.
+    pub cert_timing: CertTiming,
+    /// Scale set instance every tunnel uses; `None` means pick one on create.
+    pub instance_id: Option<String>,
+    /// Port presets offered when creating a tunnel to this machine.
+    pub presets: Vec<Preset>,
+}
+
+impl Machine {
+    /// A VM called `name` with every other field empty or at its default.
+    pub fn new(name: impl Into<String>) -> Self {
+        Self {
+            name: name.into(),
+            ..Self::default()
+        }
+    }
+
+    /// A VM called `name` behind Bastion host `b`, for tests.
+    #[cfg(test)]
+    pub fn test(name: &str) -> Self {
+        Self {
+            resource_group: "rg".into(),
+            target_resource_id: format!("/subscriptions/s/{name}"),
+            bastion_name: "b".into(),
+            bastion_resource_group: "brg".into(),
+            ..Self::new(name)
+        }
+    }
+
+    /// The key pair and AAD certificate `az ssh cert` works with, when the
+    /// machine has an `ssh_config_path`.
+    pub fn key_files(&self) -> Option<KeyFiles> {
+        let dir = self.ssh_config_path.as_deref().filter(|p| !p.is_empty())?;
+        let key = expand_tilde(self.ssh_key.as_deref().unwrap_or("id_rsa"));
+        // An absolute `ssh_key` replaces the directory.
+        Some(KeyFiles::for_private_key(
+            PathBuf::from(expand_tilde(dir)).join(key),
+        ))
+    }
+}
+
+/// A private key, its public key, and the certificate `az ssh cert` writes
+/// for it.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct KeyFiles {
+    pub private_key: PathBuf,
+    pub public_key: PathBuf,
+    pub cert: PathBuf,
+}
+
+impl KeyFiles {
+    /// `<key>.pub` beside the key, and the certificate named the way `az ssh
+    /// cert` names it, `<key>.pub-aadcert.pub`.
+    pub fn for_private_key(private_key: PathBuf) -> Self {
+        let with_suffix = |suffix: &str| {
+            let mut name = private_key.clone().into_os_string();
+            name.push(suffix);
+            PathBuf::from(name)
+        };
+        Self {
+            public_key: with_suffix(".pub"),
+            cert: with_suffix(".pub-aadcert.pub"),
+            private_key,
+        }
+    }
+}
+
+/// A named set of (local, remote) port pairs from a machine's `presets:`.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct Preset {
+    pub name: String,
+    pub ports: Vec<(u16, u16)>,
 }
 
 #[derive(Debug, Clone, PartialEq, Eq)]
@@ -25,6 +125,10 @@ pub enum TunnelStatus {
     Starting,
     Connecting,
     Active,
+    /// Held back until the named `wait_for` tunnel is up and ready.
+    Waiting(String),
+    /// Asked to exit; killed if it hasn't within the stop timeout.
+    Stopping,
     Error(String),
 }
 
@@ -33,10 +137,32 @@ impl TunnelStatus {
     pub fn is_running(&self) -> bool {
         matches!(
             self,
-            TunnelStatus::Starting | TunnelStatus::Connecting | TunnelStatus::Active
+            TunnelStatus::Starting
+                | TunnelStatus::Connecting
+                | TunnelStatus::Active
+                | TunnelStatus::Waiting(_)
         )
     }
 
+    /// Whether a start is allowed: not running, nor still on its way down.
+    pub fn can_start(&self) -> bool {
+        !self.is_running() && *self != TunnelStatus::Stopping
+    }
+
+    /// A shape per state, shown before the label so states can be told apart
+    /// without colour.
+    pub fn symbol(&self) -> char {
+        match self {
+            TunnelStatus::Inactive => '○',
+            TunnelStatus::Starting
+            | TunnelStatus::Connecting
+            | TunnelStatus::Waiting(_)
+            | TunnelStatus::Stopping => '◐',
+            TunnelStatus::Active => '●',
+            TunnelStatus::Error(_) => '×',
+        }
+    }
+
     /// Display label shown in the table (matches Go status strings).
     pub fn label(&self) -> String {
         match self {
@@ -44,6 +170,8 @@ impl TunnelStatus {
             TunnelStatus::Starting => "Starting".into(),
             TunnelStatus::Connecting => "Connecting...".into(),
             TunnelStatus::Active => "Active".into(),
+            TunnelStatus::Waiting(dep) => format!("Waiting for {dep}"),
+            TunnelStatus::Stopping => "Stopping...".into(),
             TunnelStatus::Error(e) => format!("Error: {e}"),
         }
     }
@@ -73,6 +201,69 @@ impl CertStatus {
     }
 }
 
+/// A `wait_for` dependency on another named tunnel.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct Dependency {
+    pub tunnel: String,
+    pub check: Option<ReadyCheck>,
+}
+
+/// Colour tag that sets a tunnel apart from similar rows, e.g. red for a
+/// production database.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum TagColor {
+    Red,
+    Yellow,
+    Green,
+    Blue,
+    Magenta,
+    Cyan,
+}
+
+impl TagColor {
+    const ALL: [TagColor; 6] = [
+        TagColor::Red,
+        TagColor::Yellow,
+        TagColor::Green,
+        TagColor::Blue,
+        TagColor::Magenta,
+        TagColor::Cyan,
+    ];
+
+    /// The colour after `current` when cycling with `t`; `None` (untagged)
+    /// follows the last one.
+    pub fn cycle(current: Option<TagColor>) -> Option<TagColor> {
+        match current {
+            None => Some(Self::ALL[0]),
+            Some(c) => {
+                let i = Self::ALL.iter().position(|&x| x == c).unwrap_or(0);
+                Self::ALL.get(i + 1).copied()
+            }
+        }
+    }
+
+    pub fn name(self) -> &'static str {
+        match self {
+            TagColor::Red => "red",
+            TagColor::Yellow => "yellow",
+            TagColor::Green => "green",
+            TagColor::Blue => "blue",
+            TagColor::Magenta => "magenta",
+            TagColor::Cyan => "cyan",
+        }
+    }
+}
+
+/// Shell commands run on a tunnel's lifecycle events; see [`crate::hooks`].
+#[derive(Debug, Clone, Default, PartialEq, Eq)]
+pub struct Hooks {
+    pub on_start: Option<String>,
+    pub on_ready: Option<String>,
+    pub on_stop: Option<String>,
+    pub on_error: Option<String>,
+}
+
 /// A configured/active tunnel and its runtime state.
 #[derive(Debug, Clone)]
 pub struct Tunnel {
@@ -83,6 +274,299 @@ pub struct Tunnel {
     pub status: TunnelStatus,
     pub cert_status: Option<CertStatus>,
     pub cert_expires_in: Option<String>,
+    /// Set for tunnels declared under `tunnels:` in config.
+    pub name: Option<String>,
+    pub depends: Option<Dependency>,
+    /// Tunnels created from one multi-port spec share a group and are shown,
+    /// started, stopped and deleted as a single connection.
+    pub group: Option<u64>,
+    /// Scale set instance this tunnel reaches (`Vmss` targets only).
+    pub instance: Option<String>,
+    /// Set for tunnels declared under `tunnels:` in config.
+    pub hooks: Hooks,
+    /// Shown on the tunnel's row and in notifications about it.
+    pub color: Option<TagColor>,
+    pub icon: Option<String>,
+    /// Set when the tunnel goes on from the machine over SSH: `remote_port`
+    /// is then the machine's SSH port rather than the destination.
+    pub ssh: Option<SshForward>,
+    /// Private AKS cluster whose API server the tunnel reaches.
+    pub aks: Option<AksCluster>,
+    /// The database behind the tunnel, for `y` to copy a connection string.
+    pub database: Option<Database>,
+    /// Free text set with `l`, e.g. `pgAdmin for ticket #1234`.
+    pub note: Option<String>,
+    /// Address the local port listens on, when not loopback (`bind_address`).
+    pub bind_address: Option<IpAddr>,
+}
+
+impl Tunnel {
+    /// A stopped, ungrouped tunnel forwarding `local_port` to `remote_port`.
+    pub fn new(
+        id: TunnelId,
+        machine: Machine,
+        local_port: impl Into<String>,
+        remote_port: impl Into<String>,
+    ) -> Self {
+        Self {
+            id,
+            machine,
+            local_port: local_port.into(),
+            remote_port: remote_port.into(),
+            status: TunnelStatus::Inactive,
+            cert_status: None,
+            cert_expires_in: None,
+            name: None,
+            depends: None,
+            group: None,
+            instance: None,
+            hooks: Hooks::default(),
+            color: None,
+            icon: None,
+            ssh: None,
+            aks: None,
+            database: None,
+            note: None,
+            bind_address: None,
+        }
+    }
+
+    /// Name shown in the table: the configured tunnel name, else the machine.
+    pub fn display_name(&self) -> &str {
+        self.name.as_deref().unwrap_or(&self.machine.name)
+    }
+
+    /// The display name behind the tunnel's icon, if it has one, for
+    /// notifications.
+    pub fn label(&self) -> String {
+        match &self.icon {
+            Some(icon) => format!("{icon} {}", self.display_name()),
+            None => self.display_name().to_string(),
+        }
+    }
+
+    /// `host:port` at which the tunnel's local end is reached from this
+    /// machine: its bind address, or loopback for none or all interfaces.
+    pub fn local_addr(&self) -> String {
+        let ip = self
+            .bind_address
+            .filter(|ip| !ip.is_unspecified())
+            .unwrap_or(IpAddr::V4(Ipv4Addr::LOCALHOST));
+        match self.local_port.parse() {
+            Ok(port) => SocketAddr::new(ip, port).to_string(),
+            Err(_) => format!("{ip}:{}", self.local_port),
+        }
+    }
+
+    /// The local end as ssh's `-L`/`-D` take it: the port, prefixed with the
+    /// bind address when there is one.
+    pub fn listen_spec(&self) -> String {
+        match (self.bind_address, self.local_port.parse()) {
+            (Some(ip), Ok(port)) => SocketAddr::new(ip, port).to_string(),
+            (Some(ip), Err(_)) => format!("{ip}:{}", self.local_port),
+            (None, _) => self.local_port.clone(),
+        }
+    }
+
+    /// Resource ID handed to Bastion: the machine's, or for a scale set the
+    /// chosen instance's.
+    pub fn target_resource_id(&self) -> String {
+        match (&self.machine.target_type, &self.instance) {
+            (TargetType::Vmss, Some(instance)) => format!(
+                "{}/virtualMachines/{instance}",
+                self.machine.target_resource_id.trim_end_matches('/')
+            ),
+            _ => self.machine.target_resource_id.clone(),
+        }
+    }
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum DbEngine {
+    Postgres,
+    Mysql,
+    Mssql,
+}
+
+/// A database reached through a tunnel (`database:` in config).
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct Database {
+    pub engine: DbEngine,
+    /// Database name.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub name: Option<String>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub user: Option<String>,
+    /// Replaces the engine's usual format; `{host}`, `{port}`, `{name}` and
+    /// `{user}` are filled in.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub template: Option<String>,
+}
+
+impl Database {
+    /// How to connect through the tunnel listening on `local_port`.
+    pub fn connection_string(&self, local_port: &str) -> String {
+        const HOST: &str = "127.0.0.1";
+        let name = self.name.as_deref().unwrap_or_default();
+        let user = self.user.as_deref().unwrap_or_default();
+        if let Some(template) = &self.template {
+            return template
+                .replace("{host}", HOST)
+                .replace("{port}", local_port)
+                .replace("{name}", name)
+                .replace("{user}", user);
+        }
+        match self.engine {
+            DbEngine::Postgres => {
+                let mut s = format!("host={HOST} port={local_port}");
+                if !name.is_empty() {
+                    s.push_str(&format!(" dbname={name}"));
+                }
+                if !user.is_empty() {
+                    s.push_str(&format!(" user={user}"));
+                }
+                s
+            }
+            DbEngine::Mysql => {
+                let user = if user.is_empty() {
+                    String::new()
+                } else {
+                    format!("{user}@")
+                };
+                format!("mysql://{user}{HOST}:{local_port}/{name}")
+            }
+            DbEngine::Mssql => {
+                let mut s = format!("Server={HOST},{local_port};");
+                if !name.is_empty() {
+                    s.push_str(&format!("Database={name};"));
+                }
+                if !user.is_empty() {
+                    s.push_str(&format!("User Id={user};"));
+                }
+                // The certificate names the real server, not 127.0.0.1.
+                s.push_str("TrustServerCertificate=True");
+                s
+            }
+        }
+    }
+}
+
+/// A private AKS cluster reached through a tunnel; see [`crate::azure::aks`].
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct AksCluster {
+    pub resource_group: String,
+    pub name: String,
+    /// Where the kubeconfig is written while the tunnel is up (may contain a
+    /// leading ~).
+    pub kubeconfig: String,
+}
+
+/// Where a tunnel goes on to from its machine, over SSH as `user`.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub enum SshForward {
+    /// A SOCKS5 proxy (`ssh -D`) into everything the machine can reach.
+    Socks { user: String },
+    /// `host:port` behind the machine (`ssh -L`), the machine acting as a
+    /// jump host.
+    Jump {
+        user: String,
+        host: String,
+        port: u16,
+    },
+}
+
+impl SshForward {
+    /// Parse a `jump` value: `user@host:port`.
+    pub fn parse_jump(spec: &str) -> Result<Self, String> {
+        let (user, dest) = spec
+            .trim()
+            .split_once('@')
+            .ok_or_else(|| format!("expected user@host:port, got `{spec}`"))?;
+        let (host, port) = dest
+            .rsplit_once(':')
+            .ok_or_else(|| format!("expected user@host:port, got `{spec}`"))?;
+        let port = match port.parse::<u16>() {
+            Ok(n) if n > 0 => n,
+            _ => return Err(format!("invalid port `{port}`")),
+        };
+        if user.is_empty() || host.is_empty() {
+            return Err(format!("expected user@host:port, got `{spec}`"));
+        }
+        Ok(SshForward::Jump {
+            user: user.to_string(),
+            host: host.to_string(),
+            port,
+        })
+    }
+
+    pub fn user(&self) -> &str {
+        match self {
+            SshForward::Socks { user } | SshForward::Jump { user, .. } => user,
+        }
+    }
+
+    /// The ssh forwarding option and its argument for listening on `listen`,
+    /// `[bind_address:]port`.
+    pub fn ssh_args(&self, listen: &str) -> [String; 2] {
+        match self {
+            SshForward::Socks { .. } => ["-D".into(), listen.to_string()],
+            SshForward::Jump { host, port, .. } => ["-L".into(), format!("{listen}:{host}:{port}")],
+        }
+    }
+}
+
+/// Parse one port number, 1–65535.
+pub fn parse_port(text: &str) -> Result<u16, String> {
+    match text.trim().parse::<u16>() {
+        Ok(n) if n > 0 => Ok(n),
+        _ => Err(format!("invalid port `{}`: use 1-65535", text.trim())),
+    }
+}
+
+/// Local ports below this need privileges to listen on; `None` when this
+/// process has them (root) or the platform reserves none (Windows).
+pub fn privileged_port_limit() -> Option<u16> {
+    #[cfg(unix)]
+    {
+        if nix::unistd::geteuid().is_root() {
+            return None;
+        }
+        // Linux can move the limit (`net.ipv4.ip_unprivileged_port_start`).
+        let limit = std::fs::read_to_string("/proc/sys/net/ipv4/ip_unprivileged_port_start")
+            .ok()
+            .and_then(|s| s.trim().parse().ok())
+            .unwrap_or(1024);
+        (limit > 0).then_some(limit)
+    }
+    #[cfg(not(unix))]
+    {
+        None
+    }
+}
+
+/// Parse a multi-port spec like `2022:22,8080:80` into (local, remote) pairs.
+pub fn parse_port_spec(spec: &str) -> Result<Vec<(u16, u16)>, String> {
+    let pairs = spec
+        .split(',')
+        .map(str::trim)
+        .filter(|p| !p.is_empty())
+        .map(|pair| {
+            let (local, remote) = pair
+                .split_once(':')
+                .ok_or_else(|| format!("expected local:remote, got `{pair}`"))?;
+            Ok((parse_port(local)?, parse_port(remote)?))
+        })
+        .collect::<Result<Vec<_>, String>>()?;
+    if pairs.is_empty() {
+        return Err("no ports given".into());
+    }
+    for (i, (local, _)) in pairs.iter().enumerate() {
+        if pairs[..i].iter().any(|(l, _)| l == local) {
+            return Err(format!("local port {local} is used twice"));
+        }
+    }
+    Ok(pairs)
 }
 
 /// Human-readable duration, matching Go's formatDuration:
@@ -106,6 +590,78 @@ mod tests {
     use super::*;
     use std::time::Duration;
 
+    #[test]
+    fn connection_strings_per_engine() {
+        let db = |engine, template: Option<&str>| Database {
+            engine,
+            name: Some("app".into()),
+            user: Some("reader".into()),
+            template: template.map(String::from),
+        };
+        assert_eq!(
+            db(DbEngine::Postgres, None).connection_string("15432"),
+            "host=127.0.0.1 port=15432 dbname=app user=reader"
+        );
+        assert_eq!(
+            db(DbEngine::Mysql, None).connection_string("13306"),
+            "mysql://reader@127.0.0.1:13306/app"
+        );
+        assert_eq!(
+            db(DbEngine::Mssql, None).connection_string("11433"),
+            "Server=127.0.0.1,11433;Database=app;User Id=reader;TrustServerCertificate=True"
+        );
+        assert_eq!(
+            db(
+                DbEngine::Postgres,
+                Some("postgresql://{user}@{host}:{port}/{name}")
+            )
+            .connection_string("15432"),
+            "postgresql://reader@127.0.0.1:15432/app"
+        );
+    }
+
+    #[test]
+    fn key_files_follow_ssh_key() {
+        let mut m = Machine {
+            ssh_key: Some("id_ed25519".into()),
+            ..Machine::test("vm")
+        };
+        assert_eq!(m.key_files(), None);
+
+        m.ssh_config_path = Some("/keys/vm".into());
+        let files = m.key_files().unwrap();
+        assert_eq!(files.private_key, PathBuf::from("/keys/vm/id_ed25519"));
+        assert_eq!(files.public_key, PathBuf::from("/keys/vm/id_ed25519.pub"));
+        assert_eq!(
+            files.cert,
+            PathBuf::from("/keys/vm/id_ed25519.pub-aadcert.pub")
+        );
+
+        m.ssh_key = None;
+        assert_eq!(
+            m.key_files().unwrap().cert,
+            PathBuf::from("/keys/vm/id_rsa.pub-aadcert.pub")
+        );
+    }
+
+    #[test]
+    fn parses_multi_port_spec() {
+        assert_eq!(
+            parse_port_spec("2022:22, 8080:80").unwrap(),
+            vec![(2022, 22), (8080, 80)]
+        );
+        assert_eq!(parse_port_spec("5432:5432").unwrap(), vec![(5432, 5432)]);
+    }
+
+    #[test]
+    fn rejects_bad_port_specs() {
+        assert!(parse_port_spec("").is_err());
+        assert!(parse_port_spec("2022").is_err());
+        assert!(parse_port_spec("2022:0").is_err());
+        assert!(parse_port_spec("2022:22,2022:80").is_err());
+        assert!(parse_port_spec("70000:22").is_err());
+    }
+
     #[test]
     fn format_duration_hours() {
         assert_eq!(
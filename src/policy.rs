@@ -0,0 +1,114 @@
+//! Port policy (`policy:` in config): limits a platform team shipping a
+//! shared config puts on the tunnels run with it, so a teammate can't forward
+//! onto a port reserved for something else or open a tunnel to the LAN. It is
+//! checked when a tunnel is declared, created in the TUI and started.
+
+use crate::model::parse_port;
+use serde::Deserialize;
+use std::net::IpAddr;
+use std::ops::RangeInclusive;
+
+#[derive(Debug, Clone, PartialEq, Eq, Deserialize)]
+pub struct Policy {
+    /// Local ports tunnels may use, as ports and ranges, e.g.
+    /// `15000-15999,2022`. Any port when unset.
+    #[serde(default)]
+    pub local_ports: Option<String>,
+    /// Whether tunnels may listen beyond loopback (`bind_address`).
+    #[serde(default = "allowed")]
+    pub allow_remote_bind: bool,
+}
+
+fn allowed() -> bool {
+    true
+}
+
+impl Default for Policy {
+    /// No restrictions.
+    fn default() -> Self {
+        Self {
+            local_ports: None,
+            allow_remote_bind: true,
+        }
+    }
+}
+
+impl Policy {
+    /// Check `local_ports` parses.
+    pub fn validate(&self) -> Result<(), String> {
+        self.ranges().map(|_| ())
+    }
+
+    /// Why a tunnel on `local_port`, listening on `bind_address`, is not
+    /// allowed, if it isn't.
+    pub fn check(&self, local_port: &str, bind_address: Option<IpAddr>) -> Result<(), String> {
+        if let (Some(spec), Ok(ranges)) = (&self.local_ports, self.ranges()) {
+            let port = parse_port(local_port)?;
+            if !ranges.iter().any(|r| r.contains(&port)) {
+                return Err(format!(
+                    "local port {port} is not allowed by policy (use {spec})"
+                ));
+            }
+        }
+        match bind_address {
+            Some(ip) if !self.allow_remote_bind && !ip.is_loopback() => Err(format!(
+                "listening on {ip} is not allowed by policy (loopback only)"
+            )),
+            _ => Ok(()),
+        }
+    }
+
+    fn ranges(&self) -> Result<Vec<RangeInclusive<u16>>, String> {
+        let Some(spec) = &self.local_ports else {
+            return Ok(Vec::new());
+        };
+        spec.split(',')
+            .map(|part| match part.split_once('-') {
+                Some((from, to)) => {
+                    let (from, to) = (parse_port(from)?, parse_port(to)?);
+                    if from > to {
+                        return Err(format!("invalid port range `{}`", part.trim()));
+                    }
+                    Ok(from..=to)
+                }
+                None => parse_port(part).map(|p| p..=p),
+            })
+            .collect()
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn ports_outside_the_ranges_and_remote_binds_are_refused() {
+        let policy = Policy {
+            local_ports: Some("15000-15999, 2022".into()),
+            allow_remote_bind: false,
+        };
+        assert!(policy.validate().is_ok());
+        assert!(policy.check("15432", None).is_ok());
+        assert!(policy
+            .check("2022", Some("127.0.0.1".parse().unwrap()))
+            .is_ok());
+        assert_eq!(
+            policy.check("5432", None),
+            Err("local port 5432 is not allowed by policy (use 15000-15999, 2022)".into())
+        );
+        assert!(policy
+            .check("15432", Some("0.0.0.0".parse().unwrap()))
+            .is_err());
+        assert!(Policy::default()
+            .check("80", Some("0.0.0.0".parse().unwrap()))
+            .is_ok());
+
+        for bad in ["2000-1000", "1-2-3", "http"] {
+            let policy = Policy {
+                local_ports: Some(bad.into()),
+                ..Policy::default()
+            };
+            assert!(policy.validate().is_err(), "{bad}");
+        }
+    }
+}
@@ -0,0 +1,204 @@
+//! Readiness checks gating dependent tunnels (`wait_for` + `ready_check`).
+//! A dependency counts as up once its tunnel is Active *and* the check passes
+//! against it: `tcp` connects to its local port, an `http://` URL expects a
+//! 2xx/3xx response.
+
+use color_eyre::eyre::{eyre, Result};
+use std::time::Duration;
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use tokio::net::TcpStream;
+
+/// Give up on a dependency that isn't ready after this long.
+const READY_TIMEOUT: Duration = Duration::from_secs(30);
+const RETRY_DELAY: Duration = Duration::from_secs(1);
+const ATTEMPT_TIMEOUT: Duration = Duration::from_secs(3);
+/// Bastion can take a few seconds to reconnect a tunnel's first connection.
+const HEALTH_TIMEOUT: Duration = Duration::from_secs(15);
+
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub enum ReadyCheck {
+    /// Connect to the dependency's local port.
+    Tcp,
+    /// `GET` the URL (plain HTTP only) and expect a 2xx/3xx status.
+    Http {
+        host: String,
+        port: u16,
+        path: String,
+    },
+}
+
+impl ReadyCheck {
+    /// Parse a `ready_check` config value: `tcp` or `http://host[:port][/path]`.
+    pub fn parse(s: &str) -> Result<Self> {
+        let s = s.trim();
+        if s.eq_ignore_ascii_case("tcp") {
+            return Ok(ReadyCheck::Tcp);
+        }
+        let rest = s
+            .strip_prefix("http://")
+            .ok_or_else(|| eyre!("ready_check must be `tcp` or an http:// URL, got `{s}`"))?;
+        let (authority, path) = match rest.find('/') {
+            Some(i) => (&rest[..i], &rest[i..]),
+            None => (rest, "/"),
+        };
+        let (host, port) = match authority.rsplit_once(':') {
+            Some((h, p)) => (
+                h,
+                p.parse::<u16>()
+                    .map_err(|_| eyre!("invalid port in ready_check URL `{s}`"))?,
+            ),
+            None => (authority, 80),
+        };
+        if host.is_empty() {
+            return Err(eyre!("missing host in ready_check URL `{s}`"));
+        }
+        Ok(ReadyCheck::Http {
+            host: host.to_string(),
+            port,
+            path: path.to_string(),
+        })
+    }
+}
+
+/// Retry `check` until it passes or [`READY_TIMEOUT`] elapses. `local_addr` is
+/// where the dependency tunnel listens, `host:port` (used by the `tcp` check).
+pub async fn wait_until_ready(check: &ReadyCheck, local_addr: &str) -> Result<(), String> {
+    let deadline = tokio::time::Instant::now() + READY_TIMEOUT;
+    loop {
+        let last = match tokio::time::timeout(ATTEMPT_TIMEOUT, probe_once(check, local_addr)).await
+        {
+            Ok(Ok(())) => return Ok(()),
+            Ok(Err(e)) => e,
+            Err(_) => "timed out".to_string(),
+        };
+        if tokio::time::Instant::now() + RETRY_DELAY >= deadline {
+            return Err(last);
+        }
+        tokio::time::sleep(RETRY_DELAY).await;
+    }
+}
+
+async fn probe_once(check: &ReadyCheck, local_addr: &str) -> Result<(), String> {
+    match check {
+        ReadyCheck::Tcp => TcpStream::connect(local_addr)
+            .await
+            .map(|_| ())
+            .map_err(|e| e.to_string()),
+        ReadyCheck::Http { host, port, path } => {
+            let mut stream = TcpStream::connect((host.as_str(), *port))
+                .await
+                .map_err(|e| e.to_string())?;
+            let request =
+                format!("GET {path} HTTP/1.0\r\nHost: {host}\r\nConnection: close\r\n\r\n");
+            stream
+                .write_all(request.as_bytes())
+                .await
+                .map_err(|e| e.to_string())?;
+            let mut head = [0u8; 64];
+            let n = stream.read(&mut head).await.map_err(|e| e.to_string())?;
+            let line = String::from_utf8_lossy(&head[..n]);
+            match parse_status(&line) {
+                Some(code) if (200..400).contains(&code) => Ok(()),
+                Some(code) => Err(format!("HTTP {code}")),
+                None => Err("malformed HTTP response".to_string()),
+            }
+        }
+    }
+}
+
+/// Whether a tunnel that is up still reaches its target: its local address
+/// accepts a connection and, when it forwards straight to an SSH server
+/// (`ssh`), the server's banner comes back through it. Other protocols wait
+/// for the client to speak, so a connection is all that can be checked.
+pub async fn probe_health(local_addr: &str, ssh: bool) -> Result<(), String> {
+    let probe = async {
+        let mut stream = TcpStream::connect(local_addr)
+            .await
+            .map_err(|e| e.to_string())?;
+        if !ssh {
+            return Ok(());
+        }
+        let mut banner = [0u8; 4];
+        stream
+            .read_exact(&mut banner)
+            .await
+            .map_err(|e| format!("no SSH banner: {e}"))?;
+        if &banner == b"SSH-" {
+            Ok(())
+        } else {
+            Err("no SSH banner".to_string())
+        }
+    };
+    tokio::time::timeout(HEALTH_TIMEOUT, probe)
+        .await
+        .unwrap_or_else(|_| Err("timed out".to_string()))
+}
+
+/// Status code from an HTTP status line, e.g. `HTTP/1.1 200 OK` -> 200.
+fn parse_status(line: &str) -> Option<u16> {
+    let mut parts = line.split_whitespace();
+    if !parts.next()?.starts_with("HTTP/") {
+        return None;
+    }
+    parts.next()?.parse().ok()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn parses_tcp_and_http_checks() {
+        assert_eq!(ReadyCheck::parse("tcp").unwrap(), ReadyCheck::Tcp);
+        assert_eq!(
+            ReadyCheck::parse("http://127.0.0.1:8080/health").unwrap(),
+            ReadyCheck::Http {
+                host: "127.0.0.1".into(),
+                port: 8080,
+                path: "/health".into(),
+            }
+        );
+        assert_eq!(
+            ReadyCheck::parse("http://localhost").unwrap(),
+            ReadyCheck::Http {
+                host: "localhost".into(),
+                port: 80,
+                path: "/".into(),
+            }
+        );
+    }
+
+    #[test]
+    fn rejects_unknown_checks() {
+        assert!(ReadyCheck::parse("https://example.com").is_err());
+        assert!(ReadyCheck::parse("http://host:notaport/").is_err());
+        assert!(ReadyCheck::parse("ping").is_err());
+    }
+
+    #[test]
+    fn parses_http_status_line() {
+        assert_eq!(parse_status("HTTP/1.1 204 No Content\r\n"), Some(204));
+        assert_eq!(parse_status("garbage"), None);
+    }
+
+    #[tokio::test]
+    async fn tcp_check_passes_against_listening_port() {
+        let listener = tokio::net::TcpListener::bind("127.0.0.1:0").await.unwrap();
+        let addr = listener.local_addr().unwrap().to_string();
+        assert!(probe_once(&ReadyCheck::Tcp, &addr).await.is_ok());
+    }
+
+    #[tokio::test]
+    async fn health_probe_expects_an_ssh_banner() {
+        let listener = tokio::net::TcpListener::bind("127.0.0.1:0").await.unwrap();
+        let addr = listener.local_addr().unwrap().to_string();
+        tokio::spawn(async move {
+            for banner in [&b"SSH-2.0-OpenSSH_9.6\r\n"[..], b"HTTP/1.1 400\r\n"] {
+                let (mut conn, _) = listener.accept().await.unwrap();
+                conn.write_all(banner).await.unwrap();
+            }
+        });
+        assert!(probe_health(&addr, true).await.is_ok());
+        assert_eq!(probe_health(&addr, true).await, Err("no SSH banner".into()));
+    }
+}
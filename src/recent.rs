@@ -0,0 +1,143 @@
+//! Tunnels created before, kept in `burrow.history.yaml` next to the config
+//! so the create dialog can offer them again with one key.
+
+use chrono::{DateTime, Utc};
+use color_eyre::eyre::{Context, Result};
+use serde::{Deserialize, Serialize};
+use std::path::{Path, PathBuf};
+
+/// Entries kept; the least recently used are dropped.
+const CAPACITY: usize = 20;
+
+/// One created connection: a machine and the ports forwarded to it.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct RecentTunnel {
+    pub machine: String,
+    /// `local:remote` pairs as typed in the create dialog, e.g. `2022:22` or
+    /// `2022:22,8080:80`.
+    pub ports: String,
+    /// Scale set instance, for tunnels to a VMSS.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub instance: Option<String>,
+    /// RFC 3339, when it was last created.
+    pub last_used: String,
+}
+
+impl RecentTunnel {
+    pub fn last_used(&self) -> Option<DateTime<Utc>> {
+        DateTime::parse_from_rfc3339(&self.last_used)
+            .ok()
+            .map(|t| t.with_timezone(&Utc))
+    }
+}
+
+/// The on-disk shape of `burrow.history.yaml`, most recently used first.
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
+pub struct Recent {
+    #[serde(default)]
+    pub tunnels: Vec<RecentTunnel>,
+}
+
+impl Recent {
+    /// Record that `ports` were just forwarded to `machine`, moving an
+    /// existing entry for the same connection to the front.
+    pub fn record(
+        &mut self,
+        machine: &str,
+        ports: &str,
+        instance: Option<&str>,
+        now: DateTime<Utc>,
+    ) {
+        self.tunnels.retain(|r| {
+            !(r.machine == machine && r.ports == ports && r.instance.as_deref() == instance)
+        });
+        self.tunnels.insert(
+            0,
+            RecentTunnel {
+                machine: machine.to_string(),
+                ports: ports.to_string(),
+                instance: instance.map(str::to_string),
+                last_used: now.to_rfc3339_opts(chrono::SecondsFormat::Secs, true),
+            },
+        );
+        self.tunnels.truncate(CAPACITY);
+    }
+}
+
+/// `(local, remote)` pairs as a spec for [`Recent::record`].
+pub fn port_spec(pairs: &[(String, String)]) -> String {
+    pairs
+        .iter()
+        .map(|(l, r)| format!("{l}:{r}"))
+        .collect::<Vec<_>>()
+        .join(",")
+}
+
+/// Sibling history file next to the config: `burrow.history.yaml`.
+pub fn recent_path(config_path: &Path) -> PathBuf {
+    match config_path.parent() {
+        Some(dir) => dir.join("burrow.history.yaml"),
+        None => PathBuf::from("burrow.history.yaml"),
+    }
+}
+
+/// Tolerant load, like the state file: a missing or corrupt history is empty.
+pub fn load(path: &Path) -> Recent {
+    std::fs::read_to_string(path)
+        .ok()
+        .and_then(|text| serde_norway::from_str(&text).ok())
+        .unwrap_or_default()
+}
+
+pub fn save(path: &Path, recent: &Recent) -> Result<()> {
+    let text = serde_norway::to_string(recent).wrap_err("serializing history")?;
+    std::fs::write(path, text).wrap_err("writing history file")?;
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use chrono::TimeZone;
+
+    #[test]
+    fn record_moves_repeats_to_the_front_and_caps_the_list() {
+        let at = |h| Utc.with_ymd_and_hms(2026, 3, 1, h, 0, 0).unwrap();
+        let mut recent = Recent::default();
+        recent.record("vm-db", "15432:5432", None, at(1));
+        recent.record("vm-web", "2022:22,8080:80", None, at(2));
+        recent.record("vm-db", "15432:5432", None, at(3));
+        recent.record("vm-db", "15432:5432", Some("2"), at(4));
+
+        let order: Vec<(&str, Option<&str>)> = recent
+            .tunnels
+            .iter()
+            .map(|r| (r.ports.as_str(), r.instance.as_deref()))
+            .collect();
+        assert_eq!(
+            order,
+            [
+                ("15432:5432", Some("2")),
+                ("15432:5432", None),
+                ("2022:22,8080:80", None)
+            ]
+        );
+        assert_eq!(recent.tunnels[1].last_used(), Some(at(3)));
+
+        for port in 0..CAPACITY as u16 {
+            recent.record("vm-web", &format!("{}:22", 3000 + port), None, at(5));
+        }
+        assert_eq!(recent.tunnels.len(), CAPACITY);
+        assert!(recent.tunnels.iter().all(|r| r.machine == "vm-web"));
+
+        let path = std::env::temp_dir().join(format!(
+            "az-burrow-history-test-{}.yaml",
+            std::process::id()
+        ));
+        save(&path, &recent).unwrap();
+        assert_eq!(load(&path).tunnels, recent.tunnels);
+        std::fs::write(&path, "tunnels: [").unwrap();
+        assert!(load(&path).tunnels.is_empty());
+        let _ = std::fs::remove_file(&path);
+    }
+}
@@ -0,0 +1,199 @@
+//! Named saved sessions: a tunnel set kept under a name in
+//! `burrow.sessions.yaml` next to the config, with the tunnels to start when
+//! it is restored. Saved with `S` in the TUI or `session save <name>`, and
+//! restored with `S` or `--session <name>`.
+
+use crate::model::{TagColor, Tunnel};
+use crate::state::PersistedState;
+use color_eyre::eyre::{Context, Result};
+use serde::{Deserialize, Serialize};
+use std::path::{Path, PathBuf};
+
+/// One tunnel of a session, matched to an existing tunnel by machine and
+/// ports on restore.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct SessionTunnel {
+    pub machine: String,
+    pub local_port: String,
+    pub remote_port: String,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub group: Option<u64>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub instance: Option<String>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub color: Option<TagColor>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub icon: Option<String>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub note: Option<String>,
+    /// Started as soon as the session is restored.
+    #[serde(default, skip_serializing_if = "std::ops::Not::not")]
+    pub start: bool,
+}
+
+impl SessionTunnel {
+    /// `t` as saved from the TUI: started on restore if it is running now.
+    pub fn from_tunnel(t: &Tunnel) -> Self {
+        Self {
+            machine: t.machine.name.clone(),
+            local_port: t.local_port.clone(),
+            remote_port: t.remote_port.clone(),
+            group: t.group,
+            instance: t.instance.clone(),
+            color: t.color,
+            icon: t.icon.clone(),
+            note: t.note.clone(),
+            start: t.status.is_running(),
+        }
+    }
+}
+
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct Session {
+    pub name: String,
+    #[serde(default)]
+    pub tunnels: Vec<SessionTunnel>,
+}
+
+/// The on-disk shape of `burrow.sessions.yaml`.
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
+pub struct Sessions {
+    #[serde(default)]
+    pub sessions: Vec<Session>,
+}
+
+impl Sessions {
+    pub fn get(&self, name: &str) -> Option<&Session> {
+        self.sessions.iter().find(|s| s.name == name)
+    }
+
+    /// Add `session`, replacing a saved one of the same name in place.
+    pub fn put(&mut self, session: Session) {
+        match self.sessions.iter_mut().find(|s| s.name == session.name) {
+            Some(s) => *s = session,
+            None => self.sessions.push(session),
+        }
+    }
+
+    /// Forget the session `name`; whether there was one.
+    pub fn remove(&mut self, name: &str) -> bool {
+        let before = self.sessions.len();
+        self.sessions.retain(|s| s.name != name);
+        self.sessions.len() != before
+    }
+}
+
+/// Sibling sessions file next to the config: `burrow.sessions.yaml`.
+pub fn sessions_path(config_path: &Path) -> PathBuf {
+    match config_path.parent() {
+        Some(dir) => dir.join("burrow.sessions.yaml"),
+        None => PathBuf::from("burrow.sessions.yaml"),
+    }
+}
+
+/// Read the sessions file; a missing one has no sessions. Unlike the state
+/// file, a corrupt one is an error: sessions are the user's, not a cache.
+pub fn load(path: &Path) -> Result<Sessions> {
+    match std::fs::read_to_string(path) {
+        Ok(text) => serde_norway::from_str(&text)
+            .wrap_err_with(|| format!("failed to parse {}", path.display())),
+        Err(e) if e.kind() == std::io::ErrorKind::NotFound => Ok(Sessions::default()),
+        Err(e) => Err(e).wrap_err_with(|| format!("reading {}", path.display())),
+    }
+}
+
+pub fn save(path: &Path, sessions: &Sessions) -> Result<()> {
+    let text = serde_norway::to_string(sessions).wrap_err("serializing sessions")?;
+    std::fs::write(path, text).wrap_err("writing sessions file")?;
+    Ok(())
+}
+
+/// The tunnels in the state file, for `session save` outside the TUI. Those
+/// left running by a detach (`alive` says their PID, with its start time,
+/// still is) are started on restore.
+pub fn from_state(state: &PersistedState, alive: impl Fn(u32, &str) -> bool) -> Vec<SessionTunnel> {
+    state
+        .tunnels
+        .iter()
+        .map(|p| SessionTunnel {
+            machine: p.machine.clone(),
+            local_port: p.local_port.clone(),
+            remote_port: p.remote_port.clone(),
+            group: p.group,
+            instance: p.instance.clone(),
+            color: p.color,
+            icon: p.icon.clone(),
+            note: p.note.clone(),
+            start: p
+                .pid
+                .zip(p.pid_started.as_deref())
+                .is_some_and(|(pid, started)| alive(pid, started)),
+        })
+        .collect()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::state::PersistedTunnel;
+
+    fn persisted(machine: &str, pid: Option<u32>) -> PersistedTunnel {
+        PersistedTunnel {
+            machine: machine.into(),
+            local_port: "2022".into(),
+            remote_port: "22".into(),
+            pid,
+            pid_started: pid.map(|_| "Fri Oct 16 18:03:17 2026".into()),
+            group: None,
+            instance: None,
+            color: None,
+            icon: None,
+            note: None,
+        }
+    }
+
+    #[test]
+    fn sessions_round_trip_and_replace_by_name() {
+        let path = std::env::temp_dir().join(format!(
+            "az-burrow-sessions-test-{}.yaml",
+            std::process::id()
+        ));
+        let _ = std::fs::remove_file(&path);
+        assert!(load(&path).unwrap().sessions.is_empty());
+
+        let state = PersistedState {
+            tunnels: vec![persisted("vm-db", Some(4242)), persisted("vm-web", None)],
+            last_seen_version: None,
+        };
+        let mut sessions = Sessions::default();
+        sessions.put(Session {
+            name: "prod-debug".into(),
+            tunnels: from_state(&state, |pid, _| pid == 4242),
+        });
+        sessions.put(Session {
+            name: "empty".into(),
+            tunnels: Vec::new(),
+        });
+        save(&path, &sessions).unwrap();
+        let text = std::fs::read_to_string(&path).unwrap();
+        assert_eq!(text.matches("start: true").count(), 1, "{text}");
+
+        let mut loaded = load(&path).unwrap();
+        let debug = loaded.get("prod-debug").unwrap();
+        assert!(debug.tunnels[0].start);
+        assert!(!debug.tunnels[1].start);
+
+        loaded.put(Session {
+            name: "prod-debug".into(),
+            tunnels: Vec::new(),
+        });
+        let names: Vec<&str> = loaded.sessions.iter().map(|s| s.name.as_str()).collect();
+        assert_eq!(names, ["prod-debug", "empty"]);
+        assert!(loaded.remove("empty"));
+        assert!(!loaded.remove("empty"));
+
+        std::fs::write(&path, "sessions: [").unwrap();
+        assert!(load(&path).is_err());
+        let _ = std::fs::remove_file(&path);
+    }
+}
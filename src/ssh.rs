@@ -0,0 +1,343 @@
+//! SSH sessions through a tunnel, in the user's own tools: `s` runs `ssh`
+//! (in a new tmux window or pane when inside tmux), `f` hands the terminal to
+//! `sftp`, `v` opens VS Code Remote-SSH on a host entry written to
+//! `~/.ssh/config`. All log in with the machine's AAD certificate when
+//! `ssh_config_path` has one, as the user the certificate names.
+
+use crate::azure::cert::read_cert_principal;
+use crate::model::{KeyFiles, Tunnel, TunnelStatus};
+use serde::Deserialize;
+use std::path::{Path, PathBuf};
+use std::process::Stdio;
+
+const BLOCK_BEGIN: &str = "# BEGIN az-burrow (managed; edits are overwritten)";
+const BLOCK_END: &str = "# END az-burrow";
+
+/// How to log in over SSH through a tunnel.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct Login {
+    pub port: String,
+    /// Tunnels come and go on different local ports, so host keys are
+    /// recorded against the machine instead of localhost:<port>.
+    pub host_key_alias: String,
+    /// The machine's key and AAD certificate, when it has an `ssh_config_path`.
+    pub keys: Option<KeyFiles>,
+    pub user: Option<String>,
+}
+
+/// The login for `tunnel`, or why it can't be used for SSH.
+pub fn login(tunnel: &Tunnel) -> Result<Login, String> {
+    if tunnel.status != TunnelStatus::Active {
+        return Err(format!("{} is not active", tunnel.display_name()));
+    }
+    if tunnel.ssh.is_some() || tunnel.remote_port != "22" {
+        return Err(format!(
+            "{} does not forward to SSH (port 22)",
+            tunnel.display_name()
+        ));
+    }
+    let keys = tunnel.machine.key_files();
+    let user = keys.as_ref().and_then(|k| read_cert_principal(&k.cert));
+    Ok(Login {
+        port: tunnel.local_port.clone(),
+        host_key_alias: tunnel.machine.name.clone(),
+        keys,
+        user,
+    })
+}
+
+/// The `ssh` arguments for `login`.
+pub fn ssh_args(login: &Login) -> Vec<String> {
+    client_args("-p", login)
+}
+
+/// The `sftp` arguments for `login`.
+pub fn sftp_args(login: &Login) -> Vec<String> {
+    client_args("-P", login)
+}
+
+/// ssh and sftp take the same options, except for how the port is given.
+fn client_args(port_flag: &str, login: &Login) -> Vec<String> {
+    let mut args = vec![
+        port_flag.to_string(),
+        login.port.clone(),
+        "-o".to_string(),
+        "StrictHostKeyChecking=accept-new".to_string(),
+        "-o".to_string(),
+        format!("HostKeyAlias={}", login.host_key_alias),
+    ];
+    if let Some(keys) = &login.keys {
+        args.push("-i".to_string());
+        args.push(keys.private_key.display().to_string());
+        args.push("-o".to_string());
+        args.push(format!("CertificateFile={}", keys.cert.display()));
+    }
+    args.push(match &login.user {
+        Some(user) => format!("{user}@127.0.0.1"),
+        None => "127.0.0.1".to_string(),
+    });
+    args
+}
+
+/// The `Host` alias written for a tunnel's machine.
+pub fn alias(tunnel: &Tunnel) -> String {
+    let name: String = tunnel
+        .machine
+        .name
+        .chars()
+        .map(|c| if c.is_whitespace() { '-' } else { c })
+        .collect();
+    format!("burrow-{name}")
+}
+
+/// An ssh_config `Host` entry for `login`.
+pub fn host_entry(alias: &str, login: &Login) -> String {
+    let mut entry = format!(
+        "Host {alias}\n    HostName 127.0.0.1\n    Port {}\n    HostKeyAlias {}\n    StrictHostKeyChecking accept-new\n",
+        login.port, login.host_key_alias
+    );
+    if let Some(user) = &login.user {
+        entry.push_str(&format!("    User {user}\n"));
+    }
+    if let Some(keys) = &login.keys {
+        entry.push_str(&format!(
+            "    IdentityFile \"{}\"\n    CertificateFile \"{}\"\n",
+            keys.private_key.display(),
+            keys.cert.display()
+        ));
+    }
+    entry
+}
+
+/// `config` with `entry` as the managed block's entry for `alias`, replacing
+/// an earlier one. The block is created at the end if missing; everything
+/// outside it is left as it was.
+fn upsert_host(config: &str, alias: &str, entry: &str) -> String {
+    let (before, block, after) = match (config.find(BLOCK_BEGIN), config.find(BLOCK_END)) {
+        (Some(b), Some(e)) if b < e => (
+            &config[..b],
+            &config[b + BLOCK_BEGIN.len()..e],
+            config[e + BLOCK_END.len()..].trim_start_matches('\n'),
+        ),
+        _ => (config, "", ""),
+    };
+    // Entries in the block, keyed by their `Host` line.
+    let mut entries: Vec<String> = Vec::new();
+    for line in block.lines().filter(|l| !l.trim().is_empty()) {
+        if line.starts_with("Host ") || entries.is_empty() {
+            entries.push(String::new());
+        }
+        let last = entries.last_mut().expect("pushed above");
+        last.push_str(line);
+        last.push('\n');
+    }
+    let header = format!("Host {alias}\n");
+    entries.retain(|e| !e.starts_with(&header));
+    entries.push(entry.to_string());
+
+    let mut out = before.to_string();
+    if !out.is_empty() && !out.ends_with("\n\n") {
+        out.push_str(if out.ends_with('\n') { "\n" } else { "\n\n" });
+    }
+    out.push_str(BLOCK_BEGIN);
+    out.push('\n');
+    out.push_str(&entries.join("\n"));
+    out.push_str(BLOCK_END);
+    out.push('\n');
+    if !after.is_empty() {
+        out.push('\n');
+        out.push_str(after);
+    }
+    out
+}
+
+/// Write `alias`'s entry into the managed block of `~/.ssh/config`.
+pub fn write_host(alias: &str, login: &Login) -> std::io::Result<PathBuf> {
+    let home = home::home_dir()
+        .ok_or_else(|| std::io::Error::new(std::io::ErrorKind::NotFound, "no home directory"))?;
+    let path = home.join(".ssh").join("config");
+    write_host_to(&path, alias, login)?;
+    Ok(path)
+}
+
+fn write_host_to(path: &Path, alias: &str, login: &Login) -> std::io::Result<()> {
+    if let Some(dir) = path.parent() {
+        std::fs::create_dir_all(dir)?;
+    }
+    let config = match std::fs::read_to_string(path) {
+        Ok(text) => text,
+        Err(e) if e.kind() == std::io::ErrorKind::NotFound => String::new(),
+        Err(e) => return Err(e),
+    };
+    std::fs::write(path, upsert_host(&config, alias, &host_entry(alias, login)))
+}
+
+/// Where `s` opens SSH sessions when az-burrow runs inside tmux (`tmux`).
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Default, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum TmuxTarget {
+    #[default]
+    Window,
+    /// A split of az-burrow's own window.
+    Pane,
+}
+
+/// Whether az-burrow runs inside a tmux session.
+pub fn in_tmux() -> bool {
+    std::env::var_os("TMUX").is_some_and(|v| !v.is_empty())
+}
+
+/// The `tmux` arguments that run `command` in a new window named `title`,
+/// or in a pane beside az-burrow's.
+fn tmux_args(target: TmuxTarget, title: &str, command: Vec<String>) -> Vec<String> {
+    let mut args = match target {
+        TmuxTarget::Window => vec![
+            "new-window".to_string(),
+            "-n".to_string(),
+            title.to_string(),
+        ],
+        TmuxTarget::Pane => vec!["split-window".to_string(), "-h".to_string()],
+    };
+    args.extend(command);
+    args
+}
+
+/// Run `program args` in a new tmux window or pane, leaving the TUI where it
+/// is. Must be called within a tokio runtime, which reaps `tmux`.
+pub fn open_in_tmux(
+    target: TmuxTarget,
+    title: &str,
+    program: &str,
+    args: Vec<String>,
+) -> std::io::Result<()> {
+    let mut command = vec![program.to_string()];
+    command.extend(args);
+    let mut child = tokio::process::Command::new("tmux")
+        .args(tmux_args(target, title, command))
+        .stdin(Stdio::null())
+        .stdout(Stdio::null())
+        .stderr(Stdio::null())
+        .spawn()?;
+    tokio::spawn(async move {
+        let _ = child.wait().await;
+    });
+    Ok(())
+}
+
+/// Open a VS Code Remote-SSH window on `alias`, without waiting for it. Must
+/// be called within a tokio runtime, which reaps the launcher.
+pub fn open_vscode(alias: &str) -> std::io::Result<()> {
+    let remote = format!("ssh-remote+{alias}");
+    // `code` is a .cmd script on Windows, which only cmd can run.
+    #[cfg(windows)]
+    let mut cmd = {
+        let mut cmd = tokio::process::Command::new("cmd");
+        cmd.args(["/C", "code"]);
+        cmd
+    };
+    #[cfg(not(windows))]
+    let mut cmd = tokio::process::Command::new("code");
+    let mut child = cmd
+        .arg("--remote")
+        .arg(remote)
+        .stdin(Stdio::null())
+        .stdout(Stdio::null())
+        .stderr(Stdio::null())
+        .spawn()?;
+    tokio::spawn(async move {
+        let _ = child.wait().await;
+    });
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::model::{Machine, TunnelId};
+
+    fn tunnel(remote_port: &str) -> Tunnel {
+        let machine = Machine::test("vm-web");
+        Tunnel::new(TunnelId(1), machine, "2022", remote_port)
+    }
+
+    fn cert_login() -> Login {
+        Login {
+            port: "2022".into(),
+            host_key_alias: "vm-web".into(),
+            keys: Some(KeyFiles::for_private_key(PathBuf::from(
+                "/home/me/.ssh/az_ssh_config/vm-web/id_rsa",
+            ))),
+            user: Some("alice@contoso.com".into()),
+        }
+    }
+
+    #[test]
+    fn needs_an_active_ssh_tunnel() {
+        let mut t = tunnel("22");
+        assert!(login(&t).unwrap_err().contains("not active"));
+        t.status = TunnelStatus::Active;
+        assert!(login(&t).is_ok());
+        let mut web = tunnel("80");
+        web.status = TunnelStatus::Active;
+        assert!(login(&web).unwrap_err().contains("port 22"));
+    }
+
+    #[test]
+    fn sftp_logs_in_with_the_certificate_principal() {
+        let joined = sftp_args(&cert_login()).join(" ");
+        assert!(joined.starts_with("-P 2022 "));
+        assert!(joined.contains("HostKeyAlias=vm-web"));
+        assert!(joined.contains("-i /home/me/.ssh/az_ssh_config/vm-web/id_rsa"));
+        assert!(joined.ends_with("alice@contoso.com@127.0.0.1"));
+    }
+
+    #[test]
+    fn ssh_and_tmux_arguments() {
+        let ssh = ssh_args(&cert_login());
+        assert_eq!(ssh[..2], ["-p", "2022"]);
+        assert_eq!(ssh[2..], sftp_args(&cert_login())[2..]);
+
+        let command = vec!["ssh".to_string(), "-p".to_string(), "2022".to_string()];
+        assert_eq!(
+            tmux_args(TmuxTarget::Window, "vm-web", command.clone()),
+            ["new-window", "-n", "vm-web", "ssh", "-p", "2022"]
+        );
+        assert_eq!(
+            tmux_args(TmuxTarget::Pane, "vm-web", command),
+            ["split-window", "-h", "ssh", "-p", "2022"]
+        );
+    }
+
+    #[test]
+    fn host_entries_replace_their_own_and_keep_the_rest() {
+        let user_config = "Host github.com\n    User git\n";
+        let first = upsert_host(
+            user_config,
+            "burrow-vm-web",
+            &host_entry("burrow-vm-web", &cert_login()),
+        );
+        assert!(first.starts_with("Host github.com\n    User git\n\n# BEGIN az-burrow"));
+        assert!(first.contains("    Port 2022\n"));
+        assert!(first.contains("    User alice@contoso.com\n"));
+
+        let mut moved = cert_login();
+        moved.port = "2023".into();
+        let other = Login {
+            port: "2024".into(),
+            host_key_alias: "vm-db".into(),
+            ..cert_login()
+        };
+        let second = upsert_host(&first, "burrow-vm-db", &host_entry("burrow-vm-db", &other));
+        let third = upsert_host(
+            &second,
+            "burrow-vm-web",
+            &host_entry("burrow-vm-web", &moved),
+        );
+        assert_eq!(third.matches("Host burrow-vm-web\n").count(), 1);
+        assert!(third.contains("Host burrow-vm-db\n"));
+        assert!(third.contains("    Port 2023\n"));
+        assert!(!third.contains("    Port 2022\n"));
+        assert_eq!(third.matches(BLOCK_BEGIN).count(), 1);
+        assert!(third.starts_with("Host github.com\n"));
+    }
+}
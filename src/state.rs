@@ -1,14 +1,36 @@
+use crate::model::TagColor;
 use color_eyre::eyre::{Context, Result};
 use serde::{Deserialize, Serialize};
 use std::path::{Path, PathBuf};
 
 /// One persisted port-forward entry. Status is intentionally NOT stored —
-/// reloaded tunnels always start Inactive.
+/// reloaded tunnels start Inactive unless they were detached and are still alive.
 #[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
 pub struct PersistedTunnel {
     pub machine: String,
     pub local_port: String,
     pub remote_port: String,
+    /// PID of the az process left running by "detach", reattached on next launch.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub pid: Option<u32>,
+    /// When that process started, to tell it from a later one given the
+    /// same PID.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub pid_started: Option<String>,
+    /// Shared by the forwards of one multi-port connection.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub group: Option<u64>,
+    /// Scale set instance, for tunnels to a VMSS.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub instance: Option<String>,
+    /// Tag set with `t` (or in config) to tell rows apart.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub color: Option<TagColor>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub icon: Option<String>,
+    /// Free text set with `l`.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub note: Option<String>,
 }
 
 /// The on-disk shape of `burrow.state.yaml`.
@@ -16,6 +38,9 @@ pub struct PersistedTunnel {
 pub struct PersistedState {
     #[serde(default)]
     pub tunnels: Vec<PersistedTunnel>,
+    /// Version that last wrote this file; a different one means an upgrade.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub last_seen_version: Option<String>,
 }
 
 /// Sibling state file next to the config: same directory, `burrow.state.yaml`.
@@ -70,11 +95,61 @@ mod tests {
                 machine: "vm1".into(),
                 local_port: "1234".into(),
                 remote_port: "22".into(),
+                pid: None,
+                pid_started: None,
+                group: Some(1),
+                instance: Some("3".into()),
+                color: Some(TagColor::Red),
+                icon: Some("🔥".into()),
+                note: Some("pgAdmin for ticket #1234".into()),
             }],
+            last_seen_version: Some("0.2.1".into()),
         };
         save(&path, &state).unwrap();
         let loaded = load(&path);
         assert_eq!(loaded.tunnels, state.tunnels);
+        assert_eq!(loaded.last_seen_version, state.last_seen_version);
+        let _ = std::fs::remove_file(&path);
+    }
+
+    #[test]
+    fn detached_pid_round_trips_and_is_omitted_when_absent() {
+        let path = tmp("detached-pid");
+        let _ = std::fs::remove_file(&path);
+        let state = PersistedState {
+            tunnels: vec![
+                PersistedTunnel {
+                    machine: "vm1".into(),
+                    local_port: "1234".into(),
+                    remote_port: "22".into(),
+                    pid: Some(4242),
+                    pid_started: Some("Fri Oct 16 18:03:17 2026".into()),
+                    group: None,
+                    instance: None,
+                    color: None,
+                    icon: None,
+                    note: None,
+                },
+                PersistedTunnel {
+                    machine: "vm2".into(),
+                    local_port: "1235".into(),
+                    remote_port: "22".into(),
+                    pid: None,
+                    pid_started: None,
+                    group: None,
+                    instance: None,
+                    color: None,
+                    icon: None,
+                    note: None,
+                },
+            ],
+            last_seen_version: None,
+        };
+        save(&path, &state).unwrap();
+        let text = std::fs::read_to_string(&path).unwrap();
+        assert_eq!(text.matches("pid:").count(), 1);
+        assert_eq!(text.matches("pid_started:").count(), 1);
+        assert_eq!(load(&path).tunnels, state.tunnels);
         let _ = std::fs::remove_file(&path);
     }
 
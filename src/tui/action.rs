@@ -1,20 +1,71 @@
-use crate::model::{CertStatus, TunnelId, TunnelStatus};
+use crate::azure::login::DeviceCode;
+use crate::azure::parse::CertificateFields;
+use crate::azure::vm::{PowerAction, PowerState, VmInfo};
+use crate::model::{CertStatus, Machine, TunnelId, TunnelStatus};
+use chrono::{DateTime, Utc};
 
-/// Background events pushed from tokio tasks (tunnel monitors, cert manager)
-/// into the single mpsc channel the event loop drains.
+/// Background events published by tokio tasks (tunnel monitors, cert manager)
+/// to the [`crate::bus::Bus`], whose subscribers include the event loop.
 #[derive(Debug, Clone)]
 pub enum BgEvent {
     /// A tunnel's status changed (parsed from az output).
     TunnelStatus { id: TunnelId, status: TunnelStatus },
-    /// A new log line for a tunnel (already prefixed). The line itself is kept
-    /// for completeness; the UI pulls the full buffer via `TunnelManager::logs`.
-    TunnelLog {
-        id: TunnelId,
-        #[allow(dead_code)]
-        line: String,
-    },
+    /// A tunnel has new log lines; the UI pulls the buffer via
+    /// `TunnelManager::logs`. At most one is queued per tunnel until it does.
+    TunnelLog { id: TunnelId },
     /// The az process for a tunnel exited (with an optional error description).
     TunnelExited { id: TunnelId, error: Option<String> },
+    /// A tunnel asked to stop is gone; `forced` if it had to be killed after
+    /// the stop timeout.
+    TunnelStopped { id: TunnelId, forced: bool },
+    /// Outcome of the readiness check a waiting tunnel runs against its
+    /// `wait_for` dependency.
+    TunnelReady {
+        id: TunnelId,
+        result: Result<(), String>,
+    },
+    /// Outcome of the health probe sent to every active tunnel after the
+    /// machine wakes from sleep.
+    TunnelHealth {
+        id: TunnelId,
+        result: Result<(), String>,
+    },
+    /// Instance IDs of a scale set, fetched for the create dialog's picker.
+    ScaleSetInstances {
+        machine: String,
+        result: Result<Vec<String>, String>,
+    },
+    /// Outcome of the pre-flight check on a Bastion host (keyed by
+    /// `bastion::key`): `Some` explains why it can't tunnel.
+    BastionChecked {
+        bastion: String,
+        problem: Option<String>,
+    },
+    /// A VM's power state, keyed by machine name, or why az couldn't tell.
+    PowerState {
+        machine: String,
+        result: Result<PowerState, String>,
+    },
+    /// A VM's size, OS and private IP, keyed by machine name, for the
+    /// machines view.
+    VmInfo {
+        machine: String,
+        result: Result<VmInfo, String>,
+    },
+    /// Outcome of starting or deallocating a VM from the machines view.
+    PowerChanged {
+        machine: String,
+        action: PowerAction,
+        result: Result<(), String>,
+    },
+    /// Machines from a refreshed shared config (`R`).
+    SharedConfig {
+        result: Result<Vec<Machine>, String>,
+    },
+    /// Machines re-read after the machine editor changed the config file.
+    ConfigReloaded {
+        result: Result<Vec<Machine>, String>,
+    },
     /// A certificate status update, keyed by VM name (fans out to matching tunnels).
     Cert {
         vm_name: String,
@@ -27,6 +78,34 @@ pub enum BgEvent {
         ok: bool,
         message: String,
     },
+    /// `ssh-add` of a new certificate (`ssh_agent: true`) failed.
+    AgentLoadFailed { vm_name: String, error: String },
+    /// `ssh-keygen -L` on a machine's certificate, for the cert view (`i`).
+    CertInspected {
+        vm_name: String,
+        result: Result<CertificateFields, String>,
+    },
+    /// The signed-in az account and subscription, for the status bar, or why
+    /// `az account show` failed.
+    Account { result: Result<String, String> },
+    /// When the az access token expires, after asking az for one (which
+    /// refreshes it if due), or why that failed.
+    Token {
+        result: Result<DateTime<Utc>, String>,
+    },
+    /// The code and page `az login --use-device-code` asks the user to
+    /// sign in with.
+    DeviceCode(DeviceCode),
+    /// `az login` finished: signed in, or why not.
+    LoggedIn { result: Result<(), String> },
+    /// A `notifications.webhook_url` POST didn't go through.
+    WebhookFailed { error: String },
+    /// Outcome of writing the kubeconfig for an AKS tunnel that came up: the
+    /// file written, or why it couldn't be.
+    KubeconfigWritten {
+        id: TunnelId,
+        result: Result<std::path::PathBuf, String>,
+    },
 }
 
 /// High-level actions the event loop applies to `App`.
@@ -43,4 +122,9 @@ pub enum Action {
     ClearNotification,
     /// Quit the program (after teardown).
     Quit,
+    /// Quit but leave running tunnels alive, recording their PIDs so the next
+    /// launch can reattach to them.
+    Detach,
+    /// Hand the terminal to `program` (e.g. `sftp`) until it exits.
+    External { program: String, args: Vec<String> },
 }
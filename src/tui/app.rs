@@ -1,20 +1,86 @@
+use crate::audit;
+use crate::azure::aks;
+use crate::azure::bastion;
 use crate::azure::cert::CertManager;
-use crate::azure::tunnel::TunnelManager;
-use crate::model::format_duration;
-use crate::model::{Machine, Tunnel, TunnelId, TunnelStatus};
+use crate::azure::cleanup;
+use crate::azure::login::{self, DeviceCode};
+use crate::azure::parse::CertificateFields;
+use crate::azure::retry::{self, RetryPolicy};
+use crate::azure::shared::SharedConfig;
+use crate::azure::token;
+use crate::azure::tunnel::{self, Detached, LogLine, TunnelManager};
+use crate::azure::vm::{self, PowerAction, PowerState, VmInfo};
+use crate::config_edit;
+use crate::export;
+use crate::hooks::{self, HookEvent};
+use crate::lock::InstanceLock;
+use crate::metrics;
+use crate::model::{self, format_duration, parse_port, parse_port_spec, CertStatus};
+use crate::model::{Machine, TagColor, TargetType, Tunnel, TunnelId, TunnelStatus};
+use crate::policy::Policy;
+use crate::recent::{self, Recent, RecentTunnel};
+use crate::session::{self, Session, SessionTunnel};
+use crate::ssh;
 use crate::tui::action::{Action, BgEvent};
+use crate::tui::busy::Busy;
+use crate::tui::clipboard;
+use crate::tui::ext::Extensions;
+use crate::tui::history::{History, Severity};
+use crate::tui::machine_form::MachineForm;
 use crate::tui::view;
+use crate::tunnel_log;
+use crate::webhook::{self, Webhook};
+use chrono::{DateTime, Local, Utc};
 use color_eyre::eyre::Result;
 use crossterm::event::{Event, EventStream, KeyCode, KeyEvent, KeyEventKind, KeyModifiers};
+use crossterm::execute;
+use crossterm::terminal::{
+    disable_raw_mode, enable_raw_mode, EnterAlternateScreen, LeaveAlternateScreen,
+};
 use futures::StreamExt;
 use ratatui::backend::Backend;
 use ratatui::widgets::TableState;
 use ratatui::Terminal;
-use std::path::PathBuf;
+use std::collections::{HashMap, HashSet};
+use std::io::stdout;
+use std::path::{Path, PathBuf};
 use std::time::{Duration, Instant};
 use tokio::sync::mpsc::UnboundedReceiver;
+use tokio_util::sync::CancellationToken;
 
-/// Which overlay (if any) is currently shown.
+/// A gap this large between the wall clock and the monotonic clock over one
+/// tick means the machine slept (or the clock was set).
+const CLOCK_JUMP: Duration = Duration::from_secs(30);
+/// How long the quit screen lists tunnels that outlived their kill.
+const LEFTOVER_PAUSE: Duration = Duration::from_secs(2);
+
+/// A wait shown with a spinner and its elapsed time in the Status cell.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+enum Pending {
+    /// Starting or Connecting: one wait as far as the user is concerned.
+    Start,
+    Stop,
+}
+
+impl Pending {
+    fn of(status: &TunnelStatus) -> Option<Self> {
+        match status {
+            TunnelStatus::Starting | TunnelStatus::Connecting => Some(Pending::Start),
+            TunnelStatus::Stopping => Some(Pending::Stop),
+            _ => None,
+        }
+    }
+}
+
+/// The latest certificate state of one machine, as the tunnel rows show it.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct MachineCert {
+    pub status: CertStatus,
+    /// "4m0s", or "expired".
+    pub expires_in: String,
+}
+
+/// A dialog drawn over the tunnel table. `None` means no dialog is open.
 #[derive(Debug, Clone, Copy, PartialEq, Eq)]
 pub enum Overlay {
     None,
@@ -22,13 +88,100 @@ pub enum Overlay {
     ConfirmDelete(usize),
     ConfirmQuit,
     Logs(TunnelId),
+    /// Certificate state and last renewal error for the tunnel's machine.
+    Cert(TunnelId),
     Help,
+    /// One-time release notes after an upgrade.
+    WhatsNew,
+    /// Recent notifications, newest first.
+    Notifications,
+    /// Every configured machine with its certificate, tunnels or not.
+    Machines,
+    /// The machine editor (`a` / `e` in the machines view).
+    EditMachine,
+    /// Remove `machines[idx]` from the config file? Closed when the machines
+    /// are reloaded, since `idx` may then name another one.
+    ConfirmRemoveMachine(usize),
+    /// Start or deallocate the VM `machines[idx]`? Closed on reload too.
+    ConfirmPower(usize, PowerAction),
+    /// Saved sessions, to restore one or save the current tunnels (`S`).
+    Sessions,
+    /// Typing the note for a tunnel's connection (`l`).
+    EditNote(TunnelId),
+    /// The device code to sign in to az with, while `az login` waits.
+    Login,
+}
+
+/// Open dialogs, topmost last. Only the top one receives keys; closing it
+/// reveals the one underneath, so a dialog raised while another is open waits
+/// its turn instead of replacing (and losing) it.
+#[derive(Debug, Default)]
+pub struct Dialogs(Vec<Overlay>);
+
+impl Dialogs {
+    /// The dialog receiving input, or `Overlay::None`.
+    pub fn top(&self) -> Overlay {
+        self.0.last().copied().unwrap_or(Overlay::None)
+    }
+
+    /// All open dialogs, bottom first (the order they are drawn in).
+    pub fn iter(&self) -> impl Iterator<Item = Overlay> + '_ {
+        self.0.iter().copied()
+    }
+
+    pub fn is_open(&self) -> bool {
+        !self.0.is_empty()
+    }
+
+    /// Show `dialog` on top. One that is already open moves to the top rather
+    /// than appearing twice.
+    pub fn open(&mut self, dialog: Overlay) {
+        if dialog != Overlay::None {
+            self.0.retain(|&d| d != dialog);
+            self.0.push(dialog);
+        }
+    }
+
+    /// Show `dialog` once everything currently open has been closed. For
+    /// dialogs that don't come from a keypress, so they never steal input
+    /// from one the user is typing into.
+    pub fn queue(&mut self, dialog: Overlay) {
+        if dialog != Overlay::None && !self.0.contains(&dialog) {
+            self.0.insert(0, dialog);
+        }
+    }
+
+    /// Close the top dialog.
+    pub fn close(&mut self) {
+        self.0.pop();
+    }
+
+    /// Close `dialog` wherever it is, e.g. one whose work has finished on
+    /// its own.
+    pub fn dismiss(&mut self, dialog: Overlay) {
+        self.0.retain(|&d| d != dialog);
+    }
+}
+
+/// What a tunnel held until az's token is refreshed waits for (`Waiting for
+/// …`).
+const FRESH_TOKEN: &str = "a fresh az token";
+
+/// An `az login --use-device-code` in flight.
+pub struct DeviceLogin {
+    /// The code and page to sign in with, once az has printed them.
+    pub code: Option<DeviceCode>,
+    cancel: CancellationToken,
 }
 
 /// Step in the create-tunnel wizard.
 #[derive(Debug, Clone, Copy, PartialEq, Eq)]
 pub enum CreateStep {
     Machine,
+    /// Only for scale sets without a fixed `instance_id`.
+    Instance,
+    /// Only for machines with `presets:`; the last entry is "Custom ports".
+    Preset,
     LocalPort,
     RemotePort,
 }
@@ -38,20 +191,153 @@ pub struct App {
     pub machines: Vec<Machine>,
     pub tunnels: Vec<Tunnel>,
     pub cursor: usize,
-    pub overlay: Overlay,
+    pub dialogs: Dialogs,
     pub create_step: CreateStep,
     pub selected_machine: usize,
+    /// Why each machine (by index) can't be tunnelled right now, checked when
+    /// the create dialog opens.
+    pub machine_problems: Vec<Option<String>>,
+    pub selected_preset: usize,
+    /// Instances of the selected scale set; `None` while still loading.
+    pub scale_set_instances: Option<Result<Vec<String>, String>>,
+    pub selected_instance: usize,
+    create_instance: Option<String>,
     pub create_local: String,
     pub create_remote: String,
+    /// Why the port just entered was refused, shown under the field.
+    pub create_error: Option<String>,
+    /// Local ports below this need privileges this process lacks.
+    pub privileged_below: Option<u16>,
+    /// Limits from the config's `policy:` on which tunnels may run.
+    pub policy: Policy,
     pub notification: Option<String>,
-    pub shown_logs: Vec<String>,
+    /// The notification most recently timed out, kept dimmed in the status
+    /// bar.
+    pub last_notification: Option<String>,
+    /// Every notification shown, for the `n` overlay.
+    pub history: History,
+    /// az work in flight, spinning in the status bar.
+    pub busy: Busy,
+    /// Wall-clock and monotonic time of the last tick, to notice sleep.
+    last_tick: Option<(DateTime<Utc>, Instant)>,
+    /// Machines whose automatic certificate renewal is paused (`p`), and
+    /// whether it is paused for all of them (`P`).
+    pub renewal_paused: HashSet<String>,
+    pub renewal_paused_all: bool,
+    /// Tunnels still running after quitting killed them, e.g. `vm-web on
+    /// port 2022 (pid 4242)`, for the caller to report once the terminal is
+    /// back.
+    pub leftovers: Vec<String>,
+    /// Certificate state by machine name, kept whether or not the machine
+    /// has a tunnel.
+    pub machine_certs: HashMap<String, MachineCert>,
+    /// Power state by machine name, for VMs az has told us about.
+    pub power_states: HashMap<String, PowerState>,
+    /// Size, OS and private IP by machine name, fetched once per VM when the
+    /// machines view first lists it (again after a failure).
+    pub vm_info: HashMap<String, Result<VmInfo, String>>,
+    /// VMs being started or deallocated from the machines view.
+    power_changing: HashSet<String>,
+    /// Selected row of the machines view (`m`).
+    pub machine_cursor: usize,
+    /// The open machine editor's fields.
+    pub machine_form: Option<MachineForm>,
+    /// Where named sessions are kept; unset in quick mode.
+    pub sessions_path: Option<PathBuf>,
+    /// Saved sessions as last read, for the sessions view, and its selected
+    /// row.
+    pub shown_sessions: Vec<Session>,
+    pub session_cursor: usize,
+    /// The name being typed to save the current tunnels under.
+    pub session_name: Option<String>,
+    /// The note being typed in the `l` dialog.
+    pub note_input: String,
+    /// Connections created before, offered again by the create dialog, and
+    /// where they are kept (unset in quick mode).
+    pub recent: Recent,
+    pub recent_path: Option<PathBuf>,
+    /// For the status bar: the signed-in az account, once known, and the
+    /// config file in use (`None` for a quick tunnel).
+    pub account: Option<String>,
+    pub config_path: Option<String>,
+    pub shown_logs: Vec<LogLine>,
+    /// The least severe log lines the logs view shows; `f` there raises it.
+    pub log_severity: Severity,
+    /// `ssh-keygen -L` of the certificate in the open cert view; `None`
+    /// until it has run.
+    pub shown_cert: Option<Result<CertificateFields, String>>,
     pub tunnel_mgr: TunnelManager,
     pub cert_mgr: CertManager,
     pub filter: Option<String>,
     pub filtering: bool,
     pub table_state: TableState,
+    /// Embedder-registered columns and row actions.
+    pub extensions: Extensions,
+    /// Quick-tunnel session: never write the state file.
+    pub ephemeral: bool,
+    /// `--read-only`: tunnels and certificates are shown, never changed.
+    pub read_only: bool,
+    /// This instance's claim on the config; another instance taking it over
+    /// makes us quit.
+    pub instance_lock: Option<InstanceLock>,
+    /// Where to keep a Prometheus textfile-collector file up to date.
+    pub metrics_textfile: Option<PathBuf>,
+    metrics_written_at: Option<Instant>,
+    /// Under WSL without mirrored networking: how Windows apps reach tunnels,
+    /// shown when picking a local port.
+    pub wsl_hint: Option<&'static str>,
+    /// `audit_log`: where user actions are recorded, and as whom.
+    pub audit_log: Option<PathBuf>,
+    audit_user: String,
+    /// `notifications.webhook_url`: told about tunnel and certificate events.
+    pub webhook: Option<Webhook>,
+    /// Set when running inside tmux: where `s` opens SSH sessions instead of
+    /// suspending the TUI.
+    pub tmux: Option<ssh::TmuxTarget>,
+    /// Reloads machines from the config file; `R` refreshes the shared config
+    /// when there is a `config_source`. Unset in quick mode.
+    pub shared_config: Option<SharedConfig>,
     next_id: u64,
+    next_group: u64,
+    /// Waiting tunnels whose readiness probe is in flight.
+    probing: HashSet<TunnelId>,
+    /// Tunnels found dead after sleep, to start again once stopped.
+    restart_after_stop: HashSet<TunnelId>,
+    /// Why a Bastion host (by `bastion::key`) can't tunnel, from its last check.
+    bastion_problems: HashMap<String, String>,
+    /// How tunnels that exit with a transient `az` error are restarted.
+    pub tunnel_retry: RetryPolicy,
+    /// Automatic restarts so far, per tunnel; cleared once it comes up.
+    retry_counts: HashMap<TunnelId, u32>,
+    /// When each failed tunnel is due its next automatic restart.
+    retry_at: HashMap<TunnelId, Instant>,
+    /// How long a starting tunnel gets to come up; `None` waits forever.
+    pub start_timeout: Option<Duration>,
+    /// When each starting or stopping tunnel began to, for the elapsed time
+    /// beside it and the start timeout.
+    pending_since: HashMap<TunnelId, (Pending, Instant)>,
+    /// Tunnels stopped because they can't come up (too slow, or their VM is
+    /// off), with the error to show once they are gone.
+    fail_after_stop: HashMap<TunnelId, String>,
+    /// Whether to run a device-code `az login` when az needs one. Off with
+    /// `auth:`, which signs in on its own.
+    pub interactive_login: bool,
+    /// The sign-in in progress, if any.
+    pub device_login: Option<DeviceLogin>,
+    /// Tunnels, and certificates by machine, that failed for want of a
+    /// login, to try again once signed in.
+    resume_after_login: HashSet<TunnelId>,
+    regen_after_login: HashSet<String>,
+    /// When the az access token expires, for the status bar.
+    pub token_expires: Option<DateTime<Utc>>,
+    /// A token az handed out already close to expiring: it won't refresh it
+    /// until it is all but used up, so tunnels don't wait on it again.
+    token_final: Option<DateTime<Utc>>,
+    refreshing_token: bool,
+    /// Tunnels held in `Waiting` until the token has been refreshed.
+    token_waiters: HashSet<TunnelId>,
     should_quit: bool,
+    detaching: bool,
     state_path: PathBuf,
 }
 
@@ -75,25 +361,89 @@ impl App {
                 t
             })
             .collect();
+        let next_group = tunnels.iter().filter_map(|t| t.group).max().unwrap_or(0) + 1;
         Self {
             version,
             machines,
             tunnels,
             cursor: 0,
-            overlay: Overlay::None,
+            dialogs: Dialogs::default(),
             create_step: CreateStep::Machine,
             selected_machine: 0,
+            machine_problems: Vec::new(),
+            selected_preset: 0,
+            scale_set_instances: None,
+            selected_instance: 0,
+            create_instance: None,
             create_local: String::new(),
             create_remote: String::new(),
+            create_error: None,
+            privileged_below: model::privileged_port_limit(),
+            policy: Policy::default(),
             notification: None,
+            last_notification: None,
+            history: History::default(),
+            busy: Busy::default(),
+            last_tick: None,
+            renewal_paused: HashSet::new(),
+            renewal_paused_all: false,
+            leftovers: Vec::new(),
+            machine_certs: HashMap::new(),
+            power_states: HashMap::new(),
+            power_changing: HashSet::new(),
+            vm_info: HashMap::new(),
+            machine_cursor: 0,
+            machine_form: None,
+            sessions_path: None,
+            shown_sessions: Vec::new(),
+            session_cursor: 0,
+            session_name: None,
+            note_input: String::new(),
+            recent: Recent::default(),
+            recent_path: None,
+            account: None,
+            config_path: None,
             shown_logs: Vec::new(),
+            log_severity: Severity::Info,
+            shown_cert: None,
             tunnel_mgr,
             cert_mgr,
             next_id,
+            next_group,
+            probing: HashSet::new(),
+            restart_after_stop: HashSet::new(),
+            bastion_problems: HashMap::new(),
+            tunnel_retry: tunnel::DEFAULT_RETRY,
+            retry_counts: HashMap::new(),
+            retry_at: HashMap::new(),
+            start_timeout: Some(tunnel::DEFAULT_START_TIMEOUT),
+            pending_since: HashMap::new(),
+            fail_after_stop: HashMap::new(),
+            interactive_login: true,
+            device_login: None,
+            resume_after_login: HashSet::new(),
+            regen_after_login: HashSet::new(),
+            token_expires: None,
+            token_final: None,
+            refreshing_token: false,
+            token_waiters: HashSet::new(),
             should_quit: false,
+            detaching: false,
             filter: None,
             filtering: false,
             table_state: TableState::default(),
+            extensions: Extensions::default(),
+            ephemeral: false,
+            read_only: false,
+            instance_lock: None,
+            shared_config: None,
+            wsl_hint: None,
+            webhook: None,
+            tmux: None,
+            audit_log: None,
+            audit_user: audit::user(),
+            metrics_textfile: None,
+            metrics_written_at: None,
             state_path,
         }
     }
@@ -114,15 +464,7 @@ impl App {
     pub fn add_tunnel_for_test(&mut self, machine: Machine, local: &str, remote: &str) {
         let id = TunnelId(self.next_id);
         self.next_id += 1;
-        self.tunnels.push(Tunnel {
-            id,
-            machine,
-            local_port: local.into(),
-            remote_port: remote.into(),
-            status: TunnelStatus::Inactive,
-            cert_status: None,
-            cert_expires_in: None,
-        });
+        self.tunnels.push(Tunnel::new(id, machine, local, remote));
     }
 
     /// Indices into `tunnels` that match the active filter (all when no filter).
@@ -134,7 +476,12 @@ impl App {
                 self.tunnels
                     .iter()
                     .enumerate()
-                    .filter(|(_, t)| t.machine.name.to_lowercase().contains(&q))
+                    .filter(|(_, t)| {
+                        t.machine.name.to_lowercase().contains(&q)
+                            || t.name
+                                .as_ref()
+                                .is_some_and(|n| n.to_lowercase().contains(&q))
+                    })
                     .map(|(i, _)| i)
                     .collect()
             }
@@ -155,17 +502,56 @@ impl App {
         self.table_state.select((len > 0).then_some(self.cursor));
     }
 
+    /// Put the cursor back on tunnel `id` if it is still listed, so a change
+    /// to which rows are shown doesn't move the selection to another tunnel;
+    /// otherwise just keep the cursor in range.
+    pub fn reselect(&mut self, id: Option<TunnelId>) {
+        let row = id.and_then(|id| {
+            self.visible_indices()
+                .iter()
+                .position(|&i| self.tunnels[i].id == id)
+        });
+        if let Some(row) = row {
+            self.cursor = row;
+        }
+        self.clamp_cursor();
+    }
+
     pub fn id_at_cursor(&self) -> Option<TunnelId> {
         self.selected_real_index().map(|i| self.tunnels[i].id)
     }
 
+    /// Indices of the tunnels forming one connection with `tunnels[idx]`:
+    /// its whole multi-port group, or just itself.
+    pub fn group_members(&self, idx: usize) -> Vec<usize> {
+        match self.tunnels.get(idx).and_then(|t| t.group) {
+            Some(g) => (0..self.tunnels.len())
+                .filter(|&i| self.tunnels[i].group == Some(g))
+                .collect(),
+            None if idx < self.tunnels.len() => vec![idx],
+            None => Vec::new(),
+        }
+    }
+
+    /// Remove `tunnels[idx]` together with the rest of its group.
     pub fn remove_tunnel(&mut self, idx: usize) {
-        if idx >= self.tunnels.len() {
+        if self.refuse_read_only() {
             return;
         }
-        let id = self.tunnels[idx].id;
-        self.tunnel_mgr.stop(id);
-        self.tunnels.remove(idx);
+        let members = self.group_members(idx);
+        if members.is_empty() {
+            return;
+        }
+        let ids: Vec<TunnelId> = members.iter().map(|&i| self.tunnels[i].id).collect();
+        for &i in &members {
+            self.audit_tunnel("delete", i);
+            let id = self.tunnels[i].id;
+            if self.tunnel_mgr.is_running(id) {
+                self.tunnel_mgr.stop(id);
+                self.tunnel_event(i, HookEvent::Stop, None);
+            }
+        }
+        self.tunnels.retain(|t| !ids.contains(&t.id));
         self.clamp_cursor();
         self.persist();
     }
@@ -173,6 +559,14 @@ impl App {
     /// Best-effort write of the current tunnel list to the state file.
     /// Errors are intentionally ignored — persistence must never break the UI.
     fn persist(&self) {
+        self.persist_with_pids(&HashMap::new());
+    }
+
+    /// Like [`App::persist`], additionally recording the PIDs of detached tunnels.
+    fn persist_with_pids(&self, detached: &HashMap<TunnelId, Detached>) {
+        if self.ephemeral {
+            return;
+        }
         let state = crate::state::PersistedState {
             tunnels: self
                 .tunnels
@@ -181,48 +575,366 @@ impl App {
                     machine: t.machine.name.clone(),
                     local_port: t.local_port.clone(),
                     remote_port: t.remote_port.clone(),
+                    pid: detached.get(&t.id).map(|d| d.pid),
+                    pid_started: detached.get(&t.id).map(|d| d.started.clone()),
+                    group: t.group,
+                    instance: t.instance.clone(),
+                    color: t.color,
+                    icon: t.icon.clone(),
+                    note: t.note.clone(),
                 })
                 .collect(),
+            last_seen_version: Some(self.version.clone()),
         };
         let _ = crate::state::save(&self.state_path, &state);
     }
 
+    /// Show the release notes for this version, if the changelog has any.
+    /// Called at startup when the state file was written by another version.
+    pub fn show_whats_new(&mut self) {
+        if crate::changelog::notes(&self.version).is_some() {
+            self.dialogs.queue(Overlay::WhatsNew);
+        }
+    }
+
+    /// Problems found while starting up, which printed before the TUI takes
+    /// the screen would be lost: one is shown in the status bar; several are
+    /// summed up there and kept in the notification history (`n`).
+    pub fn report_startup(&mut self, warnings: &[String]) {
+        if warnings.is_empty() {
+            return;
+        }
+        // What startup already said (a restored session) stays readable.
+        if let Some(earlier) = self.notification.take() {
+            self.history.push(&earlier);
+        }
+        match warnings {
+            [only] => self.notification = Some(format!("⚠️ {only}")),
+            many => {
+                for w in many {
+                    self.history.push(&format!("⚠️ {w}"));
+                }
+                self.notification =
+                    Some(format!("⚠️ {} startup warnings (n: show them)", many.len()));
+            }
+        }
+    }
+
+    /// Reattach to tunnels a previous session detached from. `detached` lines
+    /// up with `tunnels` as passed to [`App::new`]; dead PIDs, and PIDs now
+    /// held by another process, are left Inactive.
+    pub fn reattach(&mut self, detached: &[Option<Detached>]) {
+        for (t, d) in self.tunnels.iter_mut().zip(detached) {
+            // A PID that is alive but started at another time was reused,
+            // e.g. after a reboot: not ours to show, or to kill on quit.
+            if let Some(d) = d
+                .as_ref()
+                .filter(|d| cleanup::is_same_process(d.pid, &d.started))
+            {
+                self.tunnel_mgr.adopt(t, d.clone());
+                t.status = TunnelStatus::Active;
+            }
+        }
+    }
+
+    /// Whether `d` in the quit dialog can leave tunnels running.
+    pub fn can_detach(&self) -> bool {
+        cleanup::CAN_DETACH && !self.ephemeral
+    }
+
+    /// Observe only (`--read-only`): nothing is created, started, stopped or
+    /// renewed, and the state file is left to the instance that owns it.
+    pub fn set_read_only(&mut self) {
+        self.read_only = true;
+        self.ephemeral = true;
+        self.cert_mgr.set_all_paused(true);
+    }
+
+    /// Whether a change has to be turned down because the instance is
+    /// read-only, saying so when it does.
+    fn refuse_read_only(&mut self) -> bool {
+        if self.read_only {
+            self.notification =
+                Some("🔒 Read-only: tunnels and certificates can't be changed".into());
+        }
+        self.read_only
+    }
+
     /// Apply a background event. Late events for unknown ids are dropped.
     pub fn apply_bg(&mut self, ev: BgEvent) {
         match ev {
             BgEvent::TunnelStatus { id, status } => {
-                if let Some(t) = self.tunnels.iter_mut().find(|t| t.id == id) {
-                    t.status = status;
+                if status == TunnelStatus::Active {
+                    self.retry_counts.remove(&id);
+                }
+                // Output still in flight when the user stopped the tunnel
+                // must not overwrite Stopping: TunnelStopped only finishes
+                // a stop from there, so the row would be stuck.
+                let idx = self
+                    .tunnels
+                    .iter()
+                    .position(|t| t.id == id && t.status != TunnelStatus::Stopping);
+                if let Some(idx) = idx {
+                    let came_up = status == TunnelStatus::Active
+                        && self.tunnels[idx].status != TunnelStatus::Active;
+                    self.tunnels[idx].status = status;
+                    if came_up {
+                        self.tunnel_event(idx, HookEvent::Ready, None);
+                    }
                 }
+                self.release_waiters();
             }
-            BgEvent::TunnelLog { id, .. } => {
-                if let Overlay::Logs(open) = self.overlay {
+            BgEvent::TunnelLog { id } => {
+                if let Overlay::Logs(open) = self.dialogs.top() {
                     if open == id {
                         self.shown_logs = self.tunnel_mgr.logs(id);
                     }
                 }
             }
             BgEvent::TunnelExited { id, error } => {
-                if let Some(t) = self.tunnels.iter_mut().find(|t| t.id == id) {
-                    t.status = match error {
-                        Some(e) => TunnelStatus::Error(e),
-                        None => TunnelStatus::Inactive,
+                self.fail_after_stop.remove(&id);
+                let mut signed_out = false;
+                // az's own complaint is in the log, not the exit status.
+                let logs = self.tunnel_mgr.logs(id);
+                let idx = self.tunnels.iter().position(|t| t.id == id);
+                let hook_error = error.clone();
+                if let Some(t) = idx.map(|i| &mut self.tunnels[i]) {
+                    // A known Bastion problem says more than az's exit code.
+                    let known = self.bastion_problems.get(&bastion::key(&t.machine));
+                    t.status = match (error, known) {
+                        (Some(_), Some(problem)) => TunnelStatus::Error(problem.clone()),
+                        (Some(e), None) => {
+                            let tail = logs[logs.len().saturating_sub(20)..]
+                                .iter()
+                                .map(|l| l.text.as_str())
+                                .collect::<Vec<_>>()
+                                .join("\n");
+                            signed_out = login::needs_login(&e) || login::needs_login(&tail);
+                            let attempt = self.retry_counts.get(&id).copied().unwrap_or(0) + 1;
+                            if (retry::is_transient(&e) || retry::is_transient(&tail))
+                                && attempt <= self.tunnel_retry.retries
+                            {
+                                let delay = self.tunnel_retry.delay(attempt);
+                                self.retry_counts.insert(id, attempt);
+                                self.retry_at.insert(id, Instant::now() + delay);
+                                TunnelStatus::Error(format!(
+                                    "{e} — retrying in {}s ({attempt}/{})",
+                                    delay.as_secs().max(1),
+                                    self.tunnel_retry.retries
+                                ))
+                            } else {
+                                self.retry_counts.remove(&id);
+                                TunnelStatus::Error(e)
+                            }
+                        }
+                        (None, _) => TunnelStatus::Inactive,
                     };
                 }
+                if let Some(idx) = idx {
+                    match hook_error {
+                        Some(e) => self.tunnel_event(idx, HookEvent::Error, Some(&e)),
+                        None => self.tunnel_event(idx, HookEvent::Stop, None),
+                    }
+                }
+                self.tunnel_mgr.stop(id);
+                self.release_waiters();
+                if signed_out && idx.is_some() {
+                    self.resume_after_login.insert(id);
+                    self.need_login();
+                }
+            }
+            BgEvent::TunnelHealth { id, result } => {
+                let Err(e) = result else {
+                    return;
+                };
+                let Some(idx) = self.tunnels.iter().position(|t| t.id == id) else {
+                    return;
+                };
+                if self.tunnels[idx].status != TunnelStatus::Active {
+                    return;
+                }
+                self.notification = Some(format!(
+                    "⚠️ {} stopped answering after sleep ({e}); restarting",
+                    self.tunnels[idx].display_name()
+                ));
+                self.restart_after_stop.insert(id);
+                self.stop_tunnel(idx);
+            }
+            BgEvent::TunnelStopped { id, forced } => {
                 self.tunnel_mgr.stop(id);
+                let restart = self.restart_after_stop.remove(&id);
+                let failed = self.fail_after_stop.remove(&id);
+                // Deleted while stopping: its stop hook has already run.
+                let Some(idx) = self.tunnels.iter().position(|t| t.id == id) else {
+                    return;
+                };
+                if self.tunnels[idx].status != TunnelStatus::Stopping {
+                    return;
+                }
+                if forced {
+                    self.notification = Some(format!(
+                        "⚠️ {} did not stop in time and was killed (Space: logs)",
+                        self.tunnels[idx].display_name()
+                    ));
+                }
+                if let Some(e) = failed {
+                    self.tunnels[idx].status = TunnelStatus::Error(e.clone());
+                    self.tunnel_event(idx, HookEvent::Error, Some(&e));
+                } else if restart {
+                    self.spawn_tunnel(idx);
+                } else {
+                    self.tunnels[idx].status = TunnelStatus::Inactive;
+                    self.tunnel_event(idx, HookEvent::Stop, None);
+                }
+                self.release_waiters();
+            }
+            BgEvent::TunnelReady { id, result } => {
+                self.probing.remove(&id);
+                let Some(idx) = self.tunnels.iter().position(|t| t.id == id) else {
+                    return;
+                };
+                // The user may have cancelled the wait while the probe ran.
+                let TunnelStatus::Waiting(dep) = self.tunnels[idx].status.clone() else {
+                    return;
+                };
+                match result {
+                    Ok(()) => self.spawn_tunnel(idx),
+                    Err(e) => {
+                        self.tunnels[idx].status =
+                            TunnelStatus::Error(format!("{dep} not ready: {e}"));
+                    }
+                }
+            }
+            BgEvent::ScaleSetInstances { machine, result } => {
+                // Drop answers for a picker that has since moved on or closed.
+                let waiting = self.dialogs.top() == Overlay::Create
+                    && self.create_step == CreateStep::Instance
+                    && self.machines[self.selected_machine].name == machine;
+                if waiting {
+                    self.scale_set_instances = Some(result);
+                }
             }
             BgEvent::Cert {
                 vm_name,
                 status,
                 expires_in,
             } => {
+                let kind = match status {
+                    CertStatus::Renewed => Some(webhook::Event::CertRenewed),
+                    CertStatus::RenewalFailed => Some(webhook::Event::CertFailed),
+                    _ => None,
+                };
+                let error = match status {
+                    CertStatus::RenewalFailed => self
+                        .cert_mgr
+                        .details(&vm_name)
+                        .and_then(|d| d.last_error)
+                        .map(|e| e.output),
+                    _ => None,
+                };
+                if let (Some(hook), Some(kind)) = (&self.webhook, kind) {
+                    hook.send(webhook::cert_payload(kind, &vm_name, error.as_deref()));
+                }
+                if error.as_deref().is_some_and(login::needs_login) {
+                    self.regen_after_login.insert(vm_name.clone());
+                    self.need_login();
+                }
+                let cert = MachineCert {
+                    status,
+                    expires_in: expires_in.map_or_else(|| "expired".into(), format_duration),
+                };
                 for t in self
                     .tunnels
                     .iter_mut()
                     .filter(|t| t.machine.name == vm_name)
                 {
-                    t.cert_status = Some(status);
-                    t.cert_expires_in = expires_in.map(format_duration).or(Some("expired".into()));
+                    t.cert_status = Some(cert.status);
+                    t.cert_expires_in = Some(cert.expires_in.clone());
+                }
+                self.machine_certs.insert(vm_name, cert);
+            }
+            BgEvent::BastionChecked { bastion, problem } => match problem {
+                Some(problem) => {
+                    // Tunnels that already failed get the explanation too.
+                    for t in &mut self.tunnels {
+                        if matches!(t.status, TunnelStatus::Error(_))
+                            && bastion::key(&t.machine) == bastion
+                        {
+                            t.status = TunnelStatus::Error(problem.clone());
+                        }
+                    }
+                    self.notification = Some(format!("⚠️ {problem}"));
+                    self.bastion_problems.insert(bastion, problem);
+                }
+                None => {
+                    self.bastion_problems.remove(&bastion);
+                }
+            },
+            BgEvent::PowerState { machine, result } => {
+                // If az can't tell, the tunnel speaks for itself.
+                let Ok(state) = result else {
+                    self.power_states.remove(&machine);
+                    return;
+                };
+                if state.is_down() {
+                    let error = format!("VM {machine} is {}: start it first", state.label());
+                    let starting: Vec<usize> = (0..self.tunnels.len())
+                        .filter(|&i| {
+                            self.tunnels[i].machine.name == machine
+                                && Pending::of(&self.tunnels[i].status) == Some(Pending::Start)
+                        })
+                        .collect();
+                    if !starting.is_empty() {
+                        self.notification = Some(format!("⚠️ {error}"));
+                    }
+                    for idx in starting {
+                        self.fail_start(idx, error.clone());
+                    }
+                }
+                self.power_states.insert(machine, state);
+            }
+            BgEvent::VmInfo { machine, result } => {
+                self.vm_info.insert(machine, result);
+            }
+            BgEvent::PowerChanged {
+                machine,
+                action,
+                result,
+            } => {
+                self.busy.finish(&format!("power:{machine}"));
+                self.power_changing.remove(&machine);
+                match result {
+                    // The state it ended up in follows.
+                    Ok(()) => {
+                        self.notification = Some(format!("✅ {machine} {}", action.done()));
+                    }
+                    Err(e) => {
+                        self.power_states.remove(&machine);
+                        self.notification =
+                            Some(format!("❌ Could not {} {machine}: {e}", action.command()));
+                    }
+                }
+            }
+            BgEvent::SharedConfig { result } => {
+                self.busy.finish("shared-config");
+                match result {
+                    Ok(machines) => {
+                        self.notification = Some(format!(
+                            "✅ Shared config refreshed: {} machines",
+                            machines.len()
+                        ));
+                        self.replace_machines(machines);
+                    }
+                    Err(e) => {
+                        self.notification = Some(format!("❌ Could not refresh shared config: {e}"))
+                    }
+                }
+            }
+            BgEvent::ConfigReloaded { result } => {
+                self.busy.finish("config");
+                match result {
+                    Ok(machines) => self.replace_machines(machines),
+                    Err(e) => self.notification = Some(format!("❌ Could not reload config: {e}")),
                 }
             }
             BgEvent::CertRegenResult {
@@ -230,452 +942,3709 @@ impl App {
                 ok,
                 message,
             } => {
+                self.busy.finish(&format!("cert:{vm_name}"));
+                if let Overlay::Cert(id) = self.dialogs.top() {
+                    if ok && self.cert_view_machine(id) == Some(vm_name.as_str()) {
+                        self.inspect_cert(id);
+                    }
+                }
+                if let Some(hook) = &self.webhook {
+                    let (kind, error) = if ok {
+                        (webhook::Event::CertRenewed, None)
+                    } else {
+                        (webhook::Event::CertFailed, Some(message.as_str()))
+                    };
+                    hook.send(webhook::cert_payload(kind, &vm_name, error));
+                }
                 self.notification = Some(if ok {
                     format!("✅ {message} for {vm_name}")
                 } else {
                     format!("❌ {message}")
                 });
+                if !ok && login::needs_login(&message) {
+                    self.regen_after_login.insert(vm_name);
+                    self.need_login();
+                }
+            }
+            BgEvent::AgentLoadFailed { vm_name, error } => {
+                self.notification = Some(format!("⚠️ ssh-add for {vm_name} failed: {error}"));
+            }
+            BgEvent::CertInspected { vm_name, result } => {
+                if let Overlay::Cert(id) = self.dialogs.top() {
+                    if self.cert_view_machine(id) == Some(vm_name.as_str()) {
+                        self.shown_cert = Some(result);
+                    }
+                }
+            }
+            BgEvent::Account { result } => {
+                self.busy.finish("account");
+                if result.as_ref().is_err_and(|e| login::needs_login(e)) {
+                    self.need_login();
+                }
+                self.account = Some(result.unwrap_or_else(|_| "not signed in to az".into()));
+            }
+            BgEvent::Token { result } => {
+                self.refreshing_token = false;
+                self.busy.finish("token");
+                match result {
+                    Ok(at) => {
+                        self.token_expires = Some(at);
+                        self.token_final = token::due(at, Utc::now()).then_some(at);
+                    }
+                    Err(e) => {
+                        self.token_expires = None;
+                        if login::needs_login(&e) {
+                            self.need_login();
+                        }
+                    }
+                }
+                // Start the held tunnels either way: one that fails for want
+                // of a login is resumed once signed in.
+                let held = std::mem::take(&mut self.token_waiters);
+                for idx in 0..self.tunnels.len() {
+                    if held.contains(&self.tunnels[idx].id)
+                        && self.tunnels[idx].status == TunnelStatus::Waiting(FRESH_TOKEN.into())
+                    {
+                        self.launch_tunnel(idx);
+                    }
+                }
+            }
+            BgEvent::DeviceCode(code) => {
+                if let Some(login) = &mut self.device_login {
+                    login.code = Some(code);
+                }
+            }
+            BgEvent::LoggedIn { result } => {
+                // Cancelled: already dealt with.
+                if self.device_login.take().is_none() {
+                    return;
+                }
+                self.busy.finish("login");
+                self.dialogs.dismiss(Overlay::Login);
+                match result {
+                    Ok(()) => self.resume_signed_out(),
+                    Err(e) => {
+                        self.resume_after_login.clear();
+                        self.regen_after_login.clear();
+                        self.notification = Some(format!("❌ az login failed: {e}"));
+                    }
+                }
+            }
+            BgEvent::WebhookFailed { error } => {
+                self.notification = Some(format!("⚠️ Webhook failed: {error}"));
+            }
+            BgEvent::KubeconfigWritten { id, result } => {
+                let Some(t) = self.tunnels.iter().find(|t| t.id == id) else {
+                    return;
+                };
+                // Stopped while az was fetching: don't leave a dead config.
+                if t.status != TunnelStatus::Active {
+                    if let Some(cluster) = &t.aks {
+                        aks::remove_kubeconfig(cluster);
+                    }
+                    return;
+                }
+                self.notification = Some(match result {
+                    Ok(path) => format!("☸ KUBECONFIG={}", path.display()),
+                    Err(e) => format!("❌ kubeconfig for {}: {e}", t.label()),
+                });
+            }
+        }
+    }
+
+    /// Open the machines view, asking for the power state of every VM it
+    /// lists, and the details of those not yet known.
+    fn open_machines(&mut self) {
+        self.dialogs.open(Overlay::Machines);
+        for m in self.machines.iter().filter(|m| vm::has_power_state(m)) {
+            self.tunnel_mgr.check_power_state(m);
+            if !matches!(self.vm_info.get(&m.name), Some(Ok(_))) {
+                self.tunnel_mgr.fetch_vm_info(m);
             }
         }
     }
 
     fn start_create(&mut self) {
-        if self.overlay == Overlay::None && !self.machines.is_empty() {
-            self.overlay = Overlay::Create;
+        if self.refuse_read_only() {
+            return;
+        }
+        if !self.dialogs.is_open() && !self.machines.is_empty() {
+            self.dialogs.open(Overlay::Create);
             self.create_step = CreateStep::Machine;
             self.selected_machine = 0;
+            self.machine_problems = self
+                .machines
+                .iter()
+                .map(|m| machine_problem(m, &self.bastion_problems))
+                .collect();
+            self.create_instance = None;
             self.create_local.clear();
             self.create_remote.clear();
+            self.create_error = None;
         }
     }
 
-    fn finish_create(&mut self) {
-        let id = TunnelId(self.next_id);
-        self.next_id += 1;
-        let machine = self.machines[self.selected_machine].clone();
-        self.tunnels.push(Tunnel {
-            id,
-            machine,
-            local_port: self.create_local.clone(),
-            remote_port: self.create_remote.clone(),
-            status: TunnelStatus::Inactive,
-            cert_status: None,
-            cert_expires_in: None,
-        });
-        self.overlay = Overlay::None;
-        self.persist();
+    /// The create dialog's recent connections, keyed `1`–`9`: those whose
+    /// machine is still configured, with its index.
+    pub fn recent_choices(&self) -> Vec<(usize, &RecentTunnel)> {
+        self.recent
+            .tunnels
+            .iter()
+            .filter_map(|r| {
+                let idx = self.machines.iter().position(|m| m.name == r.machine)?;
+                Some((idx, r))
+            })
+            .take(9)
+            .collect()
     }
 
-    fn toggle_selected(&mut self) {
-        let Some(idx) = self.selected_real_index() else {
+    /// Create the `n`th (from 0) recent connection again in one go.
+    fn recreate_recent(&mut self, n: usize) {
+        let Some((idx, spec, instance)) = self
+            .recent_choices()
+            .get(n)
+            .map(|&(idx, r)| (idx, r.ports.clone(), r.instance.clone()))
+        else {
             return;
         };
-        let status = self.tunnels[idx].status.clone();
-        match status {
-            TunnelStatus::Inactive | TunnelStatus::Error(_) => {
-                self.tunnels[idx].status = TunnelStatus::Starting;
-                let tunnel = self.tunnels[idx].clone();
-                if let Err(e) = self.tunnel_mgr.start(&tunnel) {
-                    self.tunnels[idx].status = TunnelStatus::Error(e.to_string());
-                }
-            }
-            TunnelStatus::Active => {
-                let id = self.tunnels[idx].id;
-                self.tunnel_mgr.stop(id);
-                self.tunnels[idx].status = TunnelStatus::Inactive;
+        match parse_port_spec(&spec).and_then(|pairs| self.allowed_pairs(pairs)) {
+            Ok(pairs) => {
+                self.selected_machine = idx;
+                self.create_instance = instance;
+                self.finish_create(pairs);
             }
-            _ => {}
+            Err(e) => self.notification = Some(format!("❌ {e}")),
         }
     }
 
-    fn any_running(&self) -> bool {
-        self.tunnels.iter().any(|t| t.status.is_running())
+    /// What stops the selected machine from tunnelling, if known.
+    pub fn selected_machine_problem(&self) -> Option<&str> {
+        self.machine_problems
+            .get(self.selected_machine)
+            .and_then(|p| p.as_deref())
     }
 
-    /// Start every stopped tunnel, or — if all are already running — stop them all.
-    fn toggle_all(&mut self) {
-        if self.tunnels.is_empty() {
-            return;
+    /// The create wizard's steps for the selected machine, in order.
+    pub fn create_steps(&self) -> Vec<CreateStep> {
+        let m = &self.machines[self.selected_machine];
+        let mut steps = vec![CreateStep::Machine];
+        if m.target_type == TargetType::Vmss && m.instance_id.is_none() {
+            steps.push(CreateStep::Instance);
         }
-        let any_stopped = self.tunnels.iter().any(|t| !t.status.is_running());
-        if any_stopped {
-            for i in 0..self.tunnels.len() {
-                if !self.tunnels[i].status.is_running() {
-                    self.tunnels[i].status = TunnelStatus::Starting;
-                    let tunnel = self.tunnels[i].clone();
-                    if let Err(e) = self.tunnel_mgr.start(&tunnel) {
-                        self.tunnels[i].status = TunnelStatus::Error(e.to_string());
-                    }
-                }
-            }
-            self.notification = Some("▶ Starting all tunnels…".into());
-        } else {
-            for t in self.tunnels.iter_mut() {
-                self.tunnel_mgr.stop(t.id);
-                t.status = TunnelStatus::Inactive;
-            }
-            self.notification = Some("■ Stopping all tunnels…".into());
+        if !m.presets.is_empty() {
+            steps.push(CreateStep::Preset);
         }
+        steps.extend([CreateStep::LocalPort, CreateStep::RemotePort]);
+        steps
     }
 
-    fn handle_main_key(&mut self, key: KeyEvent) -> Option<Action> {
-        match key.code {
-            KeyCode::Char('q') => {
-                if self.any_running() {
-                    self.overlay = Overlay::ConfirmQuit;
-                } else {
-                    return Some(Action::Quit);
-                }
-            }
-            KeyCode::Char('c') => self.start_create(),
-            KeyCode::Up | KeyCode::Char('k') => {
-                let len = self.visible_indices().len();
-                if len > 0 {
-                    self.cursor = (self.cursor + len - 1) % len;
-                }
-            }
-            KeyCode::Down | KeyCode::Char('j') => {
-                let len = self.visible_indices().len();
-                if len > 0 {
-                    self.cursor = (self.cursor + 1) % len;
-                }
-            }
-            KeyCode::Char('g') => self.cursor = 0,
-            KeyCode::Char('G') => {
-                self.cursor = self.visible_indices().len().saturating_sub(1);
-            }
-            KeyCode::Enter => self.toggle_selected(),
-            KeyCode::Char(' ') => {
-                if let Some(id) = self.id_at_cursor() {
-                    self.shown_logs = self.tunnel_mgr.logs(id);
-                    self.overlay = Overlay::Logs(id);
-                }
-            }
-            KeyCode::Char('d') | KeyCode::Delete => {
-                if let Some(real) = self.selected_real_index() {
-                    self.overlay = Overlay::ConfirmDelete(real);
-                }
-            }
-            KeyCode::Char('r') => return self.trigger_regen(),
-            KeyCode::Char('a') => self.toggle_all(),
-            KeyCode::Char('/') => {
-                self.filtering = true;
-                self.filter = Some(String::new());
+    /// Move the create wizard on to the step after the current one.
+    fn advance_create(&mut self) {
+        let steps = self.create_steps();
+        let Some(&next) = steps
+            .iter()
+            .position(|&s| s == self.create_step)
+            .and_then(|i| steps.get(i + 1))
+        else {
+            return;
+        };
+        self.create_step = next;
+        match next {
+            CreateStep::Instance => {
+                self.scale_set_instances = None;
+                self.selected_instance = 0;
+                let m = &self.machines[self.selected_machine];
+                // The scale set's own name is the last segment of its ID.
+                let scale_set = m
+                    .target_resource_id
+                    .rsplit('/')
+                    .find(|s| !s.is_empty())
+                    .unwrap_or(&m.name)
+                    .to_string();
+                self.tunnel_mgr.list_scale_set_instances(
+                    m.name.clone(),
+                    m.resource_group.clone(),
+                    scale_set,
+                );
             }
-            KeyCode::Char('?') => self.overlay = Overlay::Help,
-            KeyCode::Esc => self.filter = None,
+            CreateStep::Preset => self.selected_preset = 0,
             _ => {}
         }
-        self.clamp_cursor();
-        None
     }
 
-    fn handle_filter_key(&mut self, key: KeyEvent) {
-        match key.code {
-            KeyCode::Char(c) => {
-                if let Some(q) = self.filter.as_mut() {
-                    q.push(c);
-                }
-            }
-            KeyCode::Backspace => {
-                if let Some(q) = self.filter.as_mut() {
-                    q.pop();
-                }
-            }
-            KeyCode::Enter | KeyCode::Esc => {
-                self.filtering = false;
-                if self.filter.as_deref() == Some("") {
-                    self.filter = None;
-                }
-            }
-            _ => {}
+    /// Take the create wizard back a step, keeping what was entered.
+    fn back_create(&mut self) {
+        let steps = self.create_steps();
+        if let Some(i) = steps
+            .iter()
+            .position(|&s| s == self.create_step)
+            .filter(|&i| i > 0)
+        {
+            self.create_step = steps[i - 1];
+            self.create_error = None;
         }
-        self.clamp_cursor();
     }
 
-    fn trigger_regen(&mut self) -> Option<Action> {
-        let t = self.tunnels.get(self.selected_real_index()?)?;
-        match &t.machine.ssh_config_path {
-            Some(p) if !p.is_empty() => {
-                self.notification = Some(format!(
-                    "🔄 Regenerating certificate for {}...",
-                    t.machine.name
-                ));
-                let cert_mgr = self.cert_mgr.clone();
-                let vm = t.machine.name.clone();
-                let path = p.clone();
-                tokio::spawn(async move {
-                    cert_mgr.generate(vm, path).await;
-                });
+    /// A warning for local ports typed in the create wizard that need
+    /// privileges to bind.
+    pub fn create_port_warning(&self) -> Option<String> {
+        let limit = self.privileged_below?;
+        let low: Vec<String> = self
+            .create_local
+            .split(',')
+            .filter_map(|pair| pair.split(':').next()?.trim().parse::<u16>().ok())
+            .filter(|&p| p > 0 && p < limit)
+            .map(|p| p.to_string())
+            .collect();
+        match low.as_slice() {
+            [] => None,
+            [port] => Some(format!(
+                "Local port {port} is below {limit}: binding it needs root"
+            )),
+            _ => Some(format!(
+                "Local ports {} are below {limit}: binding them needs root",
+                low.join(", ")
+            )),
+        }
+    }
+
+    /// Add one tunnel per (local, remote) pair to the selected machine; more
+    /// than one pair are grouped into a single connection.
+    fn finish_create(&mut self, pairs: Vec<(String, String)>) {
+        let machine = self.machines[self.selected_machine].clone();
+        self.recent.record(
+            &machine.name,
+            &recent::port_spec(&pairs),
+            self.create_instance.as_deref(),
+            Utc::now(),
+        );
+        if let Some(path) = &self.recent_path {
+            let _ = recent::save(path, &self.recent);
+        }
+        let group = (pairs.len() > 1).then(|| {
+            self.next_group += 1;
+            self.next_group - 1
+        });
+        // The new tunnels show the certificate their machine already has.
+        let cert = self.machine_certs.get(&machine.name).cloned();
+        for (local_port, remote_port) in pairs {
+            let id = TunnelId(self.next_id);
+            self.next_id += 1;
+            self.tunnels.push(Tunnel {
+                id,
+                machine: machine.clone(),
+                local_port,
+                remote_port,
+                status: TunnelStatus::Inactive,
+                cert_status: cert.as_ref().map(|c| c.status),
+                cert_expires_in: cert.as_ref().map(|c| c.expires_in.clone()),
+                name: None,
+                depends: None,
+                group,
+                instance: self.create_instance.clone(),
+                hooks: Default::default(),
+                color: None,
+                icon: None,
+                ssh: None,
+                aks: None,
+                database: None,
+                note: None,
+                bind_address: None,
+            });
+            self.audit_tunnel("create", self.tunnels.len() - 1);
+        }
+        self.dialogs.close();
+        self.persist();
+    }
+
+    /// Ask `tunnels[idx]` to stop. It shows Stopping until
+    /// [`BgEvent::TunnelStopped`] says it is gone; the stop hook runs then.
+    fn stop_tunnel(&mut self, idx: usize) {
+        let id = self.tunnels[idx].id;
+        if self.tunnel_mgr.is_running(id) {
+            self.tunnel_mgr.stop(id);
+            self.tunnels[idx].status = TunnelStatus::Stopping;
+        } else {
+            self.tunnels[idx].status = TunnelStatus::Inactive;
+        }
+    }
+
+    /// Spawn the az process for `tunnels[idx]`, ignoring `wait_for`. While
+    /// az's token is close to expiring it waits for a refresh first.
+    fn spawn_tunnel(&mut self, idx: usize) {
+        // Retries and wake-up restarts come here too.
+        if self.read_only {
+            return;
+        }
+        if self.token_due(Utc::now()) {
+            self.token_waiters.insert(self.tunnels[idx].id);
+            self.tunnels[idx].status = TunnelStatus::Waiting(FRESH_TOKEN.into());
+            self.refresh_token();
+            return;
+        }
+        self.launch_tunnel(idx);
+    }
+
+    /// Spawn it now, token or not.
+    fn launch_tunnel(&mut self, idx: usize) {
+        self.tunnels[idx].status = TunnelStatus::Starting;
+        let tunnel = self.tunnels[idx].clone();
+        // Saved tunnels may predate the policy.
+        let started = self
+            .policy
+            .check(&tunnel.local_port, tunnel.bind_address)
+            .map_err(|e| color_eyre::eyre::eyre!(e))
+            .and_then(|()| self.tunnel_mgr.start(&tunnel));
+        match started {
+            Ok(()) => self.tunnel_event(idx, HookEvent::Start, None),
+            Err(e) => {
+                self.tunnels[idx].status = TunnelStatus::Error(e.to_string());
+                self.tunnel_event(idx, HookEvent::Error, Some(&e.to_string()));
             }
-            _ => self.notification = Some("⚠️ No SSH config path set for this VM".into()),
         }
-        None
     }
 
-    fn handle_key(&mut self, key: KeyEvent) -> Option<Action> {
-        // Treat Ctrl+C as `q` everywhere (Go made "q" and "ctrl+c" synonymous).
-        // Without this remap, Ctrl+C falls through to `Char('c')` and opens the
-        // create wizard, which is surprising.
-        let key = if key.modifiers.contains(KeyModifiers::CONTROL) && key.code == KeyCode::Char('c')
+    /// Tell the tunnel's hook and the webhook that `tunnels[idx]` reached
+    /// `event`, and write or remove an AKS tunnel's kubeconfig to match. A
+    /// hook that won't launch is reported.
+    fn tunnel_event(&mut self, idx: usize, event: HookEvent, error: Option<&str>) {
+        let kind = match event {
+            HookEvent::Start => None,
+            HookEvent::Ready => Some(webhook::Event::TunnelStarted),
+            HookEvent::Stop => Some(webhook::Event::TunnelStopped),
+            HookEvent::Error => Some(webhook::Event::TunnelError),
+        };
+        if let (Some(hook), Some(kind)) = (&self.webhook, kind) {
+            hook.send(webhook::tunnel_payload(kind, &self.tunnels[idx], error));
+        }
+        if let Some(cluster) = self.tunnels[idx].aks.clone() {
+            match event {
+                HookEvent::Start => {}
+                HookEvent::Ready => {
+                    let t = &self.tunnels[idx];
+                    self.tunnel_mgr
+                        .write_kubeconfig(t.id, cluster, t.local_port.clone());
+                }
+                HookEvent::Stop | HookEvent::Error => aks::remove_kubeconfig(&cluster),
+            }
+        }
+        if let Err(e) = hooks::run(&self.tunnels[idx], event, error) {
+            self.notification = Some(format!(
+                "⚠️ {} hook for {} failed: {e}",
+                event.name(),
+                self.tunnels[idx].label()
+            ));
+        }
+    }
+
+    /// Called every tick. When wall-clock time has moved much further than
+    /// the monotonic clock (which stops while the machine sleeps), or jumped
+    /// back, certificate expiries are stale and tunnels may be dead: check
+    /// both now.
+    fn note_tick(&mut self, wall: DateTime<Utc>, mono: Instant) {
+        let Some((last_wall, last_mono)) = self.last_tick.replace((wall, mono)) else {
+            return;
+        };
+        let mono_elapsed = chrono::Duration::from_std(mono - last_mono).unwrap_or_default();
+        let drift = ((wall - last_wall) - mono_elapsed)
+            .abs()
+            .to_std()
+            .unwrap_or_default();
+        if drift < CLOCK_JUMP {
+            return;
+        }
+        self.notification = Some(format!(
+            "💤 Clock jumped by {}; re-checking certificates and tunnels",
+            format_duration(drift)
+        ));
+        self.cert_mgr.check_now();
+        for t in self
+            .tunnels
+            .iter()
+            .filter(|t| t.status == TunnelStatus::Active)
         {
-            KeyEvent::new(KeyCode::Char('q'), KeyModifiers::NONE)
+            self.tunnel_mgr.probe_health(t);
+        }
+    }
+
+    /// Quit, stopping every tunnel, once another instance has asked to take
+    /// over this config.
+    fn check_takeover(&mut self) {
+        if self.instance_lock.as_ref().is_some_and(|l| l.taken_over()) {
+            self.notification = Some("⚠️ Another az-burrow is taking over; quitting".into());
+            self.should_quit = true;
+        }
+    }
+
+    /// Restart failed tunnels whose automatic retry is due. A tunnel the user
+    /// has since started, stopped or removed is left alone.
+    fn retry_due_tunnels(&mut self) {
+        let now = Instant::now();
+        let due: Vec<TunnelId> = self
+            .retry_at
+            .iter()
+            .filter(|(_, &at)| at <= now)
+            .map(|(&id, _)| id)
+            .collect();
+        for id in due {
+            self.retry_at.remove(&id);
+            let Some(idx) = self.tunnels.iter().position(|t| t.id == id) else {
+                self.retry_counts.remove(&id);
+                continue;
+            };
+            if matches!(self.tunnels[idx].status, TunnelStatus::Error(_)) {
+                self.spawn_tunnel(idx);
+            }
+        }
+    }
+
+    /// Whether az's token expires too soon to start a tunnel on, and a
+    /// refresh may get a newer one.
+    fn token_due(&self, now: DateTime<Utc>) -> bool {
+        self.token_expires
+            .is_some_and(|at| token::due(at, now) && self.token_final != Some(at))
+    }
+
+    /// Ask az for its token again, refreshing it if due. The status bar's
+    /// countdown starts over from the answer.
+    pub fn refresh_token(&mut self) {
+        if self.refreshing_token {
+            return;
+        }
+        self.refreshing_token = true;
+        self.busy.start("token", "Refreshing az token");
+        self.tunnel_mgr.refresh_token();
+    }
+
+    /// Forget any pending automatic restart: the user has taken over.
+    fn cancel_retry(&mut self, id: TunnelId) {
+        self.retry_at.remove(&id);
+        self.retry_counts.remove(&id);
+    }
+
+    /// Note which tunnels are starting or stopping, and since when. A tunnel
+    /// moving on from Starting to Connecting keeps its start time.
+    fn track_pending(&mut self, now: Instant) {
+        let mut since = HashMap::new();
+        for t in &self.tunnels {
+            let Some(phase) = Pending::of(&t.status) else {
+                continue;
+            };
+            let at = match self.pending_since.get(&t.id) {
+                Some(&(was, at)) if was == phase => at,
+                _ => now,
+            };
+            since.insert(t.id, (phase, at));
+        }
+        self.pending_since = since;
+    }
+
+    /// How long `id` has been starting or stopping, if it is.
+    pub fn pending_for(&self, id: TunnelId, now: Instant) -> Option<Duration> {
+        self.pending_since
+            .get(&id)
+            .map(|&(_, at)| now.saturating_duration_since(at))
+    }
+
+    /// Stop tunnels that have been starting for longer than `start_timeout`;
+    /// they show the error, with what az said on stderr, once stopped.
+    fn stop_slow_starts(&mut self, now: Instant) {
+        let Some(timeout) = self.start_timeout else {
+            return;
+        };
+        for idx in 0..self.tunnels.len() {
+            let id = self.tunnels[idx].id;
+            match self.pending_since.get(&id) {
+                Some(&(Pending::Start, at)) if now.saturating_duration_since(at) >= timeout => {}
+                _ => continue,
+            }
+            let logs = if self.tunnel_mgr.is_running(id) {
+                self.tunnel_mgr.logs(id)
+            } else {
+                Vec::new()
+            };
+            self.fail_start(idx, start_timeout_error(timeout, &logs));
+        }
+    }
+
+    /// Fail `tunnels[idx]`, which can't come up, with `error`: at once if
+    /// nothing is running, otherwise once it has been stopped.
+    fn fail_start(&mut self, idx: usize, error: String) {
+        let id = self.tunnels[idx].id;
+        if self.tunnel_mgr.is_running(id) {
+            self.fail_after_stop.insert(id, error);
+            self.stop_tunnel(idx);
         } else {
-            key
+            self.tunnels[idx].status = TunnelStatus::Error(error.clone());
+            self.tunnel_event(idx, HookEvent::Error, Some(&error));
+        }
+    }
+
+    /// az needs a login: run one and show its code, unless one is under way
+    /// already or signing in here is off.
+    fn need_login(&mut self) {
+        if !self.interactive_login || self.read_only || self.device_login.is_some() {
+            return;
+        }
+        self.device_login = Some(DeviceLogin {
+            code: None,
+            cancel: self.tunnel_mgr.device_login(),
+        });
+        self.busy.start("login", "Waiting for az login");
+        self.notification = Some("🔑 az needs you to sign in".into());
+        self.dialogs.queue(Overlay::Login);
+    }
+
+    /// Signed in: check the account again, and restart the tunnels and renew
+    /// the certificates that failed for want of it.
+    fn resume_signed_out(&mut self) {
+        self.busy.start("account", "Checking az account");
+        self.tunnel_mgr.fetch_account();
+        self.refresh_token();
+        let ids = std::mem::take(&mut self.resume_after_login);
+        let failed: Vec<usize> = (0..self.tunnels.len())
+            .filter(|&i| {
+                ids.contains(&self.tunnels[i].id)
+                    && matches!(self.tunnels[i].status, TunnelStatus::Error(_))
+            })
+            .collect();
+        for &idx in &failed {
+            self.start_tunnel(idx);
+        }
+        let certs = std::mem::take(&mut self.regen_after_login);
+        for vm in &certs {
+            self.busy.start(
+                format!("cert:{vm}"),
+                format!("Regenerating certificate for {vm}"),
+            );
+            let cert_mgr = self.cert_mgr.clone();
+            let vm = vm.clone();
+            tokio::spawn(async move { cert_mgr.generate(vm).await });
+        }
+        self.notification = Some(match (failed.len(), certs.len()) {
+            (0, 0) => "✅ Signed in to az".into(),
+            (t, c) => format!("✅ Signed in to az; retrying {t} tunnel(s) and {c} certificate(s)"),
+        });
+    }
+
+    /// How many tunnels and certificates will be tried again once signed in.
+    pub fn waiting_for_login(&self) -> (usize, usize) {
+        (self.resume_after_login.len(), self.regen_after_login.len())
+    }
+
+    /// Give up on the sign-in (`Esc` in its dialog).
+    fn cancel_login(&mut self) {
+        self.dialogs.close();
+        if let Some(login) = self.device_login.take() {
+            login.cancel.cancel();
+        }
+        self.busy.finish("login");
+        self.resume_after_login.clear();
+        self.regen_after_login.clear();
+        self.notification = Some("⚠️ Sign-in cancelled".into());
+    }
+
+    fn copy_device_code(&mut self) {
+        let Some(code) = self.device_login.as_ref().and_then(|l| l.code.clone()) else {
+            return;
         };
-        match self.overlay {
-            Overlay::None => {
-                if self.filtering {
-                    self.handle_filter_key(key);
-                    return None;
+        self.notification = Some(match clipboard::copy(&code.code) {
+            Ok(()) => format!("📋 Copied the code; enter it at {}", code.url),
+            Err(e) => format!("❌ Copy failed ({e}): {}", code.code),
+        });
+    }
+
+    /// Start `tunnels[idx]`. A tunnel with `wait_for` first brings up its
+    /// dependency (recursively) and then waits for it in `Waiting`.
+    pub fn start_tunnel(&mut self, idx: usize) {
+        self.cancel_retry(self.tunnels[idx].id);
+        self.start_with_deps(idx, 0);
+        self.release_waiters();
+    }
+
+    fn start_with_deps(&mut self, idx: usize, depth: usize) {
+        let Some(dep) = self.tunnels[idx].depends.clone() else {
+            self.spawn_tunnel(idx);
+            return;
+        };
+        let Some(dep_idx) = self
+            .tunnels
+            .iter()
+            .position(|t| t.name.as_deref() == Some(dep.tunnel.as_str()))
+        else {
+            self.tunnels[idx].status =
+                TunnelStatus::Error(format!("no tunnel named {} to wait for", dep.tunnel));
+            return;
+        };
+        // Config validation rejects cycles; this only guards against loops.
+        if depth > self.tunnels.len() {
+            self.tunnels[idx].status = TunnelStatus::Error("wait_for cycle".into());
+            return;
+        }
+        if self.tunnels[dep_idx].status.can_start() {
+            self.start_with_deps(dep_idx, depth + 1);
+        }
+        self.tunnels[idx].status = TunnelStatus::Waiting(dep.tunnel);
+    }
+
+    /// Move waiting tunnels along: once their dependency is Active, start them
+    /// (or probe its readiness first); if it stopped or failed, fail them.
+    fn release_waiters(&mut self) {
+        for idx in 0..self.tunnels.len() {
+            let TunnelStatus::Waiting(dep_name) = self.tunnels[idx].status.clone() else {
+                continue;
+            };
+            if self.token_waiters.contains(&self.tunnels[idx].id) {
+                continue;
+            }
+            let dep = self
+                .tunnels
+                .iter()
+                .find(|t| t.name.as_deref() == Some(dep_name.as_str()))
+                .map(|t| (t.status.clone(), t.local_addr()));
+            match dep {
+                Some((TunnelStatus::Active, dep_addr)) => {
+                    let id = self.tunnels[idx].id;
+                    match self.tunnels[idx]
+                        .depends
+                        .as_ref()
+                        .and_then(|d| d.check.clone())
+                    {
+                        None => self.spawn_tunnel(idx),
+                        Some(check) => {
+                            if self.probing.insert(id) {
+                                self.tunnel_mgr.probe_ready(id, check, dep_addr);
+                            }
+                        }
+                    }
+                }
+                Some((status, _)) if status.is_running() => {}
+                _ => {
+                    self.tunnels[idx].status =
+                        TunnelStatus::Error(format!("{dep_name} is not running"));
                 }
-                return self.handle_main_key(key);
             }
-            Overlay::ConfirmQuit => match key.code {
-                KeyCode::Char('y') => return Some(Action::Quit),
-                KeyCode::Char('q') | KeyCode::Char('n') | KeyCode::Esc => {
-                    self.overlay = Overlay::None
+        }
+    }
+
+    /// Start or stop the selected connection. Grouped tunnels follow the
+    /// selected row: all stopped members start, or all running ones stop.
+    fn toggle_selected(&mut self) {
+        if let Some(idx) = self.selected_real_index() {
+            self.toggle(idx);
+        }
+    }
+
+    /// Start or stop the connection `tunnels[idx]` belongs to, as
+    /// [`App::toggle_selected`] does for the selected one.
+    fn toggle(&mut self, idx: usize) {
+        if self.refuse_read_only() {
+            return;
+        }
+        let status = self.tunnels[idx].status.clone();
+        for i in self.group_members(idx) {
+            match (&status, &self.tunnels[i].status) {
+                (TunnelStatus::Inactive | TunnelStatus::Error(_), s) if s.can_start() => {
+                    self.audit_tunnel("start", i);
+                    self.start_tunnel(i)
                 }
-                _ => {}
-            },
-            Overlay::ConfirmDelete(idx) => match key.code {
-                KeyCode::Char('y') => {
-                    self.remove_tunnel(idx);
-                    self.overlay = Overlay::None;
+                // Nothing is spawned yet; cancelling just drops the wait.
+                (TunnelStatus::Active | TunnelStatus::Waiting(_), TunnelStatus::Waiting(_)) => {
+                    self.tunnels[i].status = TunnelStatus::Inactive
                 }
-                KeyCode::Char('q') | KeyCode::Char('n') | KeyCode::Esc => {
-                    self.overlay = Overlay::None
+                (TunnelStatus::Active, s) if s.is_running() => {
+                    let id = self.tunnels[i].id;
+                    self.cancel_retry(id);
+                    self.stop_tunnel(i);
+                    self.audit_tunnel("stop", i);
                 }
                 _ => {}
-            },
-            Overlay::Logs(_) => {
-                if matches!(key.code, KeyCode::Esc | KeyCode::Char('q')) {
-                    self.overlay = Overlay::None;
+            }
+        }
+    }
+
+    fn any_running(&self) -> bool {
+        self.tunnels.iter().any(|t| t.status.is_running())
+    }
+
+    /// Start every stopped tunnel, or — if all are already running — stop them all.
+    fn toggle_all(&mut self) {
+        if self.tunnels.is_empty() || self.refuse_read_only() {
+            return;
+        }
+        let any_stopped = self.tunnels.iter().any(|t| t.status.can_start());
+        if any_stopped {
+            for i in 0..self.tunnels.len() {
+                // A dependency started on behalf of an earlier tunnel is
+                // already running by the time the loop reaches it.
+                if self.tunnels[i].status.can_start() {
+                    self.audit_tunnel("start", i);
+                    self.start_tunnel(i);
                 }
             }
-            Overlay::Help => {
-                if matches!(
-                    key.code,
-                    KeyCode::Esc | KeyCode::Char('q') | KeyCode::Char('?')
-                ) {
-                    self.overlay = Overlay::None;
+            self.notification = Some("▶ Starting all tunnels…".into());
+        } else {
+            self.retry_at.clear();
+            self.retry_counts.clear();
+            for i in 0..self.tunnels.len() {
+                if self.tunnels[i].status == TunnelStatus::Stopping {
+                    continue;
+                }
+                if self.tunnel_mgr.is_running(self.tunnels[i].id) {
+                    self.stop_tunnel(i);
+                    self.audit_tunnel("stop", i);
+                } else {
+                    self.tunnels[i].status = TunnelStatus::Inactive;
                 }
             }
-            Overlay::Create => self.handle_create_key(key),
+            self.notification = Some("■ Stopping all tunnels…".into());
         }
-        None
     }
 
-    fn handle_create_key(&mut self, key: KeyEvent) {
-        if key.code == KeyCode::Esc {
-            self.overlay = Overlay::None;
-            return;
-        }
-        match self.create_step {
-            CreateStep::Machine => match key.code {
-                KeyCode::Up | KeyCode::Char('k') => {
-                    self.selected_machine = self.selected_machine.saturating_sub(1);
+    fn handle_main_key(&mut self, key: KeyEvent) -> Option<Action> {
+        match key.code {
+            KeyCode::Char('q') => {
+                // Read-only leaves any running tunnels to their owner.
+                if self.any_running() && !self.read_only {
+                    self.dialogs.open(Overlay::ConfirmQuit);
+                } else {
+                    return Some(Action::Quit);
                 }
-                KeyCode::Down | KeyCode::Char('j') => {
-                    if self.selected_machine + 1 < self.machines.len() {
-                        self.selected_machine += 1;
-                    }
+            }
+            KeyCode::Char('c') => self.start_create(),
+            KeyCode::Up | KeyCode::Char('k') => {
+                let len = self.visible_indices().len();
+                if len > 0 {
+                    self.cursor = (self.cursor + len - 1) % len;
                 }
-                KeyCode::Enter => self.create_step = CreateStep::LocalPort,
-                _ => {}
-            },
-            CreateStep::LocalPort | CreateStep::RemotePort => match key.code {
-                KeyCode::Char(c) if c.is_ascii_digit() => {
-                    if self.create_step == CreateStep::LocalPort {
-                        self.create_local.push(c);
-                    } else {
-                        self.create_remote.push(c);
-                    }
+            }
+            KeyCode::Down | KeyCode::Char('j') => {
+                let len = self.visible_indices().len();
+                if len > 0 {
+                    self.cursor = (self.cursor + 1) % len;
                 }
-                KeyCode::Backspace => {
-                    if self.create_step == CreateStep::LocalPort {
-                        self.create_local.pop();
-                    } else {
-                        self.create_remote.pop();
-                    }
+            }
+            KeyCode::Char('g') => self.cursor = 0,
+            KeyCode::Char('G') => {
+                self.cursor = self.visible_indices().len().saturating_sub(1);
+            }
+            KeyCode::Enter => self.toggle_selected(),
+            // The first nine rows, as numbered in the table.
+            KeyCode::Char(c @ '1'..='9') => {
+                if let Some(&idx) = self.visible_indices().get(c as usize - '1' as usize) {
+                    self.toggle(idx);
                 }
-                KeyCode::Enter => {
-                    if self.create_step == CreateStep::LocalPort && !self.create_local.is_empty() {
-                        self.create_step = CreateStep::RemotePort;
-                    } else if self.create_step == CreateStep::RemotePort
-                        && !self.create_remote.is_empty()
-                    {
-                        self.finish_create();
-                    }
+            }
+            KeyCode::Char(' ') => {
+                if let Some(id) = self.id_at_cursor() {
+                    self.shown_logs = self.tunnel_mgr.logs(id);
+                    self.dialogs.open(Overlay::Logs(id));
                 }
-                _ => {}
-            },
+            }
+            KeyCode::Char('i') => {
+                if let Some(id) = self.id_at_cursor() {
+                    self.inspect_cert(id);
+                    self.dialogs.open(Overlay::Cert(id));
+                }
+            }
+            KeyCode::Char('d') | KeyCode::Delete => self.confirm_delete(),
+            KeyCode::Char('r') => return self.trigger_regen(),
+            KeyCode::Char('p') => self.toggle_renewal_pause(),
+            KeyCode::Char('P') => self.toggle_all_renewal_pause(),
+            KeyCode::Char('R') => self.refresh_shared_config(),
+            KeyCode::Char('m') => self.open_machines(),
+            KeyCode::Char('S') => self.open_sessions(),
+            KeyCode::Char('t') => self.cycle_tag(),
+            KeyCode::Char('l') => self.edit_note(),
+            KeyCode::Char('s') => return self.open_ssh(),
+            KeyCode::Char('f') => return self.open_sftp(),
+            KeyCode::Char('v') => self.open_vscode(),
+            KeyCode::Char('y') => self.copy_connection_string(),
+            KeyCode::Char('e') => self.export_tunnels(),
+            KeyCode::Char('a') => self.toggle_all(),
+            KeyCode::Char('/') => {
+                let selected = self.id_at_cursor();
+                self.filtering = true;
+                self.filter = Some(String::new());
+                self.reselect(selected);
+            }
+            KeyCode::Char('?') => self.dialogs.open(Overlay::Help),
+            KeyCode::Char('n') => self.dialogs.open(Overlay::Notifications),
+            KeyCode::Esc => {
+                let selected = self.id_at_cursor();
+                self.filter = None;
+                self.reselect(selected);
+            }
+            KeyCode::Char(c) => self.run_extension_action(c),
+            _ => {}
+        }
+        self.clamp_cursor();
+        None
+    }
+
+    /// Ask before deleting the selected connection.
+    fn confirm_delete(&mut self) {
+        if self.refuse_read_only() {
+            return;
+        }
+        if let Some(real) = self.selected_real_index() {
+            self.dialogs.open(Overlay::ConfirmDelete(real));
         }
     }
 
-    /// The main async event loop.
-    pub async fn run<B: Backend>(
-        &mut self,
-        terminal: &mut Terminal<B>,
-        mut rx: UnboundedReceiver<BgEvent>,
-    ) -> Result<()> {
-        let mut events = EventStream::new();
-        let mut tick = tokio::time::interval(Duration::from_secs(1));
-        let mut notif_clear_at: Option<Instant> = None;
-        let mut shown_notif: Option<String> = None;
+    /// Open the note editor on the selected connection's note.
+    fn edit_note(&mut self) {
+        if self.refuse_read_only() {
+            return;
+        }
+        if let Some(idx) = self.selected_real_index() {
+            self.note_input = self.tunnels[idx].note.clone().unwrap_or_default();
+            self.dialogs.open(Overlay::EditNote(self.tunnels[idx].id));
+        }
+    }
+
+    /// Dispatch an unbound key to an embedder-registered row action.
+    fn run_extension_action(&mut self, key: char) {
+        let Some(idx) = self.selected_real_index() else {
+            return;
+        };
+        let tunnel = self.tunnels[idx].clone();
+        if let Some(action) = self.extensions.action_mut(key) {
+            match action.run(&tunnel) {
+                Ok(Some(msg)) => self.notification = Some(msg),
+                Ok(None) => {}
+                Err(e) => self.notification = Some(format!("❌ {}: {e}", action.description())),
+            }
+        }
+    }
+
+    fn handle_filter_key(&mut self, key: KeyEvent) {
+        let selected = self.id_at_cursor();
+        match key.code {
+            KeyCode::Char(c) => {
+                if let Some(q) = self.filter.as_mut() {
+                    q.push(c);
+                }
+            }
+            KeyCode::Backspace => {
+                if let Some(q) = self.filter.as_mut() {
+                    q.pop();
+                }
+            }
+            KeyCode::Enter | KeyCode::Esc => {
+                self.filtering = false;
+                if self.filter.as_deref() == Some("") {
+                    self.filter = None;
+                }
+            }
+            _ => {}
+        }
+        self.reselect(selected);
+    }
+
+    /// Copy the selected tunnel's database connection string.
+    fn copy_connection_string(&mut self) {
+        let Some(idx) = self.selected_real_index() else {
+            return;
+        };
+        let t = &self.tunnels[idx];
+        let Some(db) = &t.database else {
+            self.notification = Some(format!(
+                "{} has no database: set one in config to copy a connection string",
+                t.label()
+            ));
+            return;
+        };
+        let conn = db.connection_string(&t.local_port);
+        self.notification = Some(match clipboard::copy(&conn) {
+            Ok(()) => format!("📋 Copied {conn}"),
+            Err(e) => format!("❌ Copy failed ({e}): {conn}"),
+        });
+    }
+
+    /// Copy the commands tunnel `id` runs, to reproduce it by hand or attach
+    /// to a support ticket.
+    fn copy_command(&mut self, id: TunnelId) {
+        let Some(t) = self.tunnels.iter().find(|t| t.id == id) else {
+            return;
+        };
+        let text = tunnel::command_lines(t).join("\n");
+        self.notification = Some(match clipboard::copy(&text) {
+            Ok(()) => format!("📋 Copied the command for {}", t.label()),
+            Err(e) => format!("❌ Copy failed ({e}): {text}"),
+        });
+    }
+
+    /// The log lines the logs view shows: those at or above the severity
+    /// filter.
+    pub fn visible_logs(&self) -> impl Iterator<Item = &LogLine> {
+        self.shown_logs
+            .iter()
+            .filter(|l| l.severity >= self.log_severity)
+    }
+
+    /// `f` in the logs view: all lines, then warnings and errors, then errors
+    /// only.
+    fn cycle_log_severity(&mut self) {
+        self.log_severity = match self.log_severity {
+            Severity::Info => Severity::Warning,
+            Severity::Warning => Severity::Error,
+            Severity::Error => Severity::Info,
+        };
+    }
+
+    /// Copy the lines the logs view shows.
+    fn copy_logs(&mut self, id: TunnelId) {
+        let Some(t) = self.tunnels.iter().find(|t| t.id == id) else {
+            return;
+        };
+        let lines: Vec<String> = self.visible_logs().map(LogLine::to_string).collect();
+        if lines.is_empty() {
+            self.notification = Some(format!("⚠️ No logs to copy for {}", t.label()));
+            return;
+        }
+        self.notification = Some(match clipboard::copy(&lines.join("\n")) {
+            Ok(()) => format!("📋 Copied {} log line(s) of {}", lines.len(), t.label()),
+            Err(e) => format!("❌ Copy failed ({e}); save the logs with w instead"),
+        });
+    }
+
+    /// Save the lines the logs view shows, headed by the tunnel's commands, to
+    /// a timestamped file next to the config.
+    fn save_logs(&mut self, id: TunnelId) {
+        let Some(t) = self.tunnels.iter().find(|t| t.id == id) else {
+            return;
+        };
+        let config_path = self.shared_config.as_ref().map(|s| s.config_path());
+        let dir = config_path
+            .and_then(Path::parent)
+            .unwrap_or(Path::new(""))
+            .to_path_buf();
+        let path = tunnel_log::export_path(&dir, t, Local::now());
+        let mut text: String = tunnel::command_lines(t)
+            .iter()
+            .map(|line| format!("$ {line}\n"))
+            .collect();
+        for line in self.visible_logs() {
+            text.push_str(&format!("{line}\n"));
+        }
+        self.notification = Some(match std::fs::write(&path, text) {
+            Ok(()) => format!("💾 Saved {}'s logs to {}", t.label(), path.display()),
+            Err(e) => format!("❌ Could not save logs to {}: {e}", path.display()),
+        });
+    }
+
+    /// Write every tunnel as a `tunnels:` block to `burrow.tunnels.yaml` and
+    /// copy it, for pasting into a config file.
+    fn export_tunnels(&mut self) {
+        let config_path = self.shared_config.as_ref().map(|s| s.config_path());
+        let Some(yaml) = export::tunnels_yaml(&self.tunnels, config_path.is_none()) else {
+            self.notification = Some("⚠️ No tunnels to export".into());
+            return;
+        };
+        let path = export::export_path(config_path);
+        let copied = clipboard::copy(&yaml).is_ok();
+        self.notification = Some(match (std::fs::write(&path, &yaml), copied) {
+            (Ok(()), true) => format!("📋 Exported tunnels to {} and copied them", path.display()),
+            (Ok(()), false) => format!("📋 Exported tunnels to {}", path.display()),
+            (Err(e), true) => format!(
+                "📋 Copied tunnels (could not write {}: {e})",
+                path.display()
+            ),
+            (Err(e), false) => format!("❌ Could not export tunnels to {}: {e}", path.display()),
+        });
+    }
+
+    /// Open the sessions view with the saved sessions read afresh.
+    fn open_sessions(&mut self) {
+        let Some(path) = &self.sessions_path else {
+            self.notification =
+                Some("⚠️ Sessions need a config file; none for a quick tunnel".into());
+            return;
+        };
+        match session::load(path) {
+            Ok(saved) => {
+                self.shown_sessions = saved.sessions;
+                self.session_cursor = 0;
+                self.session_name = None;
+                self.dialogs.open(Overlay::Sessions);
+            }
+            Err(e) => self.notification = Some(format!("❌ {e:#}")),
+        }
+    }
+
+    fn handle_sessions_key(&mut self, key: KeyEvent) {
+        if let Some(name) = &mut self.session_name {
+            match key.code {
+                KeyCode::Char(c) if !c.is_whitespace() => name.push(c),
+                KeyCode::Backspace => {
+                    name.pop();
+                }
+                KeyCode::Enter => {
+                    let name = name.clone();
+                    if !name.is_empty() {
+                        self.save_session(name);
+                    }
+                }
+                KeyCode::Esc => self.session_name = None,
+                _ => {}
+            }
+            return;
+        }
+        match key.code {
+            KeyCode::Up | KeyCode::Char('k') => {
+                self.session_cursor = self.session_cursor.saturating_sub(1);
+            }
+            KeyCode::Down | KeyCode::Char('j') => {
+                if self.session_cursor + 1 < self.shown_sessions.len() {
+                    self.session_cursor += 1;
+                }
+            }
+            KeyCode::Enter => {
+                if let Some(s) = self.shown_sessions.get(self.session_cursor).cloned() {
+                    self.dialogs.close();
+                    self.restore_session(&s);
+                }
+            }
+            KeyCode::Char('s') => self.session_name = Some(String::new()),
+            KeyCode::Char('d') | KeyCode::Delete => self.delete_session(),
+            KeyCode::Esc | KeyCode::Char('q') | KeyCode::Char('S') => self.dialogs.close(),
+            _ => {}
+        }
+    }
+
+    /// Save every tunnel under `name`, replacing a session of that name.
+    /// Running tunnels are marked to start when it is restored.
+    fn save_session(&mut self, name: String) {
+        if self.refuse_read_only() {
+            return;
+        }
+        let Some(path) = self.sessions_path.clone() else {
+            return;
+        };
+        if self.tunnels.is_empty() {
+            self.notification = Some("⚠️ No tunnels to save".into());
+            return;
+        }
+        let tunnels: Vec<SessionTunnel> = self
+            .tunnels
+            .iter()
+            .map(SessionTunnel::from_tunnel)
+            .collect();
+        let started = tunnels.iter().filter(|t| t.start).count();
+        let count = tunnels.len();
+        let saved = session::load(&path).and_then(|mut all| {
+            all.put(Session {
+                name: name.clone(),
+                tunnels,
+            });
+            session::save(&path, &all)?;
+            Ok(all)
+        });
+        match saved {
+            Ok(all) => {
+                self.session_cursor = all
+                    .sessions
+                    .iter()
+                    .position(|s| s.name == name)
+                    .unwrap_or(0);
+                self.shown_sessions = all.sessions;
+                self.session_name = None;
+                self.notification = Some(format!(
+                    "💾 Saved {count} tunnel(s) as {name} ({started} started on restore)"
+                ));
+            }
+            Err(e) => self.notification = Some(format!("❌ Could not save session: {e:#}")),
+        }
+    }
+
+    fn delete_session(&mut self) {
+        if self.refuse_read_only() {
+            return;
+        }
+        let (Some(path), Some(name)) = (
+            self.sessions_path.clone(),
+            self.shown_sessions
+                .get(self.session_cursor)
+                .map(|s| s.name.clone()),
+        ) else {
+            return;
+        };
+        let deleted = session::load(&path).and_then(|mut all| {
+            all.remove(&name);
+            session::save(&path, &all)?;
+            Ok(all)
+        });
+        match deleted {
+            Ok(all) => {
+                self.shown_sessions = all.sessions;
+                self.session_cursor = self
+                    .session_cursor
+                    .min(self.shown_sessions.len().saturating_sub(1));
+                self.notification = Some(format!("🗑 Deleted session {name}"));
+            }
+            Err(e) => self.notification = Some(format!("❌ Could not delete session: {e:#}")),
+        }
+    }
+
+    /// Bring back a saved session: its tunnels that aren't in the list yet
+    /// are added, and those saved running are started. Tunnels to machines no
+    /// longer configured are skipped.
+    pub fn restore_session(&mut self, session: &Session) {
+        if self.refuse_read_only() {
+            return;
+        }
+        // Saved group numbers may clash with the groups already in the list.
+        let mut groups: HashMap<u64, u64> = HashMap::new();
+        let mut added = 0;
+        let mut skipped = Vec::new();
+        let mut to_start = Vec::new();
+        for st in &session.tunnels {
+            let existing = self.tunnels.iter().position(|t| {
+                t.machine.name == st.machine
+                    && t.local_port == st.local_port
+                    && t.remote_port == st.remote_port
+            });
+            let idx = match existing {
+                Some(idx) => {
+                    if st.note.is_some() {
+                        self.tunnels[idx].note = st.note.clone();
+                    }
+                    idx
+                }
+                None => {
+                    let Some(machine) = self.machines.iter().find(|m| m.name == st.machine) else {
+                        if !skipped.contains(&st.machine) {
+                            skipped.push(st.machine.clone());
+                        }
+                        continue;
+                    };
+                    let mut t = Tunnel::new(
+                        TunnelId(self.next_id),
+                        machine.clone(),
+                        st.local_port.clone(),
+                        st.remote_port.clone(),
+                    );
+                    self.next_id += 1;
+                    t.group = st.group.map(|g| {
+                        *groups.entry(g).or_insert_with(|| {
+                            self.next_group += 1;
+                            self.next_group - 1
+                        })
+                    });
+                    t.instance = st.instance.clone();
+                    t.color = st.color;
+                    t.icon = st.icon.clone();
+                    t.note = st.note.clone();
+                    if let Some(cert) = self.machine_certs.get(&st.machine) {
+                        t.cert_status = Some(cert.status);
+                        t.cert_expires_in = Some(cert.expires_in.clone());
+                    }
+                    self.tunnels.push(t);
+                    self.audit_tunnel("create", self.tunnels.len() - 1);
+                    added += 1;
+                    self.tunnels.len() - 1
+                }
+            };
+            if st.start {
+                to_start.push(idx);
+            }
+        }
+        let mut started = 0;
+        for idx in to_start {
+            // A dependency started on behalf of an earlier tunnel is
+            // already running by the time the loop reaches it.
+            if self.tunnels[idx].status.can_start() {
+                self.audit_tunnel("start", idx);
+                self.start_tunnel(idx);
+                started += 1;
+            }
+        }
+        let mut msg = format!(
+            "📂 Restored {}: {added} tunnel(s) added, {started} started",
+            session.name
+        );
+        if !skipped.is_empty() {
+            msg.push_str(&format!("; skipped unknown {}", skipped.join(", ")));
+        }
+        self.notification = Some(msg);
+        self.clamp_cursor();
+        self.persist();
+    }
+
+    /// The selected connection's SSH forward, or the selection itself when it
+    /// has none (which `ssh::login` then rejects).
+    fn selected_ssh_tunnel(&self) -> Option<usize> {
+        let idx = self.selected_real_index()?;
+        let members = self.group_members(idx);
+        Some(
+            members
+                .iter()
+                .copied()
+                .find(|&i| self.tunnels[i].remote_port == "22")
+                .unwrap_or(idx),
+        )
+    }
+
+    /// SSH through the selected connection's SSH forward, if it has one: in a
+    /// new tmux window or pane when inside tmux, otherwise in the foreground.
+    fn open_ssh(&mut self) -> Option<Action> {
+        let idx = self.selected_ssh_tunnel()?;
+        let tunnel = &self.tunnels[idx];
+        let args = match ssh::login(tunnel) {
+            Ok(login) => ssh::ssh_args(&login),
+            Err(e) => {
+                self.notification = Some(format!("❌ SSH: {e}"));
+                return None;
+            }
+        };
+        let Some(target) = self.tmux else {
+            return Some(Action::External {
+                program: "ssh".into(),
+                args,
+            });
+        };
+        let name = tunnel.machine.name.clone();
+        self.notification = Some(match ssh::open_in_tmux(target, &name, "ssh", args) {
+            Ok(()) => format!("🪟 SSH to {name} opened in tmux"),
+            Err(e) => format!("❌ SSH: running tmux: {e}"),
+        });
+        None
+    }
+
+    /// SFTP through the selected connection's SSH forward, if it has one.
+    fn open_sftp(&mut self) -> Option<Action> {
+        let ssh = self.selected_ssh_tunnel()?;
+        match ssh::login(&self.tunnels[ssh]) {
+            Ok(login) => Some(Action::External {
+                program: "sftp".into(),
+                args: ssh::sftp_args(&login),
+            }),
+            Err(e) => {
+                self.notification = Some(format!("❌ SFTP: {e}"));
+                None
+            }
+        }
+    }
+
+    /// Point a managed `~/.ssh/config` entry at the selected connection's SSH
+    /// forward and open VS Code Remote-SSH on it.
+    fn open_vscode(&mut self) {
+        let Some(idx) = self.selected_ssh_tunnel() else {
+            return;
+        };
+        let tunnel = &self.tunnels[idx];
+        let alias = ssh::alias(tunnel);
+        let result = ssh::login(tunnel).and_then(|login| {
+            ssh::write_host(&alias, &login).map_err(|e| format!("writing ~/.ssh/config: {e}"))?;
+            ssh::open_vscode(&alias).map_err(|e| format!("running code: {e}"))
+        });
+        self.notification = Some(match result {
+            Ok(()) => format!("🖥 Opening VS Code on ssh-remote+{alias}"),
+            Err(e) => format!("❌ VS Code: {e}"),
+        });
+    }
+
+    /// Run `program` in the foreground: the TUI leaves the alternate screen
+    /// and stops reading keys until it exits. Tunnels keep running meanwhile.
+    async fn run_external<B: Backend>(
+        &mut self,
+        terminal: &mut Terminal<B>,
+        program: &str,
+        args: &[String],
+    ) -> Result<()> {
+        disable_raw_mode()?;
+        execute!(stdout(), LeaveAlternateScreen)?;
+        let status = tokio::process::Command::new(program)
+            .args(args)
+            .status()
+            .await;
+        enable_raw_mode()?;
+        execute!(stdout(), EnterAlternateScreen)?;
+        terminal.clear()?;
+        self.notification = match status {
+            Ok(s) if s.success() => None,
+            Ok(s) => Some(format!("❌ {program} exited: {s}")),
+            Err(e) => Some(format!("❌ {program}: {e}")),
+        };
+        Ok(())
+    }
+
+    /// Give the selected connection the next colour tag, or clear it after
+    /// the last one.
+    fn cycle_tag(&mut self) {
+        if self.refuse_read_only() {
+            return;
+        }
+        let Some(idx) = self.selected_real_index() else {
+            return;
+        };
+        let color = TagColor::cycle(self.tunnels[idx].color);
+        for i in self.group_members(idx) {
+            self.tunnels[i].color = color;
+        }
+        let label = self.tunnels[idx].label();
+        self.notification = Some(match color {
+            Some(c) => format!("🏷 {label} tagged {}", c.name()),
+            None => format!("🏷 {label} untagged"),
+        });
+        self.persist();
+    }
+
+    /// Give the connection of tunnel `id` the typed note; an empty one clears
+    /// it.
+    fn set_note(&mut self, id: TunnelId) {
+        if self.refuse_read_only() {
+            return;
+        }
+        let Some(idx) = self.tunnels.iter().position(|t| t.id == id) else {
+            return;
+        };
+        let note = Some(self.note_input.trim().to_string()).filter(|n| !n.is_empty());
+        for i in self.group_members(idx) {
+            self.tunnels[i].note = note.clone();
+        }
+        let label = self.tunnels[idx].label();
+        self.notification = Some(match note {
+            Some(_) => format!("📝 Note set on {label}"),
+            None => format!("📝 Note cleared on {label}"),
+        });
+        self.persist();
+    }
+
+    /// Pause or resume automatic renewal of the selected tunnel's machine's
+    /// certificate, e.g. while interactive MFA would pop up a browser.
+    fn toggle_renewal_pause(&mut self) {
+        if let Some(idx) = self.selected_real_index() {
+            let machine = self.tunnels[idx].machine.clone();
+            self.toggle_machine_renewal_pause(&machine);
+        }
+    }
+
+    fn toggle_machine_renewal_pause(&mut self, machine: &Machine) {
+        if self.refuse_read_only() {
+            return;
+        }
+        if machine.key_files().is_none() {
+            self.notification = Some("⚠️ No SSH config path set for this VM".into());
+            return;
+        }
+        let vm = machine.name.clone();
+        let paused = !self.renewal_paused.contains(&vm);
+        self.cert_mgr.set_paused(&vm, paused);
+        self.notification = Some(if paused {
+            format!("⏸ Automatic certificate renewal paused for {vm}")
+        } else {
+            format!("▶ Automatic certificate renewal resumed for {vm}")
+        });
+        if paused {
+            self.renewal_paused.insert(vm);
+        } else {
+            self.renewal_paused.remove(&vm);
+        }
+    }
+
+    /// Pause or resume automatic renewal for every machine.
+    fn toggle_all_renewal_pause(&mut self) {
+        if self.refuse_read_only() {
+            return;
+        }
+        self.renewal_paused_all = !self.renewal_paused_all;
+        self.cert_mgr.set_all_paused(self.renewal_paused_all);
+        self.notification = Some(if self.renewal_paused_all {
+            "⏸ Automatic certificate renewal paused for all machines".into()
+        } else {
+            "▶ Automatic certificate renewal resumed".into()
+        });
+    }
+
+    /// Whether `vm`'s certificate is left alone until renewal is resumed.
+    pub fn renewal_paused_for(&self, vm: &str) -> bool {
+        self.renewal_paused_all || self.renewal_paused.contains(vm)
+    }
+
+    fn trigger_regen(&mut self) -> Option<Action> {
+        if self.refuse_read_only() {
+            return None;
+        }
+        let machine = self
+            .tunnels
+            .get(self.selected_real_index()?)?
+            .machine
+            .clone();
+        self.regen_machine(&machine);
+        None
+    }
+
+    /// Regenerate `machine`'s certificate (`r`), registering it first if it
+    /// was added since startup.
+    fn regen_machine(&mut self, machine: &Machine) {
+        if self.refuse_read_only() {
+            return;
+        }
+        match machine.key_files() {
+            Some(files) => {
+                let cert_mgr = self.cert_mgr.clone();
+                let vm = machine.name.clone();
+                let timing = machine.cert_timing;
+                self.busy.start(
+                    format!("cert:{vm}"),
+                    format!("Regenerating certificate for {vm}"),
+                );
+                let entry = audit::cert_entry(&self.audit_user, &vm);
+                self.audit(&entry);
+                tokio::spawn(async move {
+                    // Machines added since startup have no certificate yet;
+                    // registering reads the existing one with ssh-keygen.
+                    if cert_mgr.details(&vm).is_none() {
+                        cert_mgr.register(&vm, files, timing);
+                    }
+                    cert_mgr.generate(vm).await;
+                });
+            }
+            None => self.notification = Some("⚠️ No SSH config path set for this VM".into()),
+        }
+    }
+
+    /// Record a user action on `tunnels[idx]` in the audit log.
+    fn audit_tunnel(&mut self, action: &str, idx: usize) {
+        if self.audit_log.is_some() {
+            let entry = audit::tunnel_entry(&self.audit_user, action, &self.tunnels[idx]);
+            self.audit(&entry);
+        }
+    }
+
+    /// Append `entry` to the audit log, if there is one. A write that fails
+    /// is shown, since the trail now has a gap.
+    fn audit(&mut self, entry: &str) {
+        let Some(path) = &self.audit_log else {
+            return;
+        };
+        if let Err(e) = audit::append(path, entry) {
+            self.notification = Some(format!("⚠️ Could not write audit log: {e}"));
+        }
+    }
+
+    /// Rewrite the metrics textfile, at most every `metrics::WRITE_INTERVAL`.
+    fn write_metrics(&mut self) {
+        // The textfile is the owning instance's to keep.
+        let Some(path) = self.metrics_textfile.as_ref().filter(|_| !self.read_only) else {
+            return;
+        };
+        if self
+            .metrics_written_at
+            .is_some_and(|at| at.elapsed() < metrics::WRITE_INTERVAL)
+        {
+            return;
+        }
+        self.metrics_written_at = Some(Instant::now());
+        let text = metrics::render(&self.tunnels, &self.cert_mgr.expiries(), Utc::now());
+        if let Err(e) = metrics::write(path, &text) {
+            self.notification = Some(format!("⚠️ Could not write metrics: {e}"));
+        }
+    }
+
+    /// Read the certificate of tunnel `id`'s machine for the cert view.
+    fn inspect_cert(&mut self, id: TunnelId) {
+        self.shown_cert = None;
+        if let Some(machine) = self.cert_view_machine(id) {
+            self.cert_mgr.inspect(machine);
+        }
+    }
+
+    /// The machine whose certificate the cert view for tunnel `id` shows.
+    fn cert_view_machine(&self, id: TunnelId) -> Option<&str> {
+        self.tunnels
+            .iter()
+            .find(|t| t.id == id)
+            .map(|t| t.machine.name.as_str())
+    }
+
+    fn refresh_shared_config(&mut self) {
+        match &self.shared_config {
+            Some(shared) if shared.has_source() => {
+                self.busy.start("shared-config", "Refreshing shared config");
+                shared.refresh();
+            }
+            _ => self.notification = Some("⚠️ No config_source set in the config file".into()),
+        }
+    }
+
+    /// Swap in the machines from a reloaded config. Existing tunnels
+    /// pick up their machine's new settings on their next start; tunnels to
+    /// machines that were removed keep the settings they had.
+    fn replace_machines(&mut self, machines: Vec<Machine>) {
+        for t in &mut self.tunnels {
+            if let Some(m) = machines.iter().find(|m| m.name == t.machine.name) {
+                t.machine = m.clone();
+            }
+        }
+        // Registering runs ssh-keygen on each existing certificate.
+        let certs: Vec<_> = machines
+            .iter()
+            .filter_map(|m| Some((m.name.clone(), m.key_files()?, m.cert_timing)))
+            .collect();
+        if !certs.is_empty() {
+            let cert_mgr = self.cert_mgr.clone();
+            tokio::task::spawn_blocking(move || {
+                for (name, files, timing) in certs {
+                    cert_mgr.register(&name, files, timing);
+                }
+            });
+        }
+        // These point into the old list, which may have shifted under them.
+        if matches!(
+            self.dialogs.top(),
+            Overlay::Create | Overlay::ConfirmRemoveMachine(_) | Overlay::ConfirmPower(..)
+        ) {
+            self.dialogs.close();
+        }
+        self.selected_machine = 0;
+        self.machine_cursor = self.machine_cursor.min(machines.len().saturating_sub(1));
+        self.machines = machines;
+    }
+
+    /// Open the machine editor, which needs a config file to write to.
+    fn open_machine_form(&mut self, form: MachineForm) {
+        if self.refuse_read_only() {
+            return;
+        }
+        if self.shared_config.is_none() {
+            self.notification = Some("⚠️ No config file to edit for a quick tunnel".into());
+            return;
+        }
+        self.machine_form = Some(form);
+        self.dialogs.open(Overlay::EditMachine);
+    }
+
+    fn handle_machine_form_key(&mut self, key: KeyEvent) {
+        let Some(form) = &mut self.machine_form else {
+            self.dialogs.close();
+            return;
+        };
+        match key.code {
+            KeyCode::Esc => {
+                self.machine_form = None;
+                self.dialogs.close();
+            }
+            KeyCode::Tab | KeyCode::Down => form.next(),
+            KeyCode::BackTab | KeyCode::Up => form.prev(),
+            KeyCode::Backspace => form.pop(),
+            KeyCode::Char(c) => form.push(c),
+            KeyCode::Enter => self.save_machine_form(),
+            _ => {}
+        }
+    }
+
+    /// Write the machine editor's fields to the config file and reload the
+    /// machines from it. Tunnels to a renamed machine follow it.
+    fn save_machine_form(&mut self) {
+        if self.refuse_read_only() {
+            return;
+        }
+        let Some(form) = &self.machine_form else {
+            return;
+        };
+        let values = match form.values() {
+            Ok(values) => values,
+            Err(e) => {
+                self.notification = Some(format!("⚠️ {e}"));
+                return;
+            }
+        };
+        let name = values[0].clone();
+        let original = form.original.clone();
+        if original.as_deref() != Some(name.as_str())
+            && self.machines.iter().any(|m| m.name == name)
+        {
+            self.notification = Some(format!("⚠️ A machine named {name} already exists"));
+            return;
+        }
+        if original.is_some() && values == form.old {
+            self.machine_form = None;
+            self.dialogs.close();
+            return;
+        }
+        let old = form.old.clone();
+        let entry = original.clone().unwrap_or_else(|| name.clone());
+        let saved = self.edit_config(&format!("✅ Saved {name} to the config file"), |text| {
+            Some(config_edit::set_machine(text, &entry, &old, &values))
+        });
+        if saved != Some(true) {
+            return;
+        }
+        if let Some(original) = original.filter(|o| *o != name) {
+            for t in self
+                .tunnels
+                .iter_mut()
+                .filter(|t| t.machine.name == original)
+            {
+                t.machine.name = name.clone();
+            }
+            self.persist();
+        }
+        self.machine_form = None;
+        self.dialogs.close();
+    }
+
+    /// Ask before removing the selected machine. One with tunnels stays until
+    /// they are deleted, since they would be dropped on the next start.
+    fn confirm_remove_machine(&mut self) {
+        if self.refuse_read_only() {
+            return;
+        }
+        let Some(m) = self.machines.get(self.machine_cursor) else {
+            return;
+        };
+        if self.shared_config.is_none() {
+            self.notification = Some("⚠️ No config file to edit for a quick tunnel".into());
+            return;
+        }
+        let tunnels = self
+            .tunnels
+            .iter()
+            .filter(|t| t.machine.name == m.name)
+            .count();
+        if tunnels > 0 {
+            self.notification = Some(format!(
+                "⚠️ {} has {tunnels} tunnel(s); delete them first",
+                m.name
+            ));
+            return;
+        }
+        self.dialogs
+            .open(Overlay::ConfirmRemoveMachine(self.machine_cursor));
+    }
+
+    /// Ask before starting or deallocating the VM under the cursor.
+    fn confirm_power(&mut self, action: PowerAction) {
+        if self.refuse_read_only() {
+            return;
+        }
+        let Some(m) = self.machines.get(self.machine_cursor) else {
+            return;
+        };
+        if !vm::has_power_state(m) {
+            self.notification = Some(format!(
+                "⚠️ {} isn't a VM: only VMs can be started or deallocated",
+                m.name
+            ));
+            return;
+        }
+        if self.power_changing.contains(&m.name) {
+            self.notification = Some(format!("⏳ {} is already being changed", m.name));
+            return;
+        }
+        self.dialogs
+            .open(Overlay::ConfirmPower(self.machine_cursor, action));
+    }
+
+    /// Start or deallocate `machines[idx]` in the background; the machines
+    /// view shows it starting or deallocating until az is done.
+    fn set_power(&mut self, idx: usize, action: PowerAction) {
+        if self.refuse_read_only() {
+            return;
+        }
+        let Some(m) = self.machines.get(idx).cloned() else {
+            return;
+        };
+        let verb = action.command();
+        self.busy.start(
+            format!("power:{}", m.name),
+            format!("Asking az to {verb} {}", m.name),
+        );
+        if self.audit_log.is_some() {
+            let entry = audit::vm_entry(&self.audit_user, &format!("vm_{verb}"), &m);
+            self.audit(&entry);
+        }
+        self.power_changing.insert(m.name.clone());
+        self.power_states
+            .insert(m.name.clone(), action.transition());
+        self.tunnel_mgr.set_power(&m, action);
+    }
+
+    fn remove_machine(&mut self, idx: usize) {
+        if self.refuse_read_only() {
+            return;
+        }
+        let Some(name) = self.machines.get(idx).map(|m| m.name.clone()) else {
+            return;
+        };
+        let removed = self.edit_config(
+            &format!("🗑 Removed {name} from the config file"),
+            |text| config_edit::remove_machine(text, &name),
+        );
+        if removed == Some(false) {
+            self.notification = Some(format!(
+                "⚠️ {name} comes from a shared or included config; remove it there"
+            ));
+        }
+    }
+
+    /// Apply `edit` to the config file and, when it changed, reload the
+    /// machines from it. Whether anything was written, or `None` (and a
+    /// notification) when saving failed.
+    fn edit_config(
+        &mut self,
+        done: &str,
+        edit: impl FnOnce(&str) -> Option<String>,
+    ) -> Option<bool> {
+        let shared = self.shared_config.clone()?;
+        match config_edit::update(shared.config_path(), edit) {
+            Ok(true) => {
+                self.notification = Some(done.to_string());
+                self.busy.start("config", "Reloading config");
+                shared.reload();
+                Some(true)
+            }
+            Ok(false) => Some(false),
+            Err(e) => {
+                self.notification = Some(format!("❌ Could not save config: {e:#}"));
+                None
+            }
+        }
+    }
+
+    fn handle_key(&mut self, key: KeyEvent) -> Option<Action> {
+        // Treat Ctrl+C as `q` everywhere (Go made "q" and "ctrl+c" synonymous).
+        // Without this remap, Ctrl+C falls through to `Char('c')` and opens the
+        // create wizard, which is surprising.
+        let key = if key.modifiers.contains(KeyModifiers::CONTROL) && key.code == KeyCode::Char('c')
+        {
+            KeyEvent::new(KeyCode::Char('q'), KeyModifiers::NONE)
+        } else {
+            key
+        };
+        match self.dialogs.top() {
+            Overlay::None => {
+                if self.filtering {
+                    self.handle_filter_key(key);
+                    return None;
+                }
+                return self.handle_main_key(key);
+            }
+            Overlay::ConfirmQuit => match key.code {
+                KeyCode::Char('y') => return Some(Action::Quit),
+                KeyCode::Char('d') if self.can_detach() => return Some(Action::Detach),
+                // No state file records a quick session's PIDs: its tunnels
+                // would run on with nothing to find or stop them.
+                KeyCode::Char('d') if self.ephemeral => {
+                    self.notification =
+                        Some("⚠️ A --quick session can't detach: quit stops its tunnels".into());
+                }
+                KeyCode::Char('d') => {
+                    self.notification = Some("⚠️ Detach is not supported on Windows".into());
+                }
+                KeyCode::Char('q') | KeyCode::Char('n') | KeyCode::Esc => {
+                    self.dialogs.close();
+                }
+                _ => {}
+            },
+            Overlay::ConfirmDelete(idx) => match key.code {
+                KeyCode::Char('y') => {
+                    self.remove_tunnel(idx);
+                    self.dialogs.close();
+                }
+                KeyCode::Char('q') | KeyCode::Char('n') | KeyCode::Esc => {
+                    self.dialogs.close();
+                }
+                _ => {}
+            },
+            Overlay::Logs(id) => match key.code {
+                KeyCode::Char('c') => self.copy_command(id),
+                KeyCode::Char('y') => self.copy_logs(id),
+                KeyCode::Char('w') => self.save_logs(id),
+                KeyCode::Char('f') => self.cycle_log_severity(),
+                KeyCode::Esc | KeyCode::Char('q') => self.dialogs.close(),
+                _ => {}
+            },
+            Overlay::Cert(_) => match key.code {
+                KeyCode::Char('r') => return self.trigger_regen(),
+                KeyCode::Esc | KeyCode::Char('q') | KeyCode::Char('i') => self.dialogs.close(),
+                _ => {}
+            },
+            Overlay::WhatsNew => {
+                if matches!(key.code, KeyCode::Esc | KeyCode::Enter | KeyCode::Char('q')) {
+                    self.dialogs.close();
+                }
+            }
+            Overlay::Notifications => {
+                if matches!(
+                    key.code,
+                    KeyCode::Esc | KeyCode::Char('q') | KeyCode::Char('n')
+                ) {
+                    self.dialogs.close();
+                }
+            }
+            Overlay::Machines => match key.code {
+                KeyCode::Up | KeyCode::Char('k') => {
+                    self.machine_cursor = self.machine_cursor.saturating_sub(1);
+                }
+                KeyCode::Down | KeyCode::Char('j') => {
+                    if self.machine_cursor + 1 < self.machines.len() {
+                        self.machine_cursor += 1;
+                    }
+                }
+                KeyCode::Char('r') => {
+                    if let Some(m) = self.machines.get(self.machine_cursor).cloned() {
+                        self.regen_machine(&m);
+                    }
+                }
+                KeyCode::Char('p') => {
+                    if let Some(m) = self.machines.get(self.machine_cursor).cloned() {
+                        self.toggle_machine_renewal_pause(&m);
+                    }
+                }
+                KeyCode::Char('a') => self.open_machine_form(MachineForm::add()),
+                KeyCode::Char('e') | KeyCode::Enter => {
+                    if let Some(m) = self.machines.get(self.machine_cursor) {
+                        self.open_machine_form(MachineForm::edit(m));
+                    }
+                }
+                KeyCode::Char('d') | KeyCode::Delete => self.confirm_remove_machine(),
+                KeyCode::Char('s') => self.confirm_power(PowerAction::Start),
+                KeyCode::Char('x') => self.confirm_power(PowerAction::Deallocate),
+                KeyCode::Esc | KeyCode::Char('q') | KeyCode::Char('m') => self.dialogs.close(),
+                _ => {}
+            },
+            Overlay::EditMachine => self.handle_machine_form_key(key),
+            Overlay::Sessions => self.handle_sessions_key(key),
+            Overlay::EditNote(id) => match key.code {
+                KeyCode::Char(c) => self.note_input.push(c),
+                KeyCode::Backspace => {
+                    self.note_input.pop();
+                }
+                KeyCode::Enter => {
+                    self.dialogs.close();
+                    self.set_note(id);
+                }
+                KeyCode::Esc => self.dialogs.close(),
+                _ => {}
+            },
+            Overlay::Login => match key.code {
+                KeyCode::Char('c') => self.copy_device_code(),
+                KeyCode::Esc | KeyCode::Char('q') => self.cancel_login(),
+                _ => {}
+            },
+            Overlay::ConfirmPower(idx, action) => match key.code {
+                KeyCode::Char('y') => {
+                    self.dialogs.close();
+                    self.set_power(idx, action);
+                }
+                KeyCode::Char('q') | KeyCode::Char('n') | KeyCode::Esc => {
+                    self.dialogs.close();
+                }
+                _ => {}
+            },
+            Overlay::ConfirmRemoveMachine(idx) => match key.code {
+                KeyCode::Char('y') => {
+                    self.remove_machine(idx);
+                    self.dialogs.close();
+                }
+                KeyCode::Char('q') | KeyCode::Char('n') | KeyCode::Esc => {
+                    self.dialogs.close();
+                }
+                _ => {}
+            },
+            Overlay::Help => {
+                if matches!(
+                    key.code,
+                    KeyCode::Esc | KeyCode::Char('q') | KeyCode::Char('?')
+                ) {
+                    self.dialogs.close();
+                }
+            }
+            Overlay::Create => self.handle_create_key(key),
+        }
+        None
+    }
+
+    fn handle_create_key(&mut self, key: KeyEvent) {
+        match key.code {
+            KeyCode::Esc => {
+                self.dialogs.close();
+                return;
+            }
+            KeyCode::BackTab | KeyCode::Left => {
+                self.back_create();
+                return;
+            }
+            _ => {}
+        }
+        match self.create_step {
+            CreateStep::Machine => match key.code {
+                KeyCode::Up | KeyCode::Char('k') => {
+                    self.selected_machine = self.selected_machine.saturating_sub(1);
+                }
+                KeyCode::Down | KeyCode::Char('j') => {
+                    if self.selected_machine + 1 < self.machines.len() {
+                        self.selected_machine += 1;
+                    }
+                }
+                KeyCode::Enter => {
+                    self.create_instance = self.machines[self.selected_machine].instance_id.clone();
+                    self.advance_create();
+                }
+                KeyCode::Char(c @ '1'..='9') => self.recreate_recent(c as usize - '1' as usize),
+                _ => {}
+            },
+            CreateStep::Instance => {
+                let count = match &self.scale_set_instances {
+                    Some(Ok(list)) => list.len(),
+                    _ => 0,
+                };
+                match key.code {
+                    KeyCode::Up | KeyCode::Char('k') => {
+                        self.selected_instance = self.selected_instance.saturating_sub(1);
+                    }
+                    KeyCode::Down | KeyCode::Char('j') => {
+                        if self.selected_instance + 1 < count {
+                            self.selected_instance += 1;
+                        }
+                    }
+                    KeyCode::Enter => {
+                        if let Some(Ok(list)) = &self.scale_set_instances {
+                            if let Some(instance) = list.get(self.selected_instance) {
+                                self.create_instance = Some(instance.clone());
+                                self.advance_create();
+                            }
+                        }
+                    }
+                    _ => {}
+                }
+            }
+            CreateStep::Preset => {
+                let presets = &self.machines[self.selected_machine].presets;
+                match key.code {
+                    KeyCode::Up | KeyCode::Char('k') => {
+                        self.selected_preset = self.selected_preset.saturating_sub(1);
+                        self.create_error = None;
+                    }
+                    KeyCode::Down | KeyCode::Char('j') => {
+                        // One past the presets is "Custom ports".
+                        if self.selected_preset < presets.len() {
+                            self.selected_preset += 1;
+                        }
+                        self.create_error = None;
+                    }
+                    KeyCode::Enter => match presets.get(self.selected_preset) {
+                        // Held to the policy like ports typed by hand.
+                        Some(preset) => match self.allowed_pairs(preset.ports.clone()) {
+                            Ok(pairs) => self.finish_create(pairs),
+                            Err(e) => self.create_error = Some(e),
+                        },
+                        None => self.advance_create(),
+                    },
+                    _ => {}
+                }
+            }
+            CreateStep::LocalPort | CreateStep::RemotePort => match key.code {
+                // `:` and `,` let the local port field take a whole multi-port spec.
+                KeyCode::Char(c @ (':' | ',')) if self.create_step == CreateStep::LocalPort => {
+                    self.create_local.push(c);
+                    self.create_error = None;
+                }
+                KeyCode::Char(c) if c.is_ascii_digit() => {
+                    if self.create_step == CreateStep::LocalPort {
+                        self.create_local.push(c);
+                    } else {
+                        self.create_remote.push(c);
+                    }
+                    self.create_error = None;
+                }
+                KeyCode::Backspace => {
+                    if self.create_step == CreateStep::LocalPort {
+                        self.create_local.pop();
+                    } else {
+                        self.create_remote.pop();
+                    }
+                    self.create_error = None;
+                }
+                KeyCode::Enter => self.submit_create_port(),
+                _ => {}
+            },
+        }
+    }
+
+    /// `(local, remote)` port pairs as the tunnel fields take them, or why
+    /// the port policy rules one out.
+    fn allowed_pairs(&self, pairs: Vec<(u16, u16)>) -> Result<Vec<(String, String)>, String> {
+        pairs
+            .into_iter()
+            .map(|(l, r)| {
+                self.policy.check(&l.to_string(), None)?;
+                Ok((l.to_string(), r.to_string()))
+            })
+            .collect()
+    }
+
+    /// Enter in a port field: refuse a port out of range or against the
+    /// policy with an error under the field, otherwise go on to the remote
+    /// port or create the tunnel.
+    fn submit_create_port(&mut self) {
+        if self.create_step == CreateStep::LocalPort && self.create_local.contains(':') {
+            match parse_port_spec(&self.create_local).and_then(|p| self.allowed_pairs(p)) {
+                Ok(pairs) => self.finish_create(pairs),
+                Err(e) => self.create_error = Some(e),
+            }
+        } else if self.create_step == CreateStep::LocalPort && !self.create_local.is_empty() {
+            let local = parse_port(&self.create_local)
+                .and_then(|_| self.policy.check(&self.create_local, None));
+            match local {
+                Ok(()) => {
+                    self.create_step = CreateStep::RemotePort;
+                    self.create_error = None;
+                }
+                Err(e) => self.create_error = Some(e),
+            }
+        } else if self.create_step == CreateStep::RemotePort && !self.create_remote.is_empty() {
+            match (
+                parse_port(&self.create_local),
+                parse_port(&self.create_remote),
+            ) {
+                (Ok(local), Ok(remote)) => {
+                    self.finish_create(vec![(local.to_string(), remote.to_string())])
+                }
+                (Err(e), _) | (_, Err(e)) => self.create_error = Some(e),
+            }
+        }
+    }
+
+    /// The main async event loop.
+    pub async fn run<B: Backend>(
+        &mut self,
+        terminal: &mut Terminal<B>,
+        mut rx: UnboundedReceiver<BgEvent>,
+    ) -> Result<()> {
+        let mut events = EventStream::new();
+        let mut tick = tokio::time::interval(Duration::from_secs(1));
+        let mut spin = tokio::time::interval(Duration::from_millis(100));
+        let mut notif_clear_at: Option<Instant> = None;
+        let mut shown_notif: Option<String> = None;
+
+        terminal.draw(|f| view::draw(f, self))?;
+
+        loop {
+            // (Re)start the 3s auto-clear timer whenever the notification changes,
+            // so a follow-up message (e.g. regen "done" replacing "regenerating…")
+            // gets its own full 3 seconds rather than inheriting the old deadline.
+            // (Two consecutive identical strings won't re-arm — acceptable here.)
+            if self.notification != shown_notif {
+                if let Some(n) = &self.notification {
+                    self.history.push(n);
+                }
+                shown_notif = self.notification.clone();
+                notif_clear_at = self
+                    .notification
+                    .as_ref()
+                    .map(|_| Instant::now() + Duration::from_secs(3));
+            }
+
+            let action: Option<Action> = tokio::select! {
+                maybe_ev = events.next() => {
+                    match maybe_ev {
+                        Some(Ok(Event::Key(key))) if key.kind == KeyEventKind::Press => self.handle_key(key),
+                        _ => None,
+                    }
+                }
+                Some(bg) = rx.recv() => { self.apply_bg(bg); None }
+                _ = tick.tick() => Some(Action::Tick),
+                _ = spin.tick(), if !self.busy.is_idle() || !self.pending_since.is_empty() => { self.busy.tick(); None }
+            };
+
+            if let Some(Action::Quit) = action {
+                self.should_quit = true;
+            }
+            if let Some(Action::Detach) = action {
+                self.detaching = true;
+                self.should_quit = true;
+            }
+            if let Some(Action::External { program, args }) = &action {
+                // The child owns the terminal's input until it exits.
+                drop(events);
+                self.run_external(terminal, program, args).await?;
+                events = EventStream::new();
+            }
+            if let Some(Action::Tick) = action {
+                if let Overlay::Logs(id) = self.dialogs.top() {
+                    self.shown_logs = self.tunnel_mgr.logs(id);
+                }
+                self.note_tick(Utc::now(), Instant::now());
+                self.check_takeover();
+                // Expired: az refreshes it on the next call, so count down
+                // from the new one.
+                if self.token_expires.is_some_and(|at| at <= Utc::now()) {
+                    self.refresh_token();
+                }
+                self.retry_due_tunnels();
+                self.stop_slow_starts(Instant::now());
+                self.write_metrics();
+            }
+            if let Some(at) = notif_clear_at {
+                if Instant::now() >= at {
+                    self.last_notification = self.notification.take();
+                    shown_notif = None;
+                    notif_clear_at = None;
+                }
+            }
+
+            self.track_pending(Instant::now());
+            terminal.draw(|f| view::draw(f, self))?;
+
+            if self.should_quit {
+                // Tunnels a read-only instance reattached to aren't its to stop.
+                if self.detaching || self.read_only {
+                    let detached = self.tunnel_mgr.detach_all();
+                    self.persist_with_pids(&detached);
+                } else {
+                    for i in 0..self.tunnels.len() {
+                        if self.tunnel_mgr.is_running(self.tunnels[i].id) {
+                            self.audit_tunnel("stop", i);
+                            self.tunnel_event(i, HookEvent::Stop, None);
+                        }
+                    }
+                    let mut last = None;
+                    let left = self
+                        .tunnel_mgr
+                        .stop_all_with_progress(|progress| {
+                            last = Some(progress);
+                            let _ = terminal.draw(|f| view::draw_stopping(f, progress, &[]));
+                        })
+                        .await;
+                    self.leftovers = left
+                        .into_iter()
+                        .map(|(id, pid)| match self.tunnels.iter().find(|t| t.id == id) {
+                            Some(t) => {
+                                format!("{} on port {} (pid {pid})", t.display_name(), t.local_port)
+                            }
+                            None => format!("pid {pid}"),
+                        })
+                        .collect();
+                    if let (Some(progress), false) = (last, self.leftovers.is_empty()) {
+                        // Long enough to read before the screen is gone; the
+                        // list is printed again on exit.
+                        let _ =
+                            terminal.draw(|f| view::draw_stopping(f, progress, &self.leftovers));
+                        tokio::time::sleep(LEFTOVER_PAUSE).await;
+                    }
+                    // Clear any PIDs recorded by an earlier detach.
+                    self.persist();
+                }
+                // Nobody keeps the file current from here on; a missing file
+                // reads better in Prometheus than a stale one.
+                if let Some(path) = self.metrics_textfile.as_ref().filter(|_| !self.read_only) {
+                    let _ = std::fs::remove_file(path);
+                }
+                break;
+            }
+        }
+        Ok(())
+    }
+}
+
+/// Why a tunnel that never came up within `timeout` failed: the last few
+/// lines az wrote to stderr, which usually say what it is stuck on.
+fn start_timeout_error(timeout: Duration, logs: &[LogLine]) -> String {
+    let stderr: Vec<&str> = logs
+        .iter()
+        .filter(|l| l.is_stderr())
+        .map(|l| l.text.trim())
+        .filter(|l| !l.is_empty())
+        .collect();
+    let waited = format_duration(timeout);
+    match &stderr[stderr.len().saturating_sub(3)..] {
+        [] => format!("not ready after {waited}, and az printed no errors"),
+        tail => format!("not ready after {waited}: {}", tail.join("; ")),
+    }
+}
+
+/// A prerequisite `m` is missing, as a hint on what to fix: a resource ID
+/// that isn't one, a Bastion host already found unable to tunnel, or a
+/// certificate directory without the public key `az ssh cert` signs.
+fn machine_problem(m: &Machine, bastion_problems: &HashMap<String, String>) -> Option<String> {
+    // Arc machines can be named by resource group and name instead.
+    let by_name = m.target_type == TargetType::Arc && m.target_resource_id.is_empty();
+    if m.target_ip.is_none()
+        && !by_name
+        && !m
+            .target_resource_id
+            .to_lowercase()
+            .starts_with("/subscriptions/")
+    {
+        return Some(format!(
+            "target_resource_id '{}' is not an Azure resource ID (/subscriptions/…)",
+            m.target_resource_id
+        ));
+    }
+    if m.target_type != TargetType::Arc {
+        if let Some(problem) = bastion_problems.get(&bastion::key(m)) {
+            return Some(problem.clone());
+        }
+    }
+    if let Some(files) = m.key_files() {
+        if !files.public_key.exists() {
+            return Some(format!(
+                "no public key {}: create a key pair (ssh-keygen -f {})",
+                files.public_key.display(),
+                files.private_key.display()
+            ));
+        }
+    }
+    None
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::model::*;
+
+    fn app_with_two_tunnels() -> App {
+        let (tx, _rx) = tokio::sync::mpsc::unbounded_channel();
+        let mut app = App::new_for_test(tx);
+        app.add_tunnel_for_test(Machine::test("a"), "1000", "22");
+        app.add_tunnel_for_test(Machine::test("b"), "1001", "22");
+        app
+    }
+
+    #[test]
+    fn cursor_resolves_to_stable_id_after_delete() {
+        let mut app = app_with_two_tunnels();
+        let first_id = app.tunnels[0].id;
+        app.remove_tunnel(0);
+        assert_eq!(app.tunnels.len(), 1);
+        assert_ne!(app.tunnels[0].id, first_id);
+        assert_eq!(app.id_at_cursor(), Some(app.tunnels[0].id));
+    }
+
+    fn press(app: &mut App, code: KeyCode) {
+        app.handle_key(KeyEvent::new(code, KeyModifiers::NONE));
+    }
+
+    #[test]
+    fn number_keys_toggle_the_numbered_rows() {
+        let mut app = app_with_two_tunnels();
+        app.ephemeral = true;
+        press(&mut app, KeyCode::Char('2'));
+        assert_ne!(app.tunnels[1].status, TunnelStatus::Inactive);
+        assert_eq!(app.tunnels[0].status, TunnelStatus::Inactive);
+        assert_eq!(app.cursor, 0);
+
+        // Numbers follow the filtered rows.
+        app.tunnels[1].status = TunnelStatus::Active;
+        app.filter = Some("b".into());
+        press(&mut app, KeyCode::Char('1'));
+        assert_eq!(app.tunnels[1].status, TunnelStatus::Inactive);
+        press(&mut app, KeyCode::Char('2'));
+        assert_eq!(app.tunnels[0].status, TunnelStatus::Inactive);
+    }
+
+    #[test]
+    fn question_mark_opens_help_and_closes() {
+        let mut app = app_with_two_tunnels();
+        press(&mut app, KeyCode::Char('?'));
+        assert_eq!(app.dialogs.top(), Overlay::Help);
+        press(&mut app, KeyCode::Esc);
+        assert_eq!(app.dialogs.top(), Overlay::None);
+    }
+
+    #[test]
+    fn p_pauses_renewal_per_machine_and_shift_p_for_all() {
+        let mut app = app_with_two_tunnels();
+        press(&mut app, KeyCode::Char('p'));
+        assert!(app
+            .notification
+            .as_deref()
+            .unwrap()
+            .contains("No SSH config path"));
+        assert!(!app.renewal_paused_for("a"));
+
+        app.tunnels[0].machine.ssh_config_path = Some("/keys/a".into());
+        press(&mut app, KeyCode::Char('p'));
+        assert!(app.renewal_paused_for("a"));
+        assert!(!app.renewal_paused_for("b"));
+
+        press(&mut app, KeyCode::Char('P'));
+        assert!(app.renewal_paused_for("b"));
+        press(&mut app, KeyCode::Char('P'));
+        press(&mut app, KeyCode::Char('p'));
+        assert!(!app.renewal_paused_for("a"));
+        assert!(app
+            .notification
+            .as_deref()
+            .unwrap()
+            .contains("resumed for a"));
+    }
+
+    #[tokio::test]
+    async fn machines_view_tracks_certs_without_tunnels() {
+        let mut app = app_with_two_tunnels();
+        let mut idle = Machine::test("c");
+        idle.ssh_config_path = Some("/keys/c".into());
+        app.machines = vec![Machine::test("a"), idle];
+        app.apply_bg(BgEvent::Cert {
+            vm_name: "c".into(),
+            status: CertStatus::ExpiringSoon,
+            expires_in: Some(Duration::from_secs(240)),
+        });
+        assert_eq!(app.machine_certs["c"].status, CertStatus::ExpiringSoon);
+
+        press(&mut app, KeyCode::Char('m'));
+        assert_eq!(app.dialogs.top(), Overlay::Machines);
+        press(&mut app, KeyCode::Char('j'));
+        press(&mut app, KeyCode::Char('p'));
+        assert!(app.renewal_paused_for("c"));
+        press(&mut app, KeyCode::Char('r'));
+        assert!(app.busy.status().unwrap().contains("certificate for c"));
+        press(&mut app, KeyCode::Esc);
+
+        // A tunnel created later starts out showing the machine's cert.
+        app.selected_machine = 1;
+        app.finish_create(vec![("2000".into(), "22".into())]);
+        let t = app.tunnels.last().unwrap();
+        assert_eq!(t.cert_status, Some(CertStatus::ExpiringSoon));
+        assert_eq!(t.cert_expires_in.as_deref(), Some("4m0s"));
+    }
+
+    #[test]
+    fn stopping_tunnels_wait_for_their_process() {
+        let mut app = app_with_two_tunnels();
+        app.tunnels[0].status = TunnelStatus::Stopping;
+        press(&mut app, KeyCode::Enter);
+        assert_eq!(app.tunnels[0].status, TunnelStatus::Stopping);
+
+        let id = app.tunnels[0].id;
+        app.apply_bg(BgEvent::TunnelStopped { id, forced: true });
+        assert_eq!(app.tunnels[0].status, TunnelStatus::Inactive);
+        assert!(app.notification.as_deref().unwrap().contains("was killed"));
+    }
+
+    #[test]
+    fn slow_starts_count_up_and_then_fail() {
+        let mut app = app_with_two_tunnels();
+        app.start_timeout = Some(Duration::from_secs(20));
+        let (a, b) = (app.tunnels[0].id, app.tunnels[1].id);
+        let t0 = Instant::now();
+        app.tunnels[0].status = TunnelStatus::Starting;
+        app.track_pending(t0);
+        app.tunnels[0].status = TunnelStatus::Connecting;
+        app.tunnels[1].status = TunnelStatus::Stopping;
+        app.track_pending(t0 + Duration::from_secs(12));
+        assert_eq!(
+            app.pending_for(a, t0 + Duration::from_secs(12)),
+            Some(Duration::from_secs(12))
+        );
+        assert_eq!(
+            app.pending_for(b, t0 + Duration::from_secs(12)),
+            Some(Duration::ZERO)
+        );
+
+        app.stop_slow_starts(t0 + Duration::from_secs(19));
+        assert_eq!(app.tunnels[0].status, TunnelStatus::Connecting);
+        app.stop_slow_starts(t0 + Duration::from_secs(20));
+        assert_eq!(
+            app.tunnels[0].status,
+            TunnelStatus::Error("not ready after 20s, and az printed no errors".into())
+        );
+        app.track_pending(t0 + Duration::from_secs(20));
+        assert_eq!(app.pending_for(a, t0), None);
+
+        // One still running is stopped first and fails once it is gone.
+        app.fail_after_stop.insert(b, "not ready after 20s".into());
+        app.apply_bg(BgEvent::TunnelStopped {
+            id: b,
+            forced: false,
+        });
+        assert_eq!(
+            app.tunnels[1].status,
+            TunnelStatus::Error("not ready after 20s".into())
+        );
+    }
+
+    #[test]
+    fn tunnels_to_a_deallocated_vm_fail_straight_away() {
+        let mut app = app_with_two_tunnels();
+        app.tunnels[0].status = TunnelStatus::Connecting;
+        app.tunnels[1].status = TunnelStatus::Connecting;
+        app.apply_bg(BgEvent::PowerState {
+            machine: "a".into(),
+            result: Ok(PowerState::Deallocated),
+        });
+        assert_eq!(
+            app.tunnels[0].status,
+            TunnelStatus::Error("VM a is deallocated: start it first".into())
+        );
+        assert_eq!(app.tunnels[1].status, TunnelStatus::Connecting);
+        assert!(app.notification.as_deref().unwrap().contains("deallocated"));
+        assert_eq!(app.power_states["a"], PowerState::Deallocated);
+
+        app.apply_bg(BgEvent::PowerState {
+            machine: "b".into(),
+            result: Ok(PowerState::Running),
+        });
+        assert_eq!(app.tunnels[1].status, TunnelStatus::Connecting);
+        app.apply_bg(BgEvent::PowerState {
+            machine: "a".into(),
+            result: Err("AuthorizationFailed".into()),
+        });
+        assert!(!app.power_states.contains_key("a"));
+    }
+
+    #[tokio::test]
+    async fn vms_are_started_and_deallocated_after_asking() {
+        let mut app = app_with_two_tunnels();
+        let mut arc = Machine::test("edge");
+        arc.target_type = TargetType::Arc;
+        app.machines = vec![Machine::test("a"), arc];
+        press(&mut app, KeyCode::Char('m'));
+        press(&mut app, KeyCode::Char('x'));
+        assert_eq!(
+            app.dialogs.top(),
+            Overlay::ConfirmPower(0, PowerAction::Deallocate)
+        );
+        press(&mut app, KeyCode::Char('n'));
+        assert_eq!(app.dialogs.top(), Overlay::Machines);
+        assert!(app.busy.is_idle());
+
+        press(&mut app, KeyCode::Char('s'));
+        press(&mut app, KeyCode::Char('y'));
+        assert_eq!(app.dialogs.top(), Overlay::Machines);
+        assert_eq!(app.power_states["a"], PowerState::Starting);
+        press(&mut app, KeyCode::Char('x'));
+        assert!(app.notification.as_deref().unwrap().contains("already"));
+        assert_eq!(app.dialogs.top(), Overlay::Machines);
+
+        app.apply_bg(BgEvent::PowerChanged {
+            machine: "a".into(),
+            action: PowerAction::Start,
+            result: Err("AuthorizationFailed".into()),
+        });
+        assert!(app.busy.is_idle());
+        assert!(!app.power_states.contains_key("a"));
+        assert_eq!(
+            app.notification.as_deref(),
+            Some("❌ Could not start a: AuthorizationFailed")
+        );
+
+        press(&mut app, KeyCode::Char('j'));
+        press(&mut app, KeyCode::Char('s'));
+        assert_eq!(app.dialogs.top(), Overlay::Machines);
+        assert!(app.notification.as_deref().unwrap().contains("isn't a VM"));
+    }
+
+    #[test]
+    fn start_timeouts_quote_what_az_said_on_stderr() {
+        let line = |text: &str| LogLine {
+            at: Local::now(),
+            severity: Severity::Info,
+            text: text.into(),
+        };
+        let logs = [
+            line("[OUT] Opening tunnel on port: 2022"),
+            line("WARNING: Bastion host is being updated"),
+            line(""),
+            line("Retrying connection to the target"),
+            line("[SSH] Connection refused"),
+            line("Websocket handshake pending"),
+            line("[ERR] Still running 5s after being asked to stop; killed"),
+            line("Waiting for the tunnel"),
+        ];
+        assert_eq!(
+            start_timeout_error(Duration::from_secs(90), &logs),
+            "not ready after 1m30s: Retrying connection to the target; \
+             Websocket handshake pending; Waiting for the tunnel"
+        );
+    }
+
+    #[test]
+    fn clock_jumps_trigger_a_recheck() {
+        let mut app = app_with_two_tunnels();
+        let (wall, mono) = (Utc::now(), Instant::now());
+        app.note_tick(wall, mono);
+        app.note_tick(
+            wall + chrono::Duration::seconds(1),
+            mono + Duration::from_secs(1),
+        );
+        assert_eq!(app.notification, None);
+
+        // Suspended for an hour: the monotonic clock only saw one tick.
+        app.note_tick(
+            wall + chrono::Duration::hours(1),
+            mono + Duration::from_secs(2),
+        );
+        assert!(app
+            .notification
+            .as_deref()
+            .unwrap()
+            .contains("re-checking certificates and tunnels"));
+    }
+
+    #[test]
+    fn results_end_their_busy_spinner() {
+        let (tx, _rx) = tokio::sync::mpsc::unbounded_channel();
+        let mut app = App::new_for_test(tx);
+        app.busy
+            .start("cert:vm-web", "Regenerating certificate for vm-web");
+        app.busy.start("account", "Checking az account");
+
+        app.apply_bg(BgEvent::CertRegenResult {
+            vm_name: "vm-web".into(),
+            ok: true,
+            message: "Certificate regenerated".into(),
+        });
+        assert!(app.busy.status().unwrap().contains("Checking az account"));
+        app.apply_bg(BgEvent::Account {
+            result: Ok("me@example.com · dev".into()),
+        });
+        assert!(app.busy.is_idle());
+    }
+
+    #[test]
+    fn n_toggles_notification_history() {
+        let mut app = app_with_two_tunnels();
+        press(&mut app, KeyCode::Char('n'));
+        assert_eq!(app.dialogs.top(), Overlay::Notifications);
+        press(&mut app, KeyCode::Char('n'));
+        assert_eq!(app.dialogs.top(), Overlay::None);
+    }
+
+    #[test]
+    fn n_cancels_confirm_quit() {
+        let mut app = app_with_two_tunnels();
+        app.dialogs.open(Overlay::ConfirmQuit);
+        press(&mut app, KeyCode::Char('n'));
+        assert_eq!(app.dialogs.top(), Overlay::None);
+    }
+
+    #[test]
+    fn slash_enters_filter_mode_and_typing_filters() {
+        let mut app = app_with_two_tunnels();
+        press(&mut app, KeyCode::Char('/'));
+        assert!(app.filtering);
+        press(&mut app, KeyCode::Char('b'));
+        assert_eq!(app.filter.as_deref(), Some("b"));
+        assert_eq!(app.visible_indices(), vec![1]);
+    }
+
+    #[test]
+    fn enter_commits_filter_and_exits_input() {
+        let mut app = app_with_two_tunnels();
+        press(&mut app, KeyCode::Char('/'));
+        press(&mut app, KeyCode::Char('a'));
+        press(&mut app, KeyCode::Enter);
+        assert!(!app.filtering);
+        assert_eq!(app.filter.as_deref(), Some("a"));
+    }
+
+    #[test]
+    fn esc_in_main_clears_active_filter() {
+        let mut app = app_with_two_tunnels();
+        app.filter = Some("a".into());
+        press(&mut app, KeyCode::Esc);
+        assert!(app.filter.is_none());
+    }
+
+    #[test]
+    fn startup_warnings_land_in_the_notification_history() {
+        let mut app = app_with_two_tunnels();
+        app.report_startup(&[]);
+        assert!(app.notification.is_none());
+        app.report_startup(&["vm-a: SSH key ~/.ssh/id_rsa not found".into()]);
+        assert_eq!(
+            app.notification.as_deref(),
+            Some("⚠️ vm-a: SSH key ~/.ssh/id_rsa not found")
+        );
+
+        app.report_startup(&["first".into(), "second".into()]);
+        assert!(app
+            .notification
+            .as_deref()
+            .unwrap()
+            .contains("2 startup warnings"));
+        let kept: Vec<&str> = app.history.newest().map(|n| n.text.as_str()).collect();
+        assert_eq!(
+            kept,
+            [
+                "⚠️ second",
+                "⚠️ first",
+                "⚠️ vm-a: SSH key ~/.ssh/id_rsa not found"
+            ]
+        );
+    }
+
+    #[test]
+    fn selection_stays_on_the_same_tunnel_as_the_filter_changes() {
+        let mut app = app_with_two_tunnels();
+        press(&mut app, KeyCode::Char('/'));
+        press(&mut app, KeyCode::Char('b'));
+        assert_eq!(app.selected_real_index(), Some(1));
+        press(&mut app, KeyCode::Enter);
+        // Clearing the filter shows "a" above the selection again.
+        press(&mut app, KeyCode::Esc);
+        assert_eq!(app.cursor, 1);
+        assert_eq!(app.selected_real_index(), Some(1));
+
+        press(&mut app, KeyCode::Char('/'));
+        press(&mut app, KeyCode::Char('a'));
+        assert_eq!(app.selected_real_index(), Some(0), "b is hidden");
+    }
+
+    #[test]
+    fn quit_is_immediate_when_nothing_running() {
+        let mut app = app_with_two_tunnels(); // both Inactive
+        let action = app.handle_key(KeyEvent::new(KeyCode::Char('q'), KeyModifiers::NONE));
+        assert!(matches!(action, Some(Action::Quit)));
+        assert_eq!(app.dialogs.top(), Overlay::None);
+    }
+
+    #[test]
+    fn quit_confirms_when_a_tunnel_is_running() {
+        let mut app = app_with_two_tunnels();
+        app.tunnels[0].status = TunnelStatus::Active;
+        let action = app.handle_key(KeyEvent::new(KeyCode::Char('q'), KeyModifiers::NONE));
+        assert!(action.is_none());
+        assert_eq!(app.dialogs.top(), Overlay::ConfirmQuit);
+    }
+
+    #[test]
+    fn d_in_confirm_quit_detaches_where_supported() {
+        let mut app = app_with_two_tunnels();
+        app.dialogs.open(Overlay::ConfirmQuit);
+        let action = app.handle_key(KeyEvent::new(KeyCode::Char('d'), KeyModifiers::NONE));
+        if cleanup::CAN_DETACH {
+            assert!(matches!(action, Some(Action::Detach)));
+        } else {
+            assert!(action.is_none());
+            assert_eq!(app.dialogs.top(), Overlay::ConfirmQuit);
+        }
+
+        // A quick session has no state file to find its tunnels in again.
+        app.ephemeral = true;
+        let action = app.handle_key(KeyEvent::new(KeyCode::Char('d'), KeyModifiers::NONE));
+        assert!(action.is_none());
+        assert!(app
+            .notification
+            .as_deref()
+            .unwrap()
+            .contains("can't detach"));
+    }
+
+    #[tokio::test]
+    async fn read_only_mode_changes_nothing() {
+        let mut app = app_with_two_tunnels();
+        app.machines = vec![Machine::test("a")];
+        app.set_read_only();
+        for key in [
+            KeyCode::Enter,
+            KeyCode::Char('1'),
+            KeyCode::Char('a'),
+            KeyCode::Char('c'),
+            KeyCode::Char('d'),
+            KeyCode::Char('t'),
+        ] {
+            press(&mut app, key);
+        }
+        assert_eq!(app.dialogs.top(), Overlay::None);
+        assert!(app
+            .tunnels
+            .iter()
+            .all(|t| t.status == TunnelStatus::Inactive));
+        assert!(app.tunnels.iter().all(|t| t.color.is_none()));
+        assert!(app.notification.as_deref().unwrap().contains("Read-only"));
+
+        // Looking is fine, and quitting doesn't ask about tunnels.
+        press(&mut app, KeyCode::Char(' '));
+        assert!(matches!(app.dialogs.top(), Overlay::Logs(_)));
+        press(&mut app, KeyCode::Esc);
+        press(&mut app, KeyCode::Char('i'));
+        assert!(matches!(app.dialogs.top(), Overlay::Cert(_)));
+        press(&mut app, KeyCode::Char('r'));
+        press(&mut app, KeyCode::Esc);
+        press(&mut app, KeyCode::Char('m'));
+        assert_eq!(app.dialogs.top(), Overlay::Machines);
+        for key in ['a', 'e', 'd', 'r', 'p', 's', 'x'] {
+            press(&mut app, KeyCode::Char(key));
+        }
+        assert_eq!(app.dialogs.top(), Overlay::Machines);
+        assert!(app.machine_form.is_none());
+        assert!(app.busy.status().is_none());
+        assert!(!app.renewal_paused.contains("a"));
+        press(&mut app, KeyCode::Esc);
+        app.tunnels[0].status = TunnelStatus::Active;
+        assert!(matches!(
+            app.handle_key(KeyEvent::new(KeyCode::Char('q'), KeyModifiers::NONE)),
+            Some(Action::Quit)
+        ));
+    }
+
+    #[test]
+    fn reattach_skips_dead_and_reused_pids() {
+        let mut app = app_with_two_tunnels();
+        // u32::MAX is never a live PID.
+        let dead = Detached {
+            pid: u32::MAX,
+            started: "Fri Oct 16 18:03:17 2026".into(),
+        };
+        // Ours is alive, but didn't start then: a reused PID.
+        let reused = Detached {
+            pid: std::process::id(),
+            started: "Thu Jan  1 00:00:00 1970".into(),
+        };
+        app.reattach(&[Some(dead), Some(reused)]);
+        assert!(app
+            .tunnels
+            .iter()
+            .all(|t| t.status == TunnelStatus::Inactive));
+    }
+
+    fn app_with_dependency(check: Option<crate::readiness::ReadyCheck>) -> App {
+        let mut app = app_with_two_tunnels();
+        app.tunnels[0].name = Some("db".into());
+        app.tunnels[1].name = Some("app".into());
+        app.tunnels[1].depends = Some(Dependency {
+            tunnel: "db".into(),
+            check,
+        });
+        app
+    }
+
+    #[test]
+    fn dependent_waits_while_dependency_connects() {
+        let mut app = app_with_dependency(None);
+        app.tunnels[0].status = TunnelStatus::Connecting;
+        app.start_tunnel(1);
+        assert_eq!(app.tunnels[1].status, TunnelStatus::Waiting("db".into()));
+    }
+
+    #[test]
+    fn dependent_starts_once_dependency_is_active() {
+        let mut app = app_with_dependency(None);
+        let db = app.tunnels[0].id;
+        app.tunnels[0].status = TunnelStatus::Connecting;
+        app.start_tunnel(1);
+        app.apply_bg(BgEvent::TunnelStatus {
+            id: db,
+            status: TunnelStatus::Active,
+        });
+        // Spawned (Starting) or spawn failed (Error) — no `az` in unit tests.
+        assert!(!matches!(app.tunnels[1].status, TunnelStatus::Waiting(_)));
+    }
+
+    #[test]
+    fn dependent_fails_when_dependency_exits() {
+        let mut app = app_with_dependency(None);
+        let db = app.tunnels[0].id;
+        app.tunnels[0].status = TunnelStatus::Connecting;
+        app.start_tunnel(1);
+        app.apply_bg(BgEvent::TunnelExited {
+            id: db,
+            error: Some("boom".into()),
+        });
+        assert!(matches!(app.tunnels[1].status, TunnelStatus::Error(_)));
+    }
+
+    #[test]
+    fn transient_exit_schedules_a_retry_until_attempts_run_out() {
+        let (tx, _rx) = tokio::sync::mpsc::unbounded_channel();
+        let mut app = App::new_for_test(tx);
+        app.tunnel_retry = RetryPolicy::new(1, Duration::ZERO);
+        app.add_tunnel_for_test(Machine::test("a"), "2022", "22");
+        let id = app.tunnels[0].id;
+        let throttled = || BgEvent::TunnelExited {
+            id,
+            error: Some("ERROR: (TooManyRequests) throttled".into()),
+        };
+
+        app.apply_bg(throttled());
+        let TunnelStatus::Error(msg) = &app.tunnels[0].status else {
+            panic!("expected an error, got {:?}", app.tunnels[0].status);
+        };
+        assert!(msg.contains("retrying in"), "{msg}");
+        assert!(msg.contains("(1/1)"), "{msg}");
+
+        // The retry respawns it (az isn't installed here, so it fails again
+        // straight away, but no longer with the retry message)...
+        app.retry_due_tunnels();
+        assert!(app.retry_at.is_empty());
+        assert!(
+            !matches!(&app.tunnels[0].status, TunnelStatus::Error(m) if m.contains("retrying"))
+        );
+
+        // ...and once attempts are used up the error stands.
+        app.apply_bg(throttled());
+        assert_eq!(
+            app.tunnels[0].status,
+            TunnelStatus::Error("ERROR: (TooManyRequests) throttled".into())
+        );
+        assert!(app.retry_at.is_empty());
+    }
+
+    #[test]
+    fn permanent_exit_errors_are_not_retried() {
+        let (tx, _rx) = tokio::sync::mpsc::unbounded_channel();
+        let mut app = App::new_for_test(tx);
+        app.add_tunnel_for_test(Machine::test("a"), "2022", "22");
+        let id = app.tunnels[0].id;
+        app.apply_bg(BgEvent::TunnelExited {
+            id,
+            error: Some("ERROR: (AuthorizationFailed) no access".into()),
+        });
+        assert!(app.retry_at.is_empty());
+    }
+
+    #[test]
+    fn create_picker_flags_machines_with_missing_prerequisites() {
+        let (tx, _rx) = tokio::sync::mpsc::unbounded_channel();
+        let mut app = App::new_for_test(tx);
+        let mut bad_id = Machine::test("bad-id");
+        bad_id.target_resource_id = "vm-typo".into();
+        let mut no_key = Machine::test("no-key");
+        no_key.ssh_config_path = Some("/nonexistent/az-burrow-test".into());
+        let mut bad_bastion = Machine::test("basic");
+        bad_bastion.bastion_name = "basic-hub".into();
+        let arc = Machine {
+            target_type: TargetType::Arc,
+            target_resource_id: String::new(),
+            ..Machine::test("arc")
+        };
+        app.machines = vec![Machine::test("ok"), bad_id, no_key, bad_bastion, arc];
+        app.apply_bg(BgEvent::BastionChecked {
+            bastion: bastion::key(&app.machines[3]),
+            problem: Some("Bastion 'basic-hub' is on the Basic SKU".into()),
+        });
+
+        press(&mut app, KeyCode::Char('c'));
+        assert_eq!(app.machine_problems[0], None);
+        assert!(app.machine_problems[1]
+            .as_deref()
+            .unwrap()
+            .contains("not an Azure resource ID"));
+        assert!(app.machine_problems[2]
+            .as_deref()
+            .unwrap()
+            .contains("no public key /nonexistent/az-burrow-test/id_rsa.pub"));
+        assert!(app.machine_problems[3]
+            .as_deref()
+            .unwrap()
+            .contains("Basic SKU"));
+        assert_eq!(
+            app.machine_problems[4], None,
+            "an Arc machine named by group"
+        );
+        assert_eq!(app.selected_machine_problem(), None);
+    }
+
+    #[tokio::test]
+    async fn stopping_an_aks_tunnel_removes_its_kubeconfig() {
+        let mut app = app_with_two_tunnels();
+        let path = std::env::temp_dir().join(format!("az-burrow-kube-{}", std::process::id()));
+        std::fs::write(&path, "apiVersion: v1\n").unwrap();
+        app.tunnels[0].aks = Some(crate::model::AksCluster {
+            resource_group: "rg".into(),
+            name: "aks".into(),
+            kubeconfig: path.display().to_string(),
+        });
+        app.tunnels[0].status = TunnelStatus::Active;
+        app.tunnel_event(0, HookEvent::Stop, None);
+        assert!(!path.exists());
+    }
+
+    #[test]
+    fn s_runs_ssh_in_the_foreground_outside_tmux() {
+        let mut app = app_with_two_tunnels();
+        app.tunnels[0].status = TunnelStatus::Active;
+        let key = KeyEvent::new(KeyCode::Char('s'), KeyModifiers::NONE);
+        match app.handle_key(key) {
+            Some(Action::External { program, args }) => {
+                assert_eq!(program, "ssh");
+                assert_eq!(args[..2], ["-p", "1000"]);
+            }
+            other => panic!("expected ssh, got {other:?}"),
+        }
+    }
+
+    #[test]
+    fn f_hands_an_active_ssh_tunnel_to_sftp() {
+        let mut app = app_with_two_tunnels();
+        let key = KeyEvent::new(KeyCode::Char('f'), KeyModifiers::NONE);
+        assert!(app.handle_key(key).is_none());
+        assert!(app.notification.as_deref().unwrap().contains("not active"));
+
+        app.tunnels[0].status = TunnelStatus::Active;
+        match app.handle_key(key) {
+            Some(Action::External { program, args }) => {
+                assert_eq!(program, "sftp");
+                assert_eq!(args[..2], ["-P", "1000"]);
+            }
+            other => panic!("expected sftp, got {other:?}"),
+        }
+    }
+
+    #[test]
+    fn l_sets_and_clears_the_note_of_the_whole_connection() {
+        let mut app = app_with_group();
+        app.ephemeral = true;
+        press(&mut app, KeyCode::Char('l'));
+        assert_eq!(app.dialogs.top(), Overlay::EditNote(app.tunnels[0].id));
+        type_text(&mut app, "pgAdmin for ticket #1234 ");
+        press(&mut app, KeyCode::Enter);
+        assert_eq!(app.dialogs.top(), Overlay::None);
+        let note = Some("pgAdmin for ticket #1234".to_string());
+        assert_eq!(app.tunnels[0].note, note);
+        assert_eq!(app.tunnels[2].note, note);
+        assert_eq!(app.tunnels[1].note, None);
+
+        // The dialog starts from the current note.
+        press(&mut app, KeyCode::Char('l'));
+        assert_eq!(app.note_input, "pgAdmin for ticket #1234");
+        for _ in 0..app.note_input.len() {
+            press(&mut app, KeyCode::Backspace);
+        }
+        press(&mut app, KeyCode::Enter);
+        assert_eq!(app.tunnels[2].note, None);
+    }
+
+    #[test]
+    fn t_cycles_the_colour_tag_of_the_whole_connection() {
+        let (tx, _rx) = tokio::sync::mpsc::unbounded_channel();
+        let mut app = App::new_for_test(tx);
+        app.ephemeral = true;
+        app.add_tunnel_for_test(Machine::test("a"), "2022", "22");
+        app.add_tunnel_for_test(Machine::test("a"), "8080", "80");
+        app.tunnels[0].group = Some(1);
+        app.tunnels[1].group = Some(1);
+        app.tunnels[0].icon = Some("🔥".into());
+
+        press(&mut app, KeyCode::Char('t'));
+        assert_eq!(app.tunnels[0].color, Some(TagColor::Red));
+        assert_eq!(app.tunnels[1].color, Some(TagColor::Red));
+        assert_eq!(app.notification.as_deref(), Some("🏷 🔥 a tagged red"));
+
+        press(&mut app, KeyCode::Char('t'));
+        assert_eq!(app.tunnels[1].color, Some(TagColor::Yellow));
+        for _ in 0..5 {
+            press(&mut app, KeyCode::Char('t'));
+        }
+        assert_eq!(app.tunnels[0].color, None);
+    }
+
+    #[test]
+    fn user_actions_are_written_to_the_audit_log() {
+        let path =
+            std::env::temp_dir().join(format!("az-burrow-app-audit-{}.log", std::process::id()));
+        let _ = std::fs::remove_file(&path);
+        let mut app = app_with_two_tunnels();
+        app.ephemeral = true;
+        app.audit_log = Some(path.clone());
+
+        app.toggle_selected();
+        app.tunnels[0].status = TunnelStatus::Active;
+        app.toggle_selected();
+        app.remove_tunnel(0);
+
+        let text = std::fs::read_to_string(&path).unwrap();
+        let actions: Vec<&str> = text
+            .lines()
+            .map(|l| {
+                l.split("\"action\":\"")
+                    .nth(1)
+                    .unwrap()
+                    .split('"')
+                    .next()
+                    .unwrap()
+            })
+            .collect();
+        assert_eq!(actions, ["start", "stop", "delete"]);
+        assert!(text.contains("\"local_port\":\"1000\""));
+        let _ = std::fs::remove_file(&path);
+    }
+
+    #[test]
+    fn bastion_problem_replaces_opaque_exit_error() {
+        let (tx, _rx) = tokio::sync::mpsc::unbounded_channel();
+        let mut app = App::new_for_test(tx);
+        app.add_tunnel_for_test(Machine::test("a"), "2022", "22");
+        app.add_tunnel_for_test(Machine::test("b"), "2023", "22");
+        let (first, second) = (app.tunnels[0].id, app.tunnels[1].id);
+        let key = bastion::key(&app.tunnels[0].machine);
+
+        // The tunnel fails before the check answers...
+        app.apply_bg(BgEvent::TunnelExited {
+            id: first,
+            error: Some("tunnel process exited: exit status: 1".into()),
+        });
+        app.apply_bg(BgEvent::BastionChecked {
+            bastion: key.clone(),
+            problem: Some("Bastion 'b' is on the Basic SKU".into()),
+        });
+        assert_eq!(
+            app.tunnels[0].status,
+            TunnelStatus::Error("Bastion 'b' is on the Basic SKU".into())
+        );
+        // ...or after it.
+        app.apply_bg(BgEvent::TunnelExited {
+            id: second,
+            error: Some("tunnel process exited: exit status: 1".into()),
+        });
+        assert_eq!(
+            app.tunnels[1].status,
+            TunnelStatus::Error("Bastion 'b' is on the Basic SKU".into())
+        );
+
+        // Once fixed, az's own errors show again.
+        app.apply_bg(BgEvent::BastionChecked {
+            bastion: key,
+            problem: None,
+        });
+        app.apply_bg(BgEvent::TunnelExited {
+            id: second,
+            error: Some("boom".into()),
+        });
+        assert_eq!(app.tunnels[1].status, TunnelStatus::Error("boom".into()));
+    }
+
+    #[tokio::test]
+    async fn az_wanting_a_login_signs_in_and_restarts_the_tunnel() {
+        let mut app = app_with_two_tunnels();
+        app.ephemeral = true;
+        let id = app.tunnels[0].id;
+        app.dialogs.open(Overlay::Help);
+        app.apply_bg(BgEvent::TunnelExited {
+            id,
+            error: Some("ERROR: Please run 'az login' to setup account.".into()),
+        });
+        // Queued behind the dialog already open.
+        assert_eq!(app.dialogs.top(), Overlay::Help);
+        press(&mut app, KeyCode::Esc);
+        assert_eq!(app.dialogs.top(), Overlay::Login);
+        assert_eq!(app.waiting_for_login(), (1, 0));
+
+        let code = DeviceCode {
+            url: "https://microsoft.com/devicelogin".into(),
+            code: "FJ3K5PSMN".into(),
+        };
+        app.apply_bg(BgEvent::DeviceCode(code.clone()));
+        assert_eq!(app.device_login.as_ref().unwrap().code, Some(code));
+
+        app.apply_bg(BgEvent::LoggedIn { result: Ok(()) });
+        assert_eq!(app.dialogs.top(), Overlay::None);
+        assert!(app.device_login.is_none());
+        assert!(!matches!(app.tunnels[0].status, TunnelStatus::Error(_)));
+        assert_eq!(app.waiting_for_login(), (0, 0));
+
+        // Without a login under way (cancelled, say), a late result is ignored.
+        app.apply_bg(BgEvent::LoggedIn {
+            result: Err("cancelled".into()),
+        });
+        assert!(app.notification.as_deref().unwrap().contains("Signed in"));
+    }
+
+    #[tokio::test]
+    async fn tunnels_wait_for_a_token_about_to_expire_to_be_refreshed() {
+        let mut app = app_with_two_tunnels();
+        app.ephemeral = true;
+        app.token_expires = Some(Utc::now() + chrono::Duration::minutes(3));
+        press(&mut app, KeyCode::Enter);
+        assert_eq!(
+            app.tunnels[0].status,
+            TunnelStatus::Waiting(FRESH_TOKEN.into())
+        );
+
+        // az hands back a fresh token: the tunnel goes ahead.
+        let fresh = Utc::now() + chrono::Duration::minutes(60);
+        app.apply_bg(BgEvent::Token { result: Ok(fresh) });
+        assert_ne!(
+            app.tunnels[0].status,
+            TunnelStatus::Waiting(FRESH_TOKEN.into())
+        );
+        assert_eq!(app.token_expires, Some(fresh));
+
+        // One az won't renew yet isn't waited on again.
+        let stuck = Utc::now() + chrono::Duration::minutes(8);
+        app.apply_bg(BgEvent::Token { result: Ok(stuck) });
+        app.cursor = 1;
+        press(&mut app, KeyCode::Enter);
+        assert_ne!(
+            app.tunnels[1].status,
+            TunnelStatus::Waiting(FRESH_TOKEN.into())
+        );
+    }
+
+    #[test]
+    fn failed_readiness_probe_marks_dependent_error() {
+        let mut app = app_with_dependency(Some(crate::readiness::ReadyCheck::Tcp));
+        let id = app.tunnels[1].id;
+        app.tunnels[1].status = TunnelStatus::Waiting("db".into());
+        app.apply_bg(BgEvent::TunnelReady {
+            id,
+            result: Err("connection refused".into()),
+        });
+        assert!(matches!(app.tunnels[1].status, TunnelStatus::Error(_)));
+    }
+
+    fn type_text(app: &mut App, text: &str) {
+        for c in text.chars() {
+            press(app, KeyCode::Char(c));
+        }
+    }
+
+    #[test]
+    fn multi_port_spec_creates_one_grouped_connection() {
+        let (tx, _rx) = tokio::sync::mpsc::unbounded_channel();
+        let mut app = App::new_for_test(tx);
+        app.machines = vec![Machine::test("vm")];
+        press(&mut app, KeyCode::Char('c'));
+        press(&mut app, KeyCode::Enter);
+        type_text(&mut app, "2022:22,8080:80");
+        press(&mut app, KeyCode::Enter);
+        assert_eq!(app.dialogs.top(), Overlay::None);
+        assert_eq!(app.tunnels.len(), 2);
+        assert_eq!(app.tunnels[1].local_port, "8080");
+        assert!(app.tunnels[0].group.is_some());
+        assert_eq!(app.tunnels[0].group, app.tunnels[1].group);
+        assert_eq!(app.group_members(1), vec![0, 1]);
+    }
+
+    #[test]
+    fn invalid_port_spec_keeps_wizard_open() {
+        let (tx, _rx) = tokio::sync::mpsc::unbounded_channel();
+        let mut app = App::new_for_test(tx);
+        app.machines = vec![Machine::test("vm")];
+        press(&mut app, KeyCode::Char('c'));
+        press(&mut app, KeyCode::Enter);
+        type_text(&mut app, "2022:");
+        press(&mut app, KeyCode::Enter);
+        assert_eq!(app.dialogs.top(), Overlay::Create);
+        assert!(app.tunnels.is_empty());
+        assert!(app.create_error.is_some());
+        // Editing the field clears the error.
+        press(&mut app, KeyCode::Backspace);
+        assert_eq!(app.create_error, None);
+    }
 
-        terminal.draw(|f| view::draw(f, self))?;
+    #[test]
+    fn out_of_range_ports_are_refused_inline() {
+        let (tx, _rx) = tokio::sync::mpsc::unbounded_channel();
+        let mut app = App::new_for_test(tx);
+        app.machines = vec![Machine::test("vm")];
+        press(&mut app, KeyCode::Char('c'));
+        press(&mut app, KeyCode::Enter);
+        type_text(&mut app, "70000");
+        press(&mut app, KeyCode::Enter);
+        assert_eq!(app.create_step, CreateStep::LocalPort);
+        assert_eq!(
+            app.create_error.as_deref(),
+            Some("invalid port `70000`: use 1-65535")
+        );
 
-        loop {
-            // (Re)start the 3s auto-clear timer whenever the notification changes,
-            // so a follow-up message (e.g. regen "done" replacing "regenerating…")
-            // gets its own full 3 seconds rather than inheriting the old deadline.
-            // (Two consecutive identical strings won't re-arm — acceptable here.)
-            if self.notification != shown_notif {
-                shown_notif = self.notification.clone();
-                notif_clear_at = self
-                    .notification
-                    .as_ref()
-                    .map(|_| Instant::now() + Duration::from_secs(3));
-            }
+        app.create_local = "0".into();
+        press(&mut app, KeyCode::Enter);
+        assert_eq!(app.create_step, CreateStep::LocalPort);
+        app.create_local = "2022".into();
+        press(&mut app, KeyCode::Enter);
+        assert_eq!(app.create_step, CreateStep::RemotePort);
+        type_text(&mut app, "0");
+        press(&mut app, KeyCode::Enter);
+        assert!(app.create_error.is_some());
+        assert!(app.tunnels.is_empty());
+        press(&mut app, KeyCode::Backspace);
+        type_text(&mut app, "022");
+        press(&mut app, KeyCode::Enter);
+        assert_eq!(app.tunnels[0].remote_port, "22");
+    }
 
-            let action: Option<Action> = tokio::select! {
-                maybe_ev = events.next() => {
-                    match maybe_ev {
-                        Some(Ok(Event::Key(key))) if key.kind == KeyEventKind::Press => self.handle_key(key),
-                        _ => None,
-                    }
-                }
-                Some(bg) = rx.recv() => { self.apply_bg(bg); None }
-                _ = tick.tick() => Some(Action::Tick),
-            };
+    #[test]
+    fn shift_tab_and_left_go_back_a_step_keeping_input() {
+        let mut app = app_with_presets();
+        press(&mut app, KeyCode::Down);
+        press(&mut app, KeyCode::Down);
+        press(&mut app, KeyCode::Enter);
+        assert_eq!(app.create_step, CreateStep::LocalPort);
+        type_text(&mut app, "2022");
+        press(&mut app, KeyCode::Enter);
+        assert_eq!(app.create_step, CreateStep::RemotePort);
 
-            if let Some(Action::Quit) = action {
-                self.should_quit = true;
-            }
-            if let Some(Action::Tick) = action {
-                if let Overlay::Logs(id) = self.overlay {
-                    self.shown_logs = self.tunnel_mgr.logs(id);
-                }
-            }
-            if let Some(at) = notif_clear_at {
-                if Instant::now() >= at {
-                    self.notification = None;
-                    shown_notif = None;
-                    notif_clear_at = None;
-                }
-            }
+        press(&mut app, KeyCode::BackTab);
+        assert_eq!(app.create_step, CreateStep::LocalPort);
+        assert_eq!(app.create_local, "2022");
+        press(&mut app, KeyCode::Left);
+        assert_eq!(app.create_step, CreateStep::Preset);
+        assert_eq!(app.selected_preset, 2);
+        press(&mut app, KeyCode::Left);
+        assert_eq!(app.create_step, CreateStep::Machine);
+        // The first step has nowhere to go back to.
+        press(&mut app, KeyCode::Left);
+        assert_eq!(app.create_step, CreateStep::Machine);
+        assert_eq!(app.dialogs.top(), Overlay::Create);
+    }
 
-            terminal.draw(|f| view::draw(f, self))?;
+    #[test]
+    fn ports_against_the_policy_are_refused() {
+        let mut app = app_with_two_tunnels();
+        app.policy = Policy {
+            local_ports: Some("15000-15999".into()),
+            allow_remote_bind: false,
+        };
+        app.machines = vec![Machine::test("vm")];
+        press(&mut app, KeyCode::Char('c'));
+        press(&mut app, KeyCode::Enter);
+        type_text(&mut app, "2022");
+        press(&mut app, KeyCode::Enter);
+        assert_eq!(app.create_step, CreateStep::LocalPort);
+        assert_eq!(
+            app.create_error.as_deref(),
+            Some("local port 2022 is not allowed by policy (use 15000-15999)")
+        );
+        app.create_local = "15432:5432,2022:22".into();
+        press(&mut app, KeyCode::Enter);
+        assert!(app.create_error.is_some());
+        assert_eq!(app.tunnels.len(), 2);
+        app.create_local = "15432".into();
+        press(&mut app, KeyCode::Enter);
+        assert_eq!(app.create_step, CreateStep::RemotePort);
 
-            if self.should_quit {
-                self.tunnel_mgr.stop_all();
-                break;
-            }
-        }
-        Ok(())
+        // Tunnels saved before the policy came in don't start either.
+        app.spawn_tunnel(0);
+        assert!(matches!(&app.tunnels[0].status, TunnelStatus::Error(e) if e.contains("policy")));
     }
-}
 
-#[cfg(test)]
-mod tests {
-    use super::*;
-    use crate::model::*;
+    #[test]
+    fn privileged_local_ports_are_warned_about() {
+        let (tx, _rx) = tokio::sync::mpsc::unbounded_channel();
+        let mut app = App::new_for_test(tx);
+        app.privileged_below = Some(1024);
+        app.create_local = "2022:22,80:80,443:443".into();
+        assert_eq!(
+            app.create_port_warning().as_deref(),
+            Some("Local ports 80, 443 are below 1024: binding them needs root")
+        );
+        app.create_local = "8080".into();
+        assert_eq!(app.create_port_warning(), None);
+        app.create_local = "80".into();
+        assert!(app.create_port_warning().is_some());
+        app.privileged_below = None;
+        assert_eq!(app.create_port_warning(), None);
+    }
 
-    fn mk_machine(name: &str) -> Machine {
-        Machine {
-            name: name.into(),
-            resource_group: "rg".into(),
-            target_resource_id: "rid".into(),
-            bastion_name: "b".into(),
-            bastion_resource_group: "brg".into(),
-            bastion_subscription: String::new(),
-            ssh_config_path: None,
-        }
+    fn app_with_group() -> App {
+        let mut app = app_with_two_tunnels();
+        app.add_tunnel_for_test(Machine::test("a"), "1002", "80");
+        app.tunnels[0].group = Some(7);
+        app.tunnels[2].group = Some(7);
+        app
     }
 
-    fn app_with_two_tunnels() -> App {
+    #[test]
+    fn toggling_a_grouped_row_acts_on_the_whole_group() {
+        let mut app = app_with_group();
+        app.toggle_selected();
+        assert_ne!(app.tunnels[0].status, TunnelStatus::Inactive);
+        assert_ne!(app.tunnels[2].status, TunnelStatus::Inactive);
+        assert_eq!(app.tunnels[1].status, TunnelStatus::Inactive);
+
+        app.tunnels[0].status = TunnelStatus::Active;
+        app.tunnels[2].status = TunnelStatus::Active;
+        app.toggle_selected();
+        assert_eq!(app.tunnels[0].status, TunnelStatus::Inactive);
+        assert_eq!(app.tunnels[2].status, TunnelStatus::Inactive);
+    }
+
+    #[test]
+    fn deleting_a_grouped_row_removes_the_group() {
+        let mut app = app_with_group();
+        app.remove_tunnel(2);
+        assert_eq!(app.tunnels.len(), 1);
+        assert_eq!(app.tunnels[0].machine.name, "b");
+    }
+
+    #[test]
+    fn whats_new_only_opens_when_notes_exist_and_closes_on_enter() {
+        let mut app = app_with_two_tunnels();
+        app.version = "0.0.0-no-such-release".into();
+        app.show_whats_new();
+        assert_eq!(app.dialogs.top(), Overlay::None);
+
+        app.dialogs.open(Overlay::WhatsNew);
+        press(&mut app, KeyCode::Enter);
+        assert_eq!(app.dialogs.top(), Overlay::None);
+    }
+
+    fn app_with_presets() -> App {
         let (tx, _rx) = tokio::sync::mpsc::unbounded_channel();
         let mut app = App::new_for_test(tx);
-        app.add_tunnel_for_test(mk_machine("a"), "1000", "22");
-        app.add_tunnel_for_test(mk_machine("b"), "1001", "22");
+        let mut vm = Machine::test("vm");
+        vm.presets = vec![
+            Preset {
+                name: "ssh".into(),
+                ports: vec![(2022, 22)],
+            },
+            Preset {
+                name: "web".into(),
+                ports: vec![(8080, 80), (8443, 443)],
+            },
+        ];
+        app.machines = vec![vm];
+        press(&mut app, KeyCode::Char('c'));
+        press(&mut app, KeyCode::Enter);
         app
     }
 
     #[test]
-    fn cursor_resolves_to_stable_id_after_delete() {
-        let mut app = app_with_two_tunnels();
-        let first_id = app.tunnels[0].id;
+    fn picking_a_preset_creates_its_tunnels() {
+        let mut app = app_with_presets();
+        assert_eq!(app.create_step, CreateStep::Preset);
+        press(&mut app, KeyCode::Down);
+        press(&mut app, KeyCode::Enter);
+        assert_eq!(app.dialogs.top(), Overlay::None);
+        let ports: Vec<_> = app
+            .tunnels
+            .iter()
+            .map(|t| (t.local_port.as_str(), t.remote_port.as_str()))
+            .collect();
+        assert_eq!(ports, vec![("8080", "80"), ("8443", "443")]);
+    }
+
+    #[test]
+    fn presets_against_the_policy_are_refused() {
+        let mut app = app_with_presets();
+        app.policy = Policy {
+            local_ports: Some("8000-8999".into()),
+            allow_remote_bind: false,
+        };
+        press(&mut app, KeyCode::Enter);
+        assert_eq!(app.create_step, CreateStep::Preset);
+        assert!(app.create_error.as_deref().unwrap().contains("2022"));
+        assert!(app.tunnels.is_empty());
+
+        press(&mut app, KeyCode::Down);
+        assert_eq!(app.create_error, None);
+        press(&mut app, KeyCode::Enter);
+        assert_eq!(app.tunnels.len(), 2);
+    }
+
+    #[test]
+    fn recent_connections_are_recreated_with_one_key() {
+        let mut app = app_with_presets();
+        press(&mut app, KeyCode::Down);
+        press(&mut app, KeyCode::Enter);
+        app.recent.record("gone", "1:1", None, Utc::now());
         app.remove_tunnel(0);
-        assert_eq!(app.tunnels.len(), 1);
-        assert_ne!(app.tunnels[0].id, first_id);
-        assert_eq!(app.id_at_cursor(), Some(app.tunnels[0].id));
+        assert!(app.tunnels.is_empty());
+
+        press(&mut app, KeyCode::Char('c'));
+        let choices: Vec<&str> = app
+            .recent_choices()
+            .iter()
+            .map(|(_, r)| r.ports.as_str())
+            .collect();
+        assert_eq!(
+            choices,
+            ["8080:80,8443:443"],
+            "unknown machines are left out"
+        );
+        press(&mut app, KeyCode::Char('2'));
+        assert_eq!(app.dialogs.top(), Overlay::Create);
+        press(&mut app, KeyCode::Char('1'));
+        assert_eq!(app.dialogs.top(), Overlay::None);
+        assert_eq!(app.tunnels.len(), 2);
+        assert_eq!(app.tunnels[1].local_port, "8443");
+        assert_eq!(app.tunnels[0].group, app.tunnels[1].group);
     }
 
-    fn press(app: &mut App, code: KeyCode) {
-        app.handle_key(KeyEvent::new(code, KeyModifiers::NONE));
+    #[test]
+    fn custom_entry_falls_through_to_manual_ports() {
+        let mut app = app_with_presets();
+        for _ in 0..5 {
+            press(&mut app, KeyCode::Down);
+        }
+        assert_eq!(app.selected_preset, 2);
+        press(&mut app, KeyCode::Enter);
+        assert_eq!(app.create_step, CreateStep::LocalPort);
+        assert!(app.tunnels.is_empty());
     }
 
     #[test]
-    fn question_mark_opens_help_and_closes() {
-        let mut app = app_with_two_tunnels();
-        press(&mut app, KeyCode::Char('?'));
-        assert_eq!(app.overlay, Overlay::Help);
-        press(&mut app, KeyCode::Esc);
-        assert_eq!(app.overlay, Overlay::None);
+    fn dialog_stack_reveals_previous_dialog_on_close() {
+        let mut dialogs = Dialogs::default();
+        dialogs.open(Overlay::Create);
+        dialogs.open(Overlay::Help);
+        assert_eq!(dialogs.top(), Overlay::Help);
+        dialogs.close();
+        assert_eq!(dialogs.top(), Overlay::Create);
+        dialogs.close();
+        assert_eq!(dialogs.top(), Overlay::None);
+        assert!(!dialogs.is_open());
     }
 
     #[test]
-    fn n_cancels_confirm_quit() {
-        let mut app = app_with_two_tunnels();
-        app.overlay = Overlay::ConfirmQuit;
-        press(&mut app, KeyCode::Char('n'));
-        assert_eq!(app.overlay, Overlay::None);
+    fn queued_dialog_waits_behind_the_open_one() {
+        let mut dialogs = Dialogs::default();
+        dialogs.open(Overlay::Create);
+        dialogs.queue(Overlay::WhatsNew);
+        dialogs.queue(Overlay::WhatsNew);
+        assert_eq!(dialogs.top(), Overlay::Create);
+        dialogs.close();
+        assert_eq!(dialogs.top(), Overlay::WhatsNew);
+        dialogs.close();
+        assert!(!dialogs.is_open());
     }
 
     #[test]
-    fn slash_enters_filter_mode_and_typing_filters() {
-        let mut app = app_with_two_tunnels();
-        press(&mut app, KeyCode::Char('/'));
-        assert!(app.filtering);
-        press(&mut app, KeyCode::Char('b'));
-        assert_eq!(app.filter.as_deref(), Some("b"));
-        assert_eq!(app.visible_indices(), vec![1]);
+    fn reopening_a_dialog_moves_it_to_the_top() {
+        let mut dialogs = Dialogs::default();
+        dialogs.open(Overlay::Help);
+        dialogs.open(Overlay::ConfirmQuit);
+        dialogs.open(Overlay::Help);
+        assert_eq!(
+            dialogs.iter().collect::<Vec<_>>(),
+            vec![Overlay::ConfirmQuit, Overlay::Help]
+        );
     }
 
     #[test]
-    fn enter_commits_filter_and_exits_input() {
-        let mut app = app_with_two_tunnels();
-        press(&mut app, KeyCode::Char('/'));
+    fn ephemeral_session_never_writes_state() {
+        let (tx, _rx) = tokio::sync::mpsc::unbounded_channel();
+        let mut app = App::new_for_test(tx);
+        let path = std::env::temp_dir().join("az-burrow-test-ephemeral.yaml");
+        let _ = std::fs::remove_file(&path);
+        app.state_path = path.clone();
+        app.ephemeral = true;
+        app.machines = vec![Machine::test("vm1")];
+        app.finish_create(vec![("1234".into(), "22".into())]);
+        assert!(!path.exists());
+    }
+
+    fn scale_set(name: &str, instance_id: Option<&str>) -> Machine {
+        let mut m = Machine::test(name);
+        m.target_type = TargetType::Vmss;
+        m.target_resource_id = format!("/subs/x/virtualMachineScaleSets/{name}");
+        m.instance_id = instance_id.map(String::from);
+        m
+    }
+
+    #[tokio::test]
+    async fn scale_set_picker_sets_instance_on_created_tunnel() {
+        let (tx, _rx) = tokio::sync::mpsc::unbounded_channel();
+        let mut app = App::new_for_test(tx);
+        app.machines = vec![scale_set("workers", None)];
+        press(&mut app, KeyCode::Char('c'));
+        press(&mut app, KeyCode::Enter);
+        assert_eq!(app.create_step, CreateStep::Instance);
+        // Enter does nothing until the instances arrive.
+        press(&mut app, KeyCode::Enter);
+        assert_eq!(app.create_step, CreateStep::Instance);
+
+        app.apply_bg(BgEvent::ScaleSetInstances {
+            machine: "workers".into(),
+            result: Ok(vec!["0".into(), "3".into()]),
+        });
+        press(&mut app, KeyCode::Down);
+        press(&mut app, KeyCode::Enter);
+        assert_eq!(app.create_step, CreateStep::LocalPort);
+        type_text(&mut app, "2022:22");
+        press(&mut app, KeyCode::Enter);
+
+        let t = &app.tunnels[0];
+        assert_eq!(t.instance.as_deref(), Some("3"));
+        assert_eq!(
+            t.target_resource_id(),
+            "/subs/x/virtualMachineScaleSets/workers/virtualMachines/3"
+        );
+    }
+
+    #[test]
+    fn pinned_scale_set_instance_skips_the_picker() {
+        let (tx, _rx) = tokio::sync::mpsc::unbounded_channel();
+        let mut app = App::new_for_test(tx);
+        app.machines = vec![scale_set("workers", Some("1"))];
+        press(&mut app, KeyCode::Char('c'));
+        press(&mut app, KeyCode::Enter);
+        assert_eq!(app.create_step, CreateStep::LocalPort);
+        type_text(&mut app, "2022:22");
+        press(&mut app, KeyCode::Enter);
+        assert_eq!(app.tunnels[0].instance.as_deref(), Some("1"));
+    }
+
+    #[test]
+    fn refreshed_shared_config_replaces_machines_and_updates_tunnels() {
+        let (tx, _rx) = tokio::sync::mpsc::unbounded_channel();
+        let mut app = App::new_for_test(tx);
+        app.machines = vec![Machine::test("a"), Machine::test("gone")];
+        app.add_tunnel_for_test(Machine::test("a"), "2022", "22");
+        app.add_tunnel_for_test(Machine::test("gone"), "2023", "22");
+
+        let mut moved = Machine::test("a");
+        moved.bastion_name = "new-bastion".into();
+        app.apply_bg(BgEvent::SharedConfig {
+            result: Ok(vec![moved, Machine::test("b")]),
+        });
+        let names: Vec<&str> = app.machines.iter().map(|m| m.name.as_str()).collect();
+        assert_eq!(names, ["a", "b"]);
+        assert_eq!(app.tunnels[0].machine.bastion_name, "new-bastion");
+        // A tunnel whose machine left the shared config is kept as it was.
+        assert_eq!(app.tunnels[1].machine.name, "gone");
+
+        app.apply_bg(BgEvent::SharedConfig {
+            result: Err("forbidden".into()),
+        });
+        assert_eq!(app.machines.len(), 2);
+        assert!(app.notification.as_deref().unwrap().contains("forbidden"));
+
+        // A question about machines[1] must not outlive the list it was about.
+        app.dialogs.open(Overlay::Machines);
+        app.dialogs.open(Overlay::ConfirmRemoveMachine(1));
+        app.apply_bg(BgEvent::ConfigReloaded {
+            result: Ok(vec![Machine::test("c"), Machine::test("b")]),
+        });
+        assert_eq!(app.dialogs.top(), Overlay::Machines);
+        press(&mut app, KeyCode::Char('y'));
+        assert_eq!(app.machines.len(), 2);
+    }
+
+    #[tokio::test]
+    async fn machine_editor_writes_the_config_and_reloads_it() {
+        let dir = std::env::temp_dir().join("az-burrow-test-machine-editor");
+        let _ = std::fs::remove_dir_all(&dir);
+        std::fs::create_dir_all(&dir).unwrap();
+        let path = dir.join("burrow.config.yaml");
+        std::fs::write(
+            &path,
+            "machines:\n  # kept\n  - name: a\n    resource_group: rg\n    target_resource_id: /subscriptions/s/virtualMachines/a\n    bastion_name: bh\n    bastion_resource_group: rg-hub\n",
+        )
+        .unwrap();
+        let (tx, mut rx) = tokio::sync::mpsc::unbounded_channel();
+        let mut app = App::new_for_test(tx.clone());
+        app.shared_config = Some(SharedConfig::new(path.clone(), false, tx));
+        app.machines = vec![Machine::test("a")];
+        app.add_tunnel_for_test(Machine::test("a"), "2022", "22");
+        app.dialogs.open(Overlay::Machines);
+
+        // Add: name and resource group are required.
         press(&mut app, KeyCode::Char('a'));
+        assert_eq!(app.dialogs.top(), Overlay::EditMachine);
+        type_text(&mut app, "b");
         press(&mut app, KeyCode::Enter);
-        assert!(!app.filtering);
-        assert_eq!(app.filter.as_deref(), Some("a"));
+        assert!(app
+            .notification
+            .as_deref()
+            .unwrap()
+            .contains("resource_group"));
+        press(&mut app, KeyCode::Tab);
+        type_text(&mut app, "rg-b");
+        press(&mut app, KeyCode::Tab);
+        type_text(&mut app, "/subscriptions/s/virtualMachines/b");
+        press(&mut app, KeyCode::Enter);
+        // Validated like a config read at startup.
+        assert!(app
+            .notification
+            .as_deref()
+            .unwrap()
+            .contains("bastion_name"));
+        press(&mut app, KeyCode::Tab);
+        type_text(&mut app, "bh");
+        press(&mut app, KeyCode::Tab);
+        type_text(&mut app, "rg-hub");
+        press(&mut app, KeyCode::Enter);
+        assert_eq!(app.dialogs.top(), Overlay::Machines);
+        let Some(BgEvent::ConfigReloaded { result }) = rx.recv().await else {
+            panic!("expected a reload");
+        };
+        app.apply_bg(BgEvent::ConfigReloaded { result });
+        let names: Vec<&str> = app.machines.iter().map(|m| m.name.as_str()).collect();
+        assert_eq!(names, ["a", "b"]);
+
+        // Rename `a`; its tunnel follows.
+        app.machine_cursor = 0;
+        press(&mut app, KeyCode::Char('e'));
+        press(&mut app, KeyCode::Backspace);
+        type_text(&mut app, "web");
+        press(&mut app, KeyCode::Enter);
+        let Some(BgEvent::ConfigReloaded { result }) = rx.recv().await else {
+            panic!("expected a reload");
+        };
+        app.apply_bg(BgEvent::ConfigReloaded { result });
+        assert_eq!(app.machines[0].name, "web");
+        assert_eq!(app.tunnels[0].machine.name, "web");
+        let text = std::fs::read_to_string(&path).unwrap();
+        assert!(
+            text.starts_with("machines:\n  # kept\n  - name: web\n"),
+            "{text}"
+        );
+
+        // A machine with tunnels can't be removed; one without can.
+        press(&mut app, KeyCode::Char('d'));
+        assert_eq!(app.dialogs.top(), Overlay::Machines);
+        app.machine_cursor = 1;
+        press(&mut app, KeyCode::Char('d'));
+        press(&mut app, KeyCode::Char('y'));
+        let Some(BgEvent::ConfigReloaded { result }) = rx.recv().await else {
+            panic!("expected a reload");
+        };
+        app.apply_bg(BgEvent::ConfigReloaded { result });
+        assert_eq!(app.machines.len(), 1);
+        assert!(!std::fs::read_to_string(&path).unwrap().contains("rg-b"));
+        let _ = std::fs::remove_dir_all(&dir);
     }
 
     #[test]
-    fn esc_in_main_clears_active_filter() {
+    fn sessions_save_the_tunnels_and_restore_them() {
+        let path = std::env::temp_dir().join(format!(
+            "az-burrow-app-sessions-{}.yaml",
+            std::process::id()
+        ));
+        let _ = std::fs::remove_file(&path);
         let mut app = app_with_two_tunnels();
-        app.filter = Some("a".into());
+        app.ephemeral = true;
+        app.machines = vec![Machine::test("a"), Machine::test("b")];
+        app.sessions_path = Some(path.clone());
+        app.tunnels[1].status = TunnelStatus::Active;
+
+        press(&mut app, KeyCode::Char('S'));
+        assert_eq!(app.dialogs.top(), Overlay::Sessions);
+        press(&mut app, KeyCode::Char('s'));
+        type_text(&mut app, "dev");
+        press(&mut app, KeyCode::Enter);
+        assert_eq!(app.shown_sessions[0].name, "dev");
+        assert!(!app.shown_sessions[0].tunnels[0].start);
+        assert!(app.shown_sessions[0].tunnels[1].start);
         press(&mut app, KeyCode::Esc);
-        assert!(app.filter.is_none());
+        assert_eq!(app.dialogs.top(), Overlay::None);
+
+        app.tunnels.clear();
+        press(&mut app, KeyCode::Char('S'));
+        press(&mut app, KeyCode::Enter);
+        assert_eq!(app.dialogs.top(), Overlay::None);
+        assert_eq!(app.tunnels.len(), 2);
+        assert_eq!(app.tunnels[0].status, TunnelStatus::Inactive);
+        // Started (or failed to spawn: no `az` in unit tests).
+        assert_ne!(app.tunnels[1].status, TunnelStatus::Inactive);
+
+        // Restoring again finds every tunnel already there.
+        let saved = app.shown_sessions[0].clone();
+        app.restore_session(&saved);
+        assert_eq!(app.tunnels.len(), 2);
+        let _ = std::fs::remove_file(&path);
     }
 
-    #[test]
-    fn quit_is_immediate_when_nothing_running() {
-        let mut app = app_with_two_tunnels(); // both Inactive
-        let action = app.handle_key(KeyEvent::new(KeyCode::Char('q'), KeyModifiers::NONE));
-        assert!(matches!(action, Some(Action::Quit)));
-        assert_eq!(app.overlay, Overlay::None);
+    struct Shout;
+    impl crate::tui::ext::RowAction for Shout {
+        fn key(&self) -> char {
+            'x'
+        }
+        fn description(&self) -> &str {
+            "shout"
+        }
+        fn run(&mut self, tunnel: &Tunnel) -> Result<Option<String>, String> {
+            Ok(Some(format!("hello {}", tunnel.machine.name)))
+        }
     }
 
     #[test]
-    fn quit_confirms_when_a_tunnel_is_running() {
+    fn unbound_key_runs_registered_row_action() {
         let mut app = app_with_two_tunnels();
-        app.tunnels[0].status = TunnelStatus::Active;
-        let action = app.handle_key(KeyEvent::new(KeyCode::Char('q'), KeyModifiers::NONE));
-        assert!(action.is_none());
-        assert_eq!(app.overlay, Overlay::ConfirmQuit);
+        app.extensions.add_action(Shout);
+        app.cursor = 1;
+        press(&mut app, KeyCode::Char('x'));
+        assert_eq!(app.notification.as_deref(), Some("hello b"));
     }
 
     #[test]
@@ -787,11 +4756,9 @@ mod tests {
         let path = std::env::temp_dir().join("az-burrow-test-finish-create.yaml");
         let _ = std::fs::remove_file(&path);
         app.state_path = path.clone();
-        app.machines = vec![mk_machine("vm1")];
+        app.machines = vec![Machine::test("vm1")];
         app.selected_machine = 0;
-        app.create_local = "1234".into();
-        app.create_remote = "22".into();
-        app.finish_create();
+        app.finish_create(vec![("1234".into(), "22".into())]);
 
         let loaded = crate::state::load(&path);
         assert_eq!(loaded.tunnels.len(), 1);
@@ -801,6 +4768,20 @@ mod tests {
         let _ = std::fs::remove_file(&path);
     }
 
+    #[test]
+    fn late_status_lines_do_not_strand_a_stopping_tunnel() {
+        let mut app = app_with_two_tunnels();
+        let id = app.tunnels[0].id;
+        app.tunnels[0].status = TunnelStatus::Stopping;
+        app.apply_bg(crate::tui::action::BgEvent::TunnelStatus {
+            id,
+            status: TunnelStatus::Active,
+        });
+        assert_eq!(app.tunnels[0].status, TunnelStatus::Stopping);
+        app.apply_bg(crate::tui::action::BgEvent::TunnelStopped { id, forced: false });
+        assert_eq!(app.tunnels[0].status, TunnelStatus::Inactive);
+    }
+
     #[test]
     fn stale_bg_event_for_unknown_id_is_ignored() {
         let mut app = app_with_two_tunnels();
@@ -811,4 +4792,49 @@ mod tests {
         });
         assert!(app.tunnels.iter().all(|t| t.status != TunnelStatus::Active));
     }
+
+    #[test]
+    fn logs_view_saves_the_shown_lines_next_to_the_config() {
+        let mut app = app_with_two_tunnels();
+        let dir = std::env::temp_dir().join(format!("az-burrow-save-logs-{}", std::process::id()));
+        let _ = std::fs::remove_dir_all(&dir);
+        std::fs::create_dir_all(&dir).unwrap();
+        let (tx, _rx) = tokio::sync::mpsc::unbounded_channel();
+        app.shared_config = Some(SharedConfig::new(dir.join("burrow.config.yaml"), false, tx));
+        let id = app.tunnels[0].id;
+        app.dialogs.open(Overlay::Logs(id));
+
+        let line = |severity, text: &str| LogLine {
+            at: Local::now(),
+            severity,
+            text: text.into(),
+        };
+        app.shown_logs = vec![
+            line(Severity::Info, "[OUT] Opening tunnel"),
+            line(Severity::Error, "ERROR: boom"),
+        ];
+        press(&mut app, KeyCode::Char('f'));
+        press(&mut app, KeyCode::Char('f'));
+        assert_eq!(app.log_severity, Severity::Error);
+        app.shown_logs.truncate(1);
+        press(&mut app, KeyCode::Char('y'));
+        assert!(app.notification.as_deref().unwrap().contains("No logs"));
+
+        app.shown_logs.push(line(Severity::Error, "ERROR: boom"));
+        press(&mut app, KeyCode::Char('w'));
+        let saved: Vec<PathBuf> = std::fs::read_dir(&dir)
+            .unwrap()
+            .map(|e| e.unwrap().path())
+            .collect();
+        assert_eq!(saved.len(), 1, "{saved:?}");
+        let name = saved[0].file_name().unwrap().to_string_lossy().into_owned();
+        assert!(name.starts_with("a_1000-22-"), "{name}");
+        let text = std::fs::read_to_string(&saved[0]).unwrap();
+        assert!(text.starts_with("$ ") && text.contains("network bastion tunnel"));
+        assert!(!text.contains("Opening tunnel"), "{text}");
+        assert!(text.ends_with(" error ERROR: boom\n"), "{text}");
+        assert!(app.notification.as_deref().unwrap().contains("Saved"));
+        assert_eq!(app.dialogs.top(), Overlay::Logs(id));
+        let _ = std::fs::remove_dir_all(&dir);
+    }
 }
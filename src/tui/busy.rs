@@ -0,0 +1,89 @@
+//! Background az work the user started and is waiting on (`r`, `R`, the
+//! account lookup), shown with a spinner in the status bar until its result
+//! arrives, so a slow `az` call reads as progress rather than a hang. Its
+//! spinner also turns beside tunnels that are starting or stopping.
+
+use crate::tui::glyphs;
+
+const FRAMES: &[&str] = &["⠋", "⠙", "⠹", "⠸", "⠼", "⠴", "⠦", "⠧", "⠇", "⠏"];
+const ASCII_FRAMES: &[&str] = &["|", "/", "-", "\\"];
+
+#[derive(Debug, Default)]
+pub struct Busy {
+    /// (key, label), oldest first. The key lets the result event end the
+    /// task without repeating its label.
+    tasks: Vec<(String, String)>,
+    frame: usize,
+}
+
+impl Busy {
+    /// Show `label` until [`Busy::finish`] is called with `key`. Starting a
+    /// task that is already running only updates its label.
+    pub fn start(&mut self, key: impl Into<String>, label: impl Into<String>) {
+        let (key, label) = (key.into(), label.into());
+        match self.tasks.iter_mut().find(|(k, _)| *k == key) {
+            Some(task) => task.1 = label,
+            None => self.tasks.push((key, label)),
+        }
+    }
+
+    pub fn finish(&mut self, key: &str) {
+        self.tasks.retain(|(k, _)| k != key);
+    }
+
+    pub fn is_idle(&self) -> bool {
+        self.tasks.is_empty()
+    }
+
+    /// Advance the spinner one frame.
+    pub fn tick(&mut self) {
+        self.frame = self.frame.wrapping_add(1);
+    }
+
+    /// The current spinner frame, also used for tunnels starting and
+    /// stopping in the table.
+    pub fn spinner(&self) -> &'static str {
+        let frames = if glyphs::ascii() {
+            ASCII_FRAMES
+        } else {
+            FRAMES
+        };
+        frames[self.frame % frames.len()]
+    }
+
+    /// The status bar text: spinner, the oldest task, and how many more.
+    pub fn status(&self) -> Option<String> {
+        let (_, label) = self.tasks.first()?;
+        let spinner = self.spinner();
+        Some(match self.tasks.len() - 1 {
+            0 => format!("{spinner} {label}…"),
+            more => format!("{spinner} {label}… (+{more} more)"),
+        })
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn shows_the_oldest_task_until_finished() {
+        let mut busy = Busy::default();
+        assert!(busy.is_idle());
+        assert_eq!(busy.status(), None);
+
+        busy.start("cert:vm-web", "Regenerating certificate for vm-web");
+        busy.start("shared-config", "Refreshing shared config");
+        busy.start("cert:vm-web", "Regenerating certificate for vm-web");
+        assert_eq!(
+            busy.status().unwrap(),
+            "⠋ Regenerating certificate for vm-web… (+1 more)"
+        );
+
+        busy.tick();
+        busy.finish("cert:vm-web");
+        assert_eq!(busy.status().unwrap(), "⠙ Refreshing shared config…");
+        busy.finish("shared-config");
+        assert!(busy.is_idle());
+    }
+}
@@ -0,0 +1,52 @@
+//! Copying to the system clipboard with the OSC 52 escape sequence. The
+//! terminal does the copying, so it works over SSH and without a clipboard
+//! tool installed; terminals that don't support it ignore the sequence.
+
+use std::io::Write;
+
+/// Ask the terminal to put `text` on the clipboard.
+pub fn copy(text: &str) -> std::io::Result<()> {
+    let mut out = std::io::stdout();
+    write!(out, "{}", osc52(text))?;
+    out.flush()
+}
+
+fn osc52(text: &str) -> String {
+    format!("\x1b]52;c;{}\x07", base64(text.as_bytes()))
+}
+
+fn base64(bytes: &[u8]) -> String {
+    const ALPHABET: &[u8; 64] = b"ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/";
+    let mut out = String::with_capacity(bytes.len().div_ceil(3) * 4);
+    for chunk in bytes.chunks(3) {
+        let n = chunk
+            .iter()
+            .enumerate()
+            .fold(0u32, |n, (i, &b)| n | (b as u32) << (16 - 8 * i));
+        for i in 0..4 {
+            if i <= chunk.len() {
+                out.push(ALPHABET[(n >> (18 - 6 * i) & 63) as usize] as char);
+            } else {
+                out.push('=');
+            }
+        }
+    }
+    out
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn encodes_base64_with_padding() {
+        assert_eq!(base64(b""), "");
+        assert_eq!(base64(b"f"), "Zg==");
+        assert_eq!(base64(b"fo"), "Zm8=");
+        assert_eq!(base64(b"foo"), "Zm9v");
+        assert_eq!(
+            osc52("host=127.0.0.1"),
+            "\x1b]52;c;aG9zdD0xMjcuMC4wLjE=\x07"
+        );
+    }
+}
@@ -0,0 +1,58 @@
+//! Extension points for embedders: extra table columns and row actions computed
+//! from their own data sources (e.g. a CMDB owner or change-freeze status),
+//! registered on [`crate::tui::app::App::extensions`] before `run`.
+//!
+//! The az-burrow binary registers none, so the registration API is unused here.
+
+use crate::model::Tunnel;
+
+/// An extra table column appended after the built-in ones.
+pub trait ColumnProvider: Send {
+    /// Column header text.
+    fn header(&self) -> &str;
+    /// Fixed column width in cells.
+    fn width(&self) -> u16 {
+        14
+    }
+    /// Cell text for one tunnel row. Called on every draw, so keep it cheap
+    /// (cache anything that needs I/O).
+    fn cell(&self, tunnel: &Tunnel) -> String;
+}
+
+/// A keybinding that acts on the selected tunnel.
+pub trait RowAction: Send {
+    /// Key that triggers the action. Keys already bound by az-burrow win.
+    fn key(&self) -> char;
+    /// Short description, shown in the notification line on failure.
+    fn description(&self) -> &str;
+    /// Run against the selected tunnel. `Ok(Some(text))` becomes a
+    /// notification; an error is shown prefixed with the description.
+    fn run(&mut self, tunnel: &Tunnel) -> Result<Option<String>, String>;
+}
+
+#[derive(Default)]
+pub struct Extensions {
+    columns: Vec<Box<dyn ColumnProvider>>,
+    actions: Vec<Box<dyn RowAction>>,
+}
+
+impl Extensions {
+    #[allow(dead_code)]
+    pub fn add_column(&mut self, column: impl ColumnProvider + 'static) {
+        self.columns.push(Box::new(column));
+    }
+
+    #[allow(dead_code)]
+    pub fn add_action(&mut self, action: impl RowAction + 'static) {
+        self.actions.push(Box::new(action));
+    }
+
+    pub fn columns(&self) -> &[Box<dyn ColumnProvider>] {
+        &self.columns
+    }
+
+    /// The registered action bound to `key`, if any.
+    pub fn action_mut(&mut self, key: char) -> Option<&mut Box<dyn RowAction>> {
+        self.actions.iter_mut().find(|a| a.key() == key)
+    }
+}
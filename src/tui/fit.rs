@@ -0,0 +1,57 @@
+//! Fitting text into a known number of terminal cells.
+
+use unicode_width::{UnicodeWidthChar, UnicodeWidthStr};
+
+/// Shorten `s` to at most `width` cells, ending in `…` (`~` in ASCII mode)
+/// when cut. Measures display width, so wide characters (emoji, CJK) count as
+/// two.
+pub fn truncate(s: &str, width: usize) -> String {
+    if s.width() <= width {
+        return s.to_string();
+    }
+    if width == 0 {
+        return String::new();
+    }
+    let mut out = String::new();
+    let mut used = 0;
+    for c in s.chars() {
+        let w = c.width().unwrap_or(0);
+        // Leave one cell for the ellipsis.
+        if used + w > width - 1 {
+            break;
+        }
+        out.push(c);
+        used += w;
+    }
+    out.push(if crate::tui::glyphs::ascii() {
+        '~'
+    } else {
+        '…'
+    });
+    out
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn short_text_is_untouched() {
+        assert_eq!(truncate("vm-web", 10), "vm-web");
+        assert_eq!(truncate("vm-web", 6), "vm-web");
+    }
+
+    #[test]
+    fn long_text_gets_an_ellipsis_within_width() {
+        assert_eq!(truncate("vm-uk-experiment-01", 8), "vm-uk-e…");
+        assert_eq!(truncate("abc", 1), "…");
+        assert_eq!(truncate("abc", 0), "");
+    }
+
+    #[test]
+    fn wide_characters_count_double() {
+        // "🟢 valid" is 8 cells wide; the emoji never gets split.
+        assert_eq!(truncate("🟢 valid", 4), "🟢 …");
+        assert_eq!(truncate("🟢 valid", 2), "…");
+    }
+}
@@ -0,0 +1,132 @@
+//! ASCII-only rendering (`ascii: true`, `--ascii` or `BURROW_ASCII=1`), for
+//! terminals and fonts where emoji break table alignment, and for screen
+//! readers. Text is passed through [`text`] or [`line`] as it is drawn; in
+//! ASCII mode status markers are spelled out, arrows and bullets become
+//! ASCII, and anything else without a stable one-cell width is dropped.
+
+use ratatui::text::Line;
+use std::borrow::Cow;
+use std::sync::atomic::{AtomicBool, Ordering};
+use unicode_width::UnicodeWidthChar;
+
+static ASCII: AtomicBool = AtomicBool::new(false);
+
+/// Switch ASCII-only rendering on or off for the whole TUI.
+pub fn set_ascii(on: bool) {
+    ASCII.store(on, Ordering::Relaxed);
+}
+
+pub fn ascii() -> bool {
+    ASCII.load(Ordering::Relaxed)
+}
+
+/// Replacements in ASCII mode. An empty replacement drops the glyph along
+/// with the space that separated it from the text.
+const GLYPHS: &[(char, &str)] = &[
+    ('🟢', "[ok]"),
+    ('✅', "[ok]"),
+    ('🟡', "[warn]"),
+    ('⚠', "[warn]"),
+    ('❌', "[error]"),
+    ('🔄', "[..]"),
+    ('⏸', "[paused]"),
+    ('▶', ">"),
+    ('→', "->"),
+    ('↑', "Up"),
+    ('↓', "Down"),
+    ('↵', "Enter"),
+    ('␣', "Space"),
+    ('•', "|"),
+    ('·', "-"),
+    ('—', "-"),
+    ('…', "..."),
+    ('└', "`-"),
+    ('│', "|"),
+    ('█', "_"),
+    ('■', ""),
+    ('●', "*"),
+    ('◐', "~"),
+    ('○', "-"),
+    ('×', "x"),
+];
+
+/// `s` as it should be drawn.
+pub fn text(s: &str) -> Cow<'_, str> {
+    if ascii() {
+        Cow::Owned(to_ascii(s))
+    } else {
+        Cow::Borrowed(s)
+    }
+}
+
+/// `line` as it should be drawn, styles kept.
+pub fn line(mut line: Line<'_>) -> Line<'_> {
+    if ascii() {
+        for span in &mut line.spans {
+            span.content = Cow::Owned(to_ascii(&span.content));
+        }
+    }
+    line
+}
+
+/// [`line`] for every line of a paragraph.
+pub fn lines(lines: Vec<Line<'_>>) -> Vec<Line<'_>> {
+    lines.into_iter().map(line).collect()
+}
+
+fn to_ascii(s: &str) -> String {
+    let mut out = String::with_capacity(s.len());
+    let mut dropped = false;
+    for c in s.chars() {
+        if let Some((_, ascii)) = GLYPHS.iter().find(|(g, _)| *g == c) {
+            out.push_str(ascii);
+            dropped = ascii.is_empty();
+        } else if (c.width() == Some(1) && !pictograph(c)) || c.is_alphabetic() {
+            // Narrow characters, and wide letters (CJK names), are kept.
+            if dropped && c == ' ' {
+                continue;
+            }
+            out.push(c);
+            dropped = false;
+        } else if c.width() != Some(0) {
+            // Emoji and symbols: no width terminals agree on.
+            dropped = true;
+        }
+        // Variation selectors and joiners go with the glyph before them.
+    }
+    out
+}
+
+/// Symbols that terminals may draw as (wide) emoji even where Unicode
+/// counts them as one cell, e.g. 🗑 and ☸.
+fn pictograph(c: char) -> bool {
+    matches!(c, '\u{2600}'..='\u{27BF}' | '\u{2B00}'..='\u{2BFF}' | '\u{1F000}'..='\u{1FAFF}')
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn markers_are_spelled_out_and_decoration_dropped() {
+        assert_eq!(to_ascii("🟢 valid"), "[ok] valid");
+        assert_eq!(to_ascii("⚠️ failed"), "[warn] failed");
+        assert_eq!(to_ascii("🗑️  Confirm Delete"), "Confirm Delete");
+        assert_eq!(to_ascii("🏷 🔥 prod tagged red"), "prod tagged red");
+        assert_eq!(
+            to_ascii("■ Stopping all tunnels…"),
+            "Stopping all tunnels..."
+        );
+        assert_eq!(
+            to_ascii("↵ start/stop • ␣ logs"),
+            "Enter start/stop | Space logs"
+        );
+        assert_eq!(to_ascii("2022→22"), "2022->22");
+    }
+
+    #[test]
+    fn ordinary_text_is_kept() {
+        assert_eq!(to_ascii("vm-web #3 (Port 2022)"), "vm-web #3 (Port 2022)");
+        assert_eq!(to_ascii("café-東京"), "café-東京");
+    }
+}
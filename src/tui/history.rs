@@ -0,0 +1,91 @@
+//! Recent notifications, kept after they leave the status bar so an error
+//! shown for three seconds can still be read (`n`).
+
+use chrono::{DateTime, Local};
+use std::collections::VecDeque;
+
+/// Notifications kept; older ones are dropped.
+const CAPACITY: usize = 100;
+
+/// How bad a notification or a tunnel's log line is, least first.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, PartialOrd, Ord)]
+pub enum Severity {
+    Info,
+    Warning,
+    Error,
+}
+
+impl Severity {
+    /// Notifications carry their severity as a leading ❌ or ⚠️.
+    fn of(text: &str) -> Self {
+        if text.starts_with('❌') {
+            Severity::Error
+        } else if text.starts_with('⚠') {
+            Severity::Warning
+        } else {
+            Severity::Info
+        }
+    }
+
+    pub fn label(self) -> &'static str {
+        match self {
+            Severity::Info => "info",
+            Severity::Warning => "warn",
+            Severity::Error => "error",
+        }
+    }
+}
+
+#[derive(Debug, Clone)]
+pub struct Notice {
+    pub at: DateTime<Local>,
+    pub severity: Severity,
+    pub text: String,
+}
+
+#[derive(Debug, Default)]
+pub struct History(VecDeque<Notice>);
+
+impl History {
+    pub fn push(&mut self, text: &str) {
+        if self.0.len() == CAPACITY {
+            self.0.pop_front();
+        }
+        self.0.push_back(Notice {
+            at: Local::now(),
+            severity: Severity::of(text),
+            text: text.to_string(),
+        });
+    }
+
+    /// Newest first.
+    pub fn newest(&self) -> impl Iterator<Item = &Notice> {
+        self.0.iter().rev()
+    }
+
+    pub fn is_empty(&self) -> bool {
+        self.0.is_empty()
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn keeps_the_newest_with_their_severity() {
+        let mut history = History::default();
+        for i in 0..CAPACITY + 5 {
+            history.push(&format!("📋 Copied {i}"));
+        }
+        history.push("❌ SFTP: vm-web is not active");
+        history.push("⚠️ Webhook failed: 404");
+
+        let newest: Vec<&Notice> = history.newest().collect();
+        assert_eq!(newest.len(), CAPACITY);
+        assert_eq!(newest[0].severity, Severity::Warning);
+        assert_eq!(newest[1].severity, Severity::Error);
+        assert_eq!(newest[2].severity, Severity::Info);
+        assert_eq!(newest[CAPACITY - 1].text, "📋 Copied 7");
+    }
+}
@@ -0,0 +1,79 @@
+//! The machine editor opened from the machines view (`a` to add, `e` to
+//! edit): one text field per key in [`config_edit::KEYS`], saved back to the
+//! config file by [`config_edit`].
+
+use crate::config_edit::{self, MachineFields};
+use crate::model::Machine;
+
+#[derive(Debug, Clone)]
+pub struct MachineForm {
+    /// Name of the machine being edited; `None` when adding one.
+    pub original: Option<String>,
+    /// Values the form opened with, so a save rewrites only what changed.
+    pub old: MachineFields,
+    pub fields: MachineFields,
+    /// Index of the field being typed into.
+    pub focus: usize,
+}
+
+impl MachineForm {
+    pub fn add() -> Self {
+        Self {
+            original: None,
+            old: Default::default(),
+            fields: Default::default(),
+            focus: 0,
+        }
+    }
+
+    pub fn edit(m: &Machine) -> Self {
+        let fields = [
+            m.name.clone(),
+            m.resource_group.clone(),
+            m.target_resource_id.clone(),
+            m.bastion_name.clone(),
+            m.bastion_resource_group.clone(),
+            m.ssh_config_path.clone().unwrap_or_default(),
+        ];
+        Self {
+            original: Some(m.name.clone()),
+            old: fields.clone(),
+            fields,
+            focus: 0,
+        }
+    }
+
+    pub fn title(&self) -> &'static str {
+        match self.original {
+            Some(_) => "✏️  Edit Machine",
+            None => "➕ Add Machine",
+        }
+    }
+
+    pub fn next(&mut self) {
+        self.focus = (self.focus + 1) % config_edit::KEYS.len();
+    }
+
+    pub fn prev(&mut self) {
+        self.focus = (self.focus + config_edit::KEYS.len() - 1) % config_edit::KEYS.len();
+    }
+
+    pub fn push(&mut self, c: char) {
+        self.fields[self.focus].push(c);
+    }
+
+    pub fn pop(&mut self) {
+        self.fields[self.focus].pop();
+    }
+
+    /// The fields, trimmed, once the required ones are filled in.
+    pub fn values(&self) -> Result<MachineFields, String> {
+        let fields = self.fields.clone().map(|f| f.trim().to_string());
+        for (key, value) in config_edit::KEYS.iter().zip(&fields).take(2) {
+            if value.is_empty() {
+                return Err(format!("{key} is required"));
+            }
+        }
+        Ok(fields)
+    }
+}
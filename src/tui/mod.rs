@@ -1,5 +1,12 @@
 pub mod action;
 pub mod app;
+pub mod busy;
+pub mod clipboard;
+pub mod ext;
+pub mod fit;
+pub mod glyphs;
+pub mod history;
+pub mod machine_form;
 pub mod overlays;
 pub mod theme;
 pub mod view;
@@ -1,13 +1,23 @@
+use crate::azure::tunnel::{self, StopProgress};
+use crate::azure::vm::{self, PowerAction};
+use crate::config_edit;
+use crate::model::CertStatus;
 use crate::tui::app::{App, CreateStep};
+use crate::tui::fit::truncate;
+use crate::tui::glyphs;
+use crate::tui::history::Severity;
 use crate::tui::theme;
+use chrono::Local;
 use ratatui::layout::{Alignment, Constraint, Flex, Layout, Rect};
 use ratatui::style::{Color, Modifier, Style};
 use ratatui::text::{Line, Span};
 use ratatui::widgets::{Block, Borders, Clear, Paragraph, Wrap};
 use ratatui::Frame;
 
-/// Center a fixed-size rect within `area`.
+/// Center a `w`×`h` rect within `area`, shrunk to fit small terminals (dialog
+/// text wraps or is cut to the space it gets).
 fn centered(area: Rect, w: u16, h: u16) -> Rect {
+    let (w, h) = (w.min(area.width), h.min(area.height));
     let [vert] = Layout::vertical([Constraint::Length(h)])
         .flex(Flex::Center)
         .areas(area);
@@ -22,28 +32,34 @@ fn dialog_block(title: &str, color: Color) -> Block<'static> {
         .borders(Borders::ALL)
         .border_style(Style::default().fg(color))
         .title(Span::styled(
-            title.to_string(),
+            glyphs::text(title).into_owned(),
             Style::default().fg(color).add_modifier(Modifier::BOLD),
         ))
 }
 
 pub fn draw_create(f: &mut Frame, area: Rect, app: &App) {
-    let rect = centered(area, 72, 16);
+    let recent = app.recent_choices();
+    let mut height = if app.wsl_hint.is_some() { 20 } else { 16 };
+    if app.create_step == CreateStep::Machine && !recent.is_empty() {
+        height += recent.len() as u16 + 2;
+    }
+    let rect = centered(area, 72, height);
     f.render_widget(Clear, rect);
-    let block = dialog_block("🚇 Create New SSH Tunnel", theme::PRIMARY);
+    let block = dialog_block("🚇 Create New SSH Tunnel", theme::primary());
     let inner = block.inner(rect);
     f.render_widget(block, rect);
 
-    let step_no = match app.create_step {
-        CreateStep::Machine => 1,
-        CreateStep::LocalPort => 2,
-        CreateStep::RemotePort => 3,
-    };
+    // Scale sets and machines with presets get extra picker steps.
+    let steps = app.create_steps();
+    let step_no = steps
+        .iter()
+        .position(|&s| s == app.create_step)
+        .map_or(1, |i| i + 1);
     let mut lines: Vec<Line> = vec![
         Line::from(Span::styled(
-            format!("Step {step_no} of 3"),
+            format!("Step {step_no} of {}", steps.len()),
             Style::default()
-                .fg(theme::PRIMARY)
+                .fg(theme::primary())
                 .add_modifier(Modifier::BOLD),
         )),
         Line::from(""),
@@ -54,7 +70,7 @@ pub fn draw_create(f: &mut Frame, area: Rect, app: &App) {
             lines.push(Line::from(Span::styled(
                 "Select Virtual Machine:",
                 Style::default()
-                    .fg(theme::SECONDARY)
+                    .fg(theme::secondary())
                     .add_modifier(Modifier::BOLD),
             )));
             lines.push(Line::from(""));
@@ -64,12 +80,139 @@ pub fn draw_create(f: &mut Frame, area: Rect, app: &App) {
                 } else {
                     "  "
                 };
-                lines.push(Line::from(format!("{prefix}{}", m.name)));
+                let problem = app.machine_problems.get(i).is_some_and(Option::is_some);
+                let badge = if problem { " ⚠" } else { "" };
+                let name = truncate(
+                    &m.name,
+                    (inner.width as usize).saturating_sub(2 + badge.len()),
+                );
+                let line = format!("{prefix}{name}{badge}");
+                lines.push(if problem {
+                    Line::from(Span::styled(line, theme::muted()))
+                } else {
+                    Line::from(line)
+                });
+            }
+            if let Some(problem) = app.selected_machine_problem() {
+                lines.push(Line::from(""));
+                lines.push(Line::from(Span::styled(
+                    format!("⚠ {problem}"),
+                    Style::default().fg(theme::danger()),
+                )));
+            }
+            if !recent.is_empty() {
+                lines.push(Line::from(""));
+                lines.push(Line::from(Span::styled(
+                    "Recent:",
+                    Style::default()
+                        .fg(theme::secondary())
+                        .add_modifier(Modifier::BOLD),
+                )));
+                for (n, (_, r)) in recent.iter().enumerate() {
+                    let instance = r
+                        .instance
+                        .as_ref()
+                        .map(|i| format!(" #{i}"))
+                        .unwrap_or_default();
+                    let when = r
+                        .last_used()
+                        .map(|t| t.with_timezone(&Local).format("%b %e %H:%M").to_string())
+                        .unwrap_or_default();
+                    let text = truncate(
+                        &format!("{}{instance}  {}", r.machine, r.ports),
+                        (inner.width as usize).saturating_sub(4 + when.len() + 2),
+                    );
+                    lines.push(Line::from(vec![
+                        Span::styled(format!("{}  ", n + 1), theme::accent()),
+                        Span::raw(text),
+                        Span::styled(format!("  {when}"), theme::muted()),
+                    ]));
+                }
+            }
+            lines.push(Line::from(""));
+            let hint = if recent.is_empty() {
+                "↑/↓: navigate • Enter: select • Esc: cancel"
+            } else {
+                "↑/↓: navigate • Enter: select • 1-9: create recent • Esc: cancel"
+            };
+            lines.push(Line::from(Span::styled(hint, theme::hint())));
+        }
+        CreateStep::Instance => {
+            lines.push(Line::from(format!(
+                "Scale set: {}",
+                app.machines[app.selected_machine].name
+            )));
+            lines.push(Line::from(""));
+            lines.push(Line::from(Span::styled(
+                "Select Instance:",
+                Style::default()
+                    .fg(theme::secondary())
+                    .add_modifier(Modifier::BOLD),
+            )));
+            lines.push(Line::from(""));
+            match &app.scale_set_instances {
+                None => lines.push(Line::from(Span::styled(
+                    "Loading instances…",
+                    theme::hint(),
+                ))),
+                Some(Err(e)) => lines.push(Line::from(Span::styled(
+                    format!("Could not list instances: {e}"),
+                    Style::default().fg(theme::danger()),
+                ))),
+                Some(Ok(list)) if list.is_empty() => {
+                    lines.push(Line::from("The scale set has no instances."))
+                }
+                Some(Ok(list)) => {
+                    for (i, id) in list.iter().enumerate() {
+                        let prefix = if i == app.selected_instance {
+                            "▶ "
+                        } else {
+                            "  "
+                        };
+                        lines.push(Line::from(format!("{prefix}#{id}")));
+                    }
+                }
+            }
+            lines.push(Line::from(""));
+            lines.push(Line::from(Span::styled(
+                "↑/↓: navigate • Enter: select • ←: back • Esc: cancel",
+                theme::hint(),
+            )));
+        }
+        CreateStep::Preset => {
+            let machine = &app.machines[app.selected_machine];
+            lines.push(Line::from(format!("Machine: {}", machine.name)));
+            lines.push(Line::from(""));
+            lines.push(Line::from(Span::styled(
+                "Select Preset:",
+                Style::default()
+                    .fg(theme::secondary())
+                    .add_modifier(Modifier::BOLD),
+            )));
+            lines.push(Line::from(""));
+            for (i, p) in machine.presets.iter().enumerate() {
+                let prefix = if i == app.selected_preset {
+                    "▶ "
+                } else {
+                    "  "
+                };
+                let ports: Vec<String> = p.ports.iter().map(|(l, r)| format!("{l}→{r}")).collect();
+                lines.push(Line::from(vec![
+                    Span::raw(format!("{prefix}{:<16}", p.name)),
+                    Span::styled(ports.join(", "), theme::hint()),
+                ]));
             }
+            let prefix = if app.selected_preset == machine.presets.len() {
+                "▶ "
+            } else {
+                "  "
+            };
+            lines.push(Line::from(format!("{prefix}Custom ports…")));
+            port_problem(&mut lines, app, None);
             lines.push(Line::from(""));
             lines.push(Line::from(Span::styled(
-                "↑/↓: navigate • Enter: select • Esc: cancel",
-                Style::default().fg(Color::DarkGray),
+                "↑/↓: navigate • Enter: select • ←: back • Esc: cancel",
+                theme::hint(),
             )));
         }
         CreateStep::LocalPort => {
@@ -81,15 +224,23 @@ pub fn draw_create(f: &mut Frame, area: Rect, app: &App) {
             lines.push(Line::from(Span::styled(
                 "Local Port:",
                 Style::default()
-                    .fg(theme::SECONDARY)
+                    .fg(theme::secondary())
                     .add_modifier(Modifier::BOLD),
             )));
             lines.push(Line::from(format!("{}█", app.create_local)));
+            port_problem(&mut lines, app, app.create_port_warning());
             lines.push(Line::from(""));
             lines.push(Line::from(Span::styled(
-                "The local port to bind (e.g., 2022, 8080)",
-                Style::default().fg(Color::DarkGray),
+                "The local port to bind (e.g., 2022, 8080) — or several pairs in one go, e.g. 2022:22,8080:80 • Shift+Tab/←: back",
+                theme::hint(),
             )));
+            if let Some(hint) = app.wsl_hint {
+                lines.push(Line::from(""));
+                lines.push(Line::from(Span::styled(
+                    hint,
+                    Style::default().fg(theme::secondary()),
+                )));
+            }
         }
         CreateStep::RemotePort => {
             lines.push(Line::from(format!(
@@ -100,86 +251,545 @@ pub fn draw_create(f: &mut Frame, area: Rect, app: &App) {
             lines.push(Line::from(Span::styled(
                 "Remote Port:",
                 Style::default()
-                    .fg(theme::SECONDARY)
+                    .fg(theme::secondary())
                     .add_modifier(Modifier::BOLD),
             )));
             lines.push(Line::from(format!("{}█", app.create_remote)));
+            port_problem(&mut lines, app, None);
             lines.push(Line::from(""));
             lines.push(Line::from(Span::styled(
-                "The remote port on the VM (e.g., 22, 80, 443) • Enter: create tunnel",
-                Style::default().fg(Color::DarkGray),
+                "The remote port on the VM (e.g., 22, 80, 443) • Enter: create tunnel • Shift+Tab/←: back",
+                theme::hint(),
             )));
         }
     }
-    f.render_widget(Paragraph::new(lines).wrap(Wrap { trim: false }), inner);
+    f.render_widget(
+        Paragraph::new(glyphs::lines(lines)).wrap(Wrap { trim: false }),
+        inner,
+    );
+}
+
+/// Under a port field: why Enter refused it, or else `warning`.
+fn port_problem(lines: &mut Vec<Line>, app: &App, warning: Option<String>) {
+    if let Some(error) = &app.create_error {
+        lines.push(Line::from(Span::styled(
+            format!("❌ {error}"),
+            Style::default().fg(theme::danger()),
+        )));
+    } else if let Some(warning) = warning {
+        lines.push(Line::from(Span::styled(
+            format!("⚠ {warning}"),
+            Style::default().fg(theme::secondary()),
+        )));
+    }
 }
 
 pub fn draw_confirm_delete(f: &mut Frame, area: Rect, app: &App, idx: usize) {
     let rect = centered(area, 60, 9);
     f.render_widget(Clear, rect);
-    let block = dialog_block("🗑️  Confirm Delete", theme::SECONDARY);
+    let block = dialog_block("🗑️  Confirm Delete", theme::secondary());
     let inner = block.inner(rect);
     f.render_widget(block, rect);
-    let info = app
-        .tunnels
-        .get(idx)
-        .map(|t| {
+    let members = app.group_members(idx);
+    let info = match members.as_slice() {
+        [] => String::new(),
+        [i] => {
+            let t = &app.tunnels[*i];
             format!(
                 "{} (Local:{} → Remote:{})",
                 t.machine.name, t.local_port, t.remote_port
             )
-        })
-        .unwrap_or_default();
+        }
+        _ => {
+            let ports: Vec<String> = members
+                .iter()
+                .map(|&i| {
+                    format!(
+                        "{}→{}",
+                        app.tunnels[i].local_port, app.tunnels[i].remote_port
+                    )
+                })
+                .collect();
+            format!("{} ({})", app.tunnels[idx].machine.name, ports.join(", "))
+        }
+    };
     let lines = vec![
         Line::from("Are you sure you want to delete this tunnel?"),
         Line::from(""),
         Line::from(Span::styled(
             info,
             Style::default()
-                .fg(theme::PRIMARY)
+                .fg(theme::primary())
                 .add_modifier(Modifier::BOLD),
         )),
         Line::from(""),
         Line::from(Span::styled(
             "Press 'y' to delete • 'q' or Esc to cancel",
-            Style::default().fg(Color::DarkGray),
+            theme::hint(),
         )),
     ];
     f.render_widget(
-        Paragraph::new(lines)
+        Paragraph::new(glyphs::lines(lines))
             .alignment(Alignment::Center)
             .wrap(Wrap { trim: false }),
         inner,
     );
 }
 
-pub fn draw_confirm_quit(f: &mut Frame, area: Rect) {
+pub fn draw_confirm_quit(f: &mut Frame, area: Rect, can_detach: bool) {
+    let hint = if can_detach {
+        "Press 'y' to quit • 'd' to detach • 'q' or Esc to cancel"
+    } else {
+        "Press 'y' to quit • 'q' or Esc to cancel"
+    };
     let rect = centered(area, 60, 9);
     f.render_widget(Clear, rect);
-    let block = dialog_block("⚠️  Confirm Quit", theme::DANGER);
+    let block = dialog_block("⚠️  Confirm Quit", theme::danger());
     let inner = block.inner(rect);
     f.render_widget(block, rect);
     let lines = vec![
         Line::from("All active SSH tunnels will be terminated."),
         Line::from("Are you sure you want to exit?"),
         Line::from(""),
+        Line::from(Span::styled(hint, theme::hint())),
+    ];
+    f.render_widget(
+        Paragraph::new(glyphs::lines(lines))
+            .alignment(Alignment::Center)
+            .wrap(Wrap { trim: false }),
+        inner,
+    );
+}
+
+/// The quit screen: progress, then the tunnels in `left` that outlived
+/// their kill.
+pub fn draw_stopping(f: &mut Frame, area: Rect, progress: StopProgress, left: &[String]) {
+    let rect = centered(area, 60, 7 + left.len() as u16);
+    f.render_widget(Clear, rect);
+    let block = dialog_block("👋 Quitting", theme::primary());
+    let inner = block.inner(rect);
+    f.render_widget(block, rect);
+    let StopProgress {
+        done,
+        total,
+        timed_out,
+    } = progress;
+    let mut lines = vec![Line::from(format!(
+        "Shutting down {total} tunnels… {done}/{total}"
+    ))];
+    if timed_out > 0 {
+        lines.push(Line::from(Span::styled(
+            format!("{timed_out} did not stop in time and were left behind"),
+            Style::default().fg(theme::danger()),
+        )));
+    }
+    lines.extend(left.iter().map(|l| Line::from(l.as_str())));
+    f.render_widget(
+        Paragraph::new(glyphs::lines(lines))
+            .alignment(Alignment::Center)
+            .wrap(Wrap { trim: false }),
+        inner,
+    );
+}
+
+/// Every machine and its certificate, including machines with no tunnel.
+pub fn draw_machines(f: &mut Frame, area: Rect, app: &App) {
+    let rect = centered(area, 72, 24);
+    f.render_widget(Clear, rect);
+    let block = dialog_block("🖥 Machines", theme::primary());
+    let inner = block.inner(rect);
+    f.render_widget(block, rect);
+
+    let name_width = app
+        .machines
+        .iter()
+        .map(|m| m.name.chars().count())
+        .max()
+        .unwrap_or(0)
+        .min(inner.width as usize / 2);
+    let powers = app
+        .machines
+        .iter()
+        .any(|m| app.power_states.contains_key(&m.name));
+    // Keep the selected machine in view above its details and the hints.
+    let body_rows = inner.height.saturating_sub(4) as usize;
+    let skip = (app.machine_cursor + 1).saturating_sub(body_rows);
+    let mut lines: Vec<Line> = app
+        .machines
+        .iter()
+        .enumerate()
+        .skip(skip)
+        .take(body_rows)
+        .map(|(i, m)| {
+            let prefix = if i == app.machine_cursor {
+                "▶ "
+            } else {
+                "  "
+            };
+            let name = format!("{prefix}{:<name_width$}  ", truncate(&m.name, name_width));
+            let (mut cert, style) = match (m.key_files(), app.machine_certs.get(&m.name)) {
+                (None, _) => ("no ssh_config_path".to_string(), theme::muted()),
+                (Some(_), None) => ("N/A".to_string(), theme::muted()),
+                (Some(_), Some(c)) => {
+                    let style = match c.status {
+                        CertStatus::Valid | CertStatus::Renewed => theme::text(),
+                        CertStatus::ExpiringSoon | CertStatus::Renewing => {
+                            Style::default().fg(theme::secondary())
+                        }
+                        CertStatus::Expired | CertStatus::RenewalFailed => {
+                            Style::default().fg(theme::danger())
+                        }
+                    };
+                    (format!("{} {}", c.status.label(), c.expires_in), style)
+                }
+            };
+            if m.key_files().is_some() && app.renewal_paused_for(&m.name) {
+                cert = format!("⏸ {cert}");
+            }
+            let tunnels = app
+                .tunnels
+                .iter()
+                .filter(|t| t.machine.name == m.name)
+                .count();
+            let tunnels = match tunnels {
+                0 => "  no tunnels".to_string(),
+                1 => "  1 tunnel".to_string(),
+                n => format!("  {n} tunnels"),
+            };
+            // Only VMs have one, and only once az has answered.
+            let power = match app.power_states.get(&m.name) {
+                Some(p) if p.is_down() => Span::styled(
+                    format!("{:<13}", p.label()),
+                    Style::default().fg(theme::danger()),
+                ),
+                Some(p) => Span::styled(format!("{:<13}", p.label()), theme::muted()),
+                None if powers => Span::raw(" ".repeat(13)),
+                None => Span::raw(""),
+            };
+            Line::from(vec![
+                Span::raw(name),
+                power,
+                Span::styled(cert, style),
+                Span::styled(tunnels, theme::muted()),
+            ])
+        })
+        .collect();
+    if app.machines.is_empty() {
+        lines.push(Line::from("No machines configured."));
+    }
+    lines.push(Line::from(""));
+    // The selected VM's details, with its resource group, tell apart VMs of
+    // the same name.
+    if let Some(m) = app.machines.get(app.machine_cursor) {
+        let details = match (vm::has_power_state(m), app.vm_info.get(&m.name)) {
+            (false, _) => format!("{}: resource group {}", m.name, m.resource_group),
+            (true, None) => format!("{} in {}: reading VM details…", m.name, m.resource_group),
+            (true, Some(Ok(info))) => {
+                format!("{} in {}: {}", m.name, m.resource_group, info.summary())
+            }
+            (true, Some(Err(e))) => {
+                format!("{} in {}: no VM details ({e})", m.name, m.resource_group)
+            }
+        };
+        lines.push(Line::from(Span::styled(
+            truncate(&details, inner.width as usize),
+            theme::muted(),
+        )));
+    }
+    lines.push(Line::from(Span::styled(
+        "↑/↓: navigate • r: regenerate cert • p: pause renewal • Esc: close",
+        theme::hint(),
+    )));
+    lines.push(Line::from(Span::styled(
+        "a: add machine • e: edit • d: remove • s: start VM • x: deallocate",
+        theme::hint(),
+    )));
+    f.render_widget(Paragraph::new(glyphs::lines(lines)), inner);
+}
+
+pub fn draw_machine_form(f: &mut Frame, area: Rect, app: &App) {
+    let Some(form) = &app.machine_form else {
+        return;
+    };
+    let rect = centered(area, 72, 12);
+    f.render_widget(Clear, rect);
+    let block = dialog_block(form.title(), theme::primary());
+    let inner = block.inner(rect);
+    f.render_widget(block, rect);
+
+    let label_width = config_edit::KEYS.iter().map(|k| k.len()).max().unwrap_or(0);
+    let mut lines: Vec<Line> = config_edit::KEYS
+        .iter()
+        .zip(&form.fields)
+        .enumerate()
+        .map(|(i, (key, value))| {
+            let focused = i == form.focus;
+            let prefix = if focused { "▶ " } else { "  " };
+            let value = if focused {
+                Span::styled(format!("{value}█"), theme::text())
+            } else {
+                Span::styled(value.clone(), theme::muted())
+            };
+            Line::from(vec![
+                Span::styled(format!("{prefix}{key:<label_width$}  "), theme::accent()),
+                value,
+            ])
+        })
+        .collect();
+    lines.push(Line::from(""));
+    lines.push(Line::from(Span::styled(
+        "name and resource_group are required; the rest may be left empty",
+        theme::muted(),
+    )));
+    lines.push(Line::from(""));
+    lines.push(Line::from(Span::styled(
+        "Tab/↑/↓: next field • Enter: save to config • Esc: cancel",
+        theme::hint(),
+    )));
+    f.render_widget(Paragraph::new(glyphs::lines(lines)), inner);
+}
+
+pub fn draw_confirm_remove_machine(f: &mut Frame, area: Rect, app: &App, idx: usize) {
+    let rect = centered(area, 60, 9);
+    f.render_widget(Clear, rect);
+    let block = dialog_block("🗑️  Remove Machine", theme::secondary());
+    let inner = block.inner(rect);
+    f.render_widget(block, rect);
+    let name = app
+        .machines
+        .get(idx)
+        .map(|m| m.name.clone())
+        .unwrap_or_default();
+    let lines = vec![
+        Line::from("Remove this machine from the config file?"),
+        Line::from(""),
+        Line::from(Span::styled(
+            name,
+            Style::default()
+                .fg(theme::primary())
+                .add_modifier(Modifier::BOLD),
+        )),
+        Line::from(""),
+        Line::from(Span::styled(
+            "Press 'y' to remove • 'q' or Esc to cancel",
+            theme::hint(),
+        )),
+    ];
+    f.render_widget(
+        Paragraph::new(glyphs::lines(lines))
+            .alignment(Alignment::Center)
+            .wrap(Wrap { trim: false }),
+        inner,
+    );
+}
+
+pub fn draw_confirm_power(f: &mut Frame, area: Rect, app: &App, idx: usize, action: PowerAction) {
+    let rect = centered(area, 60, 10);
+    f.render_widget(Clear, rect);
+    let (title, question, color) = match action {
+        PowerAction::Start => ("⏻ Start VM", "Start this VM?", theme::primary()),
+        PowerAction::Deallocate => (
+            "⏻ Deallocate VM",
+            "Deallocate this VM? It stops and its compute is released.",
+            theme::danger(),
+        ),
+    };
+    let block = dialog_block(title, color);
+    let inner = block.inner(rect);
+    f.render_widget(block, rect);
+    let name = app
+        .machines
+        .get(idx)
+        .map(|m| m.name.clone())
+        .unwrap_or_default();
+    let running = app
+        .tunnels
+        .iter()
+        .filter(|t| t.machine.name == name && t.status.is_running())
+        .count();
+    let mut lines = vec![
+        Line::from(question),
+        Line::from(""),
         Line::from(Span::styled(
-            "Press 'y' to quit • 'q' or Esc to cancel",
-            Style::default().fg(Color::DarkGray),
+            name,
+            Style::default()
+                .fg(theme::primary())
+                .add_modifier(Modifier::BOLD),
         )),
     ];
+    if action == PowerAction::Deallocate && running > 0 {
+        lines.push(Line::from(Span::styled(
+            format!("Its {running} running tunnel(s) will drop."),
+            Style::default().fg(theme::danger()),
+        )));
+    }
+    lines.push(Line::from(""));
+    lines.push(Line::from(Span::styled(
+        format!("Press 'y' to {} • 'q' or Esc to cancel", action.command()),
+        theme::hint(),
+    )));
+    f.render_widget(
+        Paragraph::new(glyphs::lines(lines))
+            .alignment(Alignment::Center)
+            .wrap(Wrap { trim: false }),
+        inner,
+    );
+}
+
+/// The device code of the `az login` under way, and what waits for it.
+pub fn draw_login(f: &mut Frame, area: Rect, app: &App) {
+    let rect = centered(area, 64, 11);
+    f.render_widget(Clear, rect);
+    let block = dialog_block("🔑 Sign in to az", theme::primary());
+    let inner = block.inner(rect);
+    f.render_widget(block, rect);
+
+    let code = app.device_login.as_ref().and_then(|l| l.code.as_ref());
+    let mut lines = match code {
+        None => vec![Line::from("Asking az for a sign-in code…"), Line::from("")],
+        Some(code) => vec![
+            Line::from(format!("Open {}", code.url)),
+            Line::from(vec![
+                Span::raw("and enter the code "),
+                Span::styled(
+                    code.code.clone(),
+                    Style::default()
+                        .fg(theme::primary())
+                        .add_modifier(Modifier::BOLD),
+                ),
+            ]),
+        ],
+    };
+    lines.push(Line::from(""));
+    let (tunnels, certs) = app.waiting_for_login();
+    if tunnels + certs > 0 {
+        lines.push(Line::from(Span::styled(
+            format!("{tunnels} tunnel(s) and {certs} certificate(s) will be tried again."),
+            theme::muted(),
+        )));
+        lines.push(Line::from(""));
+    }
+    lines.push(Line::from(Span::styled(
+        "Press 'c' to copy the code • Esc to cancel",
+        theme::hint(),
+    )));
     f.render_widget(
-        Paragraph::new(lines)
+        Paragraph::new(glyphs::lines(lines))
             .alignment(Alignment::Center)
             .wrap(Wrap { trim: false }),
         inner,
     );
 }
 
+/// Saved sessions, and the name being typed to save the current tunnels.
+pub fn draw_sessions(f: &mut Frame, area: Rect, app: &App) {
+    let rect = centered(area, 72, 20);
+    f.render_widget(Clear, rect);
+    let block = dialog_block("💾 Sessions", theme::primary());
+    let inner = block.inner(rect);
+    f.render_widget(block, rect);
+
+    let name_width = app
+        .shown_sessions
+        .iter()
+        .map(|s| s.name.chars().count())
+        .max()
+        .unwrap_or(0)
+        .min(inner.width as usize / 2);
+    // Keep the selected session in view above the input and hint lines.
+    let body_rows = inner.height.saturating_sub(4) as usize;
+    let skip = (app.session_cursor + 1).saturating_sub(body_rows);
+    let mut lines: Vec<Line> = app
+        .shown_sessions
+        .iter()
+        .enumerate()
+        .skip(skip)
+        .take(body_rows)
+        .map(|(i, s)| {
+            let prefix = if i == app.session_cursor {
+                "▶ "
+            } else {
+                "  "
+            };
+            let started = s.tunnels.iter().filter(|t| t.start).count();
+            Line::from(vec![
+                Span::raw(format!(
+                    "{prefix}{:<name_width$}  ",
+                    truncate(&s.name, name_width)
+                )),
+                Span::styled(
+                    format!("{} tunnel(s), {started} started", s.tunnels.len()),
+                    theme::muted(),
+                ),
+            ])
+        })
+        .collect();
+    if app.shown_sessions.is_empty() {
+        lines.push(Line::from("No saved sessions."));
+    }
+    lines.push(Line::from(""));
+    match &app.session_name {
+        Some(name) => {
+            lines.push(Line::from(vec![
+                Span::styled("Save current tunnels as: ", theme::accent()),
+                Span::styled(format!("{name}█"), theme::text()),
+            ]));
+            lines.push(Line::from(Span::styled(
+                "Enter: save (running tunnels start on restore) • Esc: cancel",
+                theme::hint(),
+            )));
+        }
+        None => {
+            lines.push(Line::from(""));
+            lines.push(Line::from(Span::styled(
+                "↑/↓: navigate • Enter: restore • s: save current • d: delete • Esc: close",
+                theme::hint(),
+            )));
+        }
+    }
+    f.render_widget(Paragraph::new(glyphs::lines(lines)), inner);
+}
+
+/// The note being typed for a tunnel's connection (`l`).
+pub fn draw_note(f: &mut Frame, area: Rect, app: &App, id: crate::model::TunnelId) {
+    let rect = centered(area, 64, 7);
+    f.render_widget(Clear, rect);
+    let label = app
+        .tunnels
+        .iter()
+        .find(|t| t.id == id)
+        .map_or_else(String::new, |t| t.label());
+    let title = format!("📝 Note for {label}");
+    let block = dialog_block(
+        &truncate(&title, rect.width.saturating_sub(2) as usize),
+        theme::primary(),
+    );
+    let inner = block.inner(rect);
+    f.render_widget(block, rect);
+
+    // Show the end of a note longer than the field.
+    let input = format!("{}█", app.note_input);
+    let width = inner.width as usize;
+    let shown: String = input
+        .chars()
+        .skip(input.chars().count().saturating_sub(width))
+        .collect();
+    let lines = vec![
+        Line::from(""),
+        Line::from(Span::styled(shown, theme::text())),
+        Line::from(""),
+        Line::from(Span::styled(
+            "Enter: save (empty clears) • Esc: cancel",
+            theme::hint(),
+        )),
+    ];
+    f.render_widget(Paragraph::new(lines), inner);
+}
+
 pub fn draw_help(f: &mut Frame, area: Rect) {
-    let rect = centered(area, 56, 18);
+    let rect = centered(area, 56, 31);
     f.render_widget(Clear, rect);
-    let block = dialog_block("❓ Keybindings", theme::PRIMARY);
+    let block = dialog_block("❓ Keybindings", theme::primary());
     let inner = block.inner(rect);
     f.render_widget(block, rect);
 
@@ -197,17 +807,111 @@ pub fn draw_help(f: &mut Frame, area: Rect) {
         Line::from(""),
         Line::from(Span::styled("Tunnels", theme::title())),
         row("Enter", "start / stop selected"),
+        row("1-9", "start / stop numbered row"),
         row("a", "start / stop all"),
-        row("Space", "view logs"),
+        row("Space", "logs (c/y: copy, w: save, f: filter)"),
         row("r", "regenerate cert"),
+        row("i", "cert principals, validity, errors"),
+        row("p / P", "pause cert renewal (machine/all)"),
+        row("m", "machines: certs, edit, start / stop VM"),
         row("c", "create new tunnel"),
         row("d / Del", "delete tunnel"),
+        row("t", "cycle colour tag"),
+        row("l", "note, e.g. what the tunnel is for"),
+        row("s", "SSH (tmux window/pane)"),
+        row("f", "SFTP through selected tunnel"),
+        row("v", "VS Code Remote-SSH on tunnel"),
+        row("y", "copy database connection string"),
+        row("e", "export tunnels as config YAML"),
         Line::from(""),
         Line::from(Span::styled("App", theme::title())),
+        row("R", "refresh shared config"),
+        row("S", "saved sessions: save / restore"),
+        row("n", "notification history"),
         row("?", "toggle this help"),
         row("q", "quit"),
     ];
-    f.render_widget(Paragraph::new(lines), inner);
+    f.render_widget(
+        Paragraph::new(glyphs::lines(lines)).wrap(Wrap { trim: false }),
+        inner,
+    );
+}
+
+pub fn draw_whats_new(f: &mut Frame, area: Rect, app: &App) {
+    let notes = crate::changelog::notes(&app.version).unwrap_or_default();
+    let rect = centered(area, 72, 22);
+    f.render_widget(Clear, rect);
+    let block = dialog_block(
+        &format!("✨ What's new in v{}", app.version),
+        theme::primary(),
+    );
+    let inner = block.inner(rect);
+    f.render_widget(block, rect);
+
+    // Light markdown: `### ` subheadings and `- ` bullets (with continuations).
+    let mut lines: Vec<Line> = notes
+        .lines()
+        .map(|l| {
+            if let Some(h) = l.strip_prefix("### ") {
+                Line::from(Span::styled(h.to_string(), theme::title()))
+            } else if let Some(item) = l.strip_prefix("- ") {
+                Line::from(format!(" • {item}"))
+            } else {
+                Line::from(format!(" {l}"))
+            }
+        })
+        .collect();
+    lines.push(Line::from(""));
+    lines.push(Line::from(Span::styled(
+        "Enter or Esc: close • ?: all keybindings",
+        theme::hint(),
+    )));
+    f.render_widget(
+        Paragraph::new(glyphs::lines(lines)).wrap(Wrap { trim: false }),
+        inner,
+    );
+}
+
+pub fn draw_notifications(f: &mut Frame, area: Rect, app: &App) {
+    let rect = centered(area, 90, 24);
+    f.render_widget(Clear, rect);
+    let block = dialog_block("🔔 Notifications", theme::primary());
+    let inner = block.inner(rect);
+    f.render_widget(block, rect);
+
+    // Reserve the last body row for the "Esc: close" hint.
+    let body_rows = inner.height.saturating_sub(1) as usize;
+    let mut lines: Vec<Line> = if app.history.is_empty() {
+        vec![Line::from("Nothing yet.")]
+    } else {
+        app.history
+            .newest()
+            .take(body_rows)
+            .map(|n| {
+                Line::from(vec![
+                    Span::styled(n.at.format("%H:%M:%S ").to_string(), theme::muted()),
+                    Span::styled(
+                        format!("{:<6}", n.severity.label()),
+                        severity_style(n.severity),
+                    ),
+                    Span::raw(n.text.clone()),
+                ])
+            })
+            .collect()
+    };
+    lines.push(Line::from(Span::styled("Esc: close", theme::hint())));
+    f.render_widget(Paragraph::new(glyphs::lines(lines)), inner);
+}
+
+/// How a notification's or log line's severity tag is drawn.
+fn severity_style(severity: Severity) -> Style {
+    match severity {
+        Severity::Info => theme::muted(),
+        Severity::Warning => Style::default().fg(theme::secondary()),
+        Severity::Error => Style::default()
+            .fg(theme::danger())
+            .add_modifier(Modifier::BOLD),
+    }
 }
 
 pub fn draw_logs(f: &mut Frame, area: Rect, app: &App, id: crate::model::TunnelId) {
@@ -225,24 +929,162 @@ pub fn draw_logs(f: &mut Frame, area: Rect, app: &App, id: crate::model::TunnelI
             )
         })
         .unwrap_or_else(|| "Unknown Tunnel".to_string());
-    let block = dialog_block(&format!("📋 Tunnel Logs: {info}"), theme::PRIMARY);
+    let title = format!("📋 Tunnel Logs: {info}");
+    let block = dialog_block(
+        &truncate(&title, rect.width.saturating_sub(2) as usize),
+        theme::primary(),
+    );
     let inner = block.inner(rect);
     f.render_widget(block, rect);
 
-    // Reserve the last body row for the "Esc: close" hint.
-    let body_rows = inner.height.saturating_sub(1) as usize;
-    let mut lines: Vec<Line> = if app.shown_logs.is_empty() {
-        vec![Line::from("No logs available yet...")]
+    let tunnel = app.tunnels.iter().find(|t| t.id == id);
+    // The tunnel's note and the commands it runs head the view.
+    let mut lines: Vec<Line> = Vec::new();
+    if let Some(note) = tunnel.and_then(|t| t.note.as_deref()) {
+        lines.push(Line::from(Span::styled(
+            format!("📝 {note}"),
+            theme::accent(),
+        )));
+    }
+    for command in tunnel.map(tunnel::command_lines).unwrap_or_default() {
+        lines.push(Line::from(Span::styled(
+            format!("$ {command}"),
+            theme::muted(),
+        )));
+    }
+    if !lines.is_empty() {
+        lines.push(Line::from(""));
+    }
+    // Reserve the last body row for the hint. Long commands wrap, so count
+    // the rows they take.
+    let width = inner.width.max(1) as usize;
+    let header_rows: usize = lines.iter().map(|l| l.width().max(1).div_ceil(width)).sum();
+    let body_rows = (inner.height as usize).saturating_sub(1 + header_rows);
+    let visible: Vec<_> = app.visible_logs().collect();
+    if app.shown_logs.is_empty() {
+        lines.push(Line::from("No logs available yet..."));
+    } else if visible.is_empty() {
+        lines.push(Line::from(format!(
+            "Nothing at {} or above; {} line(s) hidden (f: change filter)",
+            app.log_severity.label(),
+            app.shown_logs.len()
+        )));
     } else {
-        let start = app.shown_logs.len().saturating_sub(body_rows);
-        app.shown_logs[start..]
-            .iter()
-            .map(|l| Line::from(l.clone()))
-            .collect()
+        let start = visible.len().saturating_sub(body_rows);
+        lines.extend(visible[start..].iter().map(|l| {
+            // Errors and warnings stand out in full, not just by their tag.
+            let text = match l.severity {
+                Severity::Info => Style::default(),
+                severity => severity_style(severity),
+            };
+            Line::from(vec![
+                Span::styled(l.at.format("%H:%M:%S ").to_string(), theme::muted()),
+                Span::styled(
+                    format!("{:<6}", l.severity.label()),
+                    severity_style(l.severity),
+                ),
+                Span::styled(l.text.clone(), text),
+            ])
+        }));
+    }
+    let filter = match app.log_severity {
+        Severity::Info => "f: warnings+",
+        Severity::Warning => "f: errors only",
+        Severity::Error => "f: all lines",
+    };
+    lines.push(Line::from(Span::styled(
+        format!("c: copy command • y: copy logs • w: save logs • {filter} • Esc: close"),
+        theme::hint(),
+    )));
+    f.render_widget(
+        Paragraph::new(glyphs::lines(lines)).wrap(Wrap { trim: false }),
+        inner,
+    );
+}
+
+pub fn draw_cert(f: &mut Frame, area: Rect, app: &App, id: crate::model::TunnelId) {
+    let rect = centered(area, 90, 26);
+    f.render_widget(Clear, rect);
+    let machine = app
+        .tunnels
+        .iter()
+        .find(|t| t.id == id)
+        .map(|t| t.machine.name.clone())
+        .unwrap_or_default();
+    let title = format!("🔐 Certificate: {machine}");
+    let block = dialog_block(
+        &truncate(&title, rect.width.saturating_sub(2) as usize),
+        theme::primary(),
+    );
+    let inner = block.inner(rect);
+    f.render_widget(block, rect);
+
+    let local = |t: chrono::DateTime<chrono::Utc>| {
+        t.with_timezone(&chrono::Local)
+            .format("%Y-%m-%d %H:%M:%S")
+            .to_string()
     };
+    let mut lines: Vec<Line> = Vec::new();
+    match app.cert_mgr.details(&machine) {
+        None => lines.push(Line::from(
+            "No certificate managed for this machine (no ssh_config_path set).",
+        )),
+        Some(d) => {
+            lines.push(Line::from(format!("Status:     {}", d.status.label())));
+            lines.push(Line::from(format!("Expires:    {}", local(d.expires_at))));
+            if app.renewal_paused_for(&machine) {
+                lines.push(Line::from(Span::styled(
+                    "Renewal:    ⏸ paused (p resumes on the main screen)",
+                    theme::accent(),
+                )));
+            }
+            match &app.shown_cert {
+                None => lines.push(Line::from(Span::styled(
+                    "Reading certificate…",
+                    theme::hint(),
+                ))),
+                Some(Ok(c)) => {
+                    let principals = if c.principals.is_empty() {
+                        "(none)".to_string()
+                    } else {
+                        c.principals.join(", ")
+                    };
+                    lines.push(Line::from(format!("Principals: {principals}")));
+                    lines.push(Line::from(format!("Valid:      {}", c.valid)));
+                    lines.push(Line::from(format!("Key ID:     {}", c.key_id)));
+                    lines.push(Line::from(format!("Serial:     {}", c.serial)));
+                    lines.push(Line::from(format!("Signing CA: {}", c.signing_ca)));
+                }
+                Some(Err(e)) => lines.push(Line::from(Span::styled(
+                    format!("ssh-keygen -L: {e}"),
+                    theme::hint(),
+                ))),
+            }
+            lines.push(Line::from(""));
+            match d.last_error {
+                None => lines.push(Line::from(Span::styled(
+                    "No renewal errors.",
+                    theme::hint(),
+                ))),
+                Some(e) => {
+                    lines.push(Line::from(Span::styled(
+                        format!("Last renewal error ({}):", local(e.at)),
+                        Style::default()
+                            .fg(theme::danger())
+                            .add_modifier(Modifier::BOLD),
+                    )));
+                    lines.extend(e.output.lines().map(|l| Line::from(l.to_string())));
+                }
+            }
+        }
+    }
+    lines.push(Line::from(""));
     lines.push(Line::from(Span::styled(
-        "Esc: close",
-        Style::default().fg(Color::DarkGray),
+        "r: regenerate • Esc: close",
+        theme::hint(),
     )));
-    f.render_widget(Paragraph::new(lines).wrap(Wrap { trim: false }), inner);
+    f.render_widget(
+        Paragraph::new(glyphs::lines(lines)).wrap(Wrap { trim: false }),
+        inner,
+    );
 }
@@ -1,34 +1,188 @@
-//! Shared "cosy" palette and style helpers for the TUI.
+//! Shared "cosy" palette and style helpers for the TUI, and the high-contrast
+//! palette (`theme: high-contrast`) for low-vision and colour-blind users:
+//! ANSI colours at full brightness, and tunnel states told apart by blue
+//! versus reversed red rather than green versus red. With colour off
+//! (`--no-color` or `NO_COLOR`) everything is drawn in the terminal's own
+//! colours, and the selection and errors are shown reversed.
 
+use crate::model::{TagColor, TunnelStatus};
 use ratatui::style::{Color, Modifier, Style};
+use serde::Deserialize;
+use std::sync::atomic::{AtomicBool, Ordering};
 
-pub const PRIMARY: Color = Color::Rgb(0x7D, 0x56, 0xF4); // cosy purple
-pub const SECONDARY: Color = Color::Rgb(0xFF, 0x8C, 0x00); // warm orange
-pub const MUTED: Color = Color::Rgb(0x6C, 0x6C, 0x6C); // dim grey
-pub const DANGER: Color = Color::Rgb(0xFF, 0x6B, 0x6B); // soft red
-pub const TEXT: Color = Color::Rgb(0xD8, 0xD8, 0xD8); // bright off-white for table rows
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Default, Deserialize)]
+#[serde(rename_all = "kebab-case")]
+pub enum Theme {
+    #[default]
+    Cosy,
+    HighContrast,
+}
+
+static HIGH_CONTRAST: AtomicBool = AtomicBool::new(false);
+
+/// Switch the whole TUI to `theme`.
+pub fn set(theme: Theme) {
+    HIGH_CONTRAST.store(theme == Theme::HighContrast, Ordering::Relaxed);
+}
+
+fn high_contrast() -> bool {
+    HIGH_CONTRAST.load(Ordering::Relaxed)
+}
+
+static NO_COLOR: AtomicBool = AtomicBool::new(false);
+
+/// Switch colour off (or back on) for the whole TUI, whatever the theme.
+pub fn set_no_color(on: bool) {
+    NO_COLOR.store(on, Ordering::Relaxed);
+}
+
+fn no_color() -> bool {
+    NO_COLOR.load(Ordering::Relaxed)
+}
+
+/// `color`, unless colour is off.
+fn paint(color: Color) -> Color {
+    if no_color() {
+        Color::Reset
+    } else {
+        color
+    }
+}
+
+/// Cosy purple.
+pub fn primary() -> Color {
+    paint(if high_contrast() {
+        Color::LightCyan
+    } else {
+        Color::Rgb(0x7D, 0x56, 0xF4)
+    })
+}
+
+/// Warm orange.
+pub fn secondary() -> Color {
+    paint(if high_contrast() {
+        Color::LightYellow
+    } else {
+        Color::Rgb(0xFF, 0x8C, 0x00)
+    })
+}
+
+/// Dim grey.
+pub fn muted_color() -> Color {
+    paint(if high_contrast() {
+        Color::Gray
+    } else {
+        Color::Rgb(0x6C, 0x6C, 0x6C)
+    })
+}
+
+/// Soft red.
+pub fn danger() -> Color {
+    paint(if high_contrast() {
+        Color::LightRed
+    } else {
+        Color::Rgb(0xFF, 0x6B, 0x6B)
+    })
+}
+
+/// Bright off-white for table rows.
+fn text_color() -> Color {
+    paint(if high_contrast() {
+        Color::White
+    } else {
+        Color::Rgb(0xD8, 0xD8, 0xD8)
+    })
+}
+
+/// Terminal colour for a tunnel's tag, softened to sit with the palette.
+pub fn tag(color: TagColor) -> Color {
+    paint(match (color, high_contrast()) {
+        (TagColor::Red, false) => Color::Rgb(0xFF, 0x5F, 0x5F),
+        (TagColor::Yellow, false) => Color::Rgb(0xF2, 0xD0, 0x55),
+        (TagColor::Green, false) => Color::Rgb(0x6B, 0xCB, 0x77),
+        (TagColor::Blue, false) => Color::Rgb(0x5C, 0x9D, 0xFF),
+        (TagColor::Magenta, false) => Color::Rgb(0xD1, 0x7B, 0xE8),
+        (TagColor::Cyan, false) => Color::Rgb(0x4E, 0xD4, 0xD4),
+        (TagColor::Red, true) => Color::LightRed,
+        (TagColor::Yellow, true) => Color::LightYellow,
+        (TagColor::Green, true) => Color::LightGreen,
+        (TagColor::Blue, true) => Color::LightBlue,
+        (TagColor::Magenta, true) => Color::LightMagenta,
+        (TagColor::Cyan, true) => Color::LightCyan,
+    })
+}
+
+/// How a tunnel's status is drawn. Its symbol carries the state too, so the
+/// colour is never the only cue.
+pub fn status(status: &TunnelStatus) -> Style {
+    let hc = high_contrast();
+    if no_color() {
+        return match status {
+            TunnelStatus::Error(_) => {
+                Style::default().add_modifier(Modifier::BOLD | Modifier::REVERSED)
+            }
+            _ => Style::default(),
+        };
+    }
+    match status {
+        TunnelStatus::Active if hc => Style::default()
+            .fg(Color::LightBlue)
+            .add_modifier(Modifier::BOLD),
+        TunnelStatus::Active => Style::default().fg(Color::Green),
+        TunnelStatus::Connecting
+        | TunnelStatus::Starting
+        | TunnelStatus::Waiting(_)
+        | TunnelStatus::Stopping => Style::default().fg(secondary()),
+        TunnelStatus::Error(_) if hc => Style::default()
+            .fg(Color::LightRed)
+            .add_modifier(Modifier::BOLD | Modifier::REVERSED),
+        TunnelStatus::Error(_) => Style::default().fg(Color::Red),
+        TunnelStatus::Inactive => Style::default().fg(muted_color()),
+    }
+}
 
 pub fn title() -> Style {
-    Style::default().fg(PRIMARY).add_modifier(Modifier::BOLD)
+    Style::default().fg(primary()).add_modifier(Modifier::BOLD)
 }
 pub fn subtitle() -> Style {
-    Style::default().fg(PRIMARY).add_modifier(Modifier::ITALIC)
+    Style::default()
+        .fg(primary())
+        .add_modifier(Modifier::ITALIC)
 }
 pub fn accent() -> Style {
-    Style::default().fg(SECONDARY).add_modifier(Modifier::BOLD)
+    Style::default()
+        .fg(secondary())
+        .add_modifier(Modifier::BOLD)
 }
 pub fn muted() -> Style {
-    Style::default().fg(MUTED)
+    Style::default().fg(muted_color())
+}
+/// Key hints at the bottom of dialogs.
+pub fn hint() -> Style {
+    Style::default().fg(paint(if high_contrast() {
+        Color::Gray
+    } else {
+        Color::DarkGray
+    }))
 }
 pub fn text() -> Style {
-    Style::default().fg(TEXT)
+    Style::default().fg(text_color())
 }
 pub fn selected_row() -> Style {
+    if no_color() {
+        return Style::default().add_modifier(Modifier::BOLD | Modifier::REVERSED);
+    }
+    if high_contrast() {
+        return Style::default()
+            .bg(Color::White)
+            .fg(Color::Black)
+            .add_modifier(Modifier::BOLD);
+    }
     Style::default()
-        .bg(PRIMARY)
+        .bg(primary())
         .fg(Color::White)
         .add_modifier(Modifier::BOLD)
 }
 pub fn border() -> Style {
-    Style::default().fg(PRIMARY)
+    Style::default().fg(primary())
 }
@@ -1,12 +1,22 @@
-use crate::model::TunnelStatus;
+//! The main screen, drawn as header / table / notification / footer
+//! components. Each fits its text to the `Rect` it is given, cutting long
+//! values (VM names, filters, errors) with an ellipsis instead of overflowing.
+
+use crate::azure::tunnel::StopProgress;
+use crate::model::{format_duration, SshForward, TunnelStatus};
 use crate::tui::app::{App, Overlay};
+use crate::tui::fit::truncate;
+use crate::tui::glyphs;
 use crate::tui::overlays;
 use crate::tui::theme;
+use chrono::Utc;
 use ratatui::layout::{Alignment, Constraint, Layout, Rect};
-use ratatui::style::{Color, Style};
+use ratatui::style::Style;
 use ratatui::text::{Line, Span};
-use ratatui::widgets::{Block, Borders, Cell, Paragraph, Row, Table};
+use ratatui::widgets::{Block, Borders, Cell, Clear, Paragraph, Row, Table};
 use ratatui::Frame;
+use std::time::{Duration, Instant};
+use unicode_width::UnicodeWidthStr;
 
 pub fn draw(f: &mut Frame, app: &mut App) {
     let area = f.area();
@@ -20,19 +30,44 @@ pub fn draw(f: &mut Frame, app: &mut App) {
 
     draw_header(f, chunks[0], app);
     draw_table(f, chunks[1], app);
-    draw_notification(f, chunks[2], app);
+    draw_status_bar(f, chunks[2], app);
     draw_footer(f, chunks[3], app);
 
-    match &app.overlay {
-        Overlay::None => {}
-        Overlay::Create => overlays::draw_create(f, area, app),
-        Overlay::ConfirmDelete(idx) => overlays::draw_confirm_delete(f, area, app, *idx),
-        Overlay::ConfirmQuit => overlays::draw_confirm_quit(f, area),
-        Overlay::Logs(id) => overlays::draw_logs(f, area, app, *id),
-        Overlay::Help => overlays::draw_help(f, area),
+    // Bottom first, so the dialog that has focus is drawn on top.
+    for dialog in app.dialogs.iter() {
+        match dialog {
+            Overlay::None => {}
+            Overlay::Create => overlays::draw_create(f, area, app),
+            Overlay::ConfirmDelete(idx) => overlays::draw_confirm_delete(f, area, app, idx),
+            Overlay::ConfirmQuit => overlays::draw_confirm_quit(f, area, app.can_detach()),
+            Overlay::Logs(id) => overlays::draw_logs(f, area, app, id),
+            Overlay::Cert(id) => overlays::draw_cert(f, area, app, id),
+            Overlay::Help => overlays::draw_help(f, area),
+            Overlay::WhatsNew => overlays::draw_whats_new(f, area, app),
+            Overlay::Notifications => overlays::draw_notifications(f, area, app),
+            Overlay::Machines => overlays::draw_machines(f, area, app),
+            Overlay::EditMachine => overlays::draw_machine_form(f, area, app),
+            Overlay::ConfirmRemoveMachine(idx) => {
+                overlays::draw_confirm_remove_machine(f, area, app, idx)
+            }
+            Overlay::ConfirmPower(idx, action) => {
+                overlays::draw_confirm_power(f, area, app, idx, action)
+            }
+            Overlay::Sessions => overlays::draw_sessions(f, area, app),
+            Overlay::EditNote(id) => overlays::draw_note(f, area, app, id),
+            Overlay::Login => overlays::draw_login(f, area, app),
+        }
     }
 }
 
+/// The quit screen while tunnels shut down (drawn without the app, whose
+/// tunnel manager is busy stopping them).
+pub fn draw_stopping(f: &mut Frame, progress: StopProgress, left: &[String]) {
+    let area = f.area();
+    f.render_widget(Clear, area);
+    overlays::draw_stopping(f, area, progress, left);
+}
+
 fn draw_header(f: &mut Frame, area: Rect, app: &App) {
     // ASCII badger on the left, title + summary on the right.
     let cols = Layout::horizontal([Constraint::Length(8), Constraint::Min(0)]).split(area);
@@ -46,8 +81,12 @@ fn draw_header(f: &mut Frame, area: Rect, app: &App) {
     .style(theme::accent());
     f.render_widget(ascii, cols[0]);
 
+    let width = cols[1].width as usize;
     let title = Line::from(Span::styled(
-        format!("Burrow v{} · cosy Azure tunnels", app.version),
+        truncate(
+            &glyphs::text(&format!("Burrow v{} · cosy Azure tunnels", app.version)),
+            width,
+        ),
         theme::title(),
     ));
 
@@ -57,12 +96,18 @@ fn draw_header(f: &mut Frame, area: Rect, app: &App) {
         Some(q) => {
             let unit = if visible == 1 { "match" } else { "matches" };
             Line::from(Span::styled(
-                format!("Filter: {q} ({visible} {unit}) — Esc to clear"),
+                truncate(
+                    &glyphs::text(&format!("Filter: {q} ({visible} {unit}) — Esc to clear")),
+                    width,
+                ),
                 theme::subtitle(),
             ))
         }
         None => Line::from(Span::styled(
-            format!("{} tunnels · {} active", app.tunnels.len(), active),
+            truncate(
+                &format!("{} tunnels · {} active", app.tunnels.len(), active),
+                width,
+            ),
             theme::subtitle(),
         )),
     };
@@ -74,14 +119,72 @@ fn draw_header(f: &mut Frame, area: Rect, app: &App) {
     );
 }
 
-fn status_span(status: &TunnelStatus) -> Span<'static> {
-    let color = match status {
-        TunnelStatus::Active => Color::Green,
-        TunnelStatus::Connecting | TunnelStatus::Starting => theme::SECONDARY,
-        TunnelStatus::Error(_) => Color::Red,
-        TunnelStatus::Inactive => theme::MUTED,
+/// The Status cell. A tunnel starting or stopping shows `pending`: the
+/// spinner's frame and how long it has been at it, in place of the trailing
+/// dots.
+fn status_span(
+    status: &TunnelStatus,
+    pending: Option<(&str, Duration)>,
+    width: usize,
+) -> Span<'static> {
+    let text = match pending {
+        Some((spinner, elapsed)) => format!(
+            "{spinner} {} {}",
+            status.label().trim_end_matches("..."),
+            format_duration(elapsed)
+        ),
+        None => format!("{} {}", status.symbol(), status.label()),
+    };
+    Span::styled(truncate(&glyphs::text(&text), width), theme::status(status))
+}
+
+/// A table column: the built-in ones, then embedder columns by index.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+enum Column {
+    Name,
+    Ports,
+    Status,
+    Cert,
+    /// Only while some tunnel has a note.
+    Note,
+    Extension(usize),
+}
+
+/// The columns that fit in `width` cells. On narrow terminals the least
+/// important go first, Note, Cert and then embedder columns from the right,
+/// until the rest fit at their narrowest.
+fn fit_columns(width: u16, notes: bool, extension_widths: &[u16]) -> Vec<Column> {
+    let mut cols = vec![Column::Name, Column::Ports, Column::Status, Column::Cert];
+    if notes {
+        cols.push(Column::Note);
+    }
+    cols.extend((0..extension_widths.len()).map(Column::Extension));
+    let narrowest = |c: &Column| match c {
+        Column::Name => 16,
+        Column::Ports => 12,
+        Column::Status => 14,
+        Column::Cert => 16,
+        Column::Note => 12,
+        Column::Extension(i) => extension_widths[*i],
+    };
+    // One cell of spacing between columns.
+    let needed = |cols: &[Column]| {
+        cols.iter().map(narrowest).sum::<u16>() + cols.len().saturating_sub(1) as u16
     };
-    Span::styled(status.label(), Style::default().fg(color))
+    while needed(&cols) > width {
+        let least = cols
+            .iter()
+            .position(|&c| c == Column::Note)
+            .or_else(|| cols.iter().position(|&c| c == Column::Cert))
+            .or_else(|| cols.iter().rposition(|c| matches!(c, Column::Extension(_))));
+        match least {
+            Some(i) => {
+                cols.remove(i);
+            }
+            None => break,
+        }
+    }
+    cols
 }
 
 fn draw_table(f: &mut Frame, area: Rect, app: &mut App) {
@@ -103,35 +206,118 @@ fn draw_table(f: &mut Frame, area: Rect, app: &mut App) {
         return;
     }
 
-    let header = Row::new(["Name", "Ports", "Status", "Cert"]).style(theme::title());
+    let extensions = app.extensions.columns();
+    let extension_widths: Vec<u16> = extensions.iter().map(|c| c.width()).collect();
+    let notes = app.tunnels.iter().any(|t| t.note.is_some());
+    let columns = fit_columns(block.inner(area).width, notes, &extension_widths);
+    let header = Row::new(columns.iter().map(|&c| match c {
+        Column::Name => "Name",
+        Column::Ports => "Ports",
+        Column::Status => "Status",
+        Column::Cert => "Cert",
+        Column::Note => "Note",
+        Column::Extension(i) => extensions[i].header(),
+    }))
+    .style(theme::title());
+
+    let widths: Vec<Constraint> = columns
+        .iter()
+        .map(|&c| match c {
+            Column::Name => Constraint::Percentage(30),
+            Column::Ports => Constraint::Length(14),
+            Column::Status => Constraint::Length(18),
+            Column::Cert => Constraint::Min(14),
+            Column::Note => Constraint::Min(12),
+            Column::Extension(i) => Constraint::Length(extension_widths[i]),
+        })
+        .collect();
+    // Resolve the constraints the way the table will (one cell of column
+    // spacing) so every cell can be cut to the width it actually gets.
+    let col = Layout::horizontal(widths.clone())
+        .spacing(1)
+        .split(block.inner(area))
+        .iter()
+        .map(|r| r.width as usize)
+        .collect::<Vec<_>>();
 
     let visible = app.visible_indices();
+    let now = Instant::now();
     let rows: Vec<Row> = visible
         .iter()
-        .map(|&i| {
+        .enumerate()
+        .map(|(row, &i)| {
             let t = &app.tunnels[i];
-            let ports = format!("{}→{}", t.local_port, t.remote_port);
-            let cert = match (t.cert_status, &t.cert_expires_in) {
-                (Some(c), Some(exp)) => format!("{} {}", c.label(), exp),
-                (Some(c), None) => c.label().to_string(),
-                (None, _) => "N/A".into(),
-            };
-            Row::new(vec![
-                Cell::from(t.machine.name.clone()),
-                Cell::from(ports),
-                Cell::from(Line::from(status_span(&t.status))),
-                Cell::from(cert),
-            ])
-            .style(theme::text())
+            // Later forwards of a multi-port connection hang off its first row.
+            let continues_group =
+                t.group.is_some() && row > 0 && app.tunnels[visible[row - 1]].group == t.group;
+            // The first nine rows can be toggled with their number key.
+            let number = Span::styled(
+                if row < 9 {
+                    format!("{} ", row + 1)
+                } else {
+                    "  ".into()
+                },
+                theme::muted(),
+            );
+            let cells = columns.iter().zip(&col).map(|(&c, &w)| match c {
+                Column::Name if continues_group => Cell::from(Line::from(vec![
+                    number.clone(),
+                    Span::styled(glyphs::text("  └").into_owned(), theme::muted()),
+                ])),
+                Column::Name => {
+                    let mut name = t.label();
+                    if let Some(instance) = &t.instance {
+                        name = format!("{name} #{instance}");
+                    }
+                    let style = t
+                        .color
+                        .map_or_else(Style::default, |c| Style::default().fg(theme::tag(c)));
+                    Cell::from(Line::from(vec![
+                        number.clone(),
+                        Span::styled(truncate(&glyphs::text(&name), w.saturating_sub(2)), style),
+                    ]))
+                }
+                Column::Ports => {
+                    // A tunnel open beyond loopback shows where it listens.
+                    let local = t.listen_spec();
+                    let ports = match &t.ssh {
+                        Some(SshForward::Socks { .. }) => format!("{local}→SOCKS"),
+                        Some(SshForward::Jump { host, port, .. }) => {
+                            format!("{local}→{host}:{port}")
+                        }
+                        None => format!("{local}→{}", t.remote_port),
+                    };
+                    Cell::from(truncate(&glyphs::text(&ports), w))
+                }
+                Column::Status => {
+                    let pending = app.pending_for(t.id, now).map(|e| (app.busy.spinner(), e));
+                    Cell::from(Line::from(status_span(&t.status, pending, w)))
+                }
+                Column::Cert => {
+                    let mut cert = match (t.cert_status, &t.cert_expires_in) {
+                        (Some(c), Some(exp)) => format!("{} {}", c.label(), exp),
+                        (Some(c), None) => c.label().to_string(),
+                        (None, _) => "N/A".into(),
+                    };
+                    if t.cert_status.is_some() && app.renewal_paused_for(&t.machine.name) {
+                        cert = format!("⏸ {cert}");
+                    }
+                    Cell::from(truncate(&glyphs::text(&cert), w))
+                }
+                // A connection's note is shown once, on its first row.
+                Column::Note if continues_group => Cell::from(""),
+                Column::Note => Cell::from(Span::styled(
+                    truncate(&glyphs::text(t.note.as_deref().unwrap_or("")), w),
+                    theme::muted(),
+                )),
+                Column::Extension(i) => {
+                    Cell::from(truncate(&glyphs::text(&extensions[i].cell(t)), w))
+                }
+            });
+            Row::new(cells).style(theme::text())
         })
         .collect();
 
-    let widths = [
-        Constraint::Percentage(30),
-        Constraint::Length(14),
-        Constraint::Length(16),
-        Constraint::Min(14),
-    ];
     let table = Table::new(rows, widths)
         .header(header)
         .row_highlight_style(theme::selected_row())
@@ -142,20 +328,68 @@ fn draw_table(f: &mut Frame, area: Rect, app: &mut App) {
     f.render_stateful_widget(table, area, &mut app.table_state);
 }
 
-fn draw_notification(f: &mut Frame, area: Rect, app: &App) {
-    if let Some(n) = &app.notification {
-        let p = Paragraph::new(n.as_str())
-            .style(theme::selected_row())
-            .alignment(Alignment::Center);
-        f.render_widget(p, area);
+/// The current notification (or, dimmed, the last one) on the left; the az
+/// account, how long its token has left, config file and active count on the
+/// right. When space is short the account goes first, then the token and the
+/// config file, leaving the notification at least half the bar.
+fn draw_status_bar(f: &mut Frame, area: Rect, app: &App) {
+    let width = area.width as usize;
+    let active = app.tunnels.iter().filter(|t| t.status.is_running()).count();
+    let token = app
+        .token_expires
+        .map(|at| match (at - Utc::now()).to_std() {
+            Ok(left) => format!("🔑 {}", format_duration(left)),
+            Err(_) => "🔑 expired".into(),
+        });
+    let mut facts: Vec<String> = [app.account.clone(), token, app.config_path.clone()]
+        .into_iter()
+        .flatten()
+        .collect();
+    if app.read_only {
+        facts.push("🔒 read-only".into());
+    } else if app.renewal_paused_all {
+        facts.push("⏸ renewal paused".into());
     }
+    facts.push(format!("{active} active"));
+    let right = loop {
+        let joined = glyphs::text(&format!(" {} ", facts.join(" │ "))).into_owned();
+        if facts.len() == 1 || joined.width() <= width / 2 {
+            break truncate(&joined, width);
+        }
+        facts.remove(0);
+    };
+    let [left_area, right_area] =
+        Layout::horizontal([Constraint::Min(0), Constraint::Length(right.width() as u16)])
+            .areas(area);
+
+    let busy = app.busy.status();
+    let left = match (&app.notification, &busy, &app.last_notification) {
+        (Some(n), _, _) => Some((n, theme::selected_row())),
+        (None, Some(b), _) => Some((b, theme::accent())),
+        (None, None, Some(n)) => Some((n, theme::muted())),
+        (None, None, None) => None,
+    };
+    if let Some((n, style)) = left {
+        let text = truncate(&glyphs::text(&format!(" {n}")), left_area.width as usize);
+        f.render_widget(Paragraph::new(text).style(style), left_area);
+    }
+    f.render_widget(Paragraph::new(right).style(theme::muted()), right_area);
 }
 
 fn draw_footer(f: &mut Frame, area: Rect, app: &App) {
-    let text = if app.tunnels.is_empty() {
+    let full = glyphs::text(if app.read_only {
+        "␣ logs • i cert • m machines • / filter • ? help • q quit"
+    } else if app.tunnels.is_empty() {
         "c: create • q: quit • ?: help"
     } else {
         "↵ start/stop • ␣ logs • c new • a all • / filter • d del • ? help"
+    });
+    // On narrow terminals point at the help overlay rather than cutting hints.
+    let width = area.width as usize;
+    let text = if full.width() <= width {
+        full.into_owned()
+    } else {
+        truncate(&glyphs::text("? help • q quit"), width)
     };
     let p = Paragraph::new(text)
         .style(theme::muted())
@@ -201,16 +435,9 @@ mod tests {
             crate::azure::tunnel::TunnelManager::new(tx.clone()),
             crate::azure::cert::CertManager::new(tx),
         );
-        let machine = Machine {
-            name: "vm-web".into(),
-            resource_group: "rg".into(),
-            target_resource_id: "rid".into(),
-            bastion_name: "b".into(),
-            bastion_resource_group: "brg".into(),
-            bastion_subscription: String::new(),
-            ssh_config_path: None,
-        };
+        let machine = Machine::test("vm-web");
         app.add_tunnel_for_test(machine, "2022", "22");
+        app.tunnels[0].note = Some("ticket #1234".into());
 
         let backend = TestBackend::new(120, 20);
         let mut terminal = Terminal::new(backend).unwrap();
@@ -219,8 +446,299 @@ mod tests {
         let content: String = buf.content().iter().map(|c| c.symbol()).collect();
 
         assert!(content.contains("Ports")); // merged column header
+        assert!(content.contains("ticket #1234")); // note column
         assert!(content.contains("2022→22")); // merged port cell
         assert!(content.contains("1 tunnels · 0 active")); // summary line
+        assert!(content.contains("○ Inactive")); // status shape, not just colour
+        assert!(content.contains("1 vm-web")); // toggled with its number key
         assert!(content.contains("2022→22")); // row content is present
     }
+
+    #[test]
+    fn long_machine_name_is_cut_with_ellipsis_on_narrow_terminal() {
+        use crate::model::Machine;
+        let (tx, _rx) = tokio::sync::mpsc::unbounded_channel();
+        let mut app = App::new_for_test(tx);
+        let name = "vm-uk-experiment-with-a-really-long-descriptive-name-01";
+        let machine = Machine::test(name);
+        app.add_tunnel_for_test(machine, "2022", "22");
+
+        let backend = TestBackend::new(60, 16);
+        let mut terminal = Terminal::new(backend).unwrap();
+        terminal.draw(|f| draw(f, &mut app)).unwrap();
+        let buf = terminal.backend().buffer().clone();
+        let content: String = buf.content().iter().map(|c| c.symbol()).collect();
+        assert!(content.contains("vm-uk-exp"));
+        assert!(content.contains('…'));
+        assert!(!content.contains(name));
+        // The narrow footer falls back to pointing at help.
+        assert!(content.contains("? help • q quit"));
+    }
+
+    #[test]
+    fn narrow_tables_drop_note_cert_then_embedder_columns() {
+        use Column::*;
+        assert_eq!(
+            fit_columns(118, false, &[14]),
+            [Name, Ports, Status, Cert, Extension(0)]
+        );
+        assert_eq!(
+            fit_columns(118, true, &[14]),
+            [Name, Ports, Status, Cert, Note, Extension(0)]
+        );
+        assert_eq!(
+            fit_columns(80, true, &[14]),
+            [Name, Ports, Status, Cert, Extension(0)]
+        );
+        assert_eq!(
+            fit_columns(70, false, &[14]),
+            [Name, Ports, Status, Extension(0)]
+        );
+        assert_eq!(fit_columns(58, false, &[14]), [Name, Ports, Status]);
+        assert_eq!(fit_columns(20, true, &[]), [Name, Ports, Status]);
+    }
+
+    #[test]
+    fn status_bar_shows_account_config_and_last_notification() {
+        let (tx, _rx) = tokio::sync::mpsc::unbounded_channel();
+        let mut app = App::new_for_test(tx);
+        app.account = Some("alice@contoso.com · Dev".into());
+        app.config_path = Some("~/burrow.config.yaml".into());
+        app.last_notification = Some("Copied".into());
+        let render = |app: &mut App, width| {
+            let mut terminal = Terminal::new(TestBackend::new(width, 12)).unwrap();
+            terminal.draw(|f| draw(f, app)).unwrap();
+            let buf = terminal.backend().buffer().clone();
+            buf.content().iter().map(|c| c.symbol()).collect::<String>()
+        };
+
+        let wide = render(&mut app, 120);
+        assert!(wide.contains("alice@contoso.com · Dev │ ~/burrow.config.yaml │ 0 active"));
+        assert!(wide.contains(" Copied"));
+        // Narrow: the account gives way first.
+        let narrow = render(&mut app, 70);
+        assert!(!narrow.contains("alice@contoso.com"));
+        assert!(narrow.contains("~/burrow.config.yaml │ 0 active"));
+    }
+
+    #[test]
+    fn quit_screen_lists_tunnels_left_behind() {
+        let progress = StopProgress {
+            done: 2,
+            total: 2,
+            timed_out: 1,
+        };
+        let left = vec!["vm-web on port 2022 (pid 4242)".to_string()];
+        let mut terminal = Terminal::new(TestBackend::new(80, 12)).unwrap();
+        terminal
+            .draw(|f| draw_stopping(f, progress, &left))
+            .unwrap();
+        let content: String = terminal
+            .backend()
+            .buffer()
+            .content()
+            .iter()
+            .map(|c| c.symbol())
+            .collect();
+        assert!(content.contains("Shutting down 2 tunnels"));
+        assert!(content.contains("1 did not stop in time"));
+        assert!(content.contains("vm-web on port 2022 (pid 4242)"));
+    }
+
+    #[test]
+    fn dialogs_fit_small_terminals() {
+        let (tx, _rx) = tokio::sync::mpsc::unbounded_channel();
+        let mut app = App::new_for_test(tx);
+        app.dialogs.open(Overlay::Help);
+        let mut terminal = Terminal::new(TestBackend::new(40, 12)).unwrap();
+        terminal.draw(|f| draw(f, &mut app)).unwrap();
+        let content: String = terminal
+            .backend()
+            .buffer()
+            .content()
+            .iter()
+            .map(|c| c.symbol())
+            .collect();
+        assert!(content.contains("Keybindings"));
+    }
+
+    struct Owner;
+    impl crate::tui::ext::ColumnProvider for Owner {
+        fn header(&self) -> &str {
+            "Owner"
+        }
+        fn cell(&self, _t: &crate::model::Tunnel) -> String {
+            "team-data".into()
+        }
+    }
+
+    #[test]
+    fn registered_column_is_rendered() {
+        use crate::model::Machine;
+        let (tx, _rx) = tokio::sync::mpsc::unbounded_channel();
+        let mut app = App::new(
+            "1.0".into(),
+            Vec::new(),
+            Vec::new(),
+            std::path::PathBuf::from(""),
+            crate::azure::tunnel::TunnelManager::new(tx.clone()),
+            crate::azure::cert::CertManager::new(tx),
+        );
+        app.extensions.add_column(Owner);
+        let machine = Machine::test("vm-web");
+        app.add_tunnel_for_test(machine, "2022", "22");
+
+        let backend = TestBackend::new(140, 20);
+        let mut terminal = Terminal::new(backend).unwrap();
+        terminal.draw(|f| draw(f, &mut app)).unwrap();
+        let buf = terminal.backend().buffer().clone();
+        let content: String = buf.content().iter().map(|c| c.symbol()).collect();
+        assert!(content.contains("Owner"));
+        assert!(content.contains("team-data"));
+    }
+
+    #[test]
+    fn cert_view_shows_last_renewal_error() {
+        use crate::model::Machine;
+        let (tx, _rx) = tokio::sync::mpsc::unbounded_channel();
+        let mut app = App::new_for_test(tx);
+        let machine = Machine {
+            ssh_config_path: Some("/nonexistent/az-burrow-test".into()),
+            ..Machine::test("vm-web")
+        };
+        app.add_tunnel_for_test(machine, "2022", "22");
+        app.cert_mgr.register(
+            "vm-web",
+            crate::model::KeyFiles::for_private_key("/nonexistent/az-burrow-test/id_rsa".into()),
+            Default::default(),
+        );
+        app.cert_mgr
+            .record_failure("vm-web", "ERROR: Please run 'az login'".into());
+        app.dialogs.open(Overlay::Cert(app.tunnels[0].id));
+        app.apply_bg(crate::tui::action::BgEvent::CertInspected {
+            vm_name: "vm-web".into(),
+            result: Ok(crate::azure::parse::CertificateFields {
+                key_id: "alice@contoso.com".into(),
+                serial: "5216934812".into(),
+                signing_ca: "RSA SHA256:Yj1o1xvSc6nT".into(),
+                valid: "from 2025-03-01T10:00:00 to 2025-03-01T11:05:00".into(),
+                principals: vec!["alice@contoso.com".into()],
+            }),
+        });
+
+        let backend = TestBackend::new(100, 30);
+        let mut terminal = Terminal::new(backend).unwrap();
+        terminal.draw(|f| draw(f, &mut app)).unwrap();
+        let buf = terminal.backend().buffer().clone();
+        let content: String = buf.content().iter().map(|c| c.symbol()).collect();
+        assert!(content.contains("Principals: alice@contoso.com"));
+        assert!(content.contains("Signing CA: RSA SHA256:Yj1o1xvSc6nT"));
+        assert!(content.contains("Last renewal error"));
+        assert!(content.contains("ERROR: Please run 'az login'"));
+    }
+
+    #[test]
+    fn logs_view_shows_the_command_and_note() {
+        use crate::model::Machine;
+        let (tx, _rx) = tokio::sync::mpsc::unbounded_channel();
+        let mut app = App::new_for_test(tx);
+        let machine = Machine {
+            bastion_name: "bastion-hub".into(),
+            ..Machine::test("vm-web")
+        };
+        app.add_tunnel_for_test(machine, "2022", "22");
+        app.tunnels[0].note = Some("ticket #1234".into());
+        app.dialogs.open(Overlay::Logs(app.tunnels[0].id));
+
+        let mut terminal = Terminal::new(TestBackend::new(160, 30)).unwrap();
+        terminal.draw(|f| draw(f, &mut app)).unwrap();
+        let buf = terminal.backend().buffer().clone();
+        let content: String = buf.content().iter().map(|c| c.symbol()).collect();
+        assert!(content.contains("ticket #1234"));
+        assert!(content.contains("network bastion tunnel --resource-group brg --name bastion-hub"));
+        assert!(content.contains("c: copy command"));
+
+        app.shown_logs = vec![crate::azure::tunnel::LogLine {
+            at: chrono::Local::now(),
+            severity: crate::tui::history::Severity::Warning,
+            text: "WARNING: preview command".into(),
+        }];
+        terminal.draw(|f| draw(f, &mut app)).unwrap();
+        let buf = terminal.backend().buffer().clone();
+        let content: String = buf.content().iter().map(|c| c.symbol()).collect();
+        assert!(content.contains("warn  WARNING: preview command"));
+        app.log_severity = crate::tui::history::Severity::Error;
+        terminal.draw(|f| draw(f, &mut app)).unwrap();
+        let buf = terminal.backend().buffer().clone();
+        let content: String = buf.content().iter().map(|c| c.symbol()).collect();
+        assert!(!content.contains("WARNING: preview command"));
+        assert!(content.contains("1 line(s) hidden"));
+    }
+
+    #[test]
+    fn create_dialog_explains_wsl_port_reachability() {
+        use crate::model::Machine;
+        use crate::tui::app::CreateStep;
+        let (tx, _rx) = tokio::sync::mpsc::unbounded_channel();
+        let mut app = App::new_for_test(tx);
+        app.machines = vec![Machine::test("vm-web")];
+        app.wsl_hint = crate::wsl::port_hint(crate::wsl::Networking::Nat);
+        app.dialogs.open(Overlay::Create);
+        app.create_step = CreateStep::LocalPort;
+
+        let backend = TestBackend::new(100, 30);
+        let mut terminal = Terminal::new(backend).unwrap();
+        terminal.draw(|f| draw(f, &mut app)).unwrap();
+        let buf = terminal.backend().buffer().clone();
+        let content: String = buf.content().iter().map(|c| c.symbol()).collect();
+        assert!(content.contains("Local Port:"));
+        assert!(content.contains("WSL: tunnels listen"));
+    }
+
+    #[test]
+    fn machines_view_shows_certs_of_machines_without_tunnels() {
+        use crate::azure::vm::{PowerState, VmInfo};
+        use crate::model::{CertStatus, Machine};
+        use crate::tui::app::MachineCert;
+        let (tx, _rx) = tokio::sync::mpsc::unbounded_channel();
+        let mut app = App::new_for_test(tx);
+        app.machines = vec![Machine {
+            ssh_config_path: Some("/keys/vm-idle".into()),
+            ..Machine::test("vm-idle")
+        }];
+        app.machine_certs.insert(
+            "vm-idle".into(),
+            MachineCert {
+                status: CertStatus::ExpiringSoon,
+                expires_in: "4m0s".into(),
+            },
+        );
+        app.dialogs.open(Overlay::Machines);
+
+        let mut terminal = Terminal::new(TestBackend::new(100, 30)).unwrap();
+        terminal.draw(|f| draw(f, &mut app)).unwrap();
+        let buf = terminal.backend().buffer().clone();
+        let content: String = buf.content().iter().map(|c| c.symbol()).collect();
+        assert!(content.contains("vm-idle"));
+        assert!(content.contains("4m0s"));
+        assert!(content.contains("no tunnels"));
+
+        app.power_states
+            .insert("vm-idle".into(), PowerState::Deallocated);
+        app.vm_info.insert(
+            "vm-idle".into(),
+            Ok(VmInfo {
+                size: "Standard_B2s".into(),
+                os: "Linux".into(),
+                image: None,
+                private_ip: Some("10.0.1.4".into()),
+                location: "westeurope".into(),
+            }),
+        );
+        terminal.draw(|f| draw(f, &mut app)).unwrap();
+        let buf = terminal.backend().buffer().clone();
+        let content: String = buf.content().iter().map(|c| c.symbol()).collect();
+        assert!(content.contains("deallocated"));
+        assert!(content.contains("vm-idle in rg: Standard_B2s · Linux · 10.0.1.4 · westeurope"));
+    }
 }
@@ -0,0 +1,178 @@
+//! Per-tunnel log files (`log_files: true`). Every line a tunnel's in-memory
+//! buffer captures is also appended, timestamped, to
+//! `$XDG_STATE_HOME/burrow/logs/<machine>_<local>-<remote>.log` (by default
+//! under `~/.local/state`), so a tunnel that died overnight can still be
+//! looked into. A file that grows past [`MAX_BYTES`] is rotated to `.1`, the
+//! old `.1` to `.2` and so on, keeping [`KEEP`] old files.
+
+use crate::model::Tunnel;
+use chrono::{DateTime, Local, Utc};
+use std::fs::{File, OpenOptions};
+use std::io::Write;
+use std::path::{Path, PathBuf};
+
+/// Size at which a log file is rotated.
+pub const MAX_BYTES: u64 = 1024 * 1024;
+/// Rotated files kept besides the current one.
+pub const KEEP: usize = 3;
+
+/// `burrow/logs` under `$XDG_STATE_HOME` (`~/.local/state` when unset or not
+/// absolute); `None` without a home directory.
+pub fn log_dir() -> Option<PathBuf> {
+    let state = std::env::var_os("XDG_STATE_HOME")
+        .map(PathBuf::from)
+        .filter(|p| p.is_absolute())
+        .or_else(|| home::home_dir().map(|h| h.join(".local").join("state")))?;
+    Some(state.join("burrow").join("logs"))
+}
+
+/// The file `tunnel` logs to in `dir`. Named after the machine and ports
+/// rather than the tunnel's ID, so it carries over between runs.
+pub fn path_for(dir: &Path, tunnel: &Tunnel) -> PathBuf {
+    dir.join(format!("{}.log", file_stem(tunnel)))
+}
+
+/// Where the logs view saves `tunnel`'s lines at `now`: beside the log
+/// files' naming, with the time so repeated saves don't overwrite each other.
+pub fn export_path(dir: &Path, tunnel: &Tunnel, now: DateTime<Local>) -> PathBuf {
+    dir.join(format!(
+        "{}-{}.log",
+        file_stem(tunnel),
+        now.format("%Y%m%d-%H%M%S")
+    ))
+}
+
+/// `<machine>[-<instance>]_<local>-<remote>`, with anything but letters,
+/// digits, `-`, `_` and `.` replaced.
+fn file_stem(tunnel: &Tunnel) -> String {
+    let safe = |s: &str| -> String {
+        s.chars()
+            .map(|c| {
+                if c.is_ascii_alphanumeric() || "-_.".contains(c) {
+                    c
+                } else {
+                    '_'
+                }
+            })
+            .collect()
+    };
+    let mut name = safe(&tunnel.machine.name);
+    if let Some(instance) = &tunnel.instance {
+        name.push_str(&format!("-{}", safe(instance)));
+    }
+    format!(
+        "{name}_{}-{}",
+        safe(&tunnel.local_port),
+        safe(&tunnel.remote_port)
+    )
+}
+
+/// An open, appending log file. Writing is best effort: a full disk or a
+/// removed directory must not take the tunnel down, so errors only close the
+/// file.
+#[derive(Debug)]
+pub struct LogFile {
+    path: PathBuf,
+    file: Option<File>,
+    size: u64,
+}
+
+impl LogFile {
+    /// Open (or create) `path` for appending, creating its directory.
+    pub fn open(path: PathBuf) -> std::io::Result<Self> {
+        if let Some(dir) = path.parent() {
+            std::fs::create_dir_all(dir)?;
+        }
+        let file = OpenOptions::new().create(true).append(true).open(&path)?;
+        let size = file.metadata()?.len();
+        Ok(Self {
+            path,
+            file: Some(file),
+            size,
+        })
+    }
+
+    /// Append `line` with the current time, rotating first if the file is
+    /// full.
+    pub fn write_line(&mut self, line: &str) {
+        if self.size >= MAX_BYTES {
+            self.rotate();
+        }
+        let Some(file) = &mut self.file else {
+            return;
+        };
+        let entry = format!(
+            "{} {line}\n",
+            Utc::now().to_rfc3339_opts(chrono::SecondsFormat::Millis, true)
+        );
+        match file.write_all(entry.as_bytes()) {
+            Ok(()) => self.size += entry.len() as u64,
+            Err(_) => self.file = None,
+        }
+    }
+
+    fn rotate(&mut self) {
+        self.file = None;
+        let numbered = |n: usize| {
+            let mut name = self.path.clone().into_os_string();
+            name.push(format!(".{n}"));
+            PathBuf::from(name)
+        };
+        let _ = std::fs::remove_file(numbered(KEEP));
+        for n in (1..KEEP).rev() {
+            let _ = std::fs::rename(numbered(n), numbered(n + 1));
+        }
+        let _ = std::fs::rename(&self.path, numbered(1));
+        if let Ok(reopened) = Self::open(self.path.clone()) {
+            *self = reopened;
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::model::{Machine, TunnelId};
+    use chrono::TimeZone;
+
+    #[test]
+    fn lines_are_timestamped_and_full_files_rotated() {
+        let dir = std::env::temp_dir().join(format!("az-burrow-logs-test-{}", std::process::id()));
+        let _ = std::fs::remove_dir_all(&dir);
+        let machine = Machine::test("vm web");
+        let tunnel = Tunnel::new(TunnelId(1), machine, "2022", "22");
+        let path = path_for(&dir, &tunnel);
+        assert_eq!(path, dir.join("vm_web_2022-22.log"));
+        let at = Local.with_ymd_and_hms(2026, 3, 1, 7, 5, 9).unwrap();
+        assert_eq!(
+            export_path(Path::new("/tmp"), &tunnel, at),
+            Path::new("/tmp/vm_web_2022-22-20260301-070509.log")
+        );
+
+        let mut log = LogFile::open(path.clone()).unwrap();
+        log.write_line("[OUT] Opening tunnel");
+        let text = std::fs::read_to_string(&path).unwrap();
+        assert!(text.ends_with("Z [OUT] Opening tunnel\n"), "{text}");
+
+        let long = "x".repeat(MAX_BYTES as usize / 2);
+        for _ in 0..(KEEP + 1) * 2 + 1 {
+            log.write_line(&long);
+        }
+        let mut rotated: Vec<String> = std::fs::read_dir(&dir)
+            .unwrap()
+            .map(|e| e.unwrap().file_name().to_string_lossy().into_owned())
+            .collect();
+        rotated.sort();
+        assert_eq!(
+            rotated,
+            [
+                "vm_web_2022-22.log",
+                "vm_web_2022-22.log.1",
+                "vm_web_2022-22.log.2",
+                "vm_web_2022-22.log.3"
+            ]
+        );
+        assert!(std::fs::metadata(&path).unwrap().len() < MAX_BYTES);
+        let _ = std::fs::remove_dir_all(&dir);
+    }
+}
@@ -0,0 +1,126 @@
+//! Webhook notifications (`notifications.webhook_url`): tunnel and
+//! certificate events POSTed as JSON, for Slack/Teams workflows or an audit
+//! pipeline. Requests go out through `az rest`, so az's proxy and certificate
+//! settings apply and no HTTP stack of our own is needed. Delivery is best
+//! effort; a failed POST is reported as [`BgEvent::WebhookFailed`].
+
+use crate::azure::{az_command, ScratchDir};
+use crate::bus::Bus;
+use crate::json::json_object;
+use crate::model::Tunnel;
+use crate::tui::action::BgEvent;
+use chrono::Utc;
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Event {
+    TunnelStarted,
+    TunnelStopped,
+    TunnelError,
+    CertRenewed,
+    CertFailed,
+}
+
+impl Event {
+    pub fn name(self) -> &'static str {
+        match self {
+            Event::TunnelStarted => "tunnel_started",
+            Event::TunnelStopped => "tunnel_stopped",
+            Event::TunnelError => "tunnel_error",
+            Event::CertRenewed => "cert_renewed",
+            Event::CertFailed => "cert_failed",
+        }
+    }
+}
+
+/// The body for a tunnel event.
+pub fn tunnel_payload(event: Event, tunnel: &Tunnel, error: Option<&str>) -> String {
+    json_object(&[
+        ("event", Some(event.name())),
+        ("time", Some(&Utc::now().to_rfc3339())),
+        ("tunnel", Some(tunnel.display_name())),
+        ("machine", Some(&tunnel.machine.name)),
+        ("resource_id", Some(&tunnel.target_resource_id())),
+        ("local_port", Some(&tunnel.local_port)),
+        ("remote_port", Some(&tunnel.remote_port)),
+        ("error", error),
+    ])
+}
+
+/// The body for a certificate event on `machine`.
+pub fn cert_payload(event: Event, machine: &str, error: Option<&str>) -> String {
+    json_object(&[
+        ("event", Some(event.name())),
+        ("time", Some(&Utc::now().to_rfc3339())),
+        ("machine", Some(machine)),
+        ("error", error),
+    ])
+}
+
+#[derive(Clone)]
+pub struct Webhook {
+    url: String,
+    bus: Bus,
+}
+
+impl Webhook {
+    pub fn new(url: String, bus: impl Into<Bus>) -> Self {
+        Self {
+            url,
+            bus: bus.into(),
+        }
+    }
+
+    /// POST `body` in the background.
+    pub fn send(&self, body: String) {
+        let url = self.url.clone();
+        let bus = self.bus.clone();
+        tokio::spawn(async move {
+            // Via a file: inline JSON doesn't survive az.cmd's quoting on
+            // Windows. A private directory keeps the body from other users.
+            let result = match ScratchDir::new() {
+                Ok(dir) => post(&url, &dir.path().join("body.json"), &body).await,
+                Err(e) => Err(format!("failed to create a temporary directory: {e}")),
+            };
+            if let Err(error) = result {
+                bus.publish(BgEvent::WebhookFailed { error });
+            }
+        });
+    }
+}
+
+async fn post(url: &str, path: &std::path::Path, body: &str) -> Result<(), String> {
+    std::fs::write(path, body).map_err(|e| e.to_string())?;
+    let out = az_command()
+        .args(["rest", "--method", "post", "--url", url])
+        .arg("--body")
+        .arg(format!("@{}", path.display()))
+        .args(["--headers", "Content-Type=application/json"])
+        .args([
+            "--skip-authorization-header",
+            "--only-show-errors",
+            "-o",
+            "none",
+        ])
+        .output()
+        .await
+        .map_err(|e| format!("failed to run az: {e}"))?;
+    if out.status.success() {
+        Ok(())
+    } else {
+        Err(String::from_utf8_lossy(&out.stderr).trim().to_string())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn payload_is_escaped_json_without_missing_fields() {
+        let body = cert_payload(Event::CertFailed, "vm-\"1\"", Some("line 1\nline 2"));
+        assert!(body.starts_with("{\"event\":\"cert_failed\",\"time\":\""));
+        assert!(body.contains("\"machine\":\"vm-\\\"1\\\"\""));
+        assert!(body.contains("\"error\":\"line 1\\nline 2\""));
+        assert!(!cert_payload(Event::CertRenewed, "vm", None).contains("error"));
+    }
+}
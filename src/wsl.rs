@@ -0,0 +1,78 @@
+//! Running inside WSL. `az network bastion tunnel` always listens on WSL's own
+//! localhost, so whether a Windows app (an SSH client, a browser) can use a
+//! tunnel depends on WSL's networking: mirrored mode shares localhost with
+//! Windows, the default NAT mode only forwards it when `localhostForwarding`
+//! is on, which breaks easily (VPNs, Hyper-V firewall rules).
+
+use std::process::Command;
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Networking {
+    /// Default: WSL has its own address behind NAT.
+    Nat,
+    /// `networkingMode=mirrored`: Windows and WSL share localhost.
+    Mirrored,
+    /// `wslinfo` is too old to say (WSL before 2.0) or something else failed.
+    Unknown,
+}
+
+/// WSL's networking mode, or `None` when not running under WSL.
+pub fn detect() -> Option<Networking> {
+    let osrelease = std::fs::read_to_string("/proc/sys/kernel/osrelease").unwrap_or_default();
+    if std::env::var_os("WSL_DISTRO_NAME").is_none() && !is_wsl_kernel(&osrelease) {
+        return None;
+    }
+    let mode = Command::new("wslinfo")
+        .arg("--networking-mode")
+        .output()
+        .ok()
+        .filter(|out| out.status.success())
+        .map(|out| parse_networking(&String::from_utf8_lossy(&out.stdout)))
+        .unwrap_or(Networking::Unknown);
+    Some(mode)
+}
+
+/// WSL kernels carry "microsoft" in their release string, e.g.
+/// `5.15.153.1-microsoft-standard-WSL2`.
+fn is_wsl_kernel(osrelease: &str) -> bool {
+    osrelease.to_lowercase().contains("microsoft")
+}
+
+fn parse_networking(output: &str) -> Networking {
+    match output.trim().to_lowercase().as_str() {
+        "nat" => Networking::Nat,
+        "mirrored" => Networking::Mirrored,
+        _ => Networking::Unknown,
+    }
+}
+
+/// What to tell the user about reaching tunnels from Windows, if anything.
+pub fn port_hint(networking: Networking) -> Option<&'static str> {
+    match networking {
+        Networking::Mirrored => None,
+        Networking::Nat | Networking::Unknown => Some(
+            "WSL: tunnels listen on WSL's localhost. Windows apps reach them only through localhost forwarding; if they can't connect, set networkingMode=mirrored in %UserProfile%\\.wslconfig and run wsl --shutdown",
+        ),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn recognises_wsl_kernels() {
+        assert!(is_wsl_kernel("5.15.153.1-microsoft-standard-WSL2\n"));
+        assert!(is_wsl_kernel("4.4.0-19041-Microsoft"));
+        assert!(!is_wsl_kernel("6.8.0-45-generic"));
+    }
+
+    #[test]
+    fn only_mirrored_networking_needs_no_hint() {
+        assert_eq!(parse_networking("mirrored\n"), Networking::Mirrored);
+        assert_eq!(parse_networking("nat\n"), Networking::Nat);
+        assert_eq!(parse_networking(""), Networking::Unknown);
+        assert!(port_hint(Networking::Mirrored).is_none());
+        assert!(port_hint(Networking::Nat).unwrap().contains("mirrored"));
+    }
+}